@@ -2,14 +2,23 @@
 package auth
 
 import (
+	"context"
 	"math/rand"
 	"sync"
 	"time"
 )
 
-// This struct stores the sync map of tokens to their username and expiry time.
+// This struct stores the sync map of tokens to their username and expiry time, along with a grace period
+// tolerated past a token's expiry to absorb clock skew between clients and the server, and how long the tokens
+// it generates stay valid. If a maximum number of tokens per user is set, the tokens of each user are also kept in
+// the order they were added, so the oldest can be evicted.
 type Auth struct {
-	tokens sync.Map
+	tokens     sync.Map
+	grace      time.Duration
+	ttl        time.Duration
+	maxPerUser int
+	userMtx    sync.Mutex          // held while the tokens of users are added to or evicted from userTokens
+	userTokens map[string][]string // usernames to their tokens, oldest first, only kept if maxPerUser is positive
 }
 
 // This struct stores the name and expiry time.
@@ -18,9 +27,14 @@ type nameAndExp struct {
 	expiry time.Time
 }
 
-// This function creates the underlying map for the Auth structure.
+// This function creates the underlying map for the Auth structure. Generated tokens expire after an hour.
 func NewAuth() *Auth {
-	return &Auth{}
+	return NewAuthWithTTL(time.Hour)
+}
+
+// This function creates an Auth whose generated tokens expire after the given ttl, which should be positive.
+func NewAuthWithTTL(ttl time.Duration) *Auth {
+	return &Auth{ttl: ttl}
 }
 
 // This is a helper function that can generate random tokens of a given length.
@@ -33,11 +47,17 @@ func generateRandomToken(length int) string {
 	return string(token)
 }
 
-// This function takes in a username and generates a unique, random token for the user (which is returned). It is set to expire in an hour.
+// This function takes in a username and generates a unique, random token for the user (which is returned). It is set to
+// expire after the Auth's ttl, an hour unless it was created by NewAuthWithTTL. If the user already has the maximum
+// number of tokens set by SetMaxTokensPerUser, their oldest token is evicted.
 func (auth *Auth) AddToken(username string) string {
+	if auth.maxPerUser > 0 {
+		auth.userMtx.Lock()
+		defer auth.userMtx.Unlock()
+	}
 	tokenLength := 14
 	for {
-		expiry := time.Now().Add(time.Hour)
+		expiry := time.Now().Add(auth.ttl)
 		token := generateRandomToken(tokenLength)
 		newNameAndExpiry := nameAndExp{
 			name:   username,
@@ -46,16 +66,133 @@ func (auth *Auth) AddToken(username string) string {
 		_, ok := auth.tokens.LoadOrStore(token, newNameAndExpiry)
 		// keep generating tokens until we find one that is unique
 		if !ok {
+			if auth.maxPerUser > 0 {
+				auth.track(username, token)
+			}
 			return token
 		}
 	}
 }
 
+// This function sets the most tokens a user can have at once. Once a user has that many, adding another token evicts
+// their oldest, making it invalid. Zero, the default, allows any number. It should be set before any tokens are
+// added and before the Auth is shared between goroutines.
+func (auth *Auth) SetMaxTokensPerUser(max int) {
+	auth.maxPerUser = max
+	auth.userTokens = make(map[string][]string)
+}
+
+// This is a helper function that records a new token of a user and evicts their oldest tokens until they are within
+// the maximum. Tokens that were deleted or expired since they were added no longer count. Must be called with userMtx
+// held.
+func (auth *Auth) track(username string, token string) {
+	live := make([]string, 0, len(auth.userTokens[username])+1)
+	for _, old := range auth.userTokens[username] {
+		data, ok := auth.tokens.Load(old)
+		if ok && data.(nameAndExp).name == username && !auth.isExpired(data.(nameAndExp).expiry) {
+			live = append(live, old)
+		}
+	}
+	live = append(live, token)
+	for len(live) > auth.maxPerUser {
+		auth.tokens.Delete(live[0])
+		live = live[1:]
+	}
+	auth.userTokens[username] = live
+}
+
+// This function takes in a valid token and generates a new token for the same user, with a fresh expiry. The old
+// token stays valid until it expires or is deleted. Returns the new token and true, or false if the old token is not
+// valid.
+func (auth *Auth) RefreshToken(old string) (string, bool) {
+	username, ok := auth.IsTokenValid(old)
+	if !ok {
+		return "", false
+	}
+	return auth.AddToken(username), true
+}
+
+// This function returns the tokens of a user that have not expired, in no particular order.
+func (auth *Auth) TokensFor(username string) []string {
+	tokens := make([]string, 0)
+	auth.tokens.Range(func(key, value any) bool {
+		nameAndExpiry := value.(nameAndExp)
+		if nameAndExpiry.name == username && !auth.isExpired(nameAndExpiry.expiry) {
+			tokens = append(tokens, key.(string))
+		}
+		return true
+	})
+	return tokens
+}
+
+// This function deletes every token of a user, logging them out everywhere. It returns the number of tokens that
+// were still valid. Tokens generated for the user while it runs may survive.
+func (auth *Auth) RevokeAll(username string) int {
+	revoked := 0
+	auth.tokens.Range(func(key, value any) bool {
+		if value.(nameAndExp).name != username {
+			return true
+		}
+		data, ok := auth.tokens.LoadAndDelete(key)
+		if ok && !auth.isExpired(data.(nameAndExp).expiry) {
+			revoked++
+		}
+		return true
+	})
+	return revoked
+}
+
 // This function allows adding tokens with corresponding usernames and times.
 // It will overwrite existing pairs with the same token, so ideally use this only at the beginning
 // when an Auth struct is created and no tokens exist.
 func (auth *Auth) AddPair(username string, token string, time time.Time) {
+	if auth.maxPerUser > 0 {
+		auth.userMtx.Lock()
+		defer auth.userMtx.Unlock()
+	}
 	auth.tokens.Store(token, nameAndExp{username, time})
+	if auth.maxPerUser > 0 {
+		auth.track(username, token)
+	}
+}
+
+// This function sets the clock skew grace period, so that a token is considered valid until its expiry plus grace.
+// The default grace period is zero. It should be set before the Auth is shared between goroutines.
+func (auth *Auth) SetGracePeriod(grace time.Duration) {
+	auth.grace = grace
+}
+
+// This is a helper function that reports whether the given expiry time has passed, taking the grace period into account.
+func (auth *Auth) isExpired(expiry time.Time) bool {
+	return time.Now().After(expiry.Add(auth.grace))
+}
+
+// This function starts a goroutine that deletes expired tokens from the map every interval, until ctx is canceled.
+// Expired tokens are otherwise only deleted when they are used, so without it they pile up on long-running servers.
+func (auth *Auth) StartSweeper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				auth.sweep()
+			}
+		}
+	}()
+}
+
+// This is a helper function that deletes every expired token. A token whose entry changes while it is being swept,
+// e.g. because AddPair gave it a new expiry, is left alone.
+func (auth *Auth) sweep() {
+	auth.tokens.Range(func(key, value any) bool {
+		if auth.isExpired(value.(nameAndExp).expiry) {
+			auth.tokens.CompareAndDelete(key, value)
+		}
+		return true
+	})
 }
 
 // This function takes in a token and returns the associated username and whether it is valid or not.
@@ -67,7 +204,7 @@ func (auth *Auth) IsTokenValid(token string) (string, bool) {
 	} else {
 		nameAndExpiry = data.(nameAndExp)
 	}
-	if time.Now().After(nameAndExpiry.expiry) {
+	if auth.isExpired(nameAndExpiry.expiry) {
 		return "", false
 	}
 	return nameAndExpiry.name, true
@@ -80,7 +217,7 @@ func (auth *Auth) DeleteToken(token string) bool {
 	retStatus := false
 	if ok {
 		nameAndExp := data.(nameAndExp)
-		if !time.Now().After(nameAndExp.expiry) {
+		if !auth.isExpired(nameAndExp.expiry) {
 			retStatus = true
 		}
 	}
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"testing"
 	"time"
 )
@@ -106,3 +107,152 @@ func TestDeleteToken(t *testing.T) {
 		t.Error("expected false output")
 	}
 }
+
+func TestGracePeriod(t *testing.T) {
+	auth := NewAuth()
+	auth.SetGracePeriod(time.Minute)
+	username := "user"
+
+	withinGrace := "withinGrace"
+	auth.AddPair(username, withinGrace, time.Now().Add(-30*time.Second))
+	name, isValid := auth.IsTokenValid(withinGrace)
+	if !isValid {
+		t.Error("wanted token expired within the grace period to be valid")
+	}
+	if name != username {
+		t.Errorf("wanted username to be %s, but got %s", username, name)
+	}
+
+	outsideGrace := "outsideGrace"
+	auth.AddPair(username, outsideGrace, time.Now().Add(-2*time.Minute))
+	_, isValid = auth.IsTokenValid(outsideGrace)
+	if isValid {
+		t.Error("wanted token expired outside the grace period to be invalid")
+	}
+
+	noGrace := NewAuth()
+	noGrace.AddPair(username, withinGrace, time.Now().Add(-30*time.Second))
+	_, isValid = noGrace.IsTokenValid(withinGrace)
+	if isValid {
+		t.Error("wanted expired token to be invalid without a grace period")
+	}
+}
+
+func TestNewAuthWithTTL(t *testing.T) {
+	short := NewAuthWithTTL(20 * time.Millisecond)
+	long := NewAuthWithTTL(24 * time.Hour)
+	shortToken := short.AddToken("user")
+	longToken := long.AddToken("user")
+
+	if _, ok := short.IsTokenValid(shortToken); !ok {
+		t.Errorf("expected a short lived token to be valid before it expires")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := short.IsTokenValid(shortToken); ok {
+		t.Errorf("expected a short lived token to be invalid after it expires")
+	}
+	if short.DeleteToken(shortToken) {
+		t.Errorf("expected deleting an expired token to be unauthorized")
+	}
+	if name, ok := long.IsTokenValid(longToken); !ok || name != "user" {
+		t.Errorf("expected a long lived token to still be valid for user, got %s, %v", name, ok)
+	}
+
+	data, _ := long.tokens.Load(longToken)
+	if expiry := data.(nameAndExp).expiry; time.Until(expiry) < 23*time.Hour {
+		t.Errorf("expected the token to expire in a day, but it expires at %v", expiry)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	auth := NewAuth()
+	old := auth.AddToken("user")
+	token, ok := auth.RefreshToken(old)
+	if !ok || token == "" || token == old {
+		t.Fatalf("expected a new token, got %q, %v", token, ok)
+	}
+	if name, ok := auth.IsTokenValid(token); !ok || name != "user" {
+		t.Errorf("expected the new token to belong to user, got %s, %v", name, ok)
+	}
+
+	auth.AddPair("user", "expired", time.Now().Add(-time.Minute))
+	if _, ok := auth.RefreshToken("expired"); ok {
+		t.Errorf("expected refreshing an expired token to fail")
+	}
+}
+
+func TestRevokeAll(t *testing.T) {
+	auth := NewAuth()
+	for i := 0; i < 3; i++ {
+		auth.AddToken("user")
+	}
+	auth.AddPair("user", "expired", time.Now().Add(-time.Minute))
+	other := auth.AddToken("other")
+
+	if tokens := auth.TokensFor("user"); len(tokens) != 3 {
+		t.Fatalf("expected 3 live tokens for user, got %v", tokens)
+	}
+	if revoked := auth.RevokeAll("user"); revoked != 3 {
+		t.Errorf("expected 3 tokens revoked, got %d", revoked)
+	}
+	if tokens := auth.TokensFor("user"); len(tokens) != 0 {
+		t.Errorf("expected no tokens left for user, got %v", tokens)
+	}
+	if name, ok := auth.IsTokenValid(other); !ok || name != "other" {
+		t.Errorf("expected the other user's token to stay valid, got %s, %v", name, ok)
+	}
+	if tokens := auth.TokensFor("other"); len(tokens) != 1 || tokens[0] != other {
+		t.Errorf("expected only %s for other, got %v", other, tokens)
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	auth := NewAuth()
+	auth.AddPair("user", "expired", time.Now().Add(-time.Minute))
+	live := auth.AddToken("user")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	auth.StartSweeper(ctx, 10*time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := auth.tokens.Load("expired"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the expired token to be swept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := auth.tokens.Load(live); !ok {
+		t.Errorf("expected the live token to survive the sweep")
+	}
+}
+
+func TestMaxTokensPerUser(t *testing.T) {
+	auth := NewAuth()
+	auth.SetMaxTokensPerUser(2)
+	oldest := auth.AddToken("user")
+	middle := auth.AddToken("user")
+	newest := auth.AddToken("user")
+	other := auth.AddToken("other")
+
+	if _, ok := auth.IsTokenValid(oldest); ok {
+		t.Errorf("expected the oldest token to be evicted")
+	}
+	for _, token := range []string{middle, newest, other} {
+		if _, ok := auth.IsTokenValid(token); !ok {
+			t.Errorf("expected token %s to stay valid", token)
+		}
+	}
+
+	// a deleted token no longer counts towards the limit
+	auth.DeleteToken(newest)
+	replacement := auth.AddToken("user")
+	for _, token := range []string{middle, replacement} {
+		if _, ok := auth.IsTokenValid(token); !ok {
+			t.Errorf("expected token %s to stay valid after a token was deleted", token)
+		}
+	}
+}
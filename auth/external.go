@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// A ValidateFunc checks a token with an external identity provider. It returns the user the token belongs to, when
+// the token expires, and whether the token is valid at all.
+type ValidateFunc func(token string) (username string, expiry time.Time, ok bool)
+
+// This struct authenticates tokens issued by an external identity provider. Tokens are checked with the provider the
+// first time they are seen and cached until they expire, so the provider is not asked on every request.
+// An ExternalAuth should be created using NewExternalAuth.
+type ExternalAuth struct {
+	validate ValidateFunc
+	cache    sync.Map // tokens to their nameAndExp
+	revoked  sync.Map // tokens logged out of to their expiry
+}
+
+// This function creates an ExternalAuth that checks tokens with the given function.
+func NewExternalAuth(validate ValidateFunc) *ExternalAuth {
+	return &ExternalAuth{validate: validate}
+}
+
+// Tokens are issued by the external provider, so this function issues none and always returns the empty string.
+func (auth *ExternalAuth) AddToken(username string) string {
+	return ""
+}
+
+// Tokens are issued by the external provider, so this function issues none. It returns the empty string, and whether
+// the old token is valid.
+func (auth *ExternalAuth) RefreshToken(old string) (string, bool) {
+	_, ok := auth.IsTokenValid(old)
+	return "", ok
+}
+
+// This function takes in a token and returns the associated username and whether it is valid or not. Tokens not in
+// the cache, or expired in it, are checked with the external provider again.
+func (auth *ExternalAuth) IsTokenValid(token string) (string, bool) {
+	if expiry, ok := auth.revoked.Load(token); ok {
+		if time.Now().Before(expiry.(time.Time)) {
+			return "", false
+		}
+		auth.revoked.Delete(token)
+	}
+
+	if data, ok := auth.cache.Load(token); ok {
+		nameAndExpiry := data.(nameAndExp)
+		if time.Now().Before(nameAndExpiry.expiry) {
+			return nameAndExpiry.name, true
+		}
+		auth.cache.Delete(token)
+	}
+
+	username, expiry, ok := auth.validate(token)
+	if !ok || !time.Now().Before(expiry) {
+		return "", false
+	}
+	auth.cache.Store(token, nameAndExp{name: username, expiry: expiry})
+	return username, true
+}
+
+// This function logs a user out of every token of theirs that has been seen, rejecting them here until they expire.
+// The provider cannot be told, so tokens of the user not seen yet stay valid. It returns the number of tokens revoked.
+func (auth *ExternalAuth) RevokeAll(username string) int {
+	revoked := 0
+	auth.cache.Range(func(key, value any) bool {
+		nameAndExpiry := value.(nameAndExp)
+		if nameAndExpiry.name != username {
+			return true
+		}
+		if _, ok := auth.cache.LoadAndDelete(key); ok && time.Now().Before(nameAndExpiry.expiry) {
+			auth.revoked.Store(key, nameAndExpiry.expiry)
+			revoked++
+		}
+		return true
+	})
+	return revoked
+}
+
+// This function logs out of a token. The provider cannot be told, so the token is rejected here until it expires.
+// It returns a bolean indicating whether the token was valid.
+func (auth *ExternalAuth) DeleteToken(token string) bool {
+	_, ok := auth.IsTokenValid(token)
+	if !ok {
+		return false
+	}
+	data, _ := auth.cache.LoadAndDelete(token)
+	if data != nil {
+		auth.revoked.Store(token, data.(nameAndExp).expiry)
+	}
+	return true
+}
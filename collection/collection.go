@@ -2,27 +2,43 @@
 package collection
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
+	"io"
+	"slices"
 	"sync"
+	"sync/atomic"
+
+	"github.com/ml575/database-project/document"
 )
 
 // This interface implements the methods needed by the Documents that a Collection holds.
 type Documenter interface {
 	DocumentJsonMake(fullPath string) ([]byte, error)
+	DocumentJsonMakeFormat(fullPath string, timeFormat string) ([]byte, error)
+	ETag() string
 	GetName() string
 	Copy() any
 }
 
 // The indexer interface is the requirments for the dbindedex used to store a collection's documents. An indexer must be able
 // to find a collection based on a key (returning the document and an ok bool). It must be able to upsert with a string key and
-// a check function (returning a document and err), and remove based on a key (returning a document and an ok bool)
+// a check function (returning a document and err), remove based on a key (returning a document and an ok bool), remove
+// based on a key only if a check function allows it, count and walk its documents without copying them, and find its
+// first and last documents.
 type Indexer[D Documenter] interface {
 	Find(key string) (D, bool)
 	Remove(key string) (D, bool)
+	CallConditionalRemove(key string, check func(currValue D, exists bool) (bool, error)) (D, bool, error)
 	CallUpsert(key string, check func(string, D, bool) (D, error)) (D, error)
+	CallUpsertCtx(ctx context.Context, key string, check func(string, D, bool) (D, error)) (D, bool, error)
 	Query(ctx context.Context, start string, end string, copier func(val D) any) (resultKeys []string, resultValues []D, err error)
+	QueryDescending(ctx context.Context, start string, end string, copier func(val D) any) (resultKeys []string, resultValues []D, err error)
+	Len() int
+	ForEach(ctx context.Context, fn func(key string, value D) bool) error
+	Min() (string, D, bool)
+	Max() (string, D, bool)
 }
 
 // This is a struct representing a database/collection. It contains a name string, a map of document names to documenters, and a read write mutex.
@@ -32,30 +48,131 @@ type Collection[D Documenter] struct {
 	docSet      Indexer[D]
 	subscribers map[chan any](chan string)
 	subMtx      sync.RWMutex
+	lastEventId atomic.Int64
+	sequences   map[string]uint64
+	seqMtx      sync.Mutex
+	counter     atomic.Uint64
+	history     [EventHistorySize]eventRecord
+	historyLen  int
+	historyMtx  sync.Mutex
+	serial      atomic.Bool
+	serialSeq   uint64
+	writeMtx    sync.Mutex
+}
+
+// The number of recent events a collection remembers for inspection.
+const EventHistorySize = 128
+
+// An event emitted to a collection's subscribers, as remembered by the collection.
+type eventRecord struct {
+	id      int64
+	event   string
+	docName string
 }
 
 // This creates a new collection with the name provided by a string parameter
 func NewCollection[D Documenter](name string, dbIndex Indexer[D]) *Collection[D] {
-	return &Collection[D]{name: name, docSet: dbIndex, subscribers: make(map[chan any]chan string)}
+	return &Collection[D]{name: name, docSet: dbIndex, subscribers: make(map[chan any]chan string),
+		sequences: make(map[string]uint64)}
 }
 
 // Creates a slice of bytes which is json representation of the collection created by iterating over all the documents in the collection.
 // Relies on dbIndex Query method for concurrency saftey. Takes a context.Context to fail after the passing of deadline, a start string
 // and a end string and will return based on documents with keys between these values (inclusive) also takes a string for the full path.
 func (d *Collection[D]) CollectionJsonMake(ctx context.Context, start string, end string, fullPath string) ([]byte, error) {
-	toReturn := make([]json.RawMessage, 0)
+	return d.CollectionJsonMakeFormat(ctx, start, end, fullPath, "", nil)
+}
+
+// Same as CollectionJsonMake, but every document's metadata timestamps are rendered in the given time format
+// (see Documenter.DocumentJsonMakeFormat), and if keep is not nil only the documents it returns true for are included.
+func (d *Collection[D]) CollectionJsonMakeFormat(ctx context.Context, start string, end string, fullPath string, timeFormat string, keep func(D) bool) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := d.CollectionJsonWrite(ctx, &buf, start, end, fullPath, timeFormat, keep, nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Writes the json array CollectionJsonMakeFormat makes to w one document at a time, so large collections do not have
+// to be held in memory. If compare is not nil the documents are written in the order it defines instead of by name,
+// which requires every document in the range to be queried before any is written. The first offset kept documents
+// are skipped. If limit is positive, at most limit documents are written after them and truncated reports whether
+// documents were left out at the end. The closing bracket is written
+// even when truncated, so the output is always an array. On an error the output written so far is incomplete.
+func (d *Collection[D]) CollectionJsonWrite(ctx context.Context, w io.Writer, start string, end string, fullPath string, timeFormat string, keep func(D) bool, compare func(a D, b D) int, offset int, limit int) (truncated bool, err error) {
 	docs := d.QueryDocuments(ctx, start, end)
 	if docs == nil {
-		return nil, errors.New(`"failed to query documents"`)
+		return false, errors.New(`"failed to query documents"`)
+	}
+	if compare != nil {
+		slices.SortStableFunc(docs, compare)
 	}
-	for _, document := range docs {
-		jsonDoc, err := document.DocumentJsonMake(fullPath + document.GetName())
+	return writeDocuments(w, docs, fullPath, timeFormat, keep, offset, limit)
+}
+
+// Same as CollectionJsonWrite without an ordering, but the documents are written in descending order of their names.
+func (d *Collection[D]) CollectionJsonWriteDescending(ctx context.Context, w io.Writer, start string, end string, fullPath string, timeFormat string, keep func(D) bool, offset int, limit int) (truncated bool, err error) {
+	docs := d.QueryDocumentsDescending(ctx, start, end)
+	if docs == nil {
+		return false, errors.New(`"failed to query documents"`)
+	}
+	return writeDocuments(w, docs, fullPath, timeFormat, keep, offset, limit)
+}
+
+// Writes the documents kept by keep to w as a json array in the order given, for CollectionJsonWrite.
+func writeDocuments[D Documenter](w io.Writer, docs []D, fullPath string, timeFormat string, keep func(D) bool, offset int, limit int) (truncated bool, err error) {
+	_, err = w.Write([]byte("["))
+	if err != nil {
+		return false, err
+	}
+	count := 0
+	for _, doc := range docs {
+		if keep != nil && !keep(doc) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if limit > 0 && count == limit {
+			truncated = true
+			break
+		}
+		jsonDoc, err := doc.DocumentJsonMakeFormat(fullPath+doc.GetName(), timeFormat)
+		if err != nil {
+			return false, err
+		}
+		// each entry carries its entity tag, so clients can make conditional requests for the documents listed
+		jsonDoc, err = document.EmbedETag(jsonDoc, doc.ETag())
+		if err != nil {
+			return false, err
+		}
+		if count > 0 {
+			jsonDoc = append([]byte(","), jsonDoc...)
+		}
+		_, err = w.Write(jsonDoc)
 		if err != nil {
-			return nil, err
+			return false, err
 		}
-		toReturn = append(toReturn, jsonDoc)
+		count++
 	}
-	return json.Marshal(toReturn)
+	_, err = w.Write([]byte("]"))
+	return truncated, err
+}
+
+// Returns the document with the smallest name in the collection, e.g. the earliest of documents named by timestamp,
+// and whether the collection has any documents. Relies on dbIndex Min for concurrency saftey.
+func (d *Collection[D]) FirstDocument() (D, bool) {
+	_, doc, ok := d.docSet.Min()
+	return doc, ok
+}
+
+// Returns the document with the largest name in the collection, e.g. the latest of documents named by timestamp, and
+// whether the collection has any documents. Relies on dbIndex Max for concurrency saftey.
+func (d *Collection[D]) LastDocument() (D, bool) {
+	_, doc, ok := d.docSet.Max()
+	return doc, ok
 }
 
 // Searches for a document of the name provided by a string parameter. Returns the document and a boolean representing if the document was found.
@@ -64,6 +181,43 @@ func (d *Collection[D]) FindDocument(name string) (D, bool) {
 	return d.docSet.Find(name)
 }
 
+// Counts the documents with names between start and end (inclusive) that keep returns true for, or all of them if keep
+// is nil. Counting a whole collection is constant time and an interval is counted by name without copying any
+// documents. A filter needs the documents themselves, so they are queried like QueryDocuments does. Fails with the
+// context's error if it is done before the count is.
+func (d *Collection[D]) CountDocuments(ctx context.Context, start string, end string, keep func(D) bool) (int, error) {
+	if keep != nil {
+		docs := d.QueryDocuments(ctx, start, end)
+		if docs == nil {
+			return 0, errors.New(`"failed to query documents"`)
+		}
+		count := 0
+		for _, doc := range docs {
+			if keep(doc) {
+				count++
+			}
+		}
+		return count, nil
+	}
+	if start == "" && end == document.MaxName {
+		return d.docSet.Len(), nil
+	}
+	count := 0
+	err := d.docSet.ForEach(ctx, func(name string, _ D) bool {
+		if name > end {
+			return false
+		}
+		if name >= start {
+			count++
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
 // This function returns all the documents between start and end in the collection as a list of documenters.
 // Relies on dbIndex Query method for concurrency saftey. Takes a context.Context to fail after the passing of deadline
 // or to let the query know when to close, a start string and a end string and will return based a list of documents with
@@ -81,18 +235,53 @@ func (d *Collection[D]) QueryDocuments(ctx context.Context, start string, end st
 	return docList
 }
 
+// Returns the documents whose names start with prefix, in order of their names, by querying the interval from prefix to
+// prefix followed by document.MaxName like QueryDocuments. An empty prefix returns every document. It returns null if
+// it could not query properly.
+func (d *Collection[D]) QueryPrefix(ctx context.Context, prefix string) []D {
+	return d.QueryDocuments(ctx, prefix, prefix+document.MaxName)
+}
+
+// Same as QueryDocuments, but the documents are returned in descending order of their names.
+func (d *Collection[D]) QueryDocumentsDescending(ctx context.Context, start string, end string) []D {
+	copyFunc := func(doc D) any {
+		return doc.Copy()
+	}
+
+	_, docList, err := d.docSet.QueryDescending(ctx, start, end, copyFunc)
+	if err != nil {
+		return nil
+	}
+
+	return docList
+}
+
 // This function updates or inserts a document based on check function. It calls dbIndex uperst with the provided update check function
 // returns a document and an err. Relies on dbIndex for concurrency saftey
 func (d *Collection[D]) PutDocument(name string, check func(string, D, bool) (D, error)) (D, error) {
 	return d.docSet.CallUpsert(name, check)
 }
 
+// Same as PutDocument, but gives up with the context's error if the context is done while the upsert is retrying
+// under contention, and also returns whether the document was newly inserted. Relies on dbIndex for concurrency saftey
+func (d *Collection[D]) PutDocumentCtx(ctx context.Context, name string, check func(string, D, bool) (D, error)) (D, bool, error) {
+	return d.docSet.CallUpsertCtx(ctx, name, check)
+}
+
 // This function deletes a document from the collection based on its name. Calls dbIndex find
 // returns a document and an ok bool. Relies on dbIndex for concurrency saftey
 func (d *Collection[D]) DeleteDocument(name string) (D, bool) {
 	return d.docSet.Remove(name)
 }
 
+// Same as DeleteDocument, but only deletes the document if check returns true. check is called with the document and
+// true, or with the zero value and false if there is no such document, and no one else can change or delete the
+// document until the delete is done. Returns the deleted document, whether it was deleted, and check's error.
+// Relies on dbIndex for concurrency saftey
+func (d *Collection[D]) DeleteDocumentIf(name string, check func(currValue D, exists bool) (bool, error)) (D, bool, error) {
+	return d.docSet.CallConditionalRemove(name, check)
+}
+
 // Returns the name of a document as a string.
 func (d *Collection[D]) GetName() string {
 	return d.name
@@ -123,3 +312,80 @@ func (d *Collection[D]) AllSubscribers() map[chan any](chan string) {
 	}
 	return copy
 }
+
+// Records that an event of the given kind about the named document was emitted to the collection's subscribers with
+// the given id, keeping the highest id seen. The last EventHistorySize events are remembered for RecentEvents.
+func (d *Collection[D]) RecordEvent(id int64, event string, docName string) {
+	d.historyMtx.Lock()
+	d.history[d.historyLen%EventHistorySize] = eventRecord{id: id, event: event, docName: docName}
+	d.historyLen++
+	d.historyMtx.Unlock()
+
+	for {
+		last := d.lastEventId.Load()
+		if id <= last || d.lastEventId.CompareAndSwap(last, id) {
+			return
+		}
+	}
+}
+
+// Returns the highest event id emitted to the collection's subscribers, or 0 if no event was emitted yet.
+func (d *Collection[D]) LastEventId() int64 {
+	return d.lastEventId.Load()
+}
+
+// Calls fn with the last limit events recorded by RecordEvent, oldest first, or with every remembered event if limit is
+// not positive. fn must not record events on the collection.
+func (d *Collection[D]) RecentEvents(limit int, fn func(id int64, event string, docName string)) {
+	d.historyMtx.Lock()
+	defer d.historyMtx.Unlock()
+	count := min(d.historyLen, EventHistorySize)
+	if limit > 0 && limit < count {
+		count = limit
+	}
+	for i := d.historyLen - count; i < d.historyLen; i++ {
+		record := d.history[i%EventHistorySize]
+		fn(record.id, record.event, record.docName)
+	}
+}
+
+// Returns the next sequence number for the events of the named document, starting at 1. The counter is kept across
+// deletes of the document, so the events of a document name are numbered in the order they were created. In a serial
+// collection, the events of every document share one counter instead.
+func (d *Collection[D]) NextSequence(name string) uint64 {
+	d.seqMtx.Lock()
+	defer d.seqMtx.Unlock()
+	if d.serial.Load() {
+		d.serialSeq++
+		return d.serialSeq
+	}
+	d.sequences[name]++
+	return d.sequences[name]
+}
+
+// Sets whether writes to the collection are serialized. Should be set when the collection is created, before any
+// documents are written to it.
+func (d *Collection[D]) SetSerial(serial bool) {
+	d.serial.Store(serial)
+}
+
+// Returns whether writes to the collection are serialized.
+func (d *Collection[D]) Serial() bool {
+	return d.serial.Load()
+}
+
+// Takes the collection's write lock if the collection is serial, and returns the function that releases it. Writers
+// hold it from changing a document until its event is sent, so the events of a serial collection are totally ordered.
+// Does nothing for other collections, where writes to different documents run concurrently.
+func (d *Collection[D]) LockWrites() (unlock func()) {
+	if !d.serial.Load() {
+		return func() {}
+	}
+	d.writeMtx.Lock()
+	return d.writeMtx.Unlock
+}
+
+// Returns the next value of the collection's counter, starting at 1, for naming posted documents.
+func (d *Collection[D]) NextCounter() uint64 {
+	return d.counter.Add(1)
+}
@@ -2,32 +2,48 @@
 package document
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"time"
 )
 
+// TimeFormatRFC3339 is the time format name that renders metadata timestamps as RFC3339 strings
+// rather than Unix milliseconds.
+const TimeFormatRFC3339 = "rfc3339"
+
+// MaxName sorts after every valid name of a database, collection or document. It is the high bound of an interval
+// without one, and the key of the tail of the skiplists indexing names, so names at or above it are rejected.
+const MaxName = "\U0010FFFF"
+
 // This interface implements all the methods we need for the Collections we will store inside a Document.
 type Collectioner interface {
 }
 
 // The indexer interface is the requirments for the dbindedex used to store a documents collections. An indexer must be able
 // to find a collection based on a key (returning the collection and an ok bool). It must be able to upsert with a string key and
-// check funchtion (returning a collection and err), and remove based on a key (returning a collection and an ok bool)
+// check funchtion (returning a collection and err), remove based on a key (returning a collection and an ok bool), and walk
+// its collections in order of key.
 type Indexer[C Collectioner] interface {
 	Find(key string) (C, bool)
 	CallUpsert(key string, check func(string, C, bool) (C, error)) (C, error)
 	Remove(key string) (C, bool)
+	ForEach(ctx context.Context, fn func(key string, value C) bool) error
 }
 
 // This is a struct representing a document. It contains a name string, a data slice of bytes, an dbindexer of collections, and a metadata struct
+// and the media type of an opaque document, empty for JSON documents.
 // A document should be created using the New function.
 type Document[C Collectioner] struct {
-	name     string
-	data     []byte
-	colSet   Indexer[C]
-	metadata metadata
+	name        string
+	data        []byte
+	colSet      Indexer[C]
+	metadata    metadata
+	contentType string
 }
 
 // This is a struct representing metadata. It contains a createdAt int of the time in miliseconds, a createdby string representing a username
@@ -42,9 +58,27 @@ type metadata struct {
 // just used to create the correct json response based on the document contents. It has a path string, a document byte array, and a metadata struct
 // a zero value struct is ready to use.
 type jsonDocumentFormat struct {
-	Path string          `json:"path"`
-	Doc  json.RawMessage `json:"doc"`
-	Meta metadata        `json:"meta"`
+	Path        string          `json:"path"`
+	Doc         json.RawMessage `json:"doc"`
+	Meta        metadata        `json:"meta"`
+	ContentType string          `json:"contentType,omitempty"`
+}
+
+// A variant of metadata with the timestamps rendered as RFC3339 strings. Used when the client asks for
+// expanded timestamps instead of the default millisecond integers.
+type rfc3339Metadata struct {
+	CreatedAt      string `json:"createdAt"`
+	CreatedBy      string `json:"createdBy"`
+	LastModifiedAt string `json:"lastModifiedAt"`
+	LastModifiedBy string `json:"lastModifiedBy"`
+}
+
+// Same as jsonDocumentFormat, but carrying rfc3339Metadata. A zero value struct is ready to use.
+type jsonRFC3339DocumentFormat struct {
+	Path        string          `json:"path"`
+	Doc         json.RawMessage `json:"doc"`
+	Meta        rfc3339Metadata `json:"meta"`
+	ContentType string          `json:"contentType,omitempty"`
 }
 
 // Creates a new document, with time as the current time in miliseconds, returns a pointer to the document.
@@ -83,10 +117,47 @@ func (d *Document[C]) ReplaceData(data []byte) {
 
 // This function creates a Json repsresentation of a document. It returns a slice of bytes and an error.
 func (d *Document[C]) DocumentJsonMake(fullPath string) ([]byte, error) {
-	returnStruct := jsonDocumentFormat{Path: fullPath, Doc: d.data, Meta: d.metadata}
+	doc, err := d.jsonData()
+	if err != nil {
+		return nil, err
+	}
+	returnStruct := jsonDocumentFormat{Path: fullPath, Doc: doc, Meta: d.metadata, ContentType: d.contentType}
 	return json.Marshal(returnStruct)
 }
 
+// Returns the data of the document as JSON. The data of an opaque document is not JSON, so it is rendered as a string.
+func (d *Document[C]) jsonData() (json.RawMessage, error) {
+	if d.contentType == "" {
+		return d.data, nil
+	}
+	return json.Marshal(string(d.data))
+}
+
+// This function creates a Json representation of a document with its metadata timestamps rendered in the given
+// time format. An empty format keeps the default millisecond integers, TimeFormatRFC3339 renders RFC3339 strings in UTC.
+// Returns an error for any other format.
+func (d *Document[C]) DocumentJsonMakeFormat(fullPath string, timeFormat string) ([]byte, error) {
+	switch timeFormat {
+	case "":
+		return d.DocumentJsonMake(fullPath)
+	case TimeFormatRFC3339:
+		meta := rfc3339Metadata{
+			CreatedAt:      time.UnixMilli(d.metadata.CreatedAt).UTC().Format(time.RFC3339Nano),
+			CreatedBy:      d.metadata.CreatedBy,
+			LastModifiedAt: time.UnixMilli(d.metadata.LastModifiedAt).UTC().Format(time.RFC3339Nano),
+			LastModifiedBy: d.metadata.LastModifiedBy,
+		}
+		doc, err := d.jsonData()
+		if err != nil {
+			return nil, err
+		}
+		returnStruct := jsonRFC3339DocumentFormat{Path: fullPath, Doc: doc, Meta: meta, ContentType: d.contentType}
+		return json.Marshal(returnStruct)
+	default:
+		return nil, fmt.Errorf("unknown time format %q", timeFormat)
+	}
+}
+
 // This function finds a collection based on its name. Calls dbIndex find
 // returns a collection and an ok bool. Relies on dbIndex for concurrency saftey.
 func (d *Document[C]) FindCollection(name string) (C, bool) {
@@ -106,6 +177,90 @@ func (d *Document[C]) DeleteCollection(name string) (C, bool) {
 	return d.colSet.Remove(name)
 }
 
+// This function returns the names of the document's collections and the collections themselves, in order of name.
+// Relies on the collection index's ForEach for concurrency saftey, and fails with the context's error if it is done
+// before the walk finishes.
+func (d *Document[C]) Collections(ctx context.Context) ([]string, []C, error) {
+	names := make([]string, 0)
+	cols := make([]C, 0)
+	err := d.colSet.ForEach(ctx, func(name string, col C) bool {
+		names = append(names, name)
+		cols = append(cols, col)
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return names, cols, nil
+}
+
+// This function returns the username of the user that created the document.
+func (d *Document[C]) CreatedBy() string {
+	return d.metadata.CreatedBy
+}
+
+// This function returns the time the document was created, in milliseconds since the Unix epoch.
+func (d *Document[C]) CreatedAt() int64 {
+	return d.metadata.CreatedAt
+}
+
+// This function sets all of the metadata of the document, for restoring a document that was saved with its metadata.
+func (d *Document[C]) RestoreMetadata(createdAt int64, createdBy string, lastModifiedAt int64, lastModifiedBy string) {
+	d.metadata = metadata{CreatedAt: createdAt, CreatedBy: createdBy, LastModifiedAt: lastModifiedAt,
+		LastModifiedBy: lastModifiedBy}
+}
+
+// This function returns the username of the last user to modify the document.
+func (d *Document[C]) LastModifiedBy() string {
+	return d.metadata.LastModifiedBy
+}
+
+// This function returns the time the document was last modified, in milliseconds since the Unix epoch.
+func (d *Document[C]) LastModifiedAt() int64 {
+	return d.metadata.LastModifiedAt
+}
+
+// This function returns a strong entity tag for the current version of the document, quoted as in an ETag header. It
+// is a hash of the document's data and last modification time, so it changes whenever the document is modified.
+func (d *Document[C]) ETag() string {
+	hash := sha256.New()
+	hash.Write(d.data)
+	binary.Write(hash, binary.BigEndian, d.metadata.LastModifiedAt)
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// This function adds an entity tag to a Json representation of a document made by DocumentJsonMake or
+// DocumentJsonMakeFormat, as an etag field after the others, for listings of many documents whose entity tags cannot
+// all be sent as headers. The tag is quoted as in an ETag header. Returns an error if encoded is not a Json object.
+func EmbedETag(encoded []byte, etag string) ([]byte, error) {
+	if len(encoded) < 2 || encoded[0] != '{' || encoded[len(encoded)-1] != '}' {
+		return nil, fmt.Errorf("document json is not an object")
+	}
+	encodedTag, err := json.Marshal(etag)
+	if err != nil {
+		return nil, err
+	}
+	embedded := make([]byte, 0, len(encoded)+len(encodedTag)+len(`,"etag":`))
+	embedded = append(embedded, encoded[:len(encoded)-1]...)
+	if len(encoded) > 2 {
+		embedded = append(embedded, ',')
+	}
+	embedded = append(embedded, `"etag":`...)
+	embedded = append(embedded, encodedTag...)
+	return append(embedded, '}'), nil
+}
+
+// This function returns the media type of an opaque document, or the empty string for a JSON document.
+func (d *Document[C]) ContentType() string {
+	return d.contentType
+}
+
+// This function sets the media type of the document's data. The empty string marks the data as JSON, any other media
+// type makes the document opaque.
+func (d *Document[C]) SetContentType(contentType string) {
+	d.contentType = contentType
+}
+
 // This function returns the name of a document as a string.
 func (d *Document[C]) GetName() string {
 	return d.name
@@ -114,10 +269,11 @@ func (d *Document[C]) GetName() string {
 // This function returns a copy of a document.
 func (d *Document[C]) Copy() any {
 	newDoc := Document[C]{
-		name:     d.name,
-		data:     d.data,
-		colSet:   d.colSet,
-		metadata: d.metadata,
+		name:        d.name,
+		data:        d.data,
+		colSet:      d.colSet,
+		metadata:    d.metadata,
+		contentType: d.contentType,
 	}
 	return &newDoc
 }
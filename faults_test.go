@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ml575/database-project/collection"
+	"github.com/ml575/database-project/document"
+	"github.com/ml575/database-project/handler"
+)
+
+// faults holds the switches used by the fault injecting wrappers below. A zero value faults injects nothing.
+type faults struct {
+	documentJson   atomic.Bool
+	collectionJson atomic.Bool
+	queryStall     atomic.Bool // queries retry until their context is done, as under endless contention
+	documentPanic  atomic.Bool // document serialization panics, as a bug in a rarely hit branch would
+}
+
+// errInjected is the error returned by every injected fault.
+var errInjected = errors.New(`"injected fault"`)
+
+// faultyDocument wraps a Documenter and fails its serialization methods while the matching fault is switched on.
+type faultyDocument struct {
+	handler.Documenter
+	faults *faults
+}
+
+func (f *faultyDocument) DocumentJsonMake(fullPath string) ([]byte, error) {
+	if f.faults.documentPanic.Load() {
+		panic("injected panic")
+	}
+	if f.faults.documentJson.Load() {
+		return nil, errInjected
+	}
+	return f.Documenter.DocumentJsonMake(fullPath)
+}
+
+func (f *faultyDocument) DocumentJsonMakeFormat(fullPath string, timeFormat string) ([]byte, error) {
+	if f.faults.documentPanic.Load() {
+		panic("injected panic")
+	}
+	if f.faults.documentJson.Load() {
+		return nil, errInjected
+	}
+	return f.Documenter.DocumentJsonMakeFormat(fullPath, timeFormat)
+}
+
+// Copy keeps the wrapper around the copied document so queried documents still inject faults.
+func (f *faultyDocument) Copy() any {
+	inner, ok := f.Documenter.Copy().(handler.Documenter)
+	if !ok {
+		return nil
+	}
+	return &faultyDocument{Documenter: inner, faults: f.faults}
+}
+
+// faultyCollection wraps a Collectioner and fails its serialization methods while the matching fault is switched on.
+type faultyCollection struct {
+	handler.Collectioner
+	faults *faults
+}
+
+func (f *faultyCollection) CollectionJsonMake(ctx context.Context, start string, end string, fullPath string) ([]byte, error) {
+	if f.faults.collectionJson.Load() {
+		return nil, errInjected
+	}
+	return f.Collectioner.CollectionJsonMake(ctx, start, end, fullPath)
+}
+
+func (f *faultyCollection) CollectionJsonMakeFormat(ctx context.Context, start string, end string, fullPath string, timeFormat string, keep func(handler.Documenter) bool) ([]byte, error) {
+	if f.faults.collectionJson.Load() {
+		return nil, errInjected
+	}
+	if f.faults.queryStall.Load() {
+		<-ctx.Done()
+		return nil, errInjected
+	}
+	return f.Collectioner.CollectionJsonMakeFormat(ctx, start, end, fullPath, timeFormat, keep)
+}
+
+func (f *faultyCollection) CollectionJsonWrite(ctx context.Context, w io.Writer, start string, end string, fullPath string, timeFormat string, keep func(handler.Documenter) bool, compare func(a handler.Documenter, b handler.Documenter) int, offset int, limit int) (bool, error) {
+	if f.faults.collectionJson.Load() {
+		return false, errInjected
+	}
+	if f.faults.queryStall.Load() {
+		<-ctx.Done()
+		return false, errInjected
+	}
+	return f.Collectioner.CollectionJsonWrite(ctx, w, start, end, fullPath, timeFormat, keep, compare, offset, limit)
+}
+
+func (f *faultyCollection) QueryDocuments(ctx context.Context, start string, end string) []handler.Documenter {
+	if f.faults.queryStall.Load() {
+		<-ctx.Done()
+		return nil
+	}
+	return f.Collectioner.QueryDocuments(ctx, start, end)
+}
+
+// faultyCollectionFactory creates collections wrapped in faultyCollection.
+type faultyCollectionFactory struct {
+	inner  handler.CollectionFactory
+	faults *faults
+}
+
+func (f faultyCollectionFactory) NewCollection(name string) handler.Collectioner {
+	return &faultyCollection{Collectioner: f.inner.NewCollection(name), faults: f.faults}
+}
+
+// faultyDocumentFactory creates documents wrapped in faultyDocument.
+type faultyDocumentFactory struct {
+	inner  handler.DocumentFactory
+	faults *faults
+}
+
+func (f faultyDocumentFactory) NewDocument(name string, data []byte, creator string) handler.Documenter {
+	return &faultyDocument{Documenter: f.inner.NewDocument(name, data, creator), faults: f.faults}
+}
+
+// newFaultyFactories creates collection and document factories whose products fail on demand through the returned faults.
+func newFaultyFactories() (*faults, handler.CollectionFactory, handler.DocumentFactory) {
+	f := new(faults)
+	colFactory := faultyCollectionFactory{inner: CollectionFactory(collection.NewCollection[handler.Documenter]), faults: f}
+	docFactory := faultyDocumentFactory{inner: DocumentFactory(document.NewDocument[handler.Collectioner]), faults: f}
+	return f, colFactory, docFactory
+}
+
+func TestGetSerializationFaults(t *testing.T) {
+	f, colFactory, docFactory := newFaultyFactories()
+	h := newTestHandlerWithFactories(colFactory, docFactory)
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	resp := doRequest(h, "PUT", "/v1/db1/dc1", `{"str":"testing"}`)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Expected status code 201 but got %d", resp.StatusCode)
+	}
+
+	f.documentJson.Store(true)
+	resp = doRequest(h, "GET", "/v1/db1/dc1", "")
+	if resp.StatusCode != 500 {
+		t.Errorf("Expected status code 500 on document serialization failure but got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected json error body but got content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	// a failing document also fails the collection listing that contains it
+	resp = doRequest(h, "GET", "/v1/db1/", "")
+	if resp.StatusCode != 500 {
+		t.Errorf("Expected status code 500 on listing a failing document but got %d", resp.StatusCode)
+	}
+	f.documentJson.Store(false)
+
+	f.collectionJson.Store(true)
+	resp = doRequest(h, "GET", "/v1/db1/", "")
+	if resp.StatusCode != 500 {
+		t.Errorf("Expected status code 500 on collection serialization failure but got %d", resp.StatusCode)
+	}
+	f.collectionJson.Store(false)
+
+	resp = doRequest(h, "GET", "/v1/db1/dc1", "")
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status code 200 once faults are cleared but got %d", resp.StatusCode)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	f, colFactory, docFactory := newFaultyFactories()
+	h := newTestHandlerWithFactories(colFactory, docFactory, handler.WithQueryTimeout(10*time.Millisecond))
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"str":"testing"}`)
+
+	f.queryStall.Store(true)
+	done := make(chan *http.Response)
+	go func() {
+		done <- doRequest(h, "GET", "/v1/db1/", "")
+	}()
+	select {
+	case resp := <-done:
+		if resp.StatusCode != 504 {
+			t.Errorf("Expected status code 504 for a timed out query but got %d", resp.StatusCode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query did not time out")
+	}
+	f.queryStall.Store(false)
+
+	resp := doRequest(h, "GET", "/v1/db1/", "")
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status code 200 once the collection is uncontended but got %d", resp.StatusCode)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	f, colFactory, docFactory := newFaultyFactories()
+	h := newTestHandlerWithFactories(colFactory, docFactory)
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"str":"testing"}`)
+
+	f.documentPanic.Store(true)
+	resp := doRequest(h, "GET", "/v1/db1/dc1", "")
+	if resp.StatusCode != 500 {
+		t.Errorf("Expected status code 500 for a panicking request but got %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "\"internal server error\"\n" {
+		t.Errorf("Expected a generic json error but got %q", body)
+	}
+	f.documentPanic.Store(false)
+
+	resp = doRequest(h, "GET", "/v1/db1/dc1", "")
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status code 200 after a recovered panic but got %d", resp.StatusCode)
+	}
+}
+
+func TestSubscriptionPanicRecovery(t *testing.T) {
+	f, colFactory, docFactory := newFaultyFactories()
+	server := httptest.NewServer(newTestHandlerWithFactories(colFactory, docFactory))
+	t.Cleanup(server.Close)
+	h := server.Config.Handler
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"str":"testing"}`)
+
+	// the stream has already started when the snapshot panics, so the subscription is closed without any events
+	f.documentPanic.Store(true)
+	events := subscribe(t, server, "/v1/db1/dc1?mode=subscribe")
+	select {
+	case event, ok := <-events:
+		if ok {
+			t.Errorf("Expected the subscription to be closed but got %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription was not closed after a panic")
+	}
+	f.documentPanic.Store(false)
+
+	events = subscribe(t, server, "/v1/db1/dc1?mode=subscribe")
+	event := nextEvent(t, events)
+	if event.event != "update" {
+		t.Errorf("Expected the snapshot once the panic is cleared but got %v", event)
+	}
+}
@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// The effective configuration of the server reported by GET /admin/config. Durations are formatted as Go durations,
+// e.g. "1m30s". Secrets such as the admin token and the schema itself are never included.
+type jsonConfigFormat struct {
+	ContentTypes       []string          `json:"contentTypes"`
+	ListingCap         int               `json:"listingCap"`
+	QueryTimeout       string            `json:"queryTimeout"`
+	CoalesceWindow     string            `json:"coalesceWindow"`
+	ReservedPrefix     string            `json:"reservedPrefix"`
+	ContentLengthCheck bool              `json:"contentLengthCheck"`
+	MaxDepth           int               `json:"maxDepth"`
+	CORSMaxAge         string            `json:"corsMaxAge"`
+	Headers            map[string]string `json:"headers"`
+}
+
+// Checks whether an Authorization header carries the admin token. Always false if no admin token is configured.
+func (d *DatabaseIndex) checkAdmin(token string) bool {
+	if d.adminToken == "" || len(token) < len("Bearer ") || token[:len("Bearer ")] != "Bearer " {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token[len("Bearer "):]), []byte(d.adminToken)) == 1
+}
+
+// This function handles requests for the effective configuration of the server, for debugging deployments.
+// Only the admin may request it.
+func (d *DatabaseIndex) adminConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	if !d.checkAdmin(r.Header.Get("Authorization")) {
+		errorHelper(w, `"unauthorized"`, http.StatusUnauthorized)
+		return
+	}
+
+	config := jsonConfigFormat{ContentTypes: append([]string{"application/json"}, d.contentTypes...),
+		ListingCap: d.listingCap, QueryTimeout: d.queryTimeout.String(), CoalesceWindow: "0s",
+		ReservedPrefix: d.reservedPrefix, ContentLengthCheck: d.checkLength, MaxDepth: d.maxDepth,
+		CORSMaxAge: d.corsMaxAge.String(), Headers: d.headers}
+	if d.coalescer != nil {
+		config.CoalesceWindow = d.coalescer.window.String()
+	}
+
+	jsonStr, err := json.Marshal(config)
+	if err != nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		return
+	}
+	slog.Info("reported server configuration")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonStr)
+}
+
+// This function handles requests to replace the schema documents are validated against, so the schema can evolve
+// without a restart. Documents already stored are not revalidated. Only the admin may replace the schema.
+func (d *DatabaseIndex) adminSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	if !d.checkAdmin(r.Header.Get("Authorization")) {
+		errorHelper(w, `"unauthorized"`, http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		errorHelper(w, `"unable to read request body"`, http.StatusBadRequest)
+		return
+	}
+
+	compiler := jsonschema.NewCompiler()
+	err = compiler.AddResource("schema.json", bytes.NewReader(body))
+	if err != nil {
+		errorHelper(w, `"schema is not valid json"`, http.StatusBadRequest)
+		return
+	}
+	schema, err := compiler.Compile("schema.json")
+	if err != nil {
+		errorHelper(w, `"schema does not compile"`, http.StatusBadRequest)
+		slog.Error(fmt.Sprintf("rejected schema: %s", err.Error()))
+		return
+	}
+
+	d.schema.Store(schema)
+	slog.Info("replaced schema")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// This function handles requests to set the maintenance banner, a notice sent with every response in a Warning header
+// so that clients can show it during degraded operation. The body is the plain text of the notice, and an empty body
+// clears it. Only the admin may set the banner.
+func (d *DatabaseIndex) adminBanner(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	if !d.checkAdmin(r.Header.Get("Authorization")) {
+		errorHelper(w, `"unauthorized"`, http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		errorHelper(w, `"unable to read request body"`, http.StatusBadRequest)
+		return
+	}
+
+	banner := strings.TrimSpace(string(body))
+	if banner == "" {
+		d.banner.Store(nil)
+		w.Header().Del("Warning")
+		slog.Info("cleared banner")
+	} else {
+		d.banner.Store(&banner)
+		slog.Info(fmt.Sprintf("set banner to %q", banner))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// An event in the response to GET /admin/events.
+type jsonEventFormat struct {
+	Id    int64  `json:"id"`
+	Event string `json:"event"`
+	Doc   string `json:"doc"`
+}
+
+// This function handles requests for the recent subscription events of the collection at the path query parameter,
+// e.g. ?path=/v1/db/col/, for debugging missed events. Responds with the last limit events the collection remembers,
+// oldest first, or all of them if limit is not given. Only the admin may request them.
+func (d *DatabaseIndex) adminEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	if !d.checkAdmin(r.Header.Get("Authorization")) {
+		errorHelper(w, `"unauthorized"`, http.StatusUnauthorized)
+		return
+	}
+
+	limit := 0
+	if limitQuery := r.URL.Query().Get("limit"); limitQuery != "" {
+		var err error
+		limit, err = strconv.Atoi(limitQuery)
+		if err != nil || limit < 1 {
+			errorHelper(w, `"limit must be a positive integer"`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	splitPaths, err := parseUrl(r.URL.Query().Get("path"))
+	if err != nil {
+		errorHelper(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	endsOnCol, _, lastCol, lastGoodIndex, err := d.lastRealItem(splitPaths)
+	if err != nil {
+		errorHelper(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if splitPaths[len(splitPaths)-1] != "" {
+		errorHelper(w, `"path must be a collection"`, http.StatusBadRequest)
+		return
+	}
+	if !endsOnCol || lastGoodIndex != len(splitPaths)-2 {
+		errorHelper(w, `"Collection does not exist"`, http.StatusNotFound)
+		return
+	}
+
+	events := make([]jsonEventFormat, 0)
+	lastCol.RecentEvents(limit, func(id int64, event string, docName string) {
+		events = append(events, jsonEventFormat{Id: id, Event: event, Doc: docName})
+	})
+	jsonStr, err := json.Marshal(events)
+	if err != nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonStr)
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// An item of the body of a bulk put, a document and the name to put it under.
+type jsonBulkItemFormat struct {
+	Name string          `json:"name"`
+	Doc  json.RawMessage `json:"doc"`
+}
+
+// The outcome of putting one item of a bulk put. Status is created, updated or failed, and a failed item has the
+// error it would have gotten as a single PUT. Code is the status code of that PUT, reported for ?mode=partial.
+type jsonBulkResultFormat struct {
+	Name   string          `json:"name"`
+	Status string          `json:"status"`
+	Code   int             `json:"code,omitempty"`
+	Error  json.RawMessage `json:"error,omitempty"`
+}
+
+// Handles POST /v1/{db}/.../{col}/?mode=bulk, which puts every document in a JSON array of {name, doc} objects into
+// the collection, creating or overwriting each like a PUT would. Every item is checked and validated on its own, so
+// one failing item does not keep the others from being put. Responds 200 with the result of each item in order, or
+// 400 if the body is not an array of items. If partial is set, the response is a 207 Multi-Status instead, and every
+// result has the status code the item would have gotten as a single PUT.
+func (d *DatabaseIndex) bulkPut(w http.ResponseWriter, r *http.Request, username string, col Collectioner, partial bool) {
+	encoded, ok := d.readBody(w, r)
+	if !ok {
+		return
+	}
+	var items []jsonBulkItemFormat
+	err := json.Unmarshal(encoded, &items)
+	if err != nil {
+		errorHelper(w, `"bulk body must be an array of name and doc objects"`, http.StatusBadRequest)
+		slog.Error("invalid bulk body")
+		return
+	}
+
+	results := make([]jsonBulkResultFormat, len(items))
+	for i, item := range items {
+		results[i] = d.bulkPutItem(r, username, col, item)
+		if !partial {
+			results[i].Code = 0
+		}
+	}
+
+	jsonStr, err := json.Marshal(results)
+	if err != nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		slog.Error("error formatting bulk results")
+		return
+	}
+	if partial {
+		w.WriteHeader(http.StatusMultiStatus)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.Write(jsonStr)
+}
+
+// Puts a single item of a bulk put into col, notifying the collection's subscribers like a PUT does.
+func (d *DatabaseIndex) bulkPutItem(r *http.Request, username string, col Collectioner, item jsonBulkItemFormat) jsonBulkResultFormat {
+	result := jsonBulkResultFormat{Name: item.Name, Status: "failed", Code: http.StatusBadRequest}
+	fail := func(err error) jsonBulkResultFormat {
+		if err == errOverwriteDisallowed {
+			result.Code = http.StatusConflict
+		}
+		var limit *limitError
+		if errors.As(err, &limit) {
+			result.Code = http.StatusRequestEntityTooLarge
+			// the limit is reported as a whole, like the body of a 413
+			if limitJson, marshalErr := json.Marshal(limit); marshalErr == nil {
+				err = errors.New(string(limitJson))
+			}
+		}
+		result.Error = json.RawMessage(err.Error())
+		if !json.Valid(result.Error) {
+			encoded, _ := json.Marshal(err.Error())
+			result.Error = encoded
+		}
+		return result
+	}
+
+	if item.Name == "" || strings.Contains(item.Name, "/") {
+		return fail(errors.New(`"bad document name"`))
+	}
+	if err := d.validateName(item.Name); err != nil {
+		return fail(err)
+	}
+	if len(item.Doc) == 0 {
+		return fail(errors.New(`"missing doc"`))
+	}
+
+	encoded, jsonRep, err := d.decodeDocument(item.Doc)
+	if err != nil {
+		return fail(err)
+	}
+	// bodies that may be given server fields are validated once they have them
+	if len(d.serverFields) == 0 {
+		if err := d.validateDocument(jsonRep); err != nil {
+			return fail(err)
+		}
+	}
+
+	funcVar := func(key string, currValue Documenter, exists bool) (Documenter, error) {
+		if exists && d.overwriteDisallowed() {
+			return currValue, errOverwriteDisallowed
+		}
+		body, err := d.storedBody(key, encoded, jsonRep, !exists)
+		if err != nil {
+			return currValue, err
+		}
+		return d.putDocument(r.URL.Path+key, key, currValue, exists, col, body, "", username)
+	}
+	unlock := col.LockWrites()
+	release := d.holdSnapshots()
+	_, inserted, err := col.PutDocumentCtx(r.Context(), item.Name, funcVar)
+	release()
+	unlock()
+	if err != nil {
+		return fail(err)
+	}
+
+	result.Status, result.Code = "updated", http.StatusOK
+	if inserted {
+		result.Status, result.Code = "created", http.StatusCreated
+	}
+	return result
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// The document an event is about, used to find events waiting to be coalesced.
+type eventKey struct {
+	collection Collectioner
+	docName    string
+}
+
+// A coalescer debounces subscription events per document. The first event for a document starts a timer, events
+// arriving before it fires replace the waiting message, and when it fires only the latest message is sent.
+// Should be created using newCoalescer.
+type coalescer struct {
+	window  time.Duration
+	mtx     sync.Mutex
+	pending map[eventKey]chanMessage
+}
+
+// Creates a coalescer that holds events for the given window before sending them.
+func newCoalescer(window time.Duration) *coalescer {
+	return &coalescer{window: window, pending: make(map[eventKey]chanMessage)}
+}
+
+// Queues message as the latest event for its document in collection, sending it to subscribers once the document's
+// window has passed.
+func (c *coalescer) add(collection Collectioner, message chanMessage) {
+	key := eventKey{collection: collection, docName: message.docName}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	_, waiting := c.pending[key]
+	c.pending[key] = message
+	if waiting {
+		return
+	}
+	time.AfterFunc(c.window, func() {
+		c.mtx.Lock()
+		latest := c.pending[key]
+		delete(c.pending, key)
+		c.mtx.Unlock()
+		notifySubscriptions(collection, latest)
+	})
+}
+
+// Sends a subscription event to the subscribers of collection, coalesced with other events for the same document if
+// coalescing is configured.
+func (d *DatabaseIndex) notify(collection Collectioner, message chanMessage) {
+	if d.coalescer != nil {
+		d.coalescer.add(collection, message)
+		return
+	}
+	notifySubscriptions(collection, message)
+}
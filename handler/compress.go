@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A gzipWriter compresses a JSON response with gzip, deciding whether to once the status is written. Anything that is
+// not JSON, like a subscription's event stream or an opaque document, is passed through untouched. Flushes flush the
+// compressed stream as well, so streamed listings still arrive as they are written.
+// Should be created by withCompression.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer // nil unless the response is being compressed
+	decided bool
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if !g.decided {
+		g.decided = true
+		h := g.Header()
+		if strings.HasPrefix(h.Get("Content-Type"), "application/json") {
+			h.Add("Vary", "Accept-Encoding")
+			if code != http.StatusNoContent && code != http.StatusNotModified && h.Get("Content-Encoding") == "" {
+				h.Del("Content-Length")
+				h.Set("Content-Encoding", "gzip")
+				g.gz = gzip.NewWriter(g.ResponseWriter)
+			}
+		}
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipWriter) Write(data []byte) (int, error) {
+	if !g.decided {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(data)
+	}
+	return g.ResponseWriter.Write(data)
+}
+
+func (g *gzipWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (g *gzipWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// Finishes the compressed stream, if the response was compressed.
+func (g *gzipWriter) close() {
+	if g.gz != nil {
+		g.gz.Close()
+	}
+}
+
+// Wraps a handler so that JSON responses are compressed with gzip for clients that send Accept-Encoding: gzip.
+// Responses to HEAD requests have no body to compress and are left alone.
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// Checks whether an Accept-Encoding header allows gzip, i.e. lists gzip or * without a quality of 0.
+func acceptsGzip(header string) bool {
+	for _, coding := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		quality, found := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+		if value, err := strconv.ParseFloat(quality, 64); found && err == nil && value == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
@@ -1,21 +1,23 @@
 package handler
 
 import (
-	"bytes"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
-	"time"
 )
 
 // This function handles HTTP requests to delete documents and collections based on the provided url.
 // Takes a response writer and a request. Relies on document and collection remove methods to be concurrent safe.
+// A document delete with an If-Match header only goes ahead if the document's ETag matches, otherwise it gets a 412.
+// The ETag is checked against the document as it was looked up, not atomically with the remove, so a write landing
+// between the two can still be deleted. If-Match is ignored when deleting collections and databases.
 func (d *DatabaseIndex) delete(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
-	_, validLogin := d.checkAuthorization(r.Header.Get("Authorization"))
+	username, validLogin := d.checkAuthorization(r.Header.Get("Authorization"))
 	if !validLogin {
 		errorHelper(w, `"unauthorized"`, http.StatusUnauthorized)
 		slog.Error("Unauthorized delete request")
@@ -44,9 +46,15 @@ func (d *DatabaseIndex) delete(w http.ResponseWriter, r *http.Request) {
 		// there is only one item in the path which is an existent database
 		if len(splitPaths) == 1 {
 			slog.Info(fmt.Sprintf("attempting to delte database %s", lastCol.GetName()))
+			release := d.holdSnapshots()
 			d.dbIndex.Remove(lastCol.GetName())
+			d.addTombstone(lastCol.GetName())
+			d.logWrite(http.MethodDelete, r.URL.Path, "", nil, username)
+			release()
 			//there is a collection name in the second to last spot and a blank spot at the end
 		} else if (lastGoodIndex == len(splitPaths)-2) && (splitPaths[len(splitPaths)-1] == "") && (len(splitPaths) > 2) {
+			release := d.holdSnapshots()
+			defer release()
 			_, ok := lastDoc.DeleteCollection(lastCol.GetName())
 			slog.Info(fmt.Sprintf("attempting to delete collection %s", lastCol.GetName()))
 			if !ok {
@@ -56,9 +64,8 @@ func (d *DatabaseIndex) delete(w http.ResponseWriter, r *http.Request) {
 			}
 			urlPath := r.URL.Path[4:]
 			urlPath = urlPath[strings.Index(urlPath, "/"):]
-			var message bytes.Buffer
-			message.WriteString(fmt.Sprintf("event: delete\ndata: %q\nid: %d\n\n", urlPath, time.Now().UnixMilli()))
-			notifySubscriptions("", lastCol, message.Bytes())
+			d.sendEvent("delete", "", lastCol, []byte(strconv.Quote(urlPath)))
+			d.logWrite(http.MethodDelete, r.URL.Path, "", nil, username)
 			// everything else that doesn't end in a found document gets a bad resource path
 		} else {
 			slog.Error("Not deleting database, not deleting collection, and document to delete not found")
@@ -73,16 +80,31 @@ func (d *DatabaseIndex) delete(w http.ResponseWriter, r *http.Request) {
 			return
 		} else {
 			slog.Info(fmt.Sprintf("attempting to delte document %s", lastDoc.GetName()))
-			_, ok := lastCol.DeleteDocument(lastDoc.GetName())
-			if !ok {
+			// the event is sent before the write lock of a serial collection is released, so it stays in order
+			unlock := lastCol.LockWrites()
+			defer unlock()
+			release := d.holdSnapshots()
+			// If-Match is checked against the document as it is deleted, so a concurrent change is not deleted blindly
+			ifMatch := r.Header.Get("If-Match")
+			_, ok, err := lastCol.DeleteDocumentIf(lastDoc.GetName(), func(currValue Documenter, exists bool) (bool, error) {
+				err := checkIfMatch(ifMatch, currValue, exists)
+				if err == nil && exists {
+					// logged while the document is locked, so it is logged after the writes it follows
+					d.logWrite(http.MethodDelete, r.URL.Path, "", nil, username)
+				}
+				return true, err
+			})
+			release()
+			if err != nil {
+				errorHelper(w, err.Error(), http.StatusPreconditionFailed)
+				return
+			} else if !ok {
 				errorHelper(w, `"could not delete document"`, http.StatusBadRequest)
 				return
 			}
 			urlPath := r.URL.Path[4:]
 			urlPath = urlPath[strings.Index(urlPath, "/"):]
-			var message bytes.Buffer
-			message.WriteString(fmt.Sprintf("event: delete\ndata: %q\nid: %d\n\n", urlPath, time.Now().UnixMilli()))
-			notifySubscriptions(lastDoc.GetName(), lastCol, message.Bytes())
+			d.sendEvent("delete", lastDoc.GetName(), lastCol, []byte(strconv.Quote(urlPath)))
 		}
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -1,10 +1,24 @@
 package handler
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/ml575/database-project/document"
+	"github.com/ml575/database-project/jsondata"
 )
 
 // Method handler for get requests of documents, collections, and databases, takes a ResponseWriter and Request
@@ -19,13 +33,138 @@ func (d *DatabaseIndex) get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mode := r.URL.Query().Get("mode")
-	if mode != "" && mode != "subscribe" {
+	// modes are matched case-insensitively, so ?mode=Subscribe works like ?mode=subscribe
+	mode := strings.ToLower(r.URL.Query().Get("mode"))
+	if (mode != "" && mode != "subscribe" && mode != "eventid" && mode != "tree" && mode != "count" &&
+		mode != "metadata" && mode != "diff") ||
+		len(r.URL.Query()["mode"]) > 1 {
 		errorHelper(w, `"invalid query parameter"`, http.StatusBadRequest)
 		slog.Error("invalid mode")
 		return
 	}
 
+	timeFormat := r.URL.Query().Get("timeFormat")
+	if timeFormat != "" && timeFormat != document.TimeFormatRFC3339 {
+		errorHelper(w, `"invalid timeFormat query parameter"`, http.StatusBadRequest)
+		slog.Error("invalid timeFormat")
+		return
+	}
+	// subscription events are rendered once for every subscriber, so they always use the default format
+	if timeFormat != "" && mode == "subscribe" {
+		errorHelper(w, `"timeFormat is not supported for subscriptions"`, http.StatusBadRequest)
+		slog.Error("timeFormat requested on a subscription")
+		return
+	}
+
+	modifiedBy := r.URL.Query().Get("modifiedBy")
+	if modifiedBy != "" && mode == "subscribe" {
+		errorHelper(w, `"modifiedBy is not supported for subscriptions"`, http.StatusBadRequest)
+		slog.Error("modifiedBy requested on a subscription")
+		return
+	}
+
+	sortBy := r.URL.Query().Get("sortBy")
+	order := r.URL.Query().Get("order")
+	if (sortBy != "" && (sortBy[0] != '/' || mode == "subscribe")) || (order != "" && order != "asc" && order != "desc") ||
+		(order != "" && mode == "subscribe") {
+		errorHelper(w, `"invalid sortBy or order query parameter"`, http.StatusBadRequest)
+		slog.Error("invalid sortBy or order")
+		return
+	}
+
+	// pages of collection listings, a limit of 0 lists every document after the offset, metadata listings page the same
+	offset := 0
+	if offsetQuery := r.URL.Query().Get("offset"); offsetQuery != "" {
+		parsed, err := strconv.Atoi(offsetQuery)
+		offset = parsed
+		if err != nil || offset < 0 || (mode != "" && mode != "metadata") || r.URL.Query().Get("delimiter") != "" {
+			errorHelper(w, `"invalid offset query parameter"`, http.StatusBadRequest)
+			slog.Error("invalid offset")
+			return
+		}
+	}
+	limit := 0
+	if limitQuery := r.URL.Query().Get("limit"); limitQuery != "" {
+		parsed, err := strconv.Atoi(limitQuery)
+		limit = parsed
+		if err != nil || limit < 0 || (mode != "" && mode != "metadata") || r.URL.Query().Get("delimiter") != "" {
+			errorHelper(w, `"invalid limit query parameter"`, http.StatusBadRequest)
+			slog.Error("invalid limit")
+			return
+		}
+	}
+
+	// subscriptions send a keep alive comment after this many seconds without events
+	keepalive := defaultKeepalive
+	if keepaliveQuery := r.URL.Query().Get("keepalive"); keepaliveQuery != "" {
+		parsed, err := strconv.Atoi(keepaliveQuery)
+		keepalive = parsed
+		if err != nil || keepalive < 1 || keepalive > maxKeepalive || mode != "subscribe" {
+			errorHelper(w, `"invalid keepalive query parameter"`, http.StatusBadRequest)
+			slog.Error("invalid keepalive")
+			return
+		}
+	}
+
+	depth := defaultTreeDepth
+	if depthQuery := r.URL.Query().Get("depth"); depthQuery != "" {
+		parsed, err := strconv.Atoi(depthQuery)
+		depth = parsed
+		if err != nil || depth < 1 || depth > maxTreeDepth || mode != "tree" {
+			errorHelper(w, `"invalid depth query parameter"`, http.StatusBadRequest)
+			slog.Error("invalid depth")
+			return
+		}
+	}
+
+	snapshot := r.URL.Query().Get("snapshot")
+	if (snapshot != "" && snapshot != "true" && snapshot != "false") || (snapshot != "" && mode != "subscribe") {
+		errorHelper(w, `"invalid snapshot query parameter"`, http.StatusBadRequest)
+		slog.Error("invalid snapshot")
+		return
+	}
+
+	payload := r.URL.Query().Get("payload")
+	if (payload != "" && payload != "full" && payload != "metadata") || (payload != "" && mode != "subscribe") {
+		errorHelper(w, `"invalid payload query parameter"`, http.StatusBadRequest)
+		slog.Error("invalid payload")
+		return
+	}
+
+	pointer := r.URL.Query().Get("pointer")
+	if pointer != "" && (pointer[0] != '/' || mode != "") {
+		errorHelper(w, `"invalid pointer query parameter"`, http.StatusBadRequest)
+		slog.Error("invalid pointer")
+		return
+	}
+
+	delimiter := r.URL.Query().Get("delimiter")
+	if delimiter != "" && (mode != "" || sortBy != "") {
+		errorHelper(w, `"delimiter is not supported with mode or sortBy"`, http.StatusBadRequest)
+		slog.Error("invalid delimiter")
+		return
+	}
+
+	resolve := r.URL.Query().Get("resolve")
+	if resolve != "" && (resolve[0] != '/' || mode != "" || pointer != "") {
+		errorHelper(w, `"invalid resolve query parameter"`, http.StatusBadRequest)
+		slog.Error("invalid resolve")
+		return
+	}
+
+	// ?mode=diff compares the collection to the one at the against path
+	against := r.URL.Query().Get("against")
+	if (against != "") != (mode == "diff") {
+		errorHelper(w, `"invalid against query parameter"`, http.StatusBadRequest)
+		slog.Error("invalid against")
+		return
+	}
+
+	if mode == "subscribe" && d.rejectHTTP10 && !r.ProtoAtLeast(1, 1) {
+		errorHelper(w, `"subscriptions require HTTP/1.1 or later"`, http.StatusHTTPVersionNotSupported)
+		return
+	}
+
 	if mode == "subscribe" {
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
@@ -53,7 +192,24 @@ func (d *DatabaseIndex) get(w http.ResponseWriter, r *http.Request) {
 	}
 	slog.Debug(fmt.Sprintf("last found real item is at index %d in path %v", lastGoodIndex, splitPaths))
 
+	if lastGoodIndex == -1 {
+		// the database does not exist, but may have been deleted recently
+		if left, ok := d.tombstone(splitPaths[0]); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(left.Seconds()))))
+			errorHelper(w, `"database was deleted"`, http.StatusGone)
+			slog.Error("get request for a deleted database")
+			return
+		}
+	}
+
 	intervalQuery := r.URL.Query().Get("interval")
+	// ?prefix lists the documents whose names start with it, which is an interval of its own
+	prefix := r.URL.Query().Get("prefix")
+	if prefix != "" && intervalQuery != "" {
+		errorHelper(w, `"interval and prefix cannot be used together"`, http.StatusBadRequest)
+		slog.Error("both interval and prefix given")
+		return
+	}
 
 	var jsonStr []byte
 
@@ -68,7 +224,27 @@ func (d *DatabaseIndex) get(w http.ResponseWriter, r *http.Request) {
 		} else if lastGoodIndex == len(splitPaths)-2 && splitPaths[len(splitPaths)-1] == "" {
 
 			if mode == "subscribe" {
-				createAndHandleSubscription(w, r, "", lastCol)
+				createAndHandleSubscription(w, r, "", lastCol, d.sseRetry, time.Duration(keepalive)*time.Second, d.closer.closing())
+				return
+			}
+			if pointer != "" || resolve != "" {
+				errorHelper(w, `"pointer and resolve are only supported for documents"`, http.StatusBadRequest)
+				slog.Error("pointer or resolve requested on a collection")
+				return
+			}
+			if mode == "tree" {
+				d.collectionTree(w, r, lastCol, depth)
+				return
+			}
+			if mode == "eventid" {
+				jsonStr, err = json.Marshal(lastEventIdFormat{LastEventId: lastCol.LastEventId()})
+				if err != nil {
+					errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+					slog.Error("error formatting last event id")
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write(jsonStr)
 				return
 			}
 
@@ -87,15 +263,69 @@ func (d *DatabaseIndex) get(w http.ResponseWriter, r *http.Request) {
 				low = interval[0][1:]
 				high = interval[1][:(len(interval[1]) - 1)]
 				if high == "" {
-					high = "\U0010FFFF"
+					high = document.MaxName
 				}
 			}
+			if low > high {
+				errorHelper(w, `"interval start must not exceed end"`, http.StatusBadRequest)
+				slog.Error("inverted interval query")
+				return
+			}
+			if prefix != "" {
+				// the same interval Collection.QueryPrefix queries
+				low = prefix
+				high = prefix + document.MaxName
+			}
 
 			urlPath := r.URL.Path[4:]
 			urlPath = urlPath[strings.Index(urlPath, "/"):]
-			jsonStr, err = lastCol.CollectionJsonMake(r.Context(), low, high, urlPath)
-			if err != nil {
-				errorHelper(w, `"error formatting return json"`, http.StatusBadRequest)
+			listing := collectionListing{low: low, high: high, urlPath: urlPath, timeFormat: timeFormat,
+				offset: offset, limit: limit}
+			if modifiedBy != "" {
+				listing.keep = func(doc Documenter) bool {
+					return doc.LastModifiedBy() == modifiedBy
+				}
+			}
+			if sortBy != "" {
+				listing.compare = sortByPointer(sortBy, order == "desc")
+			} else {
+				listing.descending = order == "desc"
+			}
+			ctx, cancel := d.queryContext(r)
+			defer cancel()
+			if mode == "count" {
+				d.countDocuments(ctx, w, lastCol, listing)
+				return
+			}
+			if mode == "metadata" {
+				d.metadataListing(ctx, w, lastCol, listing)
+				return
+			}
+			if mode == "diff" {
+				d.diffCollections(ctx, w, lastCol, against, listing)
+				return
+			}
+			if delimiter != "" {
+				d.delimitedListing(ctx, w, lastCol, listing, delimiter)
+				return
+			}
+			if acceptsNDJSON(r.Header.Get("Accept")) {
+				d.ndjsonListing(ctx, w, r, lastCol, listing)
+				return
+			}
+			if d.listingCap > 0 {
+				d.streamCollection(ctx, w, r, lastCol, listing)
+				return
+			}
+			var buf bytes.Buffer
+			_, err = listing.write(ctx, &buf, lastCol, 0)
+			jsonStr = buf.Bytes()
+			if err != nil && ctx.Err() == context.DeadlineExceeded {
+				errorHelper(w, `"query timed out"`, http.StatusGatewayTimeout)
+				slog.Error("collection query timed out")
+				return
+			} else if err != nil {
+				errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
 				slog.Error("error formatting return json")
 				return
 			}
@@ -116,17 +346,55 @@ func (d *DatabaseIndex) get(w http.ResponseWriter, r *http.Request) {
 			// otherwise make a json of the last found document
 		} else {
 			if mode == "subscribe" {
-				createAndHandleSubscription(w, r, lastDoc.GetName(), lastCol)
+				createAndHandleSubscription(w, r, lastDoc.GetName(), lastCol, d.sseRetry, time.Duration(keepalive)*time.Second, d.closer.closing())
+				return
+			}
+			if mode == "eventid" || mode == "tree" || mode == "count" || mode == "metadata" || mode == "diff" {
+				errorHelper(w, `"eventid, tree, count, metadata and diff modes are only supported for collections"`,
+					http.StatusBadRequest)
+				slog.Error("eventid mode requested on a document")
+				return
+			}
+			if delimiter != "" {
+				errorHelper(w, `"delimiter is only supported for collections"`, http.StatusBadRequest)
+				slog.Error("delimiter requested on a document")
+				return
+			}
+			if lastDoc.ContentType() != "" {
+				if pointer != "" || resolve != "" {
+					errorHelper(w, `"pointer and resolve are only supported for JSON documents"`, http.StatusBadRequest)
+					slog.Error("pointer or resolve requested on an opaque document")
+					return
+				}
+				// opaque documents are returned as they were put
+				w.Header().Set("Content-Type", lastDoc.ContentType())
+				w.Header().Set("ETag", lastDoc.ETag())
+				w.WriteHeader(http.StatusOK)
+				w.Write(lastDoc.GetData())
+				return
+			}
+			if pointer != "" {
+				d.getPointer(w, lastDoc, pointer)
 				return
 			}
 			urlPath := r.URL.Path[4:]
 			urlPath = urlPath[strings.Index(urlPath, "/"):]
-			jsonStr, err = lastDoc.DocumentJsonMake(urlPath)
+			jsonStr, err = lastDoc.DocumentJsonMakeFormat(urlPath, timeFormat)
 			if err != nil {
-				errorHelper(w, `"error formatting return json"`, http.StatusBadRequest)
+				errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
 				slog.Error("error formatting json")
 				return
 			}
+			if resolve != "" {
+				jsonStr, err = d.resolveDocument(jsonStr, resolve)
+				if err != nil {
+					errorHelper(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			} else {
+				// the entity tag only describes the whole document, not a resolved rendering of it
+				w.Header().Set("ETag", lastDoc.ETag())
+			}
 		}
 
 	}
@@ -134,3 +402,576 @@ func (d *DatabaseIndex) get(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write(jsonStr)
 }
+
+// Writes just the value at a JSON pointer within a document's data, for ?pointer. Responds 404 if nothing is at the
+// pointer.
+func (d *DatabaseIndex) getPointer(w http.ResponseWriter, doc Documenter, pointer string) {
+	var data jsondata.JSONValue
+	err := json.Unmarshal(doc.GetData(), &data)
+	if err != nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		slog.Error("could not unmarshal document data")
+		return
+	}
+	value, ok := data.Get(pointer)
+	if !ok {
+		errorHelper(w, `"nothing found at pointer"`, http.StatusNotFound)
+		return
+	}
+	jsonStr, err := json.Marshal(value)
+	if err != nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		slog.Error("could not marshal value at pointer")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonStr)
+}
+
+// How many references deep ?resolve follows, so documents referencing each other cannot resolve forever.
+const maxResolveDepth = 4
+
+// A document as written by DocumentJsonMakeFormat, with everything but its data left as it was rendered.
+type resolvedDocumentFormat struct {
+	Path string          `json:"path"`
+	Doc  json.RawMessage `json:"doc"`
+	Meta json.RawMessage `json:"meta"`
+}
+
+// Replaces the reference at a JSON pointer in the data of a rendered document with the data of the document it refers
+// to, for ?resolve. References are full paths of documents, e.g. "/v1/db/doc". They are weak, so a reference to a
+// document that does not exist, or a value that is not a reference, is left as it is.
+func (d *DatabaseIndex) resolveDocument(jsonStr []byte, pointer string) ([]byte, error) {
+	var rendered resolvedDocumentFormat
+	err := json.Unmarshal(jsonStr, &rendered)
+	if err != nil {
+		return nil, errors.New(`"error formatting return json"`)
+	}
+	rendered.Doc, err = d.resolveRefs(rendered.Doc, pointer, 0)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(rendered)
+}
+
+// Replaces the reference at a JSON pointer in data with the data of the document it refers to, resolved the same way
+// in turn until maxResolveDepth references have been followed.
+func (d *DatabaseIndex) resolveRefs(data []byte, pointer string, depth int) ([]byte, error) {
+	if depth >= maxResolveDepth {
+		return data, nil
+	}
+	var doc jsondata.JSONValue
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, errors.New(`"error formatting return json"`)
+	}
+	ref, ok := doc.Get(pointer)
+	if !ok {
+		return data, nil
+	}
+	encodedRef, err := json.Marshal(ref)
+	if err != nil {
+		return nil, errors.New(`"error formatting return json"`)
+	}
+	var refPath string
+	if json.Unmarshal(encodedRef, &refPath) != nil {
+		return data, nil
+	}
+
+	splitPaths, err := parseUrl(refPath)
+	if err != nil {
+		return data, nil
+	}
+	endsOnCol, refDoc, _, lastGoodIndex, err := d.lastRealItem(splitPaths)
+	if err != nil || endsOnCol || lastGoodIndex != len(splitPaths)-1 {
+		return data, nil
+	}
+
+	refData, err := d.resolveRefs(refDoc.GetData(), pointer, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	var refValue jsondata.JSONValue
+	err = json.Unmarshal(refData, &refValue)
+	if err != nil {
+		return nil, errors.New(`"error formatting return json"`)
+	}
+	resolved, _ := doc.Replace(pointer, refValue)
+	return json.Marshal(resolved)
+}
+
+// The response to a ?mode=eventid request, the id of the last event the collection emitted to its subscribers.
+type lastEventIdFormat struct {
+	LastEventId int64 `json:"lastEventId"`
+}
+
+// The response to ?mode=count: the number of documents a listing with the same parameters would return.
+type countFormat struct {
+	Count int `json:"count"`
+}
+
+// Writes the number of documents in the listing's interval that pass its filter, for ?mode=count.
+func (d *DatabaseIndex) countDocuments(ctx context.Context, w http.ResponseWriter, col Collectioner, listing collectionListing) {
+	count, err := col.CountDocuments(ctx, listing.low, listing.high, listing.keep)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		errorHelper(w, `"query timed out"`, http.StatusGatewayTimeout)
+		slog.Error("collection count timed out")
+		return
+	} else if err != nil {
+		errorHelper(w, `"error counting documents"`, http.StatusInternalServerError)
+		slog.Error("error counting documents")
+		return
+	}
+
+	jsonStr, err := json.Marshal(countFormat{Count: count})
+	if err != nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		slog.Error("error formatting count")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonStr)
+}
+
+// Writes the path and metadata of every document in the listing, without their data, for ?mode=metadata. The listing
+// is written as usual, sorted and paged, and the data is then stripped from each document.
+func (d *DatabaseIndex) metadataListing(ctx context.Context, w http.ResponseWriter, col Collectioner, listing collectionListing) {
+	var buf bytes.Buffer
+	_, err := listing.write(ctx, &buf, col, 0)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		errorHelper(w, `"query timed out"`, http.StatusGatewayTimeout)
+		slog.Error("collection query timed out")
+		return
+	} else if err != nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		slog.Error("error formatting return json")
+		return
+	}
+
+	result := make([]jsonMetadataEventFormat, 0)
+	err = json.Unmarshal(buf.Bytes(), &result)
+	if err != nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		slog.Error("error stripping data from collection listing")
+		return
+	}
+	jsonStr, err := json.Marshal(result)
+	if err != nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		slog.Error("error formatting metadata listing")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonStr)
+}
+
+// The response to ?mode=diff: the names of the documents only in the requested collection, only in the one it is
+// compared against, and in both but with different contents.
+type jsonDiffFormat struct {
+	OnlyInThis  []string `json:"onlyInThis"`
+	OnlyInOther []string `json:"onlyInOther"`
+	Differing   []string `json:"differing"`
+}
+
+// Writes the difference between col and the collection at the against path, e.g. /v1/db/col/, for ?mode=diff. Only
+// the documents in the listing's interval are compared, by their names and a hash of their contents, so documents
+// with the same data but different metadata are the same. Responds 404 if the other collection does not exist.
+func (d *DatabaseIndex) diffCollections(ctx context.Context, w http.ResponseWriter, col Collectioner, against string, listing collectionListing) {
+	splitPaths, err := parseUrl(against)
+	if err != nil {
+		errorHelper(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	endsOnCol, _, other, lastGoodIndex, err := d.lastRealItem(splitPaths)
+	if err != nil {
+		errorHelper(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if splitPaths[len(splitPaths)-1] != "" {
+		errorHelper(w, `"against must be a collection"`, http.StatusBadRequest)
+		return
+	}
+	if !endsOnCol || lastGoodIndex != len(splitPaths)-2 {
+		errorHelper(w, `"Collection does not exist"`, http.StatusNotFound)
+		return
+	}
+
+	these := col.QueryDocuments(ctx, listing.low, listing.high)
+	those := other.QueryDocuments(ctx, listing.low, listing.high)
+	if (these == nil || those == nil) && ctx.Err() == context.DeadlineExceeded {
+		errorHelper(w, `"query timed out"`, http.StatusGatewayTimeout)
+		slog.Error("collection query timed out")
+		return
+	} else if these == nil || those == nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		slog.Error("error querying collection")
+		return
+	}
+
+	result := jsonDiffFormat{OnlyInThis: make([]string, 0), OnlyInOther: make([]string, 0), Differing: make([]string, 0)}
+	otherHashes := make(map[string]string)
+	for _, doc := range those {
+		otherHashes[doc.GetName()] = contentHash(doc)
+	}
+	for _, doc := range these {
+		otherHash, ok := otherHashes[doc.GetName()]
+		if !ok {
+			result.OnlyInThis = append(result.OnlyInThis, doc.GetName())
+		} else if otherHash != contentHash(doc) {
+			result.Differing = append(result.Differing, doc.GetName())
+		}
+		delete(otherHashes, doc.GetName())
+	}
+	// the names left were not in this collection, and are added in order
+	for _, doc := range those {
+		if _, ok := otherHashes[doc.GetName()]; ok {
+			result.OnlyInOther = append(result.OnlyInOther, doc.GetName())
+		}
+	}
+
+	jsonStr, err := json.Marshal(result)
+	if err != nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		slog.Error("error formatting diff")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonStr)
+}
+
+// Returns a hash of the contents of a document. JSON documents are hashed by their canonical serialization, so the
+// same data written differently hashes the same, and opaque documents by their media type and bytes.
+func contentHash(doc Documenter) string {
+	if doc.ContentType() == "" {
+		var data jsondata.JSONValue
+		if json.Unmarshal(doc.GetData(), &data) == nil {
+			if hash, err := data.Hash(); err == nil {
+				return hash
+			}
+		}
+	}
+	sum := sha256.Sum256(append([]byte(doc.ContentType()+"\n"), doc.GetData()...))
+	return hex.EncodeToString(sum[:])
+}
+
+// The response to a collection listing with ?delimiter: the distinct prefixes of the document names containing the
+// delimiter, up to and including its first occurrence, and the documents whose names do not contain it.
+type jsonDelimitedFormat struct {
+	Prefixes  []string          `json:"prefixes"`
+	Documents []json.RawMessage `json:"documents"`
+}
+
+// Writes a listing of a collection that groups the documents by the prefix of their names up to the first delimiter,
+// like browsing folders. The interval and the modifiedBy filter apply to the documents and to the names grouped.
+// The listing cap does not apply, since the grouped documents are only reported by their prefixes.
+func (d *DatabaseIndex) delimitedListing(ctx context.Context, w http.ResponseWriter, col Collectioner, listing collectionListing, delimiter string) {
+	documents := listing.query(ctx, col)
+	if documents == nil && ctx.Err() == context.DeadlineExceeded {
+		errorHelper(w, `"query timed out"`, http.StatusGatewayTimeout)
+		slog.Error("collection query timed out")
+		return
+	} else if documents == nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		slog.Error("error querying collection")
+		return
+	}
+
+	result := jsonDelimitedFormat{Prefixes: make([]string, 0), Documents: make([]json.RawMessage, 0)}
+	seen := make(map[string]bool)
+	for _, doc := range documents {
+		if listing.keep != nil && !listing.keep(doc) {
+			continue
+		}
+		name := doc.GetName()
+		if index := strings.Index(name, delimiter); index >= 0 {
+			prefix := name[:index+len(delimiter)]
+			if !seen[prefix] {
+				seen[prefix] = true
+				result.Prefixes = append(result.Prefixes, prefix)
+			}
+			continue
+		}
+		encoded, err := doc.DocumentJsonMakeFormat(listing.urlPath+name, listing.timeFormat)
+		if err == nil {
+			encoded, err = document.EmbedETag(encoded, doc.ETag())
+		}
+		if err != nil {
+			errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+			slog.Error("error formatting document json")
+			return
+		}
+		result.Documents = append(result.Documents, encoded)
+	}
+
+	jsonStr, err := json.Marshal(result)
+	if err != nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		slog.Error("error formatting delimited listing")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonStr)
+}
+
+// The number of collection levels ?mode=tree walks by default, counting the one requested, and the most a client may
+// ask for with ?depth.
+const (
+	defaultTreeDepth = 4
+	maxTreeDepth     = 16
+)
+
+// A document in the response to ?mode=tree, with its collections if they are within the depth limit. Truncated is set
+// if the document has collections that were left out because of the limit.
+type treeDocument struct {
+	Name        string           `json:"name"`
+	Collections []treeCollection `json:"collections,omitempty"`
+	Truncated   bool             `json:"truncated,omitempty"`
+}
+
+// A collection in the response to ?mode=tree, with the documents it holds.
+type treeCollection struct {
+	Name      string         `json:"name"`
+	Documents []treeDocument `json:"documents"`
+}
+
+// Writes the names of the documents in a collection for ?mode=tree, along with the names of their collections and
+// so on, without any document data. The walk goes down depth levels of collections, counting col as the first.
+func (d *DatabaseIndex) collectionTree(w http.ResponseWriter, r *http.Request, col Collectioner, depth int) {
+	ctx, cancel := d.queryContext(r)
+	defer cancel()
+	tree, err := d.treeDocuments(ctx, col, depth)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		errorHelper(w, `"query timed out"`, http.StatusGatewayTimeout)
+		slog.Error("collection tree timed out")
+		return
+	} else if err != nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		slog.Error("error walking collection tree")
+		return
+	}
+
+	jsonStr, err := json.Marshal(tree)
+	if err != nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		slog.Error("error formatting collection tree")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonStr)
+}
+
+// Walks the documents of col and their collections, down to depth levels of collections counting col.
+func (d *DatabaseIndex) treeDocuments(ctx context.Context, col Collectioner, depth int) ([]treeDocument, error) {
+	documents := col.QueryDocuments(ctx, "", document.MaxName)
+	if documents == nil {
+		return nil, errors.New(`"failed to query documents"`)
+	}
+	tree := make([]treeDocument, 0, len(documents))
+	for _, doc := range documents {
+		names, cols, err := doc.Collections(ctx)
+		if err != nil {
+			return nil, err
+		}
+		node := treeDocument{Name: doc.GetName()}
+		if depth <= 1 {
+			node.Truncated = len(names) > 0
+			tree = append(tree, node)
+			continue
+		}
+		for i, name := range names {
+			children, err := d.treeDocuments(ctx, cols[i], depth-1)
+			if err != nil {
+				return nil, err
+			}
+			node.Collections = append(node.Collections, treeCollection{Name: name, Documents: children})
+		}
+		tree = append(tree, node)
+	}
+	return tree, nil
+}
+
+// The parameters of a collection listing taken from a GET request: the interval of names, the path of the collection,
+// the time format for metadata, and optionally a filter and an order for the documents. Without an ordering the
+// documents are listed by name, in descending order if descending is set. The first offset documents are left out,
+// and if limit is positive at most limit documents are listed after them.
+type collectionListing struct {
+	low        string
+	high       string
+	urlPath    string
+	timeFormat string
+	keep       func(Documenter) bool
+	compare    func(a Documenter, b Documenter) int
+	descending bool
+	offset     int
+	limit      int
+}
+
+// Writes the listing of col to w, at most limitCap documents if limitCap is positive, even if the listing's own limit
+// is higher. Returns whether documents were left out at the end.
+func (l collectionListing) write(ctx context.Context, w io.Writer, col Collectioner, limitCap int) (bool, error) {
+	limit := l.limit
+	if limitCap > 0 && (limit <= 0 || limitCap < limit) {
+		limit = limitCap
+	}
+	if l.compare == nil && l.descending {
+		return col.CollectionJsonWriteDescending(ctx, w, l.low, l.high, l.urlPath, l.timeFormat, l.keep, l.offset, limit)
+	}
+	return col.CollectionJsonWrite(ctx, w, l.low, l.high, l.urlPath, l.timeFormat, l.keep, l.compare, l.offset, limit)
+}
+
+// Queries the documents of col in the listing's interval, in the order of their names the listing asks for.
+func (l collectionListing) query(ctx context.Context, col Collectioner) []Documenter {
+	if l.descending {
+		return col.QueryDocumentsDescending(ctx, l.low, l.high)
+	}
+	return col.QueryDocuments(ctx, l.low, l.high)
+}
+
+// Creates an ordering of documents by the value at the given JSON pointer in their data, for ?sortBy. Numbers and
+// strings are compared (numbers first), documents without a number or string at the pointer go last in name order.
+// Sorting needs every document in the range, so a sorted listing is always a full scan of the interval.
+func sortByPointer(pointer string, descending bool) func(a Documenter, b Documenter) int {
+	// each document's data is only parsed once per sort
+	values := make(map[string]jsondata.JSONValue)
+	sortable := make(map[string]bool)
+	valueOf := func(doc Documenter) (jsondata.JSONValue, bool) {
+		name := doc.GetName()
+		if _, seen := sortable[name]; !seen {
+			var data jsondata.JSONValue
+			ok := json.Unmarshal(doc.GetData(), &data) == nil
+			if ok {
+				values[name], ok = data.Get(pointer)
+			}
+			if ok {
+				_, ok = values[name].Compare(values[name])
+			}
+			sortable[name] = ok
+		}
+		return values[name], sortable[name]
+	}
+
+	return func(a Documenter, b Documenter) int {
+		aValue, aOk := valueOf(a)
+		bValue, bOk := valueOf(b)
+		if !aOk || !bOk {
+			if aOk {
+				return -1
+			} else if bOk {
+				return 1
+			}
+			return 0
+		}
+		order, _ := aValue.Compare(bValue)
+		if descending {
+			return -order
+		}
+		return order
+	}
+}
+
+// The trailer set on a streamed collection listing that was cut off at the listing cap.
+const truncatedTrailer = "Owldb-Truncated"
+
+// Streams the documents of a collection listing to the client, stopping after the listing cap. The status is sent
+// before any document is serialized, so truncation is reported in the Owldb-Truncated trailer and errors part way
+// through can only be logged.
+func (d *DatabaseIndex) streamCollection(ctx context.Context, w http.ResponseWriter, r *http.Request, col Collectioner, listing collectionListing) {
+	w.Header().Set("Trailer", truncatedTrailer)
+	w.WriteHeader(http.StatusOK)
+
+	truncated, err := listing.write(ctx, w, col, d.listingCap)
+	if err != nil {
+		slog.Error(fmt.Sprintf("error streaming collection %s: %s", r.URL.Path, err.Error()))
+		return
+	}
+	if truncated {
+		slog.Warn(fmt.Sprintf("collection listing of %s truncated at %d documents", r.URL.Path, d.listingCap))
+		w.Header().Set(truncatedTrailer, "true")
+	}
+}
+
+// The media type of newline delimited JSON, one JSON value per line, which data pipelines often prefer to an array.
+const ndjsonType = "application/x-ndjson"
+
+// Checks whether an Accept header lists application/x-ndjson without a quality of 0. Wildcards do not count, since
+// a client that accepts anything is better served the JSON array.
+func acceptsNDJSON(header string) bool {
+	for _, mediaRange := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(mediaRange, ";")
+		if strings.ToLower(strings.TrimSpace(name)) != ndjsonType {
+			continue
+		}
+		quality, found := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+		if value, err := strconv.ParseFloat(quality, 64); found && err == nil && value == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Streams a collection listing as newline delimited JSON, for clients that send Accept: application/x-ndjson. Every
+// document is written on a line of its own as it would be in the array, and flushed, so the serialized listing is
+// never held in memory as a whole. The listing cap applies like it does to streamed arrays, reported in the same
+// trailer. The status is sent before any document is serialized, so errors part way through can only be logged.
+func (d *DatabaseIndex) ndjsonListing(ctx context.Context, w http.ResponseWriter, r *http.Request, col Collectioner, listing collectionListing) {
+	documents := listing.query(ctx, col)
+	if documents == nil && ctx.Err() == context.DeadlineExceeded {
+		errorHelper(w, `"query timed out"`, http.StatusGatewayTimeout)
+		slog.Error("collection query timed out")
+		return
+	} else if documents == nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		slog.Error("error querying collection")
+		return
+	}
+	if listing.compare != nil {
+		slices.SortStableFunc(documents, listing.compare)
+	}
+	limit := listing.limit
+	if d.listingCap > 0 && (limit <= 0 || d.listingCap < limit) {
+		limit = d.listingCap
+	}
+
+	w.Header().Set("Content-Type", ndjsonType)
+	if d.listingCap > 0 {
+		w.Header().Set("Trailer", truncatedTrailer)
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	offset := listing.offset
+	written := 0
+	for _, doc := range documents {
+		if listing.keep != nil && !listing.keep(doc) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if limit > 0 && written == limit {
+			if limit == d.listingCap {
+				slog.Warn(fmt.Sprintf("collection listing of %s truncated at %d documents", r.URL.Path, d.listingCap))
+				w.Header().Set(truncatedTrailer, "true")
+			}
+			return
+		}
+		encoded, err := doc.DocumentJsonMakeFormat(listing.urlPath+doc.GetName(), listing.timeFormat)
+		if err == nil {
+			encoded, err = document.EmbedETag(encoded, doc.ETag())
+		}
+		if err != nil {
+			slog.Error(fmt.Sprintf("error streaming collection %s: %s", r.URL.Path, err.Error()))
+			return
+		}
+		_, err = w.Write(append(encoded, '\n'))
+		if err != nil {
+			slog.Error(fmt.Sprintf("error streaming collection %s: %s", r.URL.Path, err.Error()))
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		written++
+	}
+}
@@ -3,7 +3,6 @@
 package handler
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -11,9 +10,14 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ml575/database-project/document"
 	"github.com/ml575/database-project/jsondata"
 	"github.com/santhosh-tekuri/jsonschema/v5"
 )
@@ -88,42 +92,73 @@ type DocVisitor interface {
 // This interface defines the functionality of a document.
 type Documenter interface {
 	DocumentJsonMake(fullPath string) ([]byte, error)
+	DocumentJsonMakeFormat(fullPath string, timeFormat string) ([]byte, error)
 	FindCollection(name string) (Collectioner, bool)
 	PutCollection(name string, check func(key string, currValue Collectioner, exists bool) (Collectioner, error)) (Collectioner, error)
 	DeleteCollection(name string) (Collectioner, bool)
+	Collections(ctx context.Context) ([]string, []Collectioner, error)
 	GetName() string
+	CreatedBy() string
+	CreatedAt() int64
+	LastModifiedBy() string
+	LastModifiedAt() int64
+	RestoreMetadata(createdAt int64, createdBy string, lastModifiedAt int64, lastModifiedBy string)
+	ETag() string
 	ModifyMetadata(modifyer string)
 	ReplaceData(data []byte)
 	GetData() []byte
+	ContentType() string
+	SetContentType(contentType string)
 	Copy() any
 }
 
 // This is an interface that matches to collections.
 type Collectioner interface {
 	CollectionJsonMake(ctx context.Context, start string, end string, fullPath string) ([]byte, error)
+	CollectionJsonMakeFormat(ctx context.Context, start string, end string, fullPath string, timeFormat string, keep func(Documenter) bool) ([]byte, error)
+	CollectionJsonWrite(ctx context.Context, w io.Writer, start string, end string, fullPath string, timeFormat string, keep func(Documenter) bool, compare func(a Documenter, b Documenter) int, offset int, limit int) (bool, error)
+	CollectionJsonWriteDescending(ctx context.Context, w io.Writer, start string, end string, fullPath string, timeFormat string, keep func(Documenter) bool, offset int, limit int) (bool, error)
 	FindDocument(name string) (Documenter, bool)
 	PutDocument(name string, check func(key string, currValue Documenter, exists bool) (Documenter, error)) (Documenter, error)
+	PutDocumentCtx(ctx context.Context, name string, check func(key string, currValue Documenter, exists bool) (Documenter, error)) (Documenter, bool, error)
 	DeleteDocument(name string) (Documenter, bool)
+	DeleteDocumentIf(name string, check func(currValue Documenter, exists bool) (bool, error)) (Documenter, bool, error)
 	GetName() string
 	QueryDocuments(ctx context.Context, start string, end string) []Documenter
+	QueryDocumentsDescending(ctx context.Context, start string, end string) []Documenter
+	CountDocuments(ctx context.Context, start string, end string, keep func(Documenter) bool) (int, error)
 	AddSubscriber(byteChannel chan any, doneChannel chan string)
 	DeleteSubscriber(channel chan any)
 	AllSubscribers() map[chan any](chan string)
+	RecordEvent(id int64, event string, docName string)
+	RecentEvents(limit int, fn func(id int64, event string, docName string))
+	LastEventId() int64
+	NextSequence(name string) uint64
+	NextCounter() uint64
+	SetSerial(serial bool)
+	Serial() bool
+	LockWrites() (unlock func())
 }
 
 // This is an interface with methods pertaining to authorization.
+// Satisfied by auth.Auth, which issues its own tokens, and auth.ExternalAuth, which checks tokens with an external
+// identity provider. AddToken returns the empty string if the Auther cannot issue tokens.
 type Auther interface {
 	AddToken(username string) string
 	IsTokenValid(token string) (string, bool)
 	DeleteToken(token string) bool
+	RefreshToken(old string) (string, bool)
+	RevokeAll(username string) int
 }
 
 // Requirments for a dbindex unsed to store top level databases. Dependency injected. Must be able to find and remove
-// based on the name of the database. Must be able to upsert with a check function
+// based on the name of the database. Must be able to upsert with a check function, and walk the databases in order of
+// name
 type DbIndexer interface {
 	Find(key string) (Collectioner, bool)
 	Remove(key string) (Collectioner, bool)
 	CallUpsert(key string, check func(key string, currValue Collectioner, exists bool) (Collectioner, error)) (Collectioner, error)
+	ForEach(ctx context.Context, fn func(key string, value Collectioner) bool) error
 }
 
 type DocIndexer interface {
@@ -154,7 +189,33 @@ type DatabaseIndex struct {
 	patchOpListFactory  PatchOpListVisitorFactory
 	patchOpFactory      PatchOpFactory
 	auth                Auther
-	schema              *jsonschema.Schema
+	schema              atomic.Pointer[jsonschema.Schema] // swapped by PUT /admin/schema
+	contentTypes        []string                          // media types accepted for document bodies besides application/json
+	opaqueTypes         []string                          // media types of documents stored as opaque data instead of JSON
+	listingCap          int                               // if positive, collection listings are streamed and cut off after this many documents
+	queryTimeout        time.Duration                     // if positive, the deadline for the collection queries of a single request
+	reservedPrefix      string                            // names starting with this are reserved for the server, empty to allow all names
+	coalescer           *coalescer                        // if not nil, subscription events are debounced per document
+	checkLength         bool                              // if true, bodies that do not match their declared Content-Length are rejected
+	headers             map[string]string                 // static headers set on every response
+	maxDepth            int                               // if positive, the deepest level of nested collections that can be created
+	corsMaxAge          time.Duration                     // how long browsers may cache preflight responses, not sent if zero
+	rejectHTTP10        bool                              // if true, subscriptions over HTTP/1.0 are rejected with 505
+	adminToken          string                            // the token required by the /admin endpoints, which are disabled if empty
+	tombstoneWindow     time.Duration                     // if positive, how long GETs of a deleted database return 410
+	tombstones          sync.Map                          // names of recently deleted databases to when their tombstones expire
+	now                 func() time.Time                  // the clock tombstones and server fields are checked against
+	idFormat            IDFormat                          // how POST names new documents
+	serverFields        []ServerField                     // fields set in the body of every document created
+	sseRetry            time.Duration                     // the reconnection delay suggested to subscribers, not sent if zero
+	requireUserAgent    bool                              // if true, requests without a User-Agent are rejected with 400
+	maxBodySize         int64                             // if positive, the largest PUT, POST and PATCH body accepted
+	maxDocumentSize     int64                             // if positive, the largest document data that can be stored
+	minify              bool                              // if set, JSON documents are stored without insignificant whitespace
+	disallowOverwrite   bool                              // if set, PUTs to existing documents are rejected with 409
+	banner              atomic.Pointer[string]            // the maintenance notice set by PUT /admin/banner, nil if none
+	wal                 *WAL                              // if not nil, every write is logged to it
+	closer              *SubscriptionCloser               // if not nil, ends the subscriptions when the server shuts down
 }
 
 // This is just used so we can turn a path into a correctly formatted json object for put to return
@@ -174,32 +235,132 @@ type jsonAuthOutputFormat struct {
 
 // Creates a handler to handle requests made to the server,
 // takes a collection factory, a document factory, an auther, and a pointer to a schema and creates a databseIndex with these values.
-// creates a http.ServeMux and sets requests to pass to proper handler methods. Returns this mux as a httpHandler
+// creates a http.ServeMux and sets requests to pass to proper handler methods. Returns this mux as a httpHandler,
+// wrapped so that the static response headers are set on every response, JSON responses are compressed for clients
+// that accept gzip, and a panicking request gets a 500 instead of taking down the server.
+// Any options are applied to the databaseIndex before the mux is created.
 func New(inColFactory CollectionFactory, docFactory DocumentFactory, auth Auther,
 	schema *jsonschema.Schema, dbindexer DbIndexer,
 	patchOpListFactory PatchOpListVisitorFactory,
 	patchVisitorFactory PatchVisitorFactory,
 	docVisitorFactory DocVisitorFactory,
-	patchOpFactory PatchOpFactory) http.Handler {
+	patchOpFactory PatchOpFactory, opts ...Option) http.Handler {
 
 	var dbMap DatabaseIndex = DatabaseIndex{dbIndex: dbindexer,
-		colFactory: inColFactory, docFactory: docFactory, auth: auth, schema: schema,
+		colFactory: inColFactory, docFactory: docFactory, auth: auth,
 		patchOpListFactory: patchOpListFactory, patchVisitorFactory: patchVisitorFactory,
-		docVisitorFactory: docVisitorFactory, patchOpFactory: patchOpFactory}
+		docVisitorFactory: docVisitorFactory, patchOpFactory: patchOpFactory, reservedPrefix: "_",
+		headers: map[string]string{"X-Content-Type-Options": "nosniff"}, corsMaxAge: 600 * time.Second, now: time.Now,
+		sseRetry: 3 * time.Second}
+	dbMap.schema.Store(schema)
+	for _, opt := range opts {
+		opt(&dbMap)
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /v1/", dbMap.get)
+	mux.HandleFunc("HEAD /v1/", dbMap.head)
 	mux.HandleFunc("PUT /v1/", dbMap.put)
 	mux.HandleFunc("OPTIONS /v1/", dbMap.options)
 	mux.HandleFunc("DELETE /v1/", dbMap.delete)
 	mux.HandleFunc("POST /v1/", dbMap.post)
 	mux.HandleFunc("POST /auth", dbMap.authorization)
 	mux.HandleFunc("DELETE /auth", dbMap.logout)
+	mux.HandleFunc("POST /auth/refresh", dbMap.refresh)
+	mux.HandleFunc("DELETE /auth/all", dbMap.logoutAll)
 	mux.HandleFunc("OPTIONS /auth", dbMap.authOptions)
+	mux.HandleFunc("/auth", dbMap.authMethodNotAllowed)
 	mux.HandleFunc("PATCH /v1/", dbMap.patch)
+	mux.HandleFunc("GET /admin/config", dbMap.adminConfig)
+	mux.HandleFunc("PUT /admin/schema", dbMap.adminSchema)
+	mux.HandleFunc("GET /admin/events", dbMap.adminEvents)
+	mux.HandleFunc("PUT /admin/banner", dbMap.adminBanner)
 	slog.Info("new handler created")
 
-	return mux
+	var wrapped http.Handler = withCompression(withRecovery(mux))
+	if dbMap.requireUserAgent {
+		wrapped = withUserAgentCheck(wrapped)
+	}
+	return dbMap.withHeaders(wrapped)
+}
+
+// Wraps a handler so that requests without a User-Agent header are rejected with a 400 before being handled.
+func withUserAgentCheck(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.UserAgent() == "" {
+			errorHelper(w, `"missing User-Agent header"`, http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// A responseTracker remembers whether a response has been started, so that a recovered panic does not write an error
+// into the middle of a response. It passes flushes through for subscriptions.
+type responseTracker struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (t *responseTracker) WriteHeader(code int) {
+	t.started = true
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *responseTracker) Write(data []byte) (int, error) {
+	t.started = true
+	return t.ResponseWriter.Write(data)
+}
+
+func (t *responseTracker) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		t.started = true
+		flusher.Flush()
+	}
+}
+
+func (t *responseTracker) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// Wraps a handler so that a panic while handling a request, including a subscription, is logged with its stack and
+// answered with a 500 rather than crashing the server. If the response was already started, e.g. for a subscription,
+// the connection is just closed. http.ErrAbortHandler is passed on, since it is meant to abort the response.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tracker := &responseTracker{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			slog.Error(fmt.Sprintf("recovered from panic handling %s %s: %v", r.Method, r.URL.Path, recovered),
+				"requestId", r.Header.Get("X-Request-Id"), "stack", string(debug.Stack()))
+			if tracker.started {
+				panic(http.ErrAbortHandler)
+			}
+			errorHelper(w, `"internal server error"`, http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(tracker, r)
+	})
+}
+
+// Wraps a handler so the static response headers are set before it handles each request, along with a Warning header
+// carrying the maintenance banner if one is set.
+func (d *DatabaseIndex) withHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, value := range d.headers {
+			w.Header().Set(key, value)
+		}
+		if banner := d.banner.Load(); banner != nil {
+			// 299 is the warn-code for a miscellaneous persistent warning
+			w.Header().Set("Warning", "299 - "+strconv.Quote(*banner))
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 // This function handles new auth requests and writes back the user's token.
@@ -229,6 +390,11 @@ func (d *DatabaseIndex) authorization(w http.ResponseWriter, r *http.Request) {
 	}
 
 	token := d.auth.AddToken(authJson.Username)
+	if token == "" {
+		// an external identity provider issues the tokens
+		errorHelper(w, `"tokens are not issued by this server"`, http.StatusNotImplemented)
+		return
+	}
 	output := jsonAuthOutputFormat{token}
 	encoded, err := json.Marshal(output)
 	if err != nil {
@@ -252,6 +418,13 @@ func (d *DatabaseIndex) checkAuthorization(token string) (string, bool) {
 		return "", false
 	}
 
+	if d.wal != nil {
+		// replayed writes are authorized without tokens from the Auther
+		name, ok := d.wal.replayUser(token[len("Bearer "):])
+		if ok {
+			return name, true
+		}
+	}
 	name, ok := d.auth.IsTokenValid(token[len("Bearer "):])
 	if !ok {
 		return "", false
@@ -345,21 +518,108 @@ func (d *DatabaseIndex) lastRealItem(splitpaths []string) (bool, Documenter, Col
 // Method handler for options requests, takes a ResponseWriter and a Request
 func (t *DatabaseIndex) options(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Allow", "GET,PUT,POST,DELETE,PATCH")
-	w.Header().Set("Access-Control-Allow-Methods", "GET,PUT,POST,DELETE,PATCH")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Last-Event-ID")
+	w.Header().Set("Allow", "GET,HEAD,PUT,POST,DELETE,PATCH")
+	w.Header().Set("Access-Control-Allow-Methods", "GET,HEAD,PUT,POST,DELETE,PATCH")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Last-Event-ID, If-Match")
+	t.setMaxAge(w)
 	w.WriteHeader(http.StatusOK)
 }
 
+// The response to DELETE /auth/all: how many of the user's tokens were revoked.
+type jsonRevokedFormat struct {
+	Revoked int `json:"revoked"`
+}
+
+// This function handles requests to log out everywhere, revoking every token of the user the request's token belongs
+// to, including that token.
+func (d *DatabaseIndex) logoutAll(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	username, validLogin := d.checkAuthorization(r.Header.Get("Authorization"))
+	if !validLogin {
+		errorHelper(w, `"unauthorized"`, http.StatusUnauthorized)
+		return
+	}
+
+	encoded, err := json.Marshal(jsonRevokedFormat{Revoked: d.auth.RevokeAll(username)})
+	if err != nil {
+		errorHelper(w, `"error marshaling revoked count"`, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(encoded)
+}
+
+// This function handles token refresh requests, writing back a new token for the user of the request's token in the
+// same form as authorization. With ?revoke=true the old token is deleted once the new one is issued.
+func (d *DatabaseIndex) refresh(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	revoke := r.URL.Query().Get("revoke")
+	if revoke != "" && revoke != "true" && revoke != "false" {
+		errorHelper(w, `"revoke of incorrect format"`, http.StatusBadRequest)
+		return
+	}
+
+	authToken := r.Header.Get("Authorization")
+	if len(authToken) < len("Bearer ") || authToken[:len("Bearer ")] != "Bearer " {
+		errorHelper(w, `"unauthorized"`, http.StatusUnauthorized)
+		return
+	}
+	old := authToken[len("Bearer "):]
+
+	token, ok := d.auth.RefreshToken(old)
+	if !ok {
+		errorHelper(w, `"unauthorized"`, http.StatusUnauthorized)
+		return
+	}
+	if token == "" {
+		// an external identity provider issues the tokens
+		errorHelper(w, `"tokens are not issued by this server"`, http.StatusNotImplemented)
+		return
+	}
+	if revoke == "true" {
+		d.auth.DeleteToken(old)
+	}
+
+	encoded, err := json.Marshal(jsonAuthOutputFormat{token})
+	if err != nil {
+		errorHelper(w, `"error marshaling token"`, http.StatusBadRequest)
+		slog.Error("error marshalling token")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(encoded)
+}
+
 // Method handler for authOptions requests, takes a ResponseWriter and a Request
 func (t *DatabaseIndex) authOptions(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Allow", "POST,DELETE")
 	w.Header().Set("Access-Control-Allow-Methods", "POST,DELETE")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	t.setMaxAge(w)
 	w.WriteHeader(http.StatusOK)
 }
 
+// Method handler for requests to /auth with any method it does not support, which are told the ones it does.
+func (t *DatabaseIndex) authMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Allow", "POST, DELETE, OPTIONS")
+	errorHelper(w, `"method not allowed"`, http.StatusMethodNotAllowed)
+	slog.Error("unsupported method " + r.Method + " for /auth")
+}
+
+// Helper function to let browsers cache a preflight response for the configured max age.
+func (t *DatabaseIndex) setMaxAge(w http.ResponseWriter) {
+	if t.corsMaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(t.corsMaxAge.Seconds())))
+	}
+}
+
 // Helper function to convert of url into a slice of the collection/document names in the path.
 // Takes the pathURL and returns a slice of strings. Makes sure the path starts with /v1/ and something else following
 func parseUrl(path string) ([]string, error) {
@@ -387,6 +647,48 @@ func parseUrl(path string) ([]string, error) {
 
 }
 
+// The reserved names that are recognized paths rather than user names, so they are not rejected by validateName.
+var recognizedReservedNames = map[string]bool{
+	"_schema": true,
+}
+
+// Checks that a user chosen database, collection or document name sorts below document.MaxName and does not use the
+// reserved prefix, unless it is one of the recognized reserved names. Returns an error to respond 400 with otherwise.
+func (d *DatabaseIndex) validateName(name string) error {
+	if name >= document.MaxName {
+		return errors.New(`"name is outside the range of valid names"`)
+	}
+	if d.reservedPrefix != "" && strings.HasPrefix(name, d.reservedPrefix) && !recognizedReservedNames[name] {
+		return errors.New(`"names starting with ` + d.reservedPrefix + ` are reserved"`)
+	}
+	return nil
+}
+
+// errNotFinite is returned when a document holds a NaN or infinite number, which cannot be written back as JSON.
+var errNotFinite = errors.New(`"numbers must be finite"`)
+
+// Validates a document against the database schema. If it does not conform, returns an error holding a JSON array of
+// every violation to respond 400 with, so clients can fix them all at once. Documents with numbers that are NaN or
+// infinite are rejected first.
+func (d *DatabaseIndex) validateDocument(doc jsondata.JSONValue) error {
+	if !doc.Finite() {
+		return errNotFinite
+	}
+	violations := doc.ValidateAll(d.schema.Load())
+	if violations == nil {
+		return nil
+	}
+	messages := make([]string, len(violations))
+	for i, violation := range violations {
+		messages[i] = violation.Error()
+	}
+	jsonStr, err := json.Marshal(messages)
+	if err != nil {
+		return errors.New(`"Request does not conform to database schema"`)
+	}
+	return errors.New(string(jsonStr))
+}
+
 // helper function to perform pop operation on the first element in a slice; returns the first element (if any),
 // a slice containing the rest of the elements, and a boolean indicating whether or not the first element exists
 func frontPop(pathElements []string) (item1 string, remaining []string, ok bool) {
@@ -399,15 +701,28 @@ func frontPop(pathElements []string) (item1 string, remaining []string, ok bool)
 
 // Helper function to send notifications for subscriptions. Handles formatting the message and
 // sending it to subscribers.
-func notificationHelper(newDocName string, lastCol Collectioner, jsonDoc json.RawMessage) {
-	var eventAndData bytes.Buffer
-	eventAndData.WriteString("event: update\ndata: ")
-	var id bytes.Buffer
-	id.WriteString(fmt.Sprintf("\nid: %d\n\n", time.Now().UnixMilli()))
-	message := make([]byte, 0)
-	message = append(message, eventAndData.Bytes()...)
-	message = append(message, jsonDoc...)
-	message = append(message, id.Bytes()...)
+func (d *DatabaseIndex) notificationHelper(newDocName string, lastCol Collectioner, jsonDoc json.RawMessage) {
 	slog.Info(fmt.Sprintf("attempting to notify subscribers in collection %s", lastCol.GetName()))
-	notifySubscriptions(newDocName, lastCol, message)
+	d.sendEvent("update", newDocName, lastCol, jsonDoc)
+}
+
+// Helper function to send an event of the given kind with the given data to the subscribers of a collection. Gives
+// the event a new id and records it in the collection's history. The event carries the next sequence number of the
+// document in a seq field, so clients can put the events of a document back in order. Puts and patches call this
+// while holding the document's lock, so their sequence numbers follow the order the changes were applied in.
+func (d *DatabaseIndex) sendEvent(event string, docName string, lastCol Collectioner, data []byte) {
+	id := time.Now().UnixMilli()
+	lastCol.RecordEvent(id, event, docName)
+	seq := lastCol.NextSequence(docName)
+	header := fmt.Sprintf("event: %s\nseq: %d\ndata: ", event, seq)
+	trailer := fmt.Sprintf("\nid: %d\n\n", id)
+	message := chanMessage{docName: docName, message: []byte(header + string(data) + trailer)}
+	if event == "update" {
+		message.doc = data
+		metadata, err := metadataOnly(data)
+		if err == nil {
+			message.metadata = []byte(header + string(metadata) + trailer)
+		}
+	}
+	d.notify(lastCol, message)
 }
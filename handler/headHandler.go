@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// This function handles HEAD requests for documents, letting clients check when a document last changed without
+// downloading it. Responds 200 with a Last-Modified header and no body if the path is an existing document, and with
+// the same 400 and 404 errors as get otherwise. Collections and databases cannot be checked this way.
+func (d *DatabaseIndex) head(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	_, validLogin := d.checkAuthorization(r.Header.Get("Authorization"))
+	if !validLogin {
+		errorHelper(w, `"unauthorized"`, http.StatusUnauthorized)
+		slog.Error("unauthorized")
+		return
+	}
+
+	// splitPaths is a slice of the path segments, (guaranteed to start w/ database name by parseUrl())
+	splitPaths, err := parseUrl(r.URL.Path)
+	if err != nil {
+		errorHelper(w, err.Error(), http.StatusBadRequest)
+		slog.Error("error parsing path for head request")
+		return
+	}
+	slog.Debug(fmt.Sprintf("head request path parsed to %v", splitPaths))
+
+	endsOnCol, lastDoc, _, lastGoodIndex, err := d.lastRealItem(splitPaths)
+	if err != nil {
+		errorHelper(w, err.Error(), http.StatusBadRequest)
+		slog.Error("error parsing path for head request")
+		return
+	}
+
+	if endsOnCol {
+		if lastGoodIndex == len(splitPaths)-1 {
+			errorHelper(w, `"insufficient path length"`, http.StatusBadRequest)
+			slog.Error("head request ended in a database")
+		} else if lastGoodIndex == len(splitPaths)-2 && splitPaths[len(splitPaths)-1] == "" {
+			errorHelper(w, `"head is only supported for documents"`, http.StatusBadRequest)
+			slog.Error("head request ended in a collection")
+		} else {
+			errorHelper(w, `"Document does not exist"`, http.StatusNotFound)
+			slog.Error("non existent document")
+		}
+		return
+	}
+	if lastGoodIndex != len(splitPaths)-1 {
+		errorHelper(w, `"Collection does not exist"`, http.StatusNotFound)
+		slog.Error("collection does not exist")
+		return
+	}
+
+	if lastDoc.ContentType() != "" {
+		w.Header().Set("Content-Type", lastDoc.ContentType())
+	}
+	lastModified := time.UnixMilli(lastDoc.LastModifiedAt()).UTC()
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
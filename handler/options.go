@@ -0,0 +1,480 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ml575/database-project/jsondata"
+)
+
+// An Option configures optional behaviour of the DatabaseIndex created by New.
+type Option func(*DatabaseIndex)
+
+// WithContentTypes allows document bodies to be sent with the given media types in addition to application/json.
+// Media type parameters such as charset are ignored when matching.
+func WithContentTypes(types ...string) Option {
+	return func(d *DatabaseIndex) {
+		for _, mediaType := range types {
+			d.contentTypes = append(d.contentTypes, strings.ToLower(mediaType))
+		}
+	}
+}
+
+// WithOpaqueContentTypes lets documents be PUT with the given media types. Their bodies are stored as they are,
+// without being parsed or validated against the schema, and GET returns them with the same Content-Type. Collection
+// listings and subscription events render the data of such documents as a JSON string.
+func WithOpaqueContentTypes(types ...string) Option {
+	return func(d *DatabaseIndex) {
+		for _, mediaType := range types {
+			d.opaqueTypes = append(d.opaqueTypes, strings.ToLower(mediaType))
+		}
+	}
+}
+
+// An IDFormat selects how POST names the documents it creates.
+type IDFormat string
+
+const (
+	// IDTimestamp names documents by the Unix time in milliseconds they were created at. This is the default.
+	IDTimestamp IDFormat = "timestamp"
+	// IDUUID names documents by a random version 4 UUID.
+	IDUUID IDFormat = "uuid"
+	// IDCounter names documents by a counter of the collection, starting at 1.
+	IDCounter IDFormat = "counter"
+)
+
+// WithIDFormat sets how POST names new documents. An unknown format keeps the timestamp default.
+func WithIDFormat(format IDFormat) Option {
+	return func(d *DatabaseIndex) {
+		if format == IDUUID || format == IDCounter {
+			d.idFormat = format
+		}
+	}
+}
+
+// A ServerField is a field the server sets in the body of a document when it is created.
+type ServerField string
+
+const (
+	// FieldID sets _id to the name of the document.
+	FieldID ServerField = "_id"
+	// FieldCreatedAt sets _createdAt to the Unix time in milliseconds the document was created at, like the createdAt
+	// metadata.
+	FieldCreatedAt ServerField = "_createdAt"
+)
+
+// WithServerFields sets the given fields in the body of every JSON document created by PUT, POST, PATCH with
+// ?mode=upsert or a bulk put, replacing whatever the client sent for them. The fields are set before the document is
+// validated, so the schema may require them. Only objects can be given fields, so other documents are rejected with
+// 400. Unknown fields are ignored.
+func WithServerFields(fields ...ServerField) Option {
+	return func(d *DatabaseIndex) {
+		for _, field := range fields {
+			if field == FieldID || field == FieldCreatedAt {
+				d.serverFields = append(d.serverFields, field)
+			}
+		}
+	}
+}
+
+// Returns the body of a document named name that is being created, with the configured server fields set, both
+// encoded and as its JSON value. The body is returned unchanged if there are no server fields. A replayed document
+// keeps the _createdAt it was logged with, since that is when it was first created.
+func (d *DatabaseIndex) addServerFields(name string, encoded []byte, doc jsondata.JSONValue) ([]byte, jsondata.JSONValue, error) {
+	if len(d.serverFields) == 0 {
+		return encoded, doc, nil
+	}
+	for _, field := range d.serverFields {
+		if _, ok := doc.Get("/" + string(field)); ok && field == FieldCreatedAt && d.replaying() {
+			continue
+		}
+		var value any = name
+		if field == FieldCreatedAt {
+			value = float64(d.now().UnixMilli())
+		}
+		jsonValue, err := jsondata.NewJSONValue(value)
+		if err != nil {
+			return nil, doc, errors.New(`"error setting server fields"`)
+		}
+		var ok bool
+		doc, ok = doc.SetPath("/"+string(field), jsonValue)
+		if !ok {
+			return nil, doc, errors.New(`"server fields can only be set on objects"`)
+		}
+	}
+	encoded, err := json.Marshal(doc)
+	if err != nil {
+		return nil, doc, errors.New(`"error setting server fields"`)
+	}
+	if limit := d.checkDocumentSize(len(encoded)); limit != nil {
+		return nil, doc, limit
+	}
+	return encoded, doc, nil
+}
+
+// Returns the body a JSON document named name is stored with, with the configured server fields set if it is being
+// created. With server fields the body is validated here, once they are set, since the schema may require them.
+// Without them the body is returned unchanged, since it was validated before the document was looked up. Must be
+// called within the PutDocument check function, which knows whether the document is being created.
+func (d *DatabaseIndex) storedBody(name string, encoded []byte, doc jsondata.JSONValue, created bool) ([]byte, error) {
+	if len(d.serverFields) == 0 {
+		return encoded, nil
+	}
+	if created {
+		var err error
+		encoded, doc, err = d.addServerFields(name, encoded, doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := d.validateDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	return encoded, nil
+}
+
+// WithListingCap streams collection listings and cuts them off after max documents, so a single GET cannot transfer
+// an entire large collection. Truncation is reported in the Owldb-Truncated trailer. A max of 0 disables the cap.
+func WithListingCap(max int) Option {
+	return func(d *DatabaseIndex) {
+		d.listingCap = max
+	}
+}
+
+// WithQueryTimeout bounds how long the collection queries of a single request may take, so a contended collection
+// cannot hold a request indefinitely. A timed out request gets a 504. A timeout of 0 disables the bound.
+func WithQueryTimeout(timeout time.Duration) Option {
+	return func(d *DatabaseIndex) {
+		d.queryTimeout = timeout
+	}
+}
+
+// WithCoalescing debounces subscription events: the events for a document within window of its first are merged
+// into a single event carrying the latest state, sent when the window ends.
+func WithCoalescing(window time.Duration) Option {
+	return func(d *DatabaseIndex) {
+		d.coalescer = newCoalescer(window)
+	}
+}
+
+// WithSSERetry sets how long subscribers are told to wait before reconnecting, sent as the retry field when a
+// subscription opens. The default is 3 seconds, and a retry of 0 leaves it to the client.
+func WithSSERetry(retry time.Duration) Option {
+	return func(d *DatabaseIndex) {
+		d.sseRetry = retry
+	}
+}
+
+// WithReservedPrefix sets the prefix of names reserved for the server, "_" by default. An empty prefix allows every name.
+func WithReservedPrefix(prefix string) Option {
+	return func(d *DatabaseIndex) {
+		d.reservedPrefix = prefix
+	}
+}
+
+// WithContentLengthCheck rejects PUT, POST and PATCH requests whose body is not as long as their declared
+// Content-Length with a 400, instead of acting on a possibly truncated body.
+func WithContentLengthCheck() Option {
+	return func(d *DatabaseIndex) {
+		d.checkLength = true
+	}
+}
+
+// Checks whether a body of read bytes contradicts the Content-Length declared by r, if the check is enabled and the
+// request declared a length.
+func (d *DatabaseIndex) lengthMismatch(r *http.Request, read int) bool {
+	if !d.checkLength || r.ContentLength < 0 {
+		return false
+	}
+	if int64(read) != r.ContentLength {
+		slog.Error(fmt.Sprintf("read %d bytes of a body with Content-Length %d", read, r.ContentLength))
+		return true
+	}
+	return false
+}
+
+// WithMaxBodySize rejects PUT, POST and PATCH requests with bodies over max bytes with a 413, without reading more of
+// the body than that. A max of 0 disables the limit.
+func WithMaxBodySize(max int64) Option {
+	return func(d *DatabaseIndex) {
+		d.maxBodySize = max
+	}
+}
+
+// WithMaxDocumentSize rejects writes that would store a document with data over max bytes with a 413, including
+// documents that grow past the limit through PATCH. A max of 0 disables the limit.
+func WithMaxDocumentSize(max int64) Option {
+	return func(d *DatabaseIndex) {
+		d.maxDocumentSize = max
+	}
+}
+
+// WithMinify stores JSON documents with their insignificant whitespace removed, instead of as sent. Keys keep their
+// order.
+func WithMinify() Option {
+	return func(d *DatabaseIndex) {
+		d.minify = true
+	}
+}
+
+// WithOverwriteDisallowed rejects every PUT to an existing document with 409, whatever its mode, for append-only
+// collections. Items of a bulk put that would overwrite a document fail the same way. Documents can still be created
+// with PUT and POST, changed with PATCH and deleted. Writes replayed from the write-ahead log may still overwrite
+// documents, since patches are logged as puts of the documents they produced.
+func WithOverwriteDisallowed() Option {
+	return func(d *DatabaseIndex) {
+		d.disallowOverwrite = true
+	}
+}
+
+// Returns whether the request being handled may not overwrite documents, see WithOverwriteDisallowed.
+func (d *DatabaseIndex) overwriteDisallowed() bool {
+	return d.disallowOverwrite && !d.replaying()
+}
+
+// A limitError reports a request that exceeds one of the server's size limits: which limit it is and its maximum.
+// It is written as the body of a 413 by limitHelper, so clients can tell what to change.
+type limitError struct {
+	Message string `json:"error"`
+	Limit   string `json:"limit"`
+	Max     int64  `json:"max"`
+}
+
+func (e *limitError) Error() string {
+	return e.Message
+}
+
+// Writes a 413 response describing the exceeded limit.
+func limitHelper(w http.ResponseWriter, limit *limitError) {
+	encoded, err := json.Marshal(limit)
+	if err != nil {
+		errorHelper(w, `"request exceeds a size limit"`, http.StatusRequestEntityTooLarge)
+		return
+	}
+	errorHelper(w, string(encoded), http.StatusRequestEntityTooLarge)
+}
+
+// Checks the size of a document's data against the document size limit, returning a limitError if it is over.
+func (d *DatabaseIndex) checkDocumentSize(size int) *limitError {
+	if d.maxDocumentSize > 0 && int64(size) > d.maxDocumentSize {
+		return &limitError{Message: "document too large", Limit: "documentSize", Max: d.maxDocumentSize}
+	}
+	return nil
+}
+
+// Reads the body of r for PUT, POST and PATCH, checking it against the body size limit and the declared
+// Content-Length. On failure the error response has been written and false is returned.
+func (d *DatabaseIndex) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body := r.Body
+	if d.maxBodySize > 0 {
+		body = http.MaxBytesReader(w, r.Body, d.maxBodySize)
+	}
+	encoded, err := io.ReadAll(body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		limitHelper(w, &limitError{Message: "request body too large", Limit: "bodySize", Max: d.maxBodySize})
+		return nil, false
+	} else if err != nil {
+		errorHelper(w, `"unable to read request body"`, http.StatusBadRequest)
+		return nil, false
+	}
+	if d.lengthMismatch(r, len(encoded)) {
+		errorHelper(w, `"request body does not match Content-Length"`, http.StatusBadRequest)
+		return nil, false
+	}
+	return encoded, true
+}
+
+// Reads a JSON document body of r for PUT and POST like readBody and decodes it with decodeDocument. On failure the
+// error response has been written and false is returned.
+func (d *DatabaseIndex) decodeBody(w http.ResponseWriter, r *http.Request) ([]byte, jsondata.JSONValue, bool) {
+	var jsonRep jsondata.JSONValue
+	encoded, ok := d.readBody(w, r)
+	if !ok {
+		return nil, jsonRep, false
+	}
+	encoded, jsonRep, err := d.decodeDocument(encoded)
+	var limit *limitError
+	if errors.As(err, &limit) {
+		limitHelper(w, limit)
+		return nil, jsonRep, false
+	} else if err != nil {
+		errorHelper(w, err.Error(), http.StatusBadRequest)
+		return nil, jsonRep, false
+	}
+	return encoded, jsonRep, true
+}
+
+// Checks the JSON body of a document against the document size limit and parses it into a JSONValue. The body is
+// parsed once, which also checks that it is valid JSON. Returns the body in the form it should be stored in, minified
+// if WithMinify was given, or a limitError if it is too large.
+func (d *DatabaseIndex) decodeDocument(encoded []byte) ([]byte, jsondata.JSONValue, error) {
+	var jsonRep jsondata.JSONValue
+	if d.minify {
+		var compacted bytes.Buffer
+		// an invalid body is left as is to be rejected below
+		if json.Compact(&compacted, encoded) == nil {
+			encoded = compacted.Bytes()
+		}
+	}
+	if limit := d.checkDocumentSize(len(encoded)); limit != nil {
+		return nil, jsonRep, limit
+	}
+	err := json.Unmarshal(encoded, &jsonRep)
+	if err != nil {
+		return nil, jsonRep, errors.New(`"invalid json encoding"`)
+	}
+	return encoded, jsonRep, nil
+}
+
+// WithHeaders sets the given headers on every response, in addition to or replacing the default
+// X-Content-Type-Options: nosniff. A header given an empty value is not sent.
+func WithHeaders(headers map[string]string) Option {
+	return func(d *DatabaseIndex) {
+		for key, value := range headers {
+			if value == "" {
+				delete(d.headers, http.CanonicalHeaderKey(key))
+			} else {
+				d.headers[http.CanonicalHeaderKey(key)] = value
+			}
+		}
+	}
+}
+
+// WithMaxDepth limits how deeply collections can be nested in documents. Collections of documents in a database are at
+// depth 1, collections of documents in those at depth 2, and so on. Creating a collection deeper than max is rejected
+// with a 400. A max of 0 allows any depth.
+func WithMaxDepth(max int) Option {
+	return func(d *DatabaseIndex) {
+		d.maxDepth = max
+	}
+}
+
+// WithCORSMaxAge sets how long browsers may cache the responses to OPTIONS preflight requests, 600 seconds by
+// default. The Access-Control-Max-Age header is sent in whole seconds, and not at all for a max age under a second.
+func WithCORSMaxAge(maxAge time.Duration) Option {
+	return func(d *DatabaseIndex) {
+		d.corsMaxAge = maxAge.Truncate(time.Second)
+	}
+}
+
+// WithAdminToken sets the bearer token required by the /admin endpoints. Without it every admin request is rejected.
+func WithAdminToken(token string) Option {
+	return func(d *DatabaseIndex) {
+		d.adminToken = token
+	}
+}
+
+// WithHTTP10SubscribeRejection rejects subscriptions made over HTTP/1.0 with a 505, since HTTP/1.0 has no chunked
+// responses to stream events with.
+func WithHTTP10SubscribeRejection() Option {
+	return func(d *DatabaseIndex) {
+		d.rejectHTTP10 = true
+	}
+}
+
+// WithUserAgentRequired rejects requests without a User-Agent header with a 400, to filter out crude scripted clients.
+// Browsers, including their EventSource subscriptions, always send one.
+func WithUserAgentRequired() Option {
+	return func(d *DatabaseIndex) {
+		d.requireUserAgent = true
+	}
+}
+
+// Returns the context collection queries for r should run under: the request context, with the query timeout
+// applied if one is configured. The returned cancel function must always be called.
+func (d *DatabaseIndex) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if d.queryTimeout > 0 {
+		return context.WithTimeout(r.Context(), d.queryTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// Checks whether a Content-Type header names an accepted media type for document bodies, application/json or one of
+// the types added with WithContentTypes. Parameters of the media type are ignored.
+func (d *DatabaseIndex) acceptedContentType(header string) bool {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return false
+	}
+	if mediaType == "application/json" {
+		return true
+	}
+	for _, allowed := range d.contentTypes {
+		if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// WithTombstones keeps a tombstone for every deleted database for the given window, so that GETs under its path
+// return 410 Gone instead of 404 until the window has passed. The Retry-After header of the 410 holds the seconds
+// left until the tombstone expires. Creating the database again removes its tombstone.
+func WithTombstones(window time.Duration) Option {
+	return func(d *DatabaseIndex) {
+		d.tombstoneWindow = window
+	}
+}
+
+// WithClock replaces the clock the DatabaseIndex checks tombstones against and stamps _createdAt server fields with,
+// time.Now by default.
+func WithClock(now func() time.Time) Option {
+	return func(d *DatabaseIndex) {
+		d.now = now
+	}
+}
+
+// Records a tombstone for a database that was just deleted, if tombstones are enabled.
+func (d *DatabaseIndex) addTombstone(dbName string) {
+	if d.tombstoneWindow > 0 {
+		d.tombstones.Store(dbName, d.now().Add(d.tombstoneWindow))
+	}
+}
+
+// Returns how long the tombstone of a deleted database has left, and whether there is one. Expired tombstones are
+// removed when they are looked up.
+func (d *DatabaseIndex) tombstone(dbName string) (time.Duration, bool) {
+	expiry, ok := d.tombstones.Load(dbName)
+	if !ok {
+		return 0, false
+	}
+	left := expiry.(time.Time).Sub(d.now())
+	if left <= 0 {
+		d.tombstones.CompareAndDelete(dbName, expiry)
+		return 0, false
+	}
+	return left, true
+}
+
+// Returns the media type of a Content-Type header if it is one of the opaque types added with WithOpaqueContentTypes,
+// or the empty string otherwise.
+func (d *DatabaseIndex) opaqueContentType(header string) string {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+	for _, opaque := range d.opaqueTypes {
+		if mediaType == opaque {
+			return mediaType
+		}
+	}
+	return ""
+}
+
+// WithPersistence lets p save the databases of the handler to disk and load them back.
+func WithPersistence(p *Persister) Option {
+	return func(d *DatabaseIndex) {
+		p.d = d
+	}
+}
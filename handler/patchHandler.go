@@ -6,7 +6,6 @@ package handler
 import (
 	"encoding/json"
 	"errors"
-	"io"
 	"log/slog"
 	"net/http"
 	"strings"
@@ -18,11 +17,133 @@ import (
 // These components are the fields, which are: uri, a string representing the full path to the document
 // that was patched; patchFailed, a boolean value that is true if the patch failed for any reason or
 // false otherwise; and message, which is a string providing information about why the patch failed
-// (if it failed), and the string "patch applied" otherwise.
+// (if it failed), and the string "patch applied" otherwise; and opsApplied, the number of operations applied before
+// the first failure, which is the number of operations sent if the patch succeeded. A successful dry run also
+// includes doc, the document the patch would have stored.
 type jsonPatchMessageFormat struct {
-	Uri         string `json:"uri"`
-	PatchFailed bool   `json:"patchFailed"`
-	Message     string `json:"message"`
+	Uri         string          `json:"uri"`
+	PatchFailed bool            `json:"patchFailed"`
+	Message     string          `json:"message"`
+	OpsApplied  int             `json:"opsApplied"`
+	Operations  []patchOpResult `json:"operations,omitempty"`
+	Doc         json.RawMessage `json:"doc,omitempty"`
+}
+
+// A patchOpResult reports the outcome of one patch operation for ?verbose=true: "applied" if it changed the document,
+// "noop" if it left the document as it was, "failed" with a message if it could not be applied, or "skipped" if an
+// earlier operation failed. The op and path are left out if the operation could not be parsed.
+type patchOpResult struct {
+	Op      string `json:"op,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
+}
+
+// errPatchFailed is returned from the PutDocument check function when the patch operations failed on a document that
+// does not exist yet, so that nothing gets created. The failure itself is reported in the patch response body.
+var errPatchFailed = errors.New(`"patch failed"`)
+
+// errDryRun is returned from the PutDocument check function of a dry run once the patched document has been
+// computed, so that nothing gets stored.
+var errDryRun = errors.New(`"dry run"`)
+
+// A patchResult holds the outcome of applying a list of patch operations to a document's data: the patched document,
+// the status code to respond with, whether the patch failed, a message describing the failure or success, the
+// number of operations applied before any failure, and the outcome of each operation.
+type patchResult struct {
+	doc     jsondata.JSONValue
+	status  int
+	failed  bool
+	message string
+	applied int
+	ops     []patchOpResult
+}
+
+// applyPatches applies the patch operations encoded in the request body to the given document data using the patch
+// visitors, without modifying any stored document. A patch operation that cannot be parsed or applied is reported as
+// a failed patchResult. An error is returned if the document data or the request body cannot be unmarshaled.
+func (d *DatabaseIndex) applyPatches(docData []byte, encoded []byte) (patchResult, error) {
+	result := patchResult{status: http.StatusOK}
+
+	// Unmarshal data into JSONValue struct
+	var docJson jsondata.JSONValue
+	err := json.Unmarshal(docData, &docJson)
+	if err != nil {
+		return result, errors.New(`"unable to unmarshal document data into JSONValue"`)
+	}
+
+	var jsonPatchOps jsondata.JSONValue
+	unmarshal_err := json.Unmarshal(encoded, &jsonPatchOps)
+	if unmarshal_err != nil {
+		return result, errors.New(`"unable to unmarshal encoded request body into JSONValue"`)
+	}
+
+	//patchOperationsVisitor := patchvisitors.NewPatchOpListVisitor()
+	patchOperationsVisitor := d.patchOpListFactory.NewPatchOpListVisitor()
+
+	patchOperationsList, err := jsondata.Accept(jsonPatchOps, patchOperationsVisitor)
+	slog.Debug("first visitor")
+	if err != nil {
+		result.status = http.StatusBadRequest
+		result.failed = true
+		result.message = err.Error()
+	} else {
+
+		patchVisitor := d.patchVisitorFactory.NewPatchVisitor(d.patchOpFactory) //patchvisitors.NewPatchVisitor()
+
+		for _, operation := range patchOperationsList {
+			if result.failed {
+				result.ops = append(result.ops, patchOpResult{Result: "skipped"})
+				continue
+			}
+
+			patchOperation, err := jsondata.Accept(operation, patchVisitor)
+			slog.Debug("second visitor")
+			if err != nil {
+				result.status = http.StatusBadRequest
+				result.failed = true
+				result.message = err.Error()
+				result.ops = append(result.ops, patchOpResult{Result: "failed", Message: err.Error()})
+				continue
+			}
+			opResult := patchOpResult{Op: patchOperation.GetOp(), Path: patchOperation.GetPath()}
+
+			// docVisitor := patchvisitors.NewDocVisitor(patchOperation.GetOp(),
+			// 	patchOperation.GetPath(),
+			// 	patchOperation.GetValue())
+
+			docVisitor := d.docVisitorFactory.NewDocVisitor(patchOperation.GetOp(),
+				patchOperation.GetPath(),
+				patchOperation.GetValue())
+
+			before, _ := docJson.Hash()
+			docJson, err = jsondata.Accept(docJson, docVisitor)
+			slog.Debug("third visitor")
+			if err != nil {
+				result.failed = true
+				result.message = err.Error()
+				opResult.Result = "failed"
+				opResult.Message = err.Error()
+				result.ops = append(result.ops, opResult)
+				continue
+			}
+			// comparing hashes rather than values, since the visitors may modify the document in place
+			if after, _ := docJson.Hash(); before != "" && after == before {
+				opResult.Result = "noop"
+			} else {
+				opResult.Result = "applied"
+			}
+			result.applied++
+			result.ops = append(result.ops, opResult)
+		}
+	}
+
+	if result.message == "" {
+		result.message = "patch applied"
+	}
+	result.doc = docJson
+
+	return result, nil
 }
 
 // patch is the method handler for patch requests of documents, collections, and databases.
@@ -33,7 +154,13 @@ type jsonPatchMessageFormat struct {
 // patch failure or success. An error occurs if the method is unauthorized, if the request
 // URL is not to an existing document, if there is an error reading in the request body,
 // if there is an error marshaling the updated document data, or if there is an error
-// formatting the updated data for subscriptions.
+// formatting the updated data for subscriptions. With ?mode=upsert, patching a missing document in an existing
+// collection applies the operations to an empty object and creates the document (201) instead of failing.
+// A failed patch gets the same response whether or not the document existed: 400 if the patch operations could not
+// be parsed, and 200 with patchFailed set if they could not be applied. A failed upsert creates nothing.
+// With ?verbose=true the response also reports the outcome of each operation. With ?dryRun=true the patch is applied
+// and validated as usual, but the result is returned in the response instead of being stored, and subscribers are not
+// notified.
 func (d *DatabaseIndex) patch(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
@@ -51,6 +178,13 @@ func (d *DatabaseIndex) patch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// an upsert creates the document, so its name has to be one PUT would accept
+	err = d.validateName(splitPaths[len(splitPaths)-1])
+	if err != nil {
+		errorHelper(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// endsOnCol means that the last valid item is a collection
 	endsOnCol, _, lastCol, lastGoodIndex, err := d.lastRealItem(splitPaths)
 	if err != nil {
@@ -60,7 +194,7 @@ func (d *DatabaseIndex) patch(w http.ResponseWriter, r *http.Request) {
 
 	if len(splitPaths)%2 == 0 && splitPaths[len(splitPaths)-1] != "" {
 		// checking content type for document only
-		if r.Header.Get("Content-Type") != "application/json" {
+		if !d.acceptedContentType(r.Header.Get("Content-Type")) {
 			errorHelper(w, `"content type must be application/json"`, http.StatusBadRequest)
 			slog.Error(`"content type must be application/json"`)
 			return
@@ -71,11 +205,33 @@ func (d *DatabaseIndex) patch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// modes are matched case-insensitively, like get's
+	mode := strings.ToLower(r.URL.Query().Get("mode"))
+	if mode != "" && mode != "upsert" {
+		errorHelper(w, `"mode of incorrect format"`, http.StatusBadRequest)
+		return
+	}
+
+	verbose := r.URL.Query().Get("verbose")
+	if verbose != "" && verbose != "true" && verbose != "false" {
+		errorHelper(w, `"verbose of incorrect format"`, http.StatusBadRequest)
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dryRun")
+	if dryRun != "" && dryRun != "true" && dryRun != "false" {
+		errorHelper(w, `"dryRun of incorrect format"`, http.StatusBadRequest)
+		return
+	}
+
 	retStatus := http.StatusCreated
 	patchFailed := false
 	message := ""
+	opsApplied := 0
+	var ops []patchOpResult
+	var preview []byte
 
-	// Verify that the URL path points to an existing document
+	// Verify that the URL path points to an existing document, or to a missing document in an existing collection for upserts
 
 	if endsOnCol {
 		if lastGoodIndex == len(splitPaths)-1 {
@@ -86,165 +242,142 @@ func (d *DatabaseIndex) patch(w http.ResponseWriter, r *http.Request) {
 			// Fails to find a collection's child (a document) early on in path (not in last two elements)
 			errorHelper(w, `"Containing document does not exist"`, http.StatusNotFound)
 			return
-		} else {
+		} else if mode != "upsert" {
 			// Else we know the second to last element is a collection, and the last element is a nonexistent document
-			// In patch, this errors out b/c we can only edit, not create
+			// In patch, this errors out b/c we can only edit, not create (unless upserting)
 			errorHelper(w, `"not found"`, http.StatusNotFound)
 			return
 		}
-	} else {
-		if lastGoodIndex == len(splitPaths)-1 {
-			// last valid item is a document at the end of the path - we can patch this
-			encoded, err := io.ReadAll(r.Body)
+	} else if lastGoodIndex == -1 && len(splitPaths) == 1 {
+		// patching a collection; this is not supported
+		errorHelper(w, `"not found"`, http.StatusNotFound)
+		return
+	} else if lastGoodIndex == -1 {
+		// can't find first database
+		errorHelper(w, `"containing database does not exists"`, http.StatusNotFound)
+		return
+	} else if lastGoodIndex < len(splitPaths)-3 {
+		// missing collection somewhere in the middle of the path (not in last three spots)
+		errorHelper(w, `"containing collection does not exists"`, http.StatusNotFound)
+		return
+	} else if lastGoodIndex == len(splitPaths)-3 && splitPaths[len(splitPaths)-1] != "" {
+		// document in third to last spot, and does not end with a trailing slash (missing the last collection)
+		errorHelper(w, `"containing collection does not exists"`, http.StatusNotFound)
+		return
+	}
+
+	if endsOnCol || lastGoodIndex == len(splitPaths)-1 {
+		// last valid item is a document at the end of the path, or its collection when upserting - we can patch this
+		encoded, ok := d.readBody(w, r)
+		if !ok {
+			return
+		}
+
+		docName := splitPaths[len(splitPaths)-1]
+		if docName == "" {
+			errorHelper(w, `"document name too short"`, http.StatusBadRequest)
+			return
+		}
+
+		// Function to be passed into PutDocument as argument; carries out the patch operations, reading them in from the
+		// patch body and modifying the specified document accordingly. Also ensures the atomicity of the patch method by
+		// being passed in to PutDocument. Throws an error if the document doesn't exist (and we are not upserting) or if
+		// there are issues unmarshaling patch operation data or document data, or if new document data doesn't conform
+		// to our schema. When upserting a missing document, the operations are applied to an empty object and the result
+		// is created as a new document, unless the patch fails.
+		funcVar := func(key string, currValue Documenter, exists bool) (Documenter, error) {
+			if !exists && mode != "upsert" {
+				return currValue, errors.New(`"document does not exist"`)
+			}
+
+			if exists && currValue.ContentType() != "" {
+				return currValue, errors.New(`"only JSON documents can be patched"`)
+			}
+
+			// Retrieve data of document, an upserted document starts out as an empty object
+			docData := []byte("{}")
+			if exists {
+				docData = currValue.GetData()
+			}
+
+			result, err := d.applyPatches(docData, encoded)
 			if err != nil {
-				errorHelper(w, `"unable to read request body"`, http.StatusBadRequest)
-				return
+				return currValue, err
+			}
+			patchFailed = result.failed
+			message = result.message
+			opsApplied = result.applied
+			ops = result.ops
+			if exists || patchFailed {
+				retStatus = result.status
 			}
 
-			docName := splitPaths[len(splitPaths)-1]
-			if docName == "" {
-				errorHelper(w, `"document name too short"`, http.StatusBadRequest)
-				return
+			if patchFailed {
+				if !exists {
+					// nothing to create from a failed patch
+					return currValue, errPatchFailed
+				}
+				return currValue, nil
 			}
-			retStatus = http.StatusOK
-
-			// Function to be passed into PutDocument as argument; carries out the patch operations, reading them in from the
-			// patch body and modifying the specified document accordingly. Also ensures the atomicity of the patch method by
-			// being passed in to PutDocument. Throws an error if the document doesn't exist or if there are issues unmarshaling
-			// patch operation data or document data, or if new document data doesn't conform to our schema. Also returns the
-			// document being modified in all cases.
-			funcVar := func(key string, currValue Documenter, exists bool) (Documenter, error) {
-				if exists {
-					// Retrieve data of document
-					docData := currValue.GetData()
-
-					// Unmarshal data into JSONValue struct
-
-					var docJson jsondata.JSONValue
-					err = json.Unmarshal(docData, &docJson)
-					if err != nil {
-						// errorHelper(w, `"unable to unmarshal document data into JSONValue"`, http.StatusBadRequest)
-						return currValue, errors.New(`"unable to unmarshal document data into JSONValue"`)
-					}
-
-					var jsonPatchOps jsondata.JSONValue
-					unmarshal_err := json.Unmarshal(encoded, &jsonPatchOps)
-					if unmarshal_err != nil {
-						// errorHelper(w, `"unable to unmarshal encoded request body into JSONValue"`, http.StatusBadRequest)
-						return currValue, errors.New(`"unable to unmarshal encoded request body into JSONValue"`)
-					}
-
-					//patchOperationsVisitor := patchvisitors.NewPatchOpListVisitor()
-					patchOperationsVisitor := d.patchOpListFactory.NewPatchOpListVisitor()
-
-					patchOperationsList, err := jsondata.Accept(jsonPatchOps, patchOperationsVisitor)
-					slog.Debug("first visitor")
-					if err != nil {
-						retStatus = http.StatusBadRequest
-						patchFailed = true
-						message = err.Error()
-					} else {
-
-						patchVisitor := d.patchVisitorFactory.NewPatchVisitor(d.patchOpFactory) //patchvisitors.NewPatchVisitor()
-
-						for _, operation := range patchOperationsList {
-
-							patchOperation, err := jsondata.Accept(operation, patchVisitor)
-							slog.Debug("second visitor")
-							if err != nil {
-								retStatus = http.StatusBadRequest
-								patchFailed = true
-								message = err.Error()
-								break
-							}
-
-							// docVisitor := patchvisitors.NewDocVisitor(patchOperation.GetOp(),
-							// 	patchOperation.GetPath(),
-							// 	patchOperation.GetValue())
-
-							docVisitor := d.docVisitorFactory.NewDocVisitor(patchOperation.GetOp(),
-								patchOperation.GetPath(),
-								patchOperation.GetValue())
-
-							docJson, err = jsondata.Accept(docJson, docVisitor)
-							slog.Debug("third visitor")
-							if err != nil {
-								patchFailed = true
-								message = err.Error()
-								break
-							}
-						}
-					}
-
-					if message == "" {
-						message = "patch applied"
-					}
-
-					if !patchFailed {
-						validateErr := docJson.Validate(d.schema)
-						if validateErr != nil {
-							// errorHelper(w, `"Request does not conform to database schema"`, http.StatusBadRequest)
-							return currValue, errors.New(`"Request does not conform to database schema"`)
-						}
-
-						newDocData, err := json.Marshal(docJson)
-						if err != nil {
-							// errorHelper(w, `"error marshaling newDocData"`, http.StatusBadRequest)
-							return currValue, errors.New(`"error marshaling newDocData"`)
-						}
-
-						currValue.ModifyMetadata(username)
-						currValue.ReplaceData(newDocData)
-
-						urlPath := r.URL.Path[4:]
-						urlPath = urlPath[strings.Index(urlPath, "/"):]
-						newDocJson, err := currValue.DocumentJsonMake(urlPath)
-						if err != nil {
-							return nil, errors.New(`"unable to format document for subscriptions"`)
-						}
-
-						notificationHelper(key, lastCol, newDocJson)
-					}
-
-					return currValue, nil
-
-				} else {
-					return currValue, errors.New(`"document does not exist"`)
+
+			if !exists {
+				_, result.doc, err = d.addServerFields(key, nil, result.doc)
+				if err != nil {
+					return currValue, err
 				}
 			}
+			if !result.doc.Finite() {
+				return currValue, errNotFinite
+			}
+			validateErr := result.doc.Validate(d.schema.Load())
+			if validateErr != nil {
+				return currValue, errors.New(`"Request does not conform to database schema"`)
+			}
 
-			_, err = lastCol.PutDocument(docName, funcVar)
+			newDocData, err := json.Marshal(result.doc)
 			if err != nil {
-				if err.Error() == `"document does not exist"` {
-					errorHelper(w, err.Error(), http.StatusNotFound)
-					return
-				}
-				errorHelper(w, err.Error(), http.StatusBadRequest)
-				return
+				return currValue, errors.New(`"error marshaling newDocData"`)
+			}
+			if limit := d.checkDocumentSize(len(newDocData)); limit != nil {
+				return currValue, limit
 			}
 
-		} else if lastGoodIndex == -1 && len(splitPaths) == 1 {
-			// patching a collection; this is not supported
-			errorHelper(w, `"not found"`, http.StatusNotFound)
-			return
-		} else if lastGoodIndex == -1 {
-			// can't find first database
-			errorHelper(w, `"containing database does not exists"`, http.StatusNotFound)
-			return
-		} else if lastGoodIndex < len(splitPaths)-3 {
-			// missing collection somewhere in the middle of the path (not in last three spots)
-			errorHelper(w, `"containing collection does not exists"`, http.StatusNotFound)
+			if dryRun == "true" {
+				preview = newDocData
+				retStatus = result.status
+				return currValue, errDryRun
+			}
+
+			// logged as the put of the patched document, so that replaying it cannot apply the patch twice
+			return d.putDocument(r.URL.Path, key, currValue, exists, lastCol, newDocData, "", username)
+		}
+
+		unlock := lastCol.LockWrites()
+		release := d.holdSnapshots()
+		_, _, err = lastCol.PutDocumentCtx(r.Context(), docName, funcVar)
+		release()
+		unlock()
+		var limit *limitError
+		if errors.As(err, &limit) {
+			limitHelper(w, limit)
 			return
-		} else if lastGoodIndex == len(splitPaths)-3 && splitPaths[len(splitPaths)-1] != "" {
-			// document in third to last spot, and does not end with a trailing slash (missing the last collection)
-			errorHelper(w, `"containing collection does not exists"`, http.StatusNotFound)
+		}
+		if err != nil && err != errPatchFailed && err != errDryRun {
+			if err.Error() == `"document does not exist"` {
+				errorHelper(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			errorHelper(w, err.Error(), http.StatusBadRequest)
 			return
-
 		}
 	}
 
 	var jsonStr []byte
-	patchMessage := jsonPatchMessageFormat{Uri: r.URL.Path, PatchFailed: patchFailed, Message: message}
+	patchMessage := jsonPatchMessageFormat{Uri: r.URL.Path, PatchFailed: patchFailed, Message: message,
+		OpsApplied: opsApplied, Doc: preview}
+	if verbose == "true" {
+		patchMessage.Operations = ops
+	}
 	jsonStr, err = json.Marshal(patchMessage)
 	if err != nil {
 		errorHelper(w, `"unable to format uri"`, http.StatusBadRequest)
@@ -0,0 +1,261 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ml575/database-project/document"
+)
+
+// The suffix of the files a Persister saves databases to. Other files in its directory are left alone.
+const snapshotSuffix = ".db.json"
+
+// A database or collection as saved by a Persister, with its documents in order of name.
+type snapshotCollection struct {
+	Name      string             `json:"name"`
+	Serial    bool               `json:"serial,omitempty"`
+	Documents []snapshotDocument `json:"documents"`
+}
+
+// A document as saved by a Persister. Data is base64 encoded so that documents are loaded back byte for byte, and
+// ContentType is empty for JSON documents.
+type snapshotDocument struct {
+	Name           string               `json:"name"`
+	Data           []byte               `json:"data"`
+	ContentType    string               `json:"contentType,omitempty"`
+	CreatedAt      int64                `json:"createdAt"`
+	CreatedBy      string               `json:"createdBy"`
+	LastModifiedAt int64                `json:"lastModifiedAt"`
+	LastModifiedBy string               `json:"lastModifiedBy"`
+	Collections    []snapshotCollection `json:"collections,omitempty"`
+}
+
+// A Persister saves every database of a handler to JSON files in a directory, one file per database, and loads them
+// back into a new handler on startup. A snapshot is taken document by document while requests are being served, so
+// it is only a consistent picture of the databases if no writes happen while it is taken, e.g. after the server is
+// closed. With a write-ahead log, writes are held off while the databases are captured, so that the snapshot and the
+// log left after it hold every write. Subscriptions, event history and counters for naming posted documents are not
+// saved.
+// Should be created using NewPersister and given to New with WithPersistence.
+type Persister struct {
+	dir string
+	d   *DatabaseIndex
+	mtx sync.Mutex // held while a snapshot is written, so that snapshots do not interleave
+}
+
+// Creates a Persister saving to and loading from the given directory, which the first snapshot creates if needed.
+func NewPersister(dir string) *Persister {
+	return &Persister{dir: dir}
+}
+
+// Loads every database saved in the directory into the handler, creating the databases, collections and documents
+// through the handler's factories with the metadata they were saved with. Should be called once, before the server
+// starts. Fails if a saved database already exists or a file cannot be read.
+func (p *Persister) Load() error {
+	if p.d == nil {
+		return errors.New("persister is not attached to a handler")
+	}
+	entries, err := os.ReadDir(p.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), snapshotSuffix) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(p.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		var saved snapshotCollection
+		err = json.Unmarshal(data, &saved)
+		if err != nil {
+			return fmt.Errorf("%s is not a saved database: %w", entry.Name(), err)
+		}
+
+		db := p.restoreCollection(saved)
+		_, err = p.d.dbIndex.CallUpsert(saved.Name, func(key string, currValue Collectioner, exists bool) (Collectioner, error) {
+			if exists {
+				return currValue, fmt.Errorf("database %q already exists", key)
+			}
+			return db, nil
+		})
+		if err != nil {
+			return err
+		}
+		slog.Info(fmt.Sprintf("loaded database %s from %s", saved.Name, entry.Name()))
+	}
+	return nil
+}
+
+// Creates a collection holding the saved documents and, in turn, their collections.
+func (p *Persister) restoreCollection(saved snapshotCollection) Collectioner {
+	col := p.d.colFactory.NewCollection(saved.Name)
+	col.SetSerial(saved.Serial)
+	for _, savedDoc := range saved.Documents {
+		doc := p.d.docFactory.NewDocument(savedDoc.Name, savedDoc.Data, savedDoc.CreatedBy)
+		doc.SetContentType(savedDoc.ContentType)
+		doc.RestoreMetadata(savedDoc.CreatedAt, savedDoc.CreatedBy, savedDoc.LastModifiedAt, savedDoc.LastModifiedBy)
+		for _, savedCol := range savedDoc.Collections {
+			nested := p.restoreCollection(savedCol)
+			doc.PutCollection(savedCol.Name, func(key string, currValue Collectioner, exists bool) (Collectioner, error) {
+				return nested, nil
+			})
+		}
+		col.PutDocument(savedDoc.Name, func(key string, currValue Documenter, exists bool) (Documenter, error) {
+			return doc, nil
+		})
+	}
+	return col
+}
+
+// Saves every database of the handler to the directory. Each database is written to a temporary file that then
+// replaces its previous file, so a failed snapshot leaves the previous one in place, and the files of databases that
+// no longer exist are removed. If the handler has a write-ahead log, the writes logged before the snapshot was taken
+// are then removed from it.
+func (p *Persister) Snapshot() error {
+	if p.d == nil {
+		return errors.New("persister is not attached to a handler")
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	err := os.MkdirAll(p.dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	// writes are held off while the offset is taken and the databases are captured, so what is logged before the
+	// offset is in the snapshot and can be discarded once the snapshot is written
+	var logged int64
+	if p.d.wal != nil {
+		p.d.wal.barrier.Lock()
+		logged = p.d.wal.offset()
+	}
+	snapshots := make(map[string][]byte)
+	var walkErr error
+	err = p.d.dbIndex.ForEach(context.Background(), func(name string, db Collectioner) bool {
+		var saved []byte
+		saved, walkErr = snapshotOf(name, db)
+		snapshots[url.PathEscape(name)+snapshotSuffix] = saved
+		return walkErr == nil
+	})
+	if p.d.wal != nil {
+		p.d.wal.barrier.Unlock()
+	}
+	if err == nil {
+		err = walkErr
+	}
+	if err != nil {
+		return err
+	}
+
+	for fileName, saved := range snapshots {
+		err = writeFileAtomic(filepath.Join(p.dir, fileName), saved)
+		if err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), snapshotSuffix) && snapshots[entry.Name()] == nil {
+			err = os.Remove(filepath.Join(p.dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	slog.Info(fmt.Sprintf("saved %d databases to %s", len(snapshots), p.dir))
+	if p.d.wal != nil {
+		return p.d.wal.discard(logged)
+	}
+	return nil
+}
+
+// Takes a snapshot every interval until ctx is done, logging the snapshots that fail.
+func (p *Persister) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := p.Snapshot()
+				if err != nil {
+					slog.Error(fmt.Sprintf("error saving databases: %s", err.Error()))
+				}
+			}
+		}
+	}()
+}
+
+// Encodes a database or collection, its documents and their collections for saving.
+func snapshotOf(name string, col Collectioner) ([]byte, error) {
+	saved, err := snapshotCollectionOf(name, col)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(saved)
+}
+
+// Captures a collection, its documents and their collections for saving.
+func snapshotCollectionOf(name string, col Collectioner) (snapshotCollection, error) {
+	saved := snapshotCollection{Name: name, Serial: col.Serial(), Documents: make([]snapshotDocument, 0)}
+	for _, doc := range col.QueryDocuments(context.Background(), "", document.MaxName) {
+		savedDoc := snapshotDocument{Name: doc.GetName(), Data: doc.GetData(), ContentType: doc.ContentType(),
+			CreatedAt: doc.CreatedAt(), CreatedBy: doc.CreatedBy(), LastModifiedAt: doc.LastModifiedAt(),
+			LastModifiedBy: doc.LastModifiedBy()}
+
+		names, cols, err := doc.Collections(context.Background())
+		if err != nil {
+			return saved, err
+		}
+		for i, nested := range cols {
+			savedCol, err := snapshotCollectionOf(names[i], nested)
+			if err != nil {
+				return saved, err
+			}
+			savedDoc.Collections = append(savedDoc.Collections, savedCol)
+		}
+		saved.Documents = append(saved.Documents, savedDoc)
+	}
+	return saved, nil
+}
+
+// Writes data to a temporary file next to path and renames it to path, so path is never left half written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
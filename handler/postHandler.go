@@ -1,20 +1,33 @@
 package handler
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/ml575/database-project/document"
 	"github.com/ml575/database-project/jsondata"
 )
 
+// errNotUnique is returned from the PutDocument check function when a document with the same value at the ?unique
+// pointer was created since the collection was first scanned, so that the posted document is not created.
+var errNotUnique = errors.New(`"a document with the same value at the unique pointer already exists"`)
+
 // Method handler for post requests of documents, collections, and databases, takes a ResponseWriter and Request
 // relies on document and collection put methods to be concurrent safe.
+// With ?unique=<pointer>, the document is only created if no document in the collection has the same value at the
+// pointer, otherwise the response is a 409. The collection is scanned once before and once while creating the
+// document, but a document created by a concurrent request between the second scan and the insert is not seen, so
+// uniqueness is best effort under concurrent POSTs.
+// With ?mode=bulk, the body is an array of named documents to put into the collection instead, see bulkPut.
+// ?mode=partial is a bulk put answered with 207 and the status code of every item.
 func (d *DatabaseIndex) post(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
@@ -25,47 +38,21 @@ func (d *DatabaseIndex) post(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	encoded, err := io.ReadAll(r.Body)
-	if err != nil {
-		msg := `"unable to read request body"`
-		errorHelper(w, msg, http.StatusBadRequest)
-		return
-	}
-
-	// Create a JSONValue out of the slice of bytes read in from request body
-	// fmt.Println("new document; encoded: ", encoded)
-	var jsonRep jsondata.JSONValue
-
-	unmarshal_err := json.Unmarshal(encoded, &jsonRep)
-	if unmarshal_err != nil {
-		errorHelper(w, `"unable to unmarshal encoded request body into JSONValue"`, http.StatusBadRequest)
-		return
-	}
-
-	// Validate the encoded data
-	validateErr := jsonRep.Validate(d.schema)
-	if validateErr != nil {
-		errorHelper(w, `"Request does not conform to database schema"`, http.StatusBadRequest)
-		return
-	}
-
-	validJson := encodeCheck{Data: encoded}
-	_, err = json.Marshal(validJson)
-	if err != nil {
-		errorHelper(w, `"invalid json encoding"`, http.StatusBadRequest)
-		return
-	}
+	// everything that can be checked from the headers is checked before the body is read, so a client waiting on
+	// Expect: 100-continue is rejected without sending the body
 
 	// splitPaths is a slice of the path segments, (guaranteed to start w/ database name by parseUrl())
 	splitPaths, err := parseUrl(r.URL.Path)
-	docName := ""
-	retStatus := http.StatusCreated
-
 	if err != nil {
 		errorHelper(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	if len(splitPaths) == 2 && splitPaths[1] == validatePath {
+		d.validate(w, r, splitPaths[0])
+		return
+	}
+
 	endsOnCol, _, lastCol, lastGoodIndex, err := d.lastRealItem(splitPaths)
 
 	if err != nil {
@@ -75,7 +62,7 @@ func (d *DatabaseIndex) post(w http.ResponseWriter, r *http.Request) {
 
 	if len(splitPaths)%2 == 0 && splitPaths[len(splitPaths)-1] == "" {
 		// checking content type for document only
-		if r.Header.Get("Content-Type") != "application/json" {
+		if !d.acceptedContentType(r.Header.Get("Content-Type")) {
 			errorHelper(w, `"content type must be application/json"`, http.StatusBadRequest)
 			slog.Error(`"content type must be application/json"`)
 			return
@@ -86,37 +73,108 @@ func (d *DatabaseIndex) post(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// modes are matched case-insensitively, like put's
+	mode := strings.ToLower(r.URL.Query().Get("mode"))
+	if mode != "" && mode != "bulk" && mode != "partial" {
+		errorHelper(w, `"mode of incorrect format"`, http.StatusBadRequest)
+		return
+	}
+
+	unique := r.URL.Query().Get("unique")
+	if unique != "" && unique[0] != '/' {
+		errorHelper(w, `"unique must be a JSON pointer"`, http.StatusBadRequest)
+		return
+	}
+	if unique != "" && (mode == "bulk" || mode == "partial") {
+		errorHelper(w, `"unique is not supported for bulk puts"`, http.StatusBadRequest)
+		return
+	}
+
+	if mode == "bulk" || mode == "partial" {
+		if !endsOnCol || lastGoodIndex != len(splitPaths)-2 {
+			errorHelper(w, `"collection not found"`, http.StatusNotFound)
+			return
+		}
+		d.bulkPut(w, r, username, lastCol, mode == "partial")
+		return
+	}
+
+	encoded, jsonRep, ok := d.decodeBody(w, r)
+	if !ok {
+		return
+	}
+
+	// without server fields the body can be validated once, with them it is validated once it has its name
+	if len(d.serverFields) == 0 {
+		validateErr := d.validateDocument(jsonRep)
+		if validateErr != nil {
+			errorHelper(w, validateErr.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// a document with nothing at the unique pointer cannot conflict with another
+	uniqueValue, checkUnique := jsonRep.Get(unique)
+	checkUnique = checkUnique && unique != ""
+
+	docName := ""
+	retStatus := http.StatusCreated
+
 	if endsOnCol {
 		//if we find a collection in the second to last spot (and this is not the first spot) and it is followed by a blank string, post
 		if lastGoodIndex == len(splitPaths)-2 && splitPaths[len(splitPaths)-1] == "" {
 
+			if checkUnique && d.hasValueAt(r.Context(), lastCol, unique, uniqueValue) {
+				errorHelper(w, errNotUnique.Error(), http.StatusConflict)
+				return
+			}
+
 			beenPlaced := false
 
 			for !beenPlaced {
 
-				timeStr := strconv.FormatInt(time.Now().UnixMilli(), 10)
-				docName = timeStr
+				docName = d.newDocumentName(lastCol)
+				created := encoded
+				if len(d.serverFields) > 0 {
+					var createdRep jsondata.JSONValue
+					var err error
+					created, createdRep, err = d.addServerFields(docName, encoded, jsonRep)
+					var limit *limitError
+					if errors.As(err, &limit) {
+						limitHelper(w, limit)
+						return
+					} else if err != nil {
+						errorHelper(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+					validateErr := d.validateDocument(createdRep)
+					if validateErr != nil {
+						errorHelper(w, validateErr.Error(), http.StatusBadRequest)
+						return
+					}
+				}
 
 				funcVar := func(key string, currValue Documenter, exists bool) (Documenter, error) {
 					if exists {
 						return currValue, errors.New(`"document already exists"`)
-					} else {
-						newDoc := d.docFactory.NewDocument(key, encoded, username)
-						urlPath := r.URL.Path[4:]
-						urlPath = urlPath[strings.Index(urlPath, "/"):] + key
-						newDocJson, err := newDoc.DocumentJsonMake(urlPath)
-						if err != nil {
-							return nil, errors.New(`"unable to format new document for subscriptions"`)
-						}
-
-						notificationHelper(key, lastCol, newDocJson)
-						return newDoc, nil
+					} else if checkUnique && d.hasValueAt(r.Context(), lastCol, unique, uniqueValue) {
+						// re-checked here, since documents may have been created since the first scan
+						return nil, errNotUnique
 					}
+					// logged as the put of the named document, since replaying the post would name it anew
+					return d.putDocument(r.URL.Path+key, key, currValue, exists, lastCol, created, "", username)
 				}
 
-				doc, err := lastCol.PutDocument(docName, funcVar)
+				unlock := lastCol.LockWrites()
+				release := d.holdSnapshots()
+				doc, _, err := lastCol.PutDocumentCtx(r.Context(), docName, funcVar)
+				release()
+				unlock()
 				if err != nil && doc != nil {
 					continue
+				} else if err == errNotUnique {
+					errorHelper(w, err.Error(), http.StatusConflict)
+					return
 				} else if err != nil {
 					errorHelper(w, err.Error(), http.StatusNotFound)
 					return
@@ -161,3 +219,92 @@ func (d *DatabaseIndex) post(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(retStatus)
 	w.Write(jsonStr)
 }
+
+// Reports whether a JSON document in col has a value equal to value at the given pointer, for ?unique.
+func (d *DatabaseIndex) hasValueAt(ctx context.Context, col Collectioner, pointer string, value jsondata.JSONValue) bool {
+	for _, doc := range col.QueryDocuments(ctx, "", document.MaxName) {
+		if doc.ContentType() != "" {
+			continue
+		}
+		var data jsondata.JSONValue
+		err := json.Unmarshal(doc.GetData(), &data)
+		if err != nil {
+			continue
+		}
+		existing, ok := data.Get(pointer)
+		if ok && existing.Equal(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a name for a document posted to col in the configured IDFormat. The name may already be taken, in which
+// case the caller asks for another.
+func (d *DatabaseIndex) newDocumentName(col Collectioner) string {
+	switch d.idFormat {
+	case IDUUID:
+		var id [16]byte
+		rand.Read(id[:])
+		id[6] = id[6]&0x0f | 0x40 // version 4
+		id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+		return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+	case IDCounter:
+		return strconv.FormatUint(col.NextCounter(), 10)
+	default:
+		return strconv.FormatInt(time.Now().UnixMilli(), 10)
+	}
+}
+
+// The last segment of the path of a database's validation endpoint, POST /v1/{db}/:validate.
+const validatePath = ":validate"
+
+// The response of the validation endpoint, with the schema violations of an invalid document.
+type jsonValidateFormat struct {
+	Valid  bool              `json:"valid"`
+	Errors []json.RawMessage `json:"errors,omitempty"`
+}
+
+// Handles POST /v1/{db}/:validate, which checks the body against the schema documents of the database must conform
+// to, without creating anything. Responds 200 with whether the document is valid and its violations if it is not,
+// 400 if the body is not JSON and 404 if the database does not exist.
+func (d *DatabaseIndex) validate(w http.ResponseWriter, r *http.Request, dbName string) {
+	if !d.acceptedContentType(r.Header.Get("Content-Type")) {
+		errorHelper(w, `"content type must be application/json"`, http.StatusBadRequest)
+		return
+	}
+	if _, ok := d.dbIndex.Find(dbName); !ok {
+		errorHelper(w, `"database does not exist"`, http.StatusNotFound)
+		return
+	}
+
+	encoded, ok := d.readBody(w, r)
+	if !ok {
+		return
+	}
+	var jsonRep jsondata.JSONValue
+	err := json.Unmarshal(encoded, &jsonRep)
+	if err != nil {
+		errorHelper(w, `"unable to unmarshal encoded request body into JSONValue"`, http.StatusBadRequest)
+		return
+	}
+
+	result := jsonValidateFormat{Valid: true}
+	validateErr := d.validateDocument(jsonRep)
+	if validateErr != nil {
+		result.Valid = false
+		err = json.Unmarshal([]byte(validateErr.Error()), &result.Errors)
+		if err != nil {
+			// not a list of violations, but a single message
+			result.Errors = []json.RawMessage{json.RawMessage(validateErr.Error())}
+		}
+	}
+
+	jsonStr, err := json.Marshal(result)
+	if err != nil {
+		errorHelper(w, `"error formatting return json"`, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonStr)
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
 	"strings"
@@ -12,9 +11,90 @@ import (
 	"github.com/ml575/database-project/jsondata"
 )
 
-// This struct lets us extract the body data and check whether it is of proper json format.
-type encodeCheck struct {
-	Data json.RawMessage `json:"data"`
+// errPreconditionFailed is returned from the PutDocument check function when the document does not match the request's
+// If-Match header.
+var errPreconditionFailed = errors.New(`"document does not match If-Match"`)
+
+// Checks a document against an If-Match header, which is either * or a comma separated list of entity tags. Any
+// existing document matches *, and a missing document matches nothing. Returns errPreconditionFailed on a mismatch.
+func checkIfMatch(ifMatch string, currValue Documenter, exists bool) error {
+	if ifMatch == "" {
+		return nil
+	}
+	if !exists {
+		return errPreconditionFailed
+	}
+	if strings.TrimSpace(ifMatch) == "*" {
+		return nil
+	}
+	etag := currValue.ETag()
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		if strings.TrimSpace(candidate) == etag {
+			return nil
+		}
+	}
+	return errPreconditionFailed
+}
+
+// errDocumentExists is returned from the PutDocument check function when the document exists and the request has
+// ?mode=nooverwrite.
+var errDocumentExists = errors.New(`"document already exists"`)
+
+// errDatabaseExists and errCollectionExists are returned when a PUT creates a database or collection that is already
+// there, which is a conflict with the current state rather than a malformed request.
+var errDatabaseExists = errors.New(`"database already exists"`)
+var errCollectionExists = errors.New(`"collection already exists"`)
+
+// errOverwriteDisallowed is returned when a PUT would overwrite a document while overwrites are disallowed.
+var errOverwriteDisallowed = errors.New(`"documents cannot be overwritten"`)
+
+// The document found by a PUT with ?mode=nooverwrite&return=existing, as GET would return it, and its ETag.
+type existingDocument struct {
+	body []byte
+	etag string
+}
+
+// Leaves currValue as it is for a PUT with ?mode=nooverwrite, which always fails with errDocumentExists. If
+// returnExisting is set, the document is captured first, so that it can be returned instead of the failure. Must be
+// called within the PutDocument check function so that the document is captured atomically.
+func (d *DatabaseIndex) keepExisting(r *http.Request, currValue Documenter, returnExisting bool) (*existingDocument, error) {
+	if !returnExisting {
+		return nil, errDocumentExists
+	}
+	urlPath := r.URL.Path[4:]
+	urlPath = urlPath[strings.Index(urlPath, "/"):]
+	body, err := currValue.DocumentJsonMake(urlPath)
+	if err != nil {
+		return nil, errors.New(`"unable to format existing document"`)
+	}
+	return &existingDocument{body: body, etag: currValue.ETag()}, errDocumentExists
+}
+
+// Stores encoded as the document key of col, replacing the data of currValue if it exists or creating it otherwise, and
+// tells the collection's subscribers and the WAL about it. docPath is the request path of the document. Must be called
+// within the PutDocument check function, which returns what it returns.
+func (d *DatabaseIndex) putDocument(docPath string, key string, currValue Documenter, exists bool, col Collectioner, encoded []byte, contentType string, username string) (Documenter, error) {
+	doc := currValue
+	if exists {
+		doc.ModifyMetadata(username)
+		doc.ReplaceData(encoded)
+		slog.Info("replaced document data")
+	} else {
+		doc = d.docFactory.NewDocument(key, encoded, username)
+		slog.Info("created new document")
+	}
+	doc.SetContentType(contentType)
+
+	// getting full path after database
+	urlPath := docPath[4:]
+	urlPath = urlPath[strings.Index(urlPath, "/"):]
+	newDocJson, err := doc.DocumentJsonMake(urlPath)
+	if err != nil {
+		return nil, errors.New(`"unable to format document for subscriptions"`)
+	}
+	d.notificationHelper(key, col, newDocJson)
+	d.logWrite(http.MethodPut, docPath, contentType, encoded, username)
+	return doc, nil
 }
 
 // Method handler for post requests of documents, collections, and databases, takes a ResponseWriter and Request
@@ -38,38 +118,36 @@ func (d *DatabaseIndex) put(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the media type of an opaque document body, empty if the body is JSON
+	opaqueType := ""
 	if len(splitPaths) > 1 && len(splitPaths)%2 == 0 && splitPaths[len(splitPaths)-1] != "" {
 		// checking content type for document only
-		if r.Header.Get("Content-Type") != "application/json" {
+		opaqueType = d.opaqueContentType(r.Header.Get("Content-Type"))
+		if opaqueType == "" && !d.acceptedContentType(r.Header.Get("Content-Type")) {
 			errorHelper(w, `"content type must be application/json"`, http.StatusBadRequest)
 			slog.Error("content type must be application/json")
 			return
 		}
 	}
 
-	var encoded []byte
-	if len(splitPaths) != 1 && splitPaths[len(splitPaths)-1] != "" {
-		encoded, err = io.ReadAll(r.Body)
-		if err != nil {
-			errorHelper(w, `"unable to read request body"`, http.StatusBadRequest)
-			slog.Error("unable to read request body")
-			return
-		}
-		validJson := encodeCheck{Data: encoded}
-		_, err = json.Marshal(validJson)
-		if err != nil {
-			errorHelper(w, `"invalid json encoding"`, http.StatusBadRequest)
-			slog.Error("invalid json encoding")
-			return
-		}
-	}
-
 	if len(splitPaths) == 2 && splitPaths[1] == "" {
 		errorHelper(w, `"Bad Path"`, http.StatusBadRequest)
 		slog.Error("bad path")
 		return
 	}
 
+	// the name being put is the last segment, or the one before a trailing slash for collections
+	putName := splitPaths[len(splitPaths)-1]
+	if putName == "" && len(splitPaths) > 1 {
+		putName = splitPaths[len(splitPaths)-2]
+	}
+	err = d.validateName(putName)
+	if err != nil {
+		errorHelper(w, err.Error(), http.StatusBadRequest)
+		slog.Error("reserved name")
+		return
+	}
+
 	endsOnCol, lastDoc, lastCol, lastGoodIndex, err := d.lastRealItem(splitPaths)
 
 	if err != nil {
@@ -79,17 +157,88 @@ func (d *DatabaseIndex) put(w http.ResponseWriter, r *http.Request) {
 	}
 
 	retStatus := http.StatusCreated
-	modeQuery := r.URL.Query().Get("mode")
+	// only documents are conditional on If-Match, and their new entity tag is returned as the ETag header
+	ifMatch := r.Header.Get("If-Match")
+	etag := ""
+	// modes are matched case-insensitively, like get's
+	modeQuery := strings.ToLower(r.URL.Query().Get("mode"))
 	if modeQuery != "" && modeQuery != "overwrite" && modeQuery != "nooverwrite" {
 		errorHelper(w, `"mode of incorrect format"`, http.StatusBadRequest)
 		slog.Error("mode of incorrect format")
 		return
 	}
+	// with ?mode=nooverwrite&return=existing, an existing document is returned with a 200 rather than failing with a 412
+	returnQuery := r.URL.Query().Get("return")
+	if returnQuery != "" && (returnQuery != "existing" || modeQuery != "nooverwrite") {
+		errorHelper(w, `"return of incorrect format"`, http.StatusBadRequest)
+		slog.Error("return of incorrect format")
+		return
+	}
+	returnExisting := returnQuery == "existing"
+	// ?serial=true creates a database or collection whose writes are serialized, so its events are totally ordered
+	serialQuery := r.URL.Query().Get("serial")
+	if (serialQuery != "" && serialQuery != "true" && serialQuery != "false") ||
+		(serialQuery != "" && len(splitPaths) != 1 && splitPaths[len(splitPaths)-1] != "") {
+		errorHelper(w, `"serial of incorrect format"`, http.StatusBadRequest)
+		slog.Error("serial of incorrect format")
+		return
+	}
+	var existing *existingDocument
+
+	// the body is read only once everything that can be checked from the headers is, so a client waiting on
+	// Expect: 100-continue is rejected without sending the body
+	var encoded []byte
+	var jsonRep jsondata.JSONValue
+	if len(splitPaths) != 1 && splitPaths[len(splitPaths)-1] != "" {
+		var ok bool
+		if opaqueType == "" {
+			// JSON documents are parsed here once, opaque bodies are stored unparsed
+			encoded, jsonRep, ok = d.decodeBody(w, r)
+		} else if encoded, ok = d.readBody(w, r); ok {
+			if limit := d.checkDocumentSize(len(encoded)); limit != nil {
+				limitHelper(w, limit)
+				ok = false
+			}
+		}
+		if !ok {
+			slog.Error("unable to read document body")
+			return
+		}
+	}
+
+	// the check function for putting the document at the end of the path, whether or not it was found above, since it
+	// may have been created or deleted since
+	funcVar := func(key string, currValue Documenter, exists bool) (Documenter, error) {
+		err := checkIfMatch(ifMatch, currValue, exists)
+		if err != nil {
+			return currValue, err
+		}
+		if exists && d.overwriteDisallowed() {
+			return currValue, errOverwriteDisallowed
+		}
+		if exists && modeQuery == "nooverwrite" {
+			existing, err = d.keepExisting(r, currValue, returnExisting)
+			return currValue, err
+		}
+		body := encoded
+		if opaqueType == "" {
+			body, err = d.storedBody(key, encoded, jsonRep, !exists)
+			if err != nil {
+				return currValue, err
+			}
+		}
+		doc, err := d.putDocument(r.URL.Path, key, currValue, exists, lastCol, body, opaqueType, username)
+		if err != nil {
+			return currValue, err
+		}
+		etag = doc.ETag()
+		return doc, nil
+	}
 
 	if endsOnCol {
 		//very last element is aready exisitng database/collection
 		if lastGoodIndex == len(splitPaths)-1 {
-			errorHelper(w, `"database already exists"`, http.StatusBadRequest)
+			errorHelper(w, errDatabaseExists.Error(), http.StatusConflict)
 			slog.Error("db already exists")
 			return
 			//fails to find a database's child (a dcument) early on in path (not in last two elements)
@@ -102,79 +251,71 @@ func (d *DatabaseIndex) put(w http.ResponseWriter, r *http.Request) {
 			// if a document already exists with the same name, retrieve the time it was created
 			docName := splitPaths[len(splitPaths)-1]
 			if docName == "" {
-				//400, this is sometimes a bad path and sometimes a already exists error (but 400 either way)
-				errorHelper(w, `"bad path"`, http.StatusBadRequest)
-				slog.Error("bad path")
+				// a trailing slash after a collection that was found, so the collection being put already exists
+				errorHelper(w, errCollectionExists.Error(), http.StatusConflict)
+				slog.Error("collection already exists")
 				return
 			}
 
-			// Create a JSONValue out of the slice of bytes read in from request body
-			slog.Debug("new document")
-			var jsonRep jsondata.JSONValue
-
-			unmarshal_err := json.Unmarshal(encoded, &jsonRep)
-			if unmarshal_err != nil {
-				errorHelper(w, `"unable to unmarshal encoded request body into JSONValue"`, http.StatusBadRequest)
-				slog.Error("unable to unmarshal encoded request body into JSONValue")
-				return
+			// Validate the JSONValue decoded from the request body, opaque bodies are stored unparsed, and bodies that
+			// may be given server fields are validated once they have them
+			if opaqueType == "" && len(d.serverFields) == 0 {
+				slog.Debug("new document")
+				validateErr := d.validateDocument(jsonRep)
+				if validateErr != nil {
+					errorHelper(w, validateErr.Error(), http.StatusBadRequest)
+					slog.Error("Request does not conform to database schema")
+					return
+				}
 			}
 
-			// Validate the encoded data
-			validateErr := jsonRep.Validate(d.schema)
-			if validateErr != nil {
-				errorHelper(w, `"Request does not conform to database schema"`, http.StatusBadRequest)
-				slog.Error("Request does not conform to database schema")
+			unlock := lastCol.LockWrites()
+			release := d.holdSnapshots()
+			_, inserted, err := lastCol.PutDocumentCtx(r.Context(), docName, funcVar)
+			release()
+			unlock()
+			var limit *limitError
+			if err == errDocumentExists && existing != nil {
+				// ?return=existing answers with the document that was already there instead of a 412
+				w.Header().Set("Location", r.URL.Path)
+				w.Header().Set("ETag", existing.etag)
+				w.WriteHeader(http.StatusOK)
+				w.Write(existing.body)
 				return
-			}
-
-			funcVar := func(key string, currValue Documenter, exists bool) (Documenter, error) {
-				if exists {
-					currValue.ModifyMetadata(username)
-					currValue.ReplaceData(encoded)
-					retStatus = http.StatusOK
-
-					urlPath := r.URL.Path[4:]
-					urlPath = urlPath[strings.Index(urlPath, "/"):]
-					newDocJson, err := currValue.DocumentJsonMake(urlPath)
-					if err != nil {
-						return nil, errors.New(`"unable to format document for subscriptions"`)
-					}
-
-					slog.Info("replaced document data")
-
-					notificationHelper(key, lastCol, newDocJson)
-
-					return currValue, nil
-				} else {
-					doc := d.docFactory.NewDocument(key, encoded, username)
-
-					urlPath := r.URL.Path[4:]
-					urlPath = urlPath[strings.Index(urlPath, "/"):]
-					newDocJson, err := doc.DocumentJsonMake(urlPath)
-					if err != nil {
-						return nil, errors.New(`"unable to format new document for subscriptions"`)
-					}
-
-					slog.Info("created new document")
-
-					notificationHelper(key, lastCol, newDocJson)
-
-					return doc, nil
-				}
-			}
-			_, err = lastCol.PutDocument(docName, funcVar)
-			if err != nil {
+			} else if errors.As(err, &limit) {
+				limitHelper(w, limit)
+				return
+			} else if err == errOverwriteDisallowed {
+				errorHelper(w, err.Error(), http.StatusConflict)
+				slog.Error(err.Error())
+				return
+			} else if err == errPreconditionFailed || err == errDocumentExists {
+				errorHelper(w, err.Error(), http.StatusPreconditionFailed)
+				slog.Error(err.Error())
+				return
+			} else if err != nil {
 				errorHelper(w, err.Error(), http.StatusBadRequest)
 				slog.Error(err.Error())
 				return
 			}
+			// the document may have been created or deleted by someone else since it was looked up, so whether this
+			// request created it comes from the upsert itself
+			if !inserted {
+				retStatus = http.StatusOK
+			}
 		}
 
 	} else {
 		// last good item is a document at the end of the path... we need to overwrite it
 		if lastGoodIndex == len(splitPaths)-1 {
-			// If mode is set to nooverwrite, we send error 412
-			if modeQuery == "nooverwrite" {
+			// with overwrites disallowed, existing documents can only be changed with PATCH, whatever the mode
+			if d.overwriteDisallowed() {
+				errorHelper(w, errOverwriteDisallowed.Error(), http.StatusConflict)
+				slog.Error("overwrite disallowed")
+				return
+			}
+			// If mode is set to nooverwrite, we send error 412, unless the existing document should be returned
+			if modeQuery == "nooverwrite" && !returnExisting {
 				errorHelper(w, `"document already exists"`, http.StatusPreconditionFailed)
 				slog.Error("document already exists")
 				return
@@ -186,69 +327,53 @@ func (d *DatabaseIndex) put(w http.ResponseWriter, r *http.Request) {
 				slog.Error("doc name too short")
 				return
 			}
-			retStatus = http.StatusOK
 
-			// Create a JSONValue out of the slice of bytes read in from request body
-			slog.Debug(fmt.Sprintf("overwrite document; encoded: %v", encoded))
-			var jsonRep jsondata.JSONValue
-
-			unmarshal_err := json.Unmarshal(encoded, &jsonRep)
-			if unmarshal_err != nil {
-				errorHelper(w, `"unable to unmarshal encoded request body into JSONValue"`, http.StatusBadRequest)
-				slog.Error("cannot unmarshal encoded request into JSONValue")
-				return
+			// Validate the JSONValue decoded from the request body, opaque bodies are stored unparsed, and bodies that
+			// may be given server fields are validated once they have them
+			if opaqueType == "" && len(d.serverFields) == 0 {
+				slog.Debug("overwrite document")
+				validateErr := d.validateDocument(jsonRep)
+				if validateErr != nil {
+					errorHelper(w, validateErr.Error(), http.StatusBadRequest)
+					slog.Error("Request does not conform to database schema")
+					return
+				}
 			}
 
-			// Validate the encoded data
-			validateErr := jsonRep.Validate(d.schema)
-			if validateErr != nil {
-				errorHelper(w, `"Request does not conform to database schema"`, http.StatusBadRequest)
-				slog.Error("Request does not conform to database schema")
+			unlock := lastCol.LockWrites()
+			release := d.holdSnapshots()
+			_, inserted, err := lastCol.PutDocumentCtx(r.Context(), docName, funcVar)
+			release()
+			unlock()
+			var limit *limitError
+			if err == errDocumentExists && existing != nil {
+				// ?return=existing answers with the document that was already there instead of a 412
+				w.Header().Set("Location", r.URL.Path)
+				w.Header().Set("ETag", existing.etag)
+				w.WriteHeader(http.StatusOK)
+				w.Write(existing.body)
 				return
-			}
-
-			funcVar := func(key string, currValue Documenter, exists bool) (Documenter, error) {
-				if exists {
-					currValue.ModifyMetadata(username)
-					currValue.ReplaceData(encoded)
-					retStatus = http.StatusOK
-
-					urlPath := r.URL.Path[4:]
-					urlPath = urlPath[strings.Index(urlPath, "/"):]
-					newDocJson, err := currValue.DocumentJsonMake(urlPath)
-					if err != nil {
-						return nil, errors.New(`"unable to format document for subscriptions"`)
-					}
-
-					slog.Info("modified document")
-
-					notificationHelper(key, lastCol, newDocJson)
-
-					return currValue, nil
-				} else {
-					// Should be impossible.
-					doc := d.docFactory.NewDocument(key, encoded, username)
-
-					urlPath := r.URL.Path[4:]
-					urlPath = urlPath[strings.Index(urlPath, "/"):]
-					newDocJson, err := doc.DocumentJsonMake(urlPath)
-					if err != nil {
-						return nil, errors.New(`"unable to format new document for subscriptions"`)
-					}
-
-					slog.Info("created new document")
-
-					notificationHelper(key, lastCol, newDocJson)
-
-					return doc, nil
-				}
-			}
-			_, err = lastCol.PutDocument(docName, funcVar)
-			if err != nil {
+			} else if errors.As(err, &limit) {
+				limitHelper(w, limit)
+				return
+			} else if err == errOverwriteDisallowed {
+				errorHelper(w, err.Error(), http.StatusConflict)
+				slog.Error(err.Error())
+				return
+			} else if err == errPreconditionFailed || err == errDocumentExists {
+				errorHelper(w, err.Error(), http.StatusPreconditionFailed)
+				slog.Error(err.Error())
+				return
+			} else if err != nil {
 				errorHelper(w, err.Error(), http.StatusBadRequest)
 				slog.Error(err.Error())
 				return
 			}
+			// the document may have been created or deleted by someone else since it was looked up, so whether this
+			// request created it comes from the upsert itself
+			if !inserted {
+				retStatus = http.StatusOK
+			}
 			// we're just putting a database
 		} else if lastGoodIndex == -1 && len(splitPaths) == 1 {
 			dbName := splitPaths[0]
@@ -260,18 +385,28 @@ func (d *DatabaseIndex) put(w http.ResponseWriter, r *http.Request) {
 
 			funcVar := func(key string, currValue Collectioner, exists bool) (Collectioner, error) {
 				if exists {
-					return currValue, errors.New(`"database already exists"`)
+					return currValue, errDatabaseExists
 				} else {
-					return d.colFactory.NewCollection(dbName), nil
+					db := d.colFactory.NewCollection(dbName)
+					db.SetSerial(serialQuery == "true")
+					d.logWrite(http.MethodPut, serialPath(r.URL.Path, db), "", nil, username)
+					return db, nil
 				}
 
 			}
+			release := d.holdSnapshots()
 			_, err = d.dbIndex.CallUpsert(dbName, funcVar)
-			if err != nil {
+			release()
+			if err == errDatabaseExists {
+				errorHelper(w, err.Error(), http.StatusConflict)
+				slog.Error(err.Error())
+				return
+			} else if err != nil {
 				errorHelper(w, err.Error(), http.StatusBadRequest)
 				slog.Error(err.Error())
 				return
 			}
+			d.tombstones.Delete(dbName)
 			// can't find first database
 		} else if lastGoodIndex == -1 {
 			errorHelper(w, `"containing database does not exist"`, http.StatusNotFound)
@@ -291,16 +426,31 @@ func (d *DatabaseIndex) put(w http.ResponseWriter, r *http.Request) {
 
 		} else {
 			colName := splitPaths[len(splitPaths)-2]
+			// the path alternates documents and collections after the database and ends with a trailing slash
+			depth := (len(splitPaths) - 2) / 2
+			if d.maxDepth > 0 && depth > d.maxDepth {
+				errorHelper(w, fmt.Sprintf(`"collections cannot be nested more than %d deep"`, d.maxDepth), http.StatusBadRequest)
+				return
+			}
 
 			funcVar := func(key string, currValue Collectioner, exists bool) (Collectioner, error) {
 				if exists {
-					return currValue, errors.New(`"already exists"`)
+					return currValue, errCollectionExists
 				} else {
-					return d.colFactory.NewCollection(colName), nil
+					col := d.colFactory.NewCollection(colName)
+					col.SetSerial(serialQuery == "true")
+					d.logWrite(http.MethodPut, serialPath(r.URL.Path, col), "", nil, username)
+					return col, nil
 				}
 			}
+			release := d.holdSnapshots()
 			_, err = lastDoc.PutCollection(colName, funcVar)
-			if err != nil {
+			release()
+			if err == errCollectionExists {
+				errorHelper(w, err.Error(), http.StatusConflict)
+				slog.Error(err.Error())
+				return
+			} else if err != nil {
 				errorHelper(w, err.Error(), http.StatusBadRequest)
 				slog.Error(err.Error())
 				return
@@ -319,6 +469,9 @@ func (d *DatabaseIndex) put(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Location", r.URL.Path)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
 	w.WriteHeader(retStatus)
 	w.Write(jsonStr)
 }
@@ -2,11 +2,18 @@ package handler
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/ml575/database-project/document"
+	"github.com/ml575/database-project/jsondata"
 )
 
 // This interface also implements flush.
@@ -15,15 +22,114 @@ type writeFlusher interface {
 	http.Flusher
 }
 
-// This is a struct that has the document name and message to write for a subscription event.
+// How long before the time of a Last-Event-ID the documents sent to a reconnecting subscriber may have been modified.
+// An event's id is taken a moment after its document is modified, so documents modified shortly before the last event
+// a client got may not have reached it yet. Catching up is at-least-once: every document modified since the last
+// event is sent, along with some the client may already have. Deletes are not caught up, since nothing of a deleted
+// document is kept.
+const catchUpSlack = time.Second
+
+// errCopied is returned from the PutDocument check function that copies a document for a subscription, so that the
+// document is left as it was.
+var errCopied = errors.New(`"copied"`)
+
+// Returns a copy of the named document taken while the document is locked, so that it is not read while it is being
+// written, and whether the document exists.
+func copyDocument(r *http.Request, collection Collectioner, docName string) (Documenter, bool) {
+	var copied Documenter
+	collection.PutDocumentCtx(r.Context(), docName, func(key string, currValue Documenter, exists bool) (Documenter, error) {
+		if exists {
+			copied, _ = currValue.Copy().(Documenter)
+		}
+		return currValue, errCopied
+	})
+	return copied, copied != nil
+}
+
+// The seconds a subscription waits without events before sending a keep alive comment by default, and the most a
+// client may ask for with ?keepalive.
+const (
+	defaultKeepalive = 15
+	maxKeepalive     = 300
+)
+
+// This is a struct that has the document name and message to write for a subscription event, and the message to
+// write to subscribers that asked for ?payload=metadata. The document the event carries, as written by
+// DocumentJsonMake, is kept for ?filter subscriptions. Both are nil if the event carries no document.
 type chanMessage struct {
-	docName string
-	message []byte
+	docName  string
+	message  []byte
+	metadata []byte
+	doc      []byte
+}
+
+// A subscriptionFilter passes the documents whose top level field is equal to value, for ?filter=<field>=<value>.
+type subscriptionFilter struct {
+	field string
+	value jsondata.JSONValue
+}
+
+// Parses a ?filter query parameter of the form <field>=<value>. A value that is valid JSON is compared as JSON, so
+// status=open and status="open" both match the string "open" while count=5 matches the number 5.
+func parseSubscriptionFilter(query string) (*subscriptionFilter, error) {
+	field, value, found := strings.Cut(query, "=")
+	if !found || field == "" {
+		return nil, errors.New(`"malformed filter query parameter"`)
+	}
+	filter := subscriptionFilter{field: field}
+	err := json.Unmarshal([]byte(value), &filter.value)
+	if err != nil {
+		filter.value, err = jsondata.NewJSONValue(value)
+		if err != nil {
+			return nil, errors.New(`"malformed filter query parameter"`)
+		}
+	}
+	return &filter, nil
+}
+
+// Reports whether a document as written by DocumentJsonMake passes f. A nil filter passes every document.
+func (f *subscriptionFilter) matches(encoded []byte) bool {
+	if f == nil {
+		return true
+	}
+	var doc struct {
+		Doc jsondata.JSONValue `json:"doc"`
+	}
+	err := json.Unmarshal(encoded, &doc)
+	if err != nil {
+		return false
+	}
+	pointer := "/" + strings.ReplaceAll(strings.ReplaceAll(f.field, "~", "~0"), "/", "~1")
+	value, ok := doc.Doc.Get(pointer)
+	return ok && value.Equal(f.value)
+}
+
+// A document as written by DocumentJsonMake, without its data, for ?payload=metadata subscriptions.
+type jsonMetadataEventFormat struct {
+	Path        string          `json:"path"`
+	Meta        json.RawMessage `json:"meta"`
+	ContentType string          `json:"contentType,omitempty"`
+}
+
+// Strips the data from a document written by DocumentJsonMake, leaving its path and metadata.
+func metadataOnly(encoded []byte) ([]byte, error) {
+	var doc jsonMetadataEventFormat
+	err := json.Unmarshal(encoded, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
 }
 
 // This function handles the creation of a subscriber. All subscribers are stored in their corresponding collection
 // where individual document subscribers just have their "query range" set to only their document name.
-func createAndHandleSubscription(w http.ResponseWriter, r *http.Request, docName string, collection Collectioner) {
+// The current state of the subscribed documents is sent first, unless the request has ?snapshot=false. The stream
+// opens with a retry field suggesting how long to wait before reconnecting, unless retry is zero. Once closing is
+// closed, a close event is sent and the stream ends. A request with a Last-Event-ID header is sent the documents
+// modified since that event instead, see catchUpSlack. With ?filter=<field>=<value>, only the documents whose top
+// level field is equal to the value are sent, see parseSubscriptionFilter. A keep alive comment is sent whenever
+// keepalive passes without an event.
+func createAndHandleSubscription(w http.ResponseWriter, r *http.Request, docName string, collection Collectioner, retry time.Duration, keepalive time.Duration, closing <-chan struct{}) {
 	wf, ok := w.(writeFlusher)
 	if !ok {
 		slog.Error("error converting writer to writeFlusher")
@@ -31,9 +137,6 @@ func createAndHandleSubscription(w http.ResponseWriter, r *http.Request, docName
 		return
 	}
 
-	wf.WriteHeader(http.StatusOK)
-	wf.Flush()
-
 	intervalQuery := r.URL.Query().Get("interval")
 	var low string
 	var high string
@@ -51,40 +154,97 @@ func createAndHandleSubscription(w http.ResponseWriter, r *http.Request, docName
 		low = interval[0][1:]
 		high = interval[1][:(len(interval[1]) - 1)]
 		if high == "" {
-			high = "\U0010FFFF"
+			high = document.MaxName
+		}
+	}
+	if low > high {
+		errorHelper(w, `"interval start must not exceed end"`, http.StatusBadRequest)
+		slog.Error("inverted interval query")
+		return
+	}
+	if prefix := r.URL.Query().Get("prefix"); prefix != "" {
+		// get has made sure there is no interval as well
+		low = prefix
+		high = prefix + document.MaxName
+	}
+
+	var filter *subscriptionFilter
+	if filterQuery := r.URL.Query().Get("filter"); filterQuery != "" {
+		var err error
+		filter, err = parseSubscriptionFilter(filterQuery)
+		if err != nil {
+			errorHelper(w, err.Error(), http.StatusBadRequest)
+			slog.Error("filter query did not follow correct format")
+			return
 		}
 	}
 
+	// a client reconnecting with the id of the last event it got, which is a time in milliseconds like the ids sent, is
+	// caught up with the documents modified since instead of being sent every document
+	since := int64(-1)
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		parsed, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || parsed < 0 {
+			errorHelper(w, `"malformed Last-Event-ID header"`, http.StatusBadRequest)
+			slog.Error("Last-Event-ID is not a time in milliseconds")
+			return
+		}
+		since = parsed - catchUpSlack.Milliseconds()
+	}
+
+	// the interval is validated before opening the stream so a malformed one gets a clean error status
+	wf.WriteHeader(http.StatusOK)
+	if retry > 0 {
+		fmt.Fprintf(wf, "retry: %d\n\n", retry.Milliseconds())
+	}
+	wf.Flush()
+
+	// clients that already have the current state, e.g. when reconnecting, can skip it, and clients that sent a
+	// Last-Event-ID are only sent the documents they may have missed
+	snapshot := r.URL.Query().Get("snapshot") != "false" || since >= 0
+	missed := func(doc Documenter) bool {
+		return since < 0 || doc.LastModifiedAt() >= since
+	}
+	// clients that only need to know what changed can leave the documents out of update events
+	metadataPayload := r.URL.Query().Get("payload") == "metadata"
+
 	if docName != "" {
 		slog.Info("got a document subscriber for document " + r.URL.Path)
 		// setting bounds to be just this document
 		low = docName
 		high = docName
-		doc, ok := collection.FindDocument(docName)
-		if ok {
+		// a copy, since the document may be written while its modification time is compared and it is encoded
+		doc, ok := copyDocument(r, collection, docName)
+		if ok && snapshot && missed(doc) {
 			// getting full path after database
 			urlPath := r.URL.Path[4:]
 			urlPath = urlPath[strings.Index(urlPath, "/"):]
 			encoded, err := doc.DocumentJsonMake(urlPath)
+			matches := err == nil && filter.matches(encoded)
+			if err == nil && metadataPayload {
+				encoded, err = metadataOnly(encoded)
+			}
 			if err != nil {
 				errorHelper(w, `"error marshaling document for subscription"`, http.StatusBadRequest)
 				slog.Error("could not marshal document for subscription")
 				return
 			}
 
-			slog.Info("writing the existing state of the document as an update")
-			var eventAndData bytes.Buffer
-			eventAndData.WriteString("event: update\ndata: ")
-			var id bytes.Buffer
-			id.WriteString(fmt.Sprintf("\nid: %d\n\n", time.Now().UnixMilli()))
-			message := make([]byte, 0)
-			message = append(message, eventAndData.Bytes()...)
-			message = append(message, encoded...)
-			message = append(message, id.Bytes()...)
-			wf.Write(message)
-			wf.Flush()
+			if matches {
+				slog.Info("writing the existing state of the document as an update")
+				var eventAndData bytes.Buffer
+				eventAndData.WriteString("event: update\ndata: ")
+				var id bytes.Buffer
+				id.WriteString(fmt.Sprintf("\nid: %d\n\n", time.Now().UnixMilli()))
+				message := make([]byte, 0)
+				message = append(message, eventAndData.Bytes()...)
+				message = append(message, encoded...)
+				message = append(message, id.Bytes()...)
+				wf.Write(message)
+				wf.Flush()
+			}
 		}
-	} else {
+	} else if snapshot {
 		slog.Info("got a collection subscriber for collection " + r.URL.Path)
 		// getting documents within the interval and writing events
 		documents := collection.QueryDocuments(r.Context(), low, high)
@@ -95,6 +255,9 @@ func createAndHandleSubscription(w http.ResponseWriter, r *http.Request, docName
 		}
 		curTime := time.Now().UnixMilli()
 		for i := 0; i < len(documents); i++ {
+			if !missed(documents[i]) {
+				continue
+			}
 			var eventAndData bytes.Buffer
 			eventAndData.WriteString("event: update\ndata: ")
 			var id bytes.Buffer
@@ -106,6 +269,12 @@ func createAndHandleSubscription(w http.ResponseWriter, r *http.Request, docName
 			urlPath := r.URL.Path[4:]
 			urlPath = urlPath[strings.Index(urlPath, "/"):]
 			encoded, err := documents[i].DocumentJsonMake(urlPath + documents[i].GetName())
+			if err == nil && !filter.matches(encoded) {
+				continue
+			}
+			if err == nil && metadataPayload {
+				encoded, err = metadataOnly(encoded)
+			}
 			if err != nil {
 				errorHelper(w, `"error marshaling document for subscription"`, http.StatusBadRequest)
 				slog.Error("could not marshal document for collection subscription")
@@ -133,6 +302,11 @@ func createAndHandleSubscription(w http.ResponseWriter, r *http.Request, docName
 		// subscriber closed
 		case <-r.Context().Done():
 			return
+		// server shutting down, the subscriber is told so it does not mistake the end of the stream for a failure
+		case <-closing:
+			wf.Write([]byte("event: close\ndata: \"server shutting down\"\n\n"))
+			wf.Flush()
+			return
 		// got data to be written
 		case data := <-reader:
 			if data == nil {
@@ -146,12 +320,17 @@ func createAndHandleSubscription(w http.ResponseWriter, r *http.Request, docName
 				slog.Error("data sent through channel for subscription not of right type")
 				return
 			}
-			if formattedData.docName >= low && formattedData.docName <= high {
+			// events without a document, like deletes, cannot be checked against a filter and are always sent
+			if formattedData.docName >= low && formattedData.docName <= high &&
+				(formattedData.doc == nil || filter.matches(formattedData.doc)) {
+				if metadataPayload && formattedData.metadata != nil {
+					formattedData.message = formattedData.metadata
+				}
 				wf.Write(formattedData.message)
 				wf.Flush()
 			}
-		// pinging every 15 seconds if nothing happens
-		case <-time.After(15 * time.Second):
+		// pinging if nothing happens for a while
+		case <-time.After(keepalive):
 			comment := ": keep alive\n\n"
 			var evt bytes.Buffer
 			evt.WriteString(comment)
@@ -161,18 +340,65 @@ func createAndHandleSubscription(w http.ResponseWriter, r *http.Request, docName
 	}
 }
 
+// A SubscriptionCloser ends every subscription of a handler with a close event when the server shuts down, and gives
+// the subscribers a moment to receive it before the server drops their connections.
+// Should be created using NewSubscriptionCloser and given to New with WithSubscriptionCloser.
+type SubscriptionCloser struct {
+	delay  time.Duration
+	once   sync.Once
+	closed chan struct{}
+}
+
+// Creates a SubscriptionCloser that waits delay after sending the close events.
+func NewSubscriptionCloser(delay time.Duration) *SubscriptionCloser {
+	return &SubscriptionCloser{delay: delay, closed: make(chan struct{})}
+}
+
+// WithSubscriptionCloser lets c close the subscriptions of the handler on shutdown.
+func WithSubscriptionCloser(c *SubscriptionCloser) Option {
+	return func(d *DatabaseIndex) {
+		d.closer = c
+	}
+}
+
+// Sends a close event to every subscriber and ends their streams, then waits for the delay, so that the server can
+// be shut down once Close returns. Subscriptions made afterwards are closed right away. Only the first call waits.
+func (c *SubscriptionCloser) Close() {
+	c.once.Do(func() {
+		close(c.closed)
+		time.Sleep(c.delay)
+	})
+}
+
+// Returns a channel that is closed once the subscriptions are closed, which is nil and so never closed if c is nil.
+func (c *SubscriptionCloser) closing() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	return c.closed
+}
+
 // This function tells the subscribers in a collection about an event that happened to a document.
-func notifySubscriptions(docName string, collection Collectioner, message []byte) {
+func notifySubscriptions(collection Collectioner, message chanMessage) {
 	collectionSubs := collection.AllSubscribers()
 	for byteChan, doneChan := range collectionSubs {
-		newMessage := chanMessage{docName: docName, message: message}
-		select {
-		// subscriber closed before we could write
-		case <-doneChan:
-			continue
-		// writing to subscriber
-		case byteChan <- newMessage:
-			continue
+		sendToSubscriber(byteChan, doneChan, message)
+	}
+}
+
+// This function sends a message to one subscriber, giving up if the subscriber is done first. The data channels are
+// never closed, only the done channels, but a panicking send is recovered from anyway so that one misbehaving
+// subscriber can neither take down the server nor keep the other subscribers from being notified.
+func sendToSubscriber(byteChan chan any, doneChan chan string, message chanMessage) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error(fmt.Sprintf("recovered from notifying a subscriber: %v", r))
 		}
+	}()
+	select {
+	// subscriber closed before we could write
+	case <-doneChan:
+	// writing to subscriber
+	case byteChan <- message:
 	}
 }
@@ -0,0 +1,293 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A write as recorded in the write-ahead log. Path is the path of the request that replays it, including the /v1
+// prefix and any query, and Body is base64 encoded so that documents are replayed byte for byte. ContentType is empty
+// for JSON documents and for writes without a body.
+type walEntry struct {
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	ContentType string `json:"contentType,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+	User        string `json:"user"`
+	Time        int64  `json:"time"`
+}
+
+// A WAL is an append-only write-ahead log of the writes made through a handler, one JSON entry per line, which is
+// replayed on startup to recover the writes made since the last snapshot. Writes are logged as the writes that
+// replay them: puts of databases and collections, puts of documents with the data they were left with, and deletes.
+// So a POST is logged as a PUT of the document it named and a PATCH as a PUT of the document it produced, which
+// replay to the same documents. Document writes are logged while the document is locked, so the writes to a
+// document are logged in the order they were applied in. Replayed documents get the time of the replay as their
+// modification time.
+// Should be created using OpenWAL and given to New with WithWAL.
+type WAL struct {
+	path      string
+	d         *DatabaseIndex
+	mtx       sync.Mutex // held while the file is appended to or rewritten
+	file      *os.File
+	size      int64
+	replaying atomic.Bool // set while the log is being replayed, so the replayed writes are not logged again
+	users     sync.Map    // the tokens replayed requests are authorized with, to the users that made the writes
+	// read locked by each write from before it is applied until after it is logged, and write locked by snapshots while
+	// they take the offset and capture the databases, so the offset never covers a write the snapshot does not have
+	barrier sync.RWMutex
+}
+
+// Opens the write-ahead log at path for appending, creating the file if it does not exist.
+func OpenWAL(path string) (*WAL, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &WAL{path: path, file: file, size: info.Size()}, nil
+}
+
+// WithWAL logs the writes made through the handler to w, and lets w replay them.
+func WithWAL(w *WAL) Option {
+	return func(d *DatabaseIndex) {
+		d.wal = w
+		w.d = d
+	}
+}
+
+// Closes the log file. Writes made after it is closed are no longer logged.
+func (w *WAL) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.file.Close()
+}
+
+// Appends an entry to the log and syncs it to disk, so that a write is not acknowledged before it is durable.
+func (w *WAL) append(entry walEntry) error {
+	if w.replaying.Load() {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// Returns how many bytes have been logged so far, for discarding them once they are part of a snapshot.
+func (w *WAL) offset() int64 {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.size
+}
+
+// Removes the first n bytes of the log, which a snapshot taken after they were logged has made redundant. The entries
+// logged after them are kept, even if the snapshot has them too, since replaying a write twice leaves the same
+// document.
+func (w *WAL) discard(n int64) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	src, err := os.Open(w.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = src.Seek(n, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	var rest bytes.Buffer
+	_, err = rest.ReadFrom(src)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(w.path, rest.Bytes())
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	w.file.Close()
+	w.file = file
+	w.size = int64(rest.Len())
+	return nil
+}
+
+// Replays every entry of the log through h, the handler the log was given to, as a request made by the user that
+// made the write. Should be called once, after any snapshot is loaded and before the server starts. Entries whose
+// replay fails, like a put of a database the snapshot already has, are skipped and logged. A last entry that was
+// only partly written, e.g. by a crash, is removed from the log, but any other entry that cannot be read fails the
+// replay.
+func (w *WAL) Replay(h http.Handler) error {
+	if w.d == nil {
+		return errors.New("write-ahead log is not attached to a handler")
+	}
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return err
+	}
+
+	w.replaying.Store(true)
+	defer w.replaying.Store(false)
+	// replayed requests are authorized with a token for each user that only the replay accepts, so no tokens are
+	// issued to users by the Auther and the replay does not count towards how many they may have
+	tokens := make(map[string]string)
+	defer func() {
+		for _, token := range tokens {
+			w.users.Delete(token)
+		}
+	}()
+
+	var read int64
+	replayed, skipped := 0, 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if read+int64(len(line)) == int64(len(data)) {
+			// entries are written with their newline at once, so an entry without one was cut short
+			slog.Warn(fmt.Sprintf("removing the partly written last entry of %s", w.path))
+			w.mtx.Lock()
+			err = w.file.Truncate(read)
+			w.size = read
+			w.mtx.Unlock()
+			if err != nil {
+				return err
+			}
+			break
+		}
+		var entry walEntry
+		err := json.Unmarshal(line, &entry)
+		if err != nil {
+			return fmt.Errorf("entry at byte %d of %s cannot be read: %w", read, w.path, err)
+		}
+		read += int64(len(line)) + 1
+
+		token, ok := tokens[entry.User]
+		if !ok {
+			token, err = replayToken()
+			if err != nil {
+				return err
+			}
+			tokens[entry.User] = token
+			w.users.Store(token, entry.User)
+		}
+		req, err := http.NewRequest(entry.Method, entry.Path, bytes.NewReader(entry.Body))
+		if err != nil {
+			return fmt.Errorf("entry at byte %d of %s cannot be replayed: %w", read, w.path, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("User-Agent", "wal-replay")
+		if entry.ContentType != "" {
+			req.Header.Set("Content-Type", entry.ContentType)
+		} else if len(entry.Body) > 0 {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		if res.Code >= 300 {
+			skipped++
+			slog.Warn(fmt.Sprintf("skipped replaying %s %s from %s: %d %s", entry.Method, entry.Path,
+				time.UnixMilli(entry.Time).UTC().Format(time.RFC3339), res.Code, res.Body.String()))
+			continue
+		}
+		replayed++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("replayed %d writes from %s, skipped %d", replayed, w.path, skipped))
+	return nil
+}
+
+// Returns whether the handler's write-ahead log is being replayed, so that the request being handled is a replayed
+// write.
+func (d *DatabaseIndex) replaying() bool {
+	return d.wal != nil && d.wal.replaying.Load()
+}
+
+// Returns a random token for authorizing the replayed writes of a user.
+func replayToken() (string, error) {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// Returns the user whose replayed writes are authorized with token, if the log is being replayed.
+func (w *WAL) replayUser(token string) (string, bool) {
+	if !w.replaying.Load() {
+		return "", false
+	}
+	username, ok := w.users.Load(token)
+	if !ok {
+		return "", false
+	}
+	return username.(string), true
+}
+
+// Holds off snapshots until the returned function is called, if the handler has a write-ahead log. Writes hold it
+// from before they are applied until after they are logged, so they are either wholly before a snapshot or wholly
+// after it. Must not be held twice by the same request, since a waiting snapshot blocks the second hold.
+func (d *DatabaseIndex) holdSnapshots() (release func()) {
+	if d.wal == nil {
+		return func() {}
+	}
+	d.wal.barrier.RLock()
+	return d.wal.barrier.RUnlock
+}
+
+// Appends a write to the write-ahead log, if there is one. The write is applied whether or not it is logged, so
+// failing to log it does not fail it, but is logged as an error.
+func (d *DatabaseIndex) logWrite(method string, path string, contentType string, body []byte, username string) {
+	if d.wal == nil {
+		return
+	}
+	entry := walEntry{Method: method, Path: path, ContentType: contentType, Body: body, User: username,
+		Time: time.Now().UnixMilli()}
+	err := d.wal.append(entry)
+	if err != nil {
+		slog.Error(fmt.Sprintf("error logging %s %s: %s", method, path, err.Error()))
+	}
+}
+
+// Returns the path of a put that creates col again, which asks for a serial collection if col is one.
+func serialPath(path string, col Collectioner) string {
+	if col.Serial() {
+		return path + "?serial=true"
+	}
+	return path
+}
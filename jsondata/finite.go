@@ -0,0 +1,47 @@
+package jsondata
+
+import "math"
+
+// Finite returns false if any number in j is NaN or infinite. Such numbers cannot come from parsing JSON, but can be
+// produced by arithmetic on parsed values, and cannot be marshaled back into JSON.
+func (j JSONValue) Finite() bool {
+	finite, _ := Accept[bool](j, finiteVisitor{})
+	return finite
+}
+
+// A visitor checking that every number in a JSON value is finite.
+type finiteVisitor struct{}
+
+func (v finiteVisitor) Map(m map[string]JSONValue) (bool, error) {
+	for _, value := range m {
+		if !value.Finite() {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (v finiteVisitor) Slice(s []JSONValue) (bool, error) {
+	for _, value := range s {
+		if !value.Finite() {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (v finiteVisitor) Bool(b bool) (bool, error) {
+	return true, nil
+}
+
+func (v finiteVisitor) Float64(f float64) (bool, error) {
+	return !math.IsNaN(f) && !math.IsInf(f, 0), nil
+}
+
+func (v finiteVisitor) String(s string) (bool, error) {
+	return true, nil
+}
+
+func (v finiteVisitor) Null() (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,27 @@
+package jsondata
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestFinite(t *testing.T) {
+	var parsed JSONValue
+	if err := json.Unmarshal([]byte(`{"x":1.5,"y":[true,null,"s",{"z":-2}]}`), &parsed); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if !parsed.Finite() {
+		t.Errorf("expected a parsed document to be finite")
+	}
+
+	for _, number := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		nested, err := NewJSONValue(map[string]any{"a": []any{1.0, map[string]any{"b": number}}})
+		if err != nil {
+			t.Fatalf("NewJSONValue failed: %v", err)
+		}
+		if nested.Finite() {
+			t.Errorf("expected a document containing %v not to be finite", number)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package jsondata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// Hash returns the hex encoded SHA-256 of the canonical serialization of j. Object keys are always marshaled in
+// sorted order and without whitespace, so semantically equal values hash the same regardless of how they were
+// written. Returns an error if j cannot be marshaled.
+func (j JSONValue) Hash() (string, error) {
+	encoded, err := json.Marshal(j.data)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
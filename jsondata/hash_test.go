@@ -0,0 +1,42 @@
+package jsondata
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	var a, b, c JSONValue
+	if err := json.Unmarshal([]byte(`{"x":1,"y":{"p":[1,2],"q":"s"}}`), &a); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if err := json.Unmarshal([]byte(`{ "y": {"q":"s", "p":[1, 2]}, "x": 1 }`), &b); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if err := json.Unmarshal([]byte(`{"x":1,"y":{"p":[2,1],"q":"s"}}`), &c); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+
+	hashA, err := a.Hash()
+	if err != nil {
+		t.Fatalf("hash failed: %v", err)
+	}
+	hashB, err := b.Hash()
+	if err != nil {
+		t.Fatalf("hash failed: %v", err)
+	}
+	hashC, err := c.Hash()
+	if err != nil {
+		t.Fatalf("hash failed: %v", err)
+	}
+
+	if hashA != hashB {
+		t.Errorf("expected equal documents to hash the same, got %s and %s", hashA, hashB)
+	}
+	if hashA == hashC {
+		t.Errorf("expected different documents to hash differently, both got %s", hashA)
+	}
+	if len(hashA) != 64 {
+		t.Errorf("expected a hex SHA-256 of length 64, got %d", len(hashA))
+	}
+}
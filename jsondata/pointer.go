@@ -0,0 +1,142 @@
+package jsondata
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Get returns the value found in j at the given JSON pointer (RFC 6901), e.g. "/a/0/b". The empty pointer refers to
+// j itself. Returns false if the pointer is malformed or nothing exists at it.
+func (j JSONValue) Get(pointer string) (JSONValue, bool) {
+	if pointer == "" {
+		return j, true
+	}
+	if pointer[0] != '/' {
+		return JSONValue{}, false
+	}
+
+	curr := j.data
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch value := curr.(type) {
+		case map[string]any:
+			next, ok := value[token]
+			if !ok {
+				return JSONValue{}, false
+			}
+			curr = next
+		case []any:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(value) || strconv.Itoa(index) != token {
+				return JSONValue{}, false
+			}
+			curr = value[index]
+		default:
+			return JSONValue{}, false
+		}
+	}
+	return JSONValue{curr}, true
+}
+
+// Compare orders j against other when both are numbers or both are strings, returning -1, 0 or 1 as j is less than,
+// equal to or greater than other. Numbers are ordered before strings. Returns false if either value is of another
+// JSON type, since those have no natural order.
+func (j JSONValue) Compare(other JSONValue) (int, bool) {
+	switch a := j.data.(type) {
+	case float64:
+		switch b := other.data.(type) {
+		case float64:
+			if a < b {
+				return -1, true
+			} else if a > b {
+				return 1, true
+			}
+			return 0, true
+		case string:
+			return -1, true
+		}
+	case string:
+		switch b := other.data.(type) {
+		case float64:
+			return 1, true
+		case string:
+			return strings.Compare(a, b), true
+		}
+	}
+	return 0, false
+}
+
+// Replace returns a copy of j with the value at the given JSON pointer replaced by value. Only the objects and arrays
+// on the way to the pointer are copied, j itself is left unchanged. Returns false if the pointer is malformed or
+// nothing exists at it.
+func (j JSONValue) Replace(pointer string, value JSONValue) (JSONValue, bool) {
+	if pointer == "" {
+		return value, true
+	}
+	if pointer[0] != '/' {
+		return JSONValue{}, false
+	}
+	replaced, ok := replaceAt(j.data, strings.Split(pointer[1:], "/"), value.data, false)
+	if !ok {
+		return JSONValue{}, false
+	}
+	return JSONValue{replaced}, true
+}
+
+// SetPath returns a copy of j with value at the given JSON pointer, like Replace, except that the last member of the
+// pointer is added to its object if it does not exist yet. Returns false if the pointer is malformed or does not lead
+// to an existing object or array element.
+func (j JSONValue) SetPath(pointer string, value JSONValue) (JSONValue, bool) {
+	if pointer == "" {
+		return value, true
+	}
+	if pointer[0] != '/' {
+		return JSONValue{}, false
+	}
+	set, ok := replaceAt(j.data, strings.Split(pointer[1:], "/"), value.data, true)
+	if !ok {
+		return JSONValue{}, false
+	}
+	return JSONValue{set}, true
+}
+
+// Returns a copy of curr with the value at the path of unescaped pointer tokens replaced by value. If add is set, a
+// missing last member of an object is added instead.
+func replaceAt(curr any, tokens []string, value any, add bool) (any, bool) {
+	if len(tokens) == 0 {
+		return value, true
+	}
+	token := strings.ReplaceAll(strings.ReplaceAll(tokens[0], "~1", "/"), "~0", "~")
+	switch container := curr.(type) {
+	case map[string]any:
+		next, ok := container[token]
+		if !ok && !(add && len(tokens) == 1) {
+			return nil, false
+		}
+		replaced, ok := replaceAt(next, tokens[1:], value, add)
+		if !ok {
+			return nil, false
+		}
+		copied := make(map[string]any, len(container))
+		for key, element := range container {
+			copied[key] = element
+		}
+		copied[token] = replaced
+		return copied, true
+	case []any:
+		index, err := strconv.Atoi(token)
+		if err != nil || index < 0 || index >= len(container) || strconv.Itoa(index) != token {
+			return nil, false
+		}
+		replaced, ok := replaceAt(container[index], tokens[1:], value, add)
+		if !ok {
+			return nil, false
+		}
+		copied := make([]any, len(container))
+		copy(copied, container)
+		copied[index] = replaced
+		return copied, true
+	default:
+		return nil, false
+	}
+}
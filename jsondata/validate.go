@@ -0,0 +1,37 @@
+package jsondata
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// ValidateAll validates j against schema like Validate, but returns every violation instead of only the first error.
+// Each violation is reported with the JSON pointer of the offending value. Returns nil if j conforms to schema.
+func (j JSONValue) ValidateAll(schema *jsonschema.Schema) []error {
+	err := j.Validate(schema)
+	if err == nil {
+		return nil
+	}
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return []error{err}
+	}
+	return leafErrors(validationErr)
+}
+
+// Collects the violations at the leaves of a validation error tree, the inner errors only group their causes.
+func leafErrors(validationErr *jsonschema.ValidationError) []error {
+	if len(validationErr.Causes) == 0 {
+		if validationErr.InstanceLocation == "" {
+			return []error{errors.New(validationErr.Message)}
+		}
+		return []error{fmt.Errorf("%s: %s", validationErr.InstanceLocation, validationErr.Message)}
+	}
+	errs := make([]error, 0)
+	for _, cause := range validationErr.Causes {
+		errs = append(errs, leafErrors(cause)...)
+	}
+	return errs
+}
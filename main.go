@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -30,7 +32,7 @@ type CollectionFactory func(name string, dbIndex collection.Indexer[handler.Docu
 
 // This is a function of CollectionFactory which takes the name of a collection as a string and returns a structure matching the Collectioner interface
 func (d CollectionFactory) NewCollection(name string) handler.Collectioner {
-	skipList := skipList.New[string, handler.Documenter](name, "", "\U0010FFFF")
+	skipList := skipList.New[string, handler.Documenter](name, "", document.MaxName)
 	return d(name, skipList)
 }
 
@@ -41,7 +43,7 @@ type DocumentFactory func(name string, collectionIndex document.Indexer[handler.
 // a flag signalling if the new document should use the createdAt time of a previous documen, and that original creation time
 // it returns a structure matching the Documenter interface
 func (d DocumentFactory) NewDocument(name string, data []byte, creator string) handler.Documenter {
-	skipList := skipList.New[string, handler.Collectioner](name, "", "\U0010FFFF")
+	skipList := skipList.New[string, handler.Collectioner](name, "", document.MaxName)
 	return d(name, skipList, data, creator)
 }
 
@@ -79,20 +81,156 @@ func (p PatchOpListVisitorFactory) NewPatchOpListVisitor() handler.PatchOpListVi
 }
 
 // Running the server.
+// An entry of the tokens file that gives its token an expiry time, in RFC 3339 format. Without an expiry the token
+// expires like the tokens of the flat format.
+type tokenEntry struct {
+	Token     string `json:"token"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+// This function adds the tokens in the contents of a tokens file to authMap. The file maps each username either to a
+// token, which expires at defaultExpiry, or to a tokenEntry. No tokens are added if any entry is invalid.
+func loadTokens(data []byte, authMap *auth.Auth, defaultExpiry time.Time) error {
+	nameToEntry := make(map[string]json.RawMessage)
+	err := json.Unmarshal(data, &nameToEntry)
+	if err != nil {
+		return fmt.Errorf("not a JSON object of users: %w", err)
+	}
+
+	// every entry is checked before any token is added
+	type pair struct {
+		name   string
+		token  string
+		expiry time.Time
+	}
+	pairs := make([]pair, 0, len(nameToEntry))
+	for name, raw := range nameToEntry {
+		var entry tokenEntry
+		if json.Unmarshal(raw, &entry.Token) != nil && json.Unmarshal(raw, &entry) != nil {
+			return fmt.Errorf("entry of user %q is neither a token nor an object with one", name)
+		}
+		if entry.Token == "" {
+			return fmt.Errorf("entry of user %q has no token", name)
+		}
+		expiry := defaultExpiry
+		if entry.ExpiresAt != "" {
+			expiry, err = time.Parse(time.RFC3339, entry.ExpiresAt)
+			if err != nil {
+				return fmt.Errorf("entry of user %q has an invalid expiresAt %q, expected RFC 3339 like %q", name,
+					entry.ExpiresAt, time.RFC3339)
+			}
+		}
+		pairs = append(pairs, pair{name: name, token: entry.Token, expiry: expiry})
+	}
+
+	for _, p := range pairs {
+		authMap.AddPair(p.name, p.token, p.expiry)
+	}
+	return nil
+}
+
 func main() {
 	var server http.Server
 	var port int
 	var schemaFile string
 	var tokensFile string
+	var grace time.Duration
+	var tokenTTL time.Duration
+	var maxTokens int
+	var contentTypes string
+	var opaqueTypes string
+	var listingCap int
+	var queryTimeout time.Duration
+	var coalesceWindow time.Duration
+	var checkLength bool
+	var headers string
+	var maxDepth int
+	var corsMaxAge time.Duration
+	var adminToken string
+	var rejectHTTP10 bool
+	var tombstoneWindow time.Duration
+	var maxSegments int
+	var idFormat string
+	var serverFields string
+	var requireUserAgent bool
+	var maxBodySize int64
+	var maxDocumentSize int64
+	var minify bool
+	var disallowOverwrite bool
+	var persistDir string
+	var snapshotInterval time.Duration
+	var walFile string
+	var closeDelay time.Duration
 	var err error
 
 	flag.IntVar(&port, "p", 3318, "This is the port the server listens to.")
 	flag.StringVar(&schemaFile, "s", "", "This is the file containing the JSON schema "+
 		"that all documents in the database must abide by.")
-	flag.StringVar(&tokensFile, "t", "", "This is the file containing the mapping of usernames to string tokens.")
+	flag.StringVar(&tokensFile, "t", "", "This is the file containing the mapping of usernames to string tokens, or to objects "+
+		"with a token and an RFC 3339 expiresAt.")
+	flag.DurationVar(&grace, "g", 0, "This is the grace period tokens stay valid past their expiry, to absorb client clock skew.")
+	flag.DurationVar(&tokenTTL, "token-ttl", time.Hour, "This is how long the tokens issued by /auth stay valid.")
+	flag.IntVar(&maxTokens, "max-tokens", 0, "This is the most tokens a user can have at once, evicting their oldest, 0 for no limit.")
+	flag.StringVar(&contentTypes, "c", "", "This is a comma separated list of content types accepted for document bodies "+
+		"in addition to application/json.")
+	flag.StringVar(&opaqueTypes, "b", "", "This is a comma separated list of content types of documents stored as opaque "+
+		"data, which are not parsed or validated against the schema.")
+	flag.IntVar(&listingCap, "m", 0, "This is the maximum number of documents a collection listing returns, 0 for no limit.")
+	flag.DurationVar(&queryTimeout, "q", 0, "This is the timeout for the collection queries of a single request, 0 for no timeout.")
+	flag.DurationVar(&coalesceWindow, "w", 0, "This is the window in which updates to a document are coalesced into one "+
+		"subscription event, 0 to send every event.")
+	flag.BoolVar(&checkLength, "l", false, "This rejects request bodies that do not match their declared Content-Length.")
+	flag.IntVar(&maxDepth, "n", 0, "This is the deepest level collections can be nested in documents, 0 for no limit.")
+	flag.DurationVar(&corsMaxAge, "a", 600*time.Second, "This is how long browsers may cache CORS preflight responses.")
+	flag.StringVar(&adminToken, "k", "", "This is the token required by the /admin endpoints, which are disabled without it.")
+	flag.BoolVar(&rejectHTTP10, "v", false, "This rejects subscriptions made over HTTP/1.0, which cannot stream events.")
+	flag.DurationVar(&tombstoneWindow, "e", 0, "This is how long GETs of a deleted database return 410 Gone instead of 404, "+
+		"0 to return 404 right away.")
+	flag.IntVar(&maxSegments, "x", 0, "This is the most segments the path of a patch operation may have, 0 for no limit.")
+	flag.StringVar(&idFormat, "id-format", "timestamp", "This is how POST names new documents: timestamp, uuid or counter.")
+	flag.StringVar(&serverFields, "server-fields", "", "This is a comma separated list of fields set in the body of every "+
+		"document created: _id for its name, _createdAt for the time it was created.")
+	flag.BoolVar(&requireUserAgent, "u", false, "This rejects requests that do not send a User-Agent header.")
+	flag.Int64Var(&maxBodySize, "max-body-size", 0, "This is the largest request body in bytes PUT, POST and PATCH accept, 0 for no limit.")
+	flag.Int64Var(&maxDocumentSize, "max-document-size", 0, "This is the largest document in bytes that can be stored, 0 for no limit.")
+	flag.BoolVar(&minify, "minify", false, "This stores JSON documents without the whitespace they were sent with.")
+	flag.BoolVar(&disallowOverwrite, "no-overwrite", false, "This rejects PUTs to existing documents, which can only be "+
+		"changed with PATCH.")
+	flag.StringVar(&persistDir, "d", "", "This is the directory the databases are saved to periodically and loaded from on "+
+		"startup, empty to keep them in memory only.")
+	flag.DurationVar(&snapshotInterval, "snapshot-interval", time.Minute, "This is how often the databases are saved to "+
+		"the directory given with -d.")
+	flag.StringVar(&walFile, "wal", "", "This is the file every write is logged to and replayed from on startup, so that "+
+		"the writes since the last snapshot survive a crash.")
+	flag.DurationVar(&closeDelay, "close-delay", 500*time.Millisecond, "This is how long subscribers are given to receive "+
+		"the close event sent on shutdown before their connections are closed.")
+	flag.StringVar(&headers, "r", "", "This is a semicolon separated list of \"Name: value\" headers set on every response.")
 
 	flag.Parse()
 
+	if idFormat != string(handler.IDTimestamp) && idFormat != string(handler.IDUUID) && idFormat != string(handler.IDCounter) {
+		fmt.Printf("Unknown id format %q\n", idFormat)
+		return
+	}
+	var fields []handler.ServerField
+	if serverFields != "" {
+		for _, field := range strings.Split(serverFields, ",") {
+			if field != string(handler.FieldID) && field != string(handler.FieldCreatedAt) {
+				fmt.Printf("Unknown server field %q\n", field)
+				return
+			}
+			fields = append(fields, handler.ServerField(field))
+		}
+	}
+	if tokenTTL <= 0 {
+		fmt.Println("Token TTL must be positive")
+		return
+	}
+	if snapshotInterval <= 0 {
+		fmt.Println("Snapshot interval must be positive")
+		return
+	}
+
 	if schemaFile == "" {
 		fmt.Println("No schema file provided")
 		return
@@ -106,21 +244,20 @@ func main() {
 		return
 	}
 
-	authMap := auth.NewAuth()
+	authMap := auth.NewAuthWithTTL(tokenTTL)
+	authMap.SetGracePeriod(grace)
+	if maxTokens > 0 {
+		authMap.SetMaxTokensPerUser(maxTokens)
+	}
 	if tokensFile != "" {
 		data, err := os.ReadFile(tokensFile)
 		if err != nil {
 			fmt.Println("Cannot open tokens file")
 		} else {
-			nameToToken := make(map[string]string)
-			err = json.Unmarshal(data, &nameToToken)
+			err = loadTokens(data, authMap, time.Now().Add(time.Hour*24))
 			if err != nil {
-				fmt.Println("Cannot unmarshal tokens file")
-			} else {
-				expiry := time.Now().Add(time.Hour * 24)
-				for name, token := range nameToToken {
-					authMap.AddPair(name, token, expiry)
-				}
+				fmt.Printf("Cannot load tokens file: %s\n", err.Error())
+				return
 			}
 		}
 	}
@@ -131,6 +268,9 @@ func main() {
 	docFactory := DocumentFactory(newDoc)
 
 	newVisitor := patchvisitors.NewPatchVisitor[handler.PatchOper, handler.PatchOpFactory]
+	if maxSegments > 0 {
+		newVisitor = patchvisitors.LimitSegments[handler.PatchOper, handler.PatchOpFactory](maxSegments)
+	}
 	visitorFactory := PatchVisitorFactory(newVisitor)
 
 	newDocVisitor := patchvisitors.NewDocVisitor
@@ -142,9 +282,113 @@ func main() {
 	newPatchOp := patchvisitors.NewPatchOp
 	patchOpFactory := PatchOpFactory(newPatchOp)
 
+	opts := []handler.Option{handler.WithCORSMaxAge(corsMaxAge), handler.WithIDFormat(handler.IDFormat(idFormat))}
+	if contentTypes != "" {
+		opts = append(opts, handler.WithContentTypes(strings.Split(contentTypes, ",")...))
+	}
+	if opaqueTypes != "" {
+		opts = append(opts, handler.WithOpaqueContentTypes(strings.Split(opaqueTypes, ",")...))
+	}
+	if len(fields) > 0 {
+		opts = append(opts, handler.WithServerFields(fields...))
+	}
+	if listingCap > 0 {
+		opts = append(opts, handler.WithListingCap(listingCap))
+	}
+	if queryTimeout > 0 {
+		opts = append(opts, handler.WithQueryTimeout(queryTimeout))
+	}
+	if coalesceWindow > 0 {
+		opts = append(opts, handler.WithCoalescing(coalesceWindow))
+	}
+	if checkLength {
+		opts = append(opts, handler.WithContentLengthCheck())
+	}
+	if adminToken != "" {
+		opts = append(opts, handler.WithAdminToken(adminToken))
+	}
+	if rejectHTTP10 {
+		opts = append(opts, handler.WithHTTP10SubscribeRejection())
+	}
+	if tombstoneWindow > 0 {
+		opts = append(opts, handler.WithTombstones(tombstoneWindow))
+	}
+	if maxDepth > 0 {
+		opts = append(opts, handler.WithMaxDepth(maxDepth))
+	}
+	if requireUserAgent {
+		opts = append(opts, handler.WithUserAgentRequired())
+	}
+	if maxBodySize > 0 {
+		opts = append(opts, handler.WithMaxBodySize(maxBodySize))
+	}
+	if maxDocumentSize > 0 {
+		opts = append(opts, handler.WithMaxDocumentSize(maxDocumentSize))
+	}
+	if minify {
+		opts = append(opts, handler.WithMinify())
+	}
+	if disallowOverwrite {
+		opts = append(opts, handler.WithOverwriteDisallowed())
+	}
+	var persister *handler.Persister
+	if persistDir != "" {
+		persister = handler.NewPersister(persistDir)
+		opts = append(opts, handler.WithPersistence(persister))
+	}
+	// subscriptions are ended with a close event when the server shuts down
+	closer := handler.NewSubscriptionCloser(closeDelay)
+	opts = append(opts, handler.WithSubscriptionCloser(closer))
+	var wal *handler.WAL
+	if walFile != "" {
+		wal, err = handler.OpenWAL(walFile)
+		if err != nil {
+			fmt.Printf("Cannot open write-ahead log: %s\n", err.Error())
+			return
+		}
+		defer wal.Close()
+		opts = append(opts, handler.WithWAL(wal))
+	}
+	if headers != "" {
+		headerMap := make(map[string]string)
+		for _, header := range strings.Split(headers, ";") {
+			name, value, found := strings.Cut(header, ":")
+			if !found {
+				fmt.Printf("Response header %q is not of the form \"Name: value\"\n", header)
+				return
+			}
+			headerMap[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+		opts = append(opts, handler.WithHeaders(headerMap))
+	}
+
+	// expired tokens are swept every minute until the server closes
+	sweepCtx, stopSweeping := context.WithCancel(context.Background())
+	defer stopSweeping()
+	authMap.StartSweeper(sweepCtx, time.Minute)
+
 	server.Addr = ":" + strconv.Itoa(port)
-	dbIndexDatabases := skipList.New[string, handler.Collectioner]("databaseList", "", "\U0010FFFF")
-	server.Handler = handler.New(dbFactory, docFactory, authMap, schema, dbIndexDatabases, patchOpListVisitorFactory, visitorFactory, docVisitorFactory, patchOpFactory)
+	dbIndexDatabases := skipList.New[string, handler.Collectioner]("databaseList", "", document.MaxName)
+	server.Handler = handler.New(dbFactory, docFactory, authMap, schema, dbIndexDatabases, patchOpListVisitorFactory, visitorFactory, docVisitorFactory, patchOpFactory, opts...)
+	if persister != nil {
+		err = persister.Load()
+		if err != nil {
+			fmt.Printf("Cannot load databases from %s: %s\n", persistDir, err.Error())
+			return
+		}
+	}
+	if wal != nil {
+		// the writes made since the snapshot that was just loaded, if there is one
+		err = wal.Replay(server.Handler)
+		if err != nil {
+			fmt.Printf("Cannot replay write-ahead log: %s\n", err.Error())
+			return
+		}
+	}
+	if persister != nil {
+		// the databases are saved until the server closes, and once more when it does
+		persister.Start(sweepCtx, snapshotInterval)
+	}
 	fmt.Println(port, schemaFile, tokensFile)
 
 	// The following code should go last and remain unchanged.
@@ -156,10 +400,25 @@ func main() {
 	// signal.Notify requires the channel to be buffered
 	ctrlc := make(chan os.Signal, 1)
 	signal.Notify(ctrlc, os.Interrupt, syscall.SIGTERM)
+	// closed once the databases are saved on shutdown, which main waits for before exiting
+	flushed := make(chan struct{})
 	go func() {
+		defer close(flushed)
 		// Wait for Ctrl-C signal
 		<-ctrlc
-		server.Close()
+		closer.Close()
+		// the subscriptions have ended, so the requests still being served should finish soon
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if server.Shutdown(ctx) != nil {
+			server.Close()
+		}
+		if persister != nil {
+			err := persister.Snapshot()
+			if err != nil {
+				slog.Error("error saving databases on shutdown", "error", err)
+			}
+		}
 	}()
 
 	// Start server
@@ -169,5 +428,6 @@ func main() {
 		slog.Error("Server closed", "error", err)
 	} else {
 		slog.Info("Server closed", "error", err)
+		<-flushed
 	}
 }
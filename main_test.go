@@ -1,13 +1,24 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -123,8 +134,8 @@ func TestSingleDatabaseAndDocument(t *testing.T) {
 	handler.ServeHTTP(w, req)
 	resp = w.Result()
 
-	if resp.StatusCode != 400 {
-		t.Errorf("Expected status code 400 but got %d", w.Code)
+	if resp.StatusCode != 409 {
+		t.Errorf("Expected status code 409 but got %d", w.Code)
 	}
 
 	req = httptest.NewRequest("GET", "/v1/db1/dc1", nil)
@@ -272,8 +283,8 @@ func TestNestedPaths(t *testing.T) {
 	handler.ServeHTTP(w, req)
 	resp = w.Result()
 
-	if resp.StatusCode != 400 {
-		t.Errorf("Expected status code 400 but got %d", w.Code)
+	if resp.StatusCode != 409 {
+		t.Errorf("Expected status code 409 but got %d", w.Code)
 	}
 
 	req = httptest.NewRequest("PUT", "/v1/db1/doc1", nil)
@@ -335,8 +346,8 @@ func TestNestedPaths(t *testing.T) {
 	handler.ServeHTTP(w, req)
 	resp = w.Result()
 
-	if resp.StatusCode != 400 {
-		t.Errorf("Expected status code 400 but got %d", w.Code)
+	if resp.StatusCode != 409 {
+		t.Errorf("Expected status code 409 but got %d", w.Code)
 	}
 
 	req = httptest.NewRequest("PUT", "/v1/db1/doc2/col1/", nil)
@@ -1395,8 +1406,8 @@ func TestSubscription(t *testing.T) {
 	handler.ServeHTTP(w, req)
 	resp = w.Result()
 
-	if resp.StatusCode != 400 {
-		t.Errorf("Expected status code 400 but got %d", w.Code)
+	if resp.StatusCode != 409 {
+		t.Errorf("Expected status code 409 but got %d", w.Code)
 	}
 
 	req = httptest.NewRequest("GET", "/v1/db1/dc1", nil)
@@ -2435,3 +2446,4044 @@ func TestPatchBadPathLiterals(t *testing.T) {
 	}
 
 }
+
+// newTestHandler wires up a handler the same way main does, using schema1.json and the valid
+// tokens "abc" belonging to the user "test" and "def" belonging to the user "other". Any options are passed on to
+// handler.New.
+func newTestHandler(opts ...handler.Option) http.Handler {
+	dbFactory := CollectionFactory(collection.NewCollection[handler.Documenter])
+	docFactory := DocumentFactory(document.NewDocument[handler.Collectioner])
+	return newTestHandlerWithFactories(dbFactory, docFactory, opts...)
+}
+
+// newTestHandlerWithFactories is newTestHandler with the collection and document factories supplied by the caller,
+// so tests can wrap the created collections and documents.
+func newTestHandlerWithFactories(dbFactory handler.CollectionFactory, docFactory handler.DocumentFactory, opts ...handler.Option) http.Handler {
+	compiler := jsonschema.NewCompiler()
+	schema, _ := compiler.Compile("schema1.json")
+	return newTestHandlerWithSchema(dbFactory, docFactory, schema, opts...)
+}
+
+// newTestHandlerWithSchema is newTestHandlerWithFactories with the schema supplied by the caller instead of schema1.json.
+func newTestHandlerWithSchema(dbFactory handler.CollectionFactory, docFactory handler.DocumentFactory, schema *jsonschema.Schema, opts ...handler.Option) http.Handler {
+	authMap := auth.NewAuth()
+	authMap.AddPair("test", "abc", time.Now().Add(time.Hour))
+	authMap.AddPair("other", "def", time.Now().Add(time.Hour))
+	return buildTestHandler(dbFactory, docFactory, schema, authMap, opts...)
+}
+
+// newTestHandlerWithAuth is newTestHandler with the Auther supplied by the caller instead of the test tokens.
+func newTestHandlerWithAuth(auther handler.Auther, opts ...handler.Option) http.Handler {
+	dbFactory := CollectionFactory(collection.NewCollection[handler.Documenter])
+	docFactory := DocumentFactory(document.NewDocument[handler.Collectioner])
+	compiler := jsonschema.NewCompiler()
+	schema, _ := compiler.Compile("schema1.json")
+	return buildTestHandler(dbFactory, docFactory, schema, auther, opts...)
+}
+
+// buildTestHandler wires up a handler the same way main does from the given parts.
+func buildTestHandler(dbFactory handler.CollectionFactory, docFactory handler.DocumentFactory, schema *jsonschema.Schema, auther handler.Auther, opts ...handler.Option) http.Handler {
+	log.SetOutput(io.Discard)
+
+	visitorFactory := PatchVisitorFactory(patchvisitors.NewPatchVisitor[handler.PatchOper, handler.PatchOpFactory])
+	docVisitorFactory := DocVisitorFactory(patchvisitors.NewDocVisitor)
+	patchOpListVisitorFactory := PatchOpListVisitorFactory(patchvisitors.NewPatchOpListVisitor)
+	patchOpFactory := PatchOpFactory(patchvisitors.NewPatchOp)
+	dbIndexDatabases := skipList.New[string, handler.Collectioner]("databaseList", "", "\U0010FFFF")
+
+	return handler.New(dbFactory, docFactory, auther, schema, dbIndexDatabases, patchOpListVisitorFactory, visitorFactory, docVisitorFactory, patchOpFactory, opts...)
+}
+
+// doRequest sends a request with the given method, path and body to h, authorized with the test token,
+// and returns the recorded response.
+func doRequest(h http.Handler, method string, path string, body string) *http.Response {
+	return doRequestAs(h, "abc", method, path, body)
+}
+
+// doRequestAs is doRequest authorized with the given token instead of the test token.
+func doRequestAs(h http.Handler, token string, method string, path string, body string) *http.Response {
+	headers := map[string]string{"Authorization": "Bearer " + token}
+	if body != "" {
+		headers["Content-Type"] = "application/json"
+	}
+	return doRequestWithHeaders(h, method, path, body, headers)
+}
+
+// doRequestWithHeaders sends a request with the given method, path, body and exactly the given headers to h,
+// and returns the recorded response.
+func doRequestWithHeaders(h http.Handler, method string, path string, body string, headers map[string]string) *http.Response {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestRFC3339TimeFormat(t *testing.T) {
+	h := newTestHandler()
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	resp := doRequest(h, "PUT", "/v1/db1/dc1", `{"str":"testing"}`)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Expected status code 201 but got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(h, "GET", "/v1/db1/dc1", "")
+	var millis docResponse
+	err := json.NewDecoder(resp.Body).Decode(&millis)
+	if err != nil {
+		t.Fatalf("Error unmarshaling document: %v", err)
+	}
+
+	resp = doRequest(h, "GET", "/v1/db1/dc1?timeFormat=rfc3339", "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected status code 200 but got %d", resp.StatusCode)
+	}
+	var expanded struct {
+		Meta struct {
+			CreatedAt      string `json:"createdAt"`
+			LastModifiedAt string `json:"lastModifiedAt"`
+		} `json:"meta"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&expanded)
+	if err != nil {
+		t.Fatalf("Error unmarshaling rfc3339 document: %v", err)
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, expanded.Meta.CreatedAt)
+	if err != nil {
+		t.Fatalf("createdAt %q is not RFC3339: %v", expanded.Meta.CreatedAt, err)
+	}
+	if createdAt.UnixMilli() != millis.Meta.CreatedAt {
+		t.Errorf("Expected createdAt %d but got %d", millis.Meta.CreatedAt, createdAt.UnixMilli())
+	}
+	modifiedAt, err := time.Parse(time.RFC3339Nano, expanded.Meta.LastModifiedAt)
+	if err != nil {
+		t.Fatalf("lastModifiedAt %q is not RFC3339: %v", expanded.Meta.LastModifiedAt, err)
+	}
+	if modifiedAt.UnixMilli() != millis.Meta.LastModifiedAt {
+		t.Errorf("Expected lastModifiedAt %d but got %d", millis.Meta.LastModifiedAt, modifiedAt.UnixMilli())
+	}
+
+	resp = doRequest(h, "GET", "/v1/db1/?timeFormat=rfc3339", "")
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status code 200 but got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(h, "GET", "/v1/db1/dc1?timeFormat=iso", "")
+	if resp.StatusCode != 400 {
+		t.Errorf("Expected status code 400 but got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(h, "GET", "/v1/db1/dc1?mode=subscribe&timeFormat=rfc3339", "")
+	if resp.StatusCode != 400 {
+		t.Errorf("Expected status code 400 for a formatted subscription but got %d", resp.StatusCode)
+	}
+}
+
+func TestArrayReplacePatch(t *testing.T) {
+	h := newTestHandler()
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	resp := doRequest(h, "PUT", "/v1/db1/dc1", `{"list":["a","b","c"]}`)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Expected status code 201 but got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(h, "PATCH", "/v1/db1/dc1", `[{"op":"ArrayReplace","path":"/list","old":"b","new":"z"}]`)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected status code 200 but got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(h, "GET", "/v1/db1/dc1", "")
+	var got struct {
+		Doc struct {
+			List []string `json:"list"`
+		} `json:"doc"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&got)
+	if err != nil {
+		t.Fatalf("Error unmarshaling document: %v", err)
+	}
+	if !reflect.DeepEqual(got.Doc.List, []string{"a", "z", "c"}) {
+		t.Errorf("Expected [a z c] but got %v", got.Doc.List)
+	}
+
+	resp = doRequest(h, "PATCH", "/v1/db1/dc1", `[{"op":"ArrayReplace","path":"/list","old":"q","new":"y"}]`)
+	var missingValue map[string]any
+	err = json.NewDecoder(resp.Body).Decode(&missingValue)
+	if err != nil {
+		t.Fatalf("Error unmarshaling patch response: %v", err)
+	}
+	if missingValue["patchFailed"] != true || missingValue["message"] != "error applying patches: value to replace not found in array" {
+		t.Errorf("Expected a failed patch for a missing old value but got %v", missingValue)
+	}
+
+	resp = doRequest(h, "PATCH", "/v1/db1/dc1", `[{"op":"ArrayReplace","path":"/list","new":"y"}]`)
+	var missingOld map[string]any
+	err = json.NewDecoder(resp.Body).Decode(&missingOld)
+	if err != nil {
+		t.Fatalf("Error unmarshaling patch response: %v", err)
+	}
+	if missingOld["patchFailed"] != true || missingOld["message"] != "patch operation missing \"old\" property" {
+		t.Errorf("Expected a failed patch for a missing old property but got %v", missingOld)
+	}
+}
+
+func TestPatchUpsert(t *testing.T) {
+	h := newTestHandler()
+
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	resp := doRequest(h, "PATCH", "/v1/db1/dc1", `[{"op":"ObjectAdd","path":"/a","value":1}]`)
+	if resp.StatusCode != 404 {
+		t.Errorf("Expected status code 404 without upsert but got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(h, "PATCH", "/v1/db1/dc1?mode=upsert", `[{"op":"ObjectAdd","path":"/a","value":1}]`)
+	if resp.StatusCode != 201 {
+		t.Fatalf("Expected status code 201 but got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(h, "GET", "/v1/db1/dc1", "")
+	var got map[string]any
+	json.NewDecoder(resp.Body).Decode(&got)
+	if !reflect.DeepEqual(got["doc"], map[string]any{"a": float64(1)}) {
+		t.Errorf("Expected upserted document {\"a\":1} but got %v", got["doc"])
+	}
+
+	resp = doRequest(h, "PATCH", "/v1/db1/dc1?mode=upsert", `[{"op":"ObjectAdd","path":"/b","value":2}]`)
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status code 200 patching an existing document but got %d", resp.StatusCode)
+	}
+
+	// a failed upsert reports the failure like a failed patch of an existing document
+	resp = doRequest(h, "PATCH", "/v1/db1/dc2?mode=upsert", `[{"op":"ArrayAdd","path":"/missing","value":1}]`)
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status code 200 for a failed upsert but got %d", resp.StatusCode)
+	}
+	var failed map[string]any
+	err := json.NewDecoder(resp.Body).Decode(&failed)
+	if err != nil {
+		t.Fatalf("Error unmarshaling patch response: %v", err)
+	}
+	if failed["patchFailed"] != true {
+		t.Errorf("Expected patchFailed for a failed upsert but got %v", failed)
+	}
+	resp = doRequest(h, "GET", "/v1/db1/dc2", "")
+	if resp.StatusCode != 404 {
+		t.Errorf("Expected failed upsert not to create a document but got %d", resp.StatusCode)
+	}
+
+	// the failed upsert must not leave the collection locked
+	done := make(chan int)
+	go func() {
+		done <- doRequest(h, "PUT", "/v1/db1/dc3", `{"str":"after"}`).StatusCode
+	}()
+	select {
+	case status := <-done:
+		if status != 201 {
+			t.Errorf("Expected status code 201 writing after a failed upsert but got %d", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write after a failed upsert did not return")
+	}
+
+	resp = doRequest(h, "PATCH", "/v1/db1/dc1?mode=create", `[{"op":"ObjectAdd","path":"/b","value":2}]`)
+	if resp.StatusCode != 400 {
+		t.Errorf("Expected status code 400 for an unknown mode but got %d", resp.StatusCode)
+	}
+}
+
+func TestModifiedByFilter(t *testing.T) {
+	h := newTestHandler()
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequestAs(h, "abc", "PUT", "/v1/db1/a", `{"str":"a"}`)
+	doRequestAs(h, "def", "PUT", "/v1/db1/b", `{"str":"b"}`)
+	doRequestAs(h, "abc", "PUT", "/v1/db1/c", `{"str":"c"}`)
+	// modifying a document changes its last modifier
+	doRequestAs(h, "def", "PUT", "/v1/db1/c", `{"str":"c2"}`)
+
+	resp := doRequest(h, "GET", "/v1/db1/?modifiedBy=other", "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected status code 200 but got %d", resp.StatusCode)
+	}
+	var docs []docResponse
+	err := json.NewDecoder(resp.Body).Decode(&docs)
+	if err != nil {
+		t.Fatalf("Error unmarshaling collection: %v", err)
+	}
+	paths := make([]string, 0)
+	for _, doc := range docs {
+		paths = append(paths, doc.Path)
+		if doc.Meta.LastModifiedBy != "other" {
+			t.Errorf("Expected only documents modified by other but got %s", doc.Meta.LastModifiedBy)
+		}
+	}
+	if !reflect.DeepEqual(paths, []string{"/b", "/c"}) {
+		t.Errorf("Expected paths [/b /c] but got %v", paths)
+	}
+
+	resp = doRequest(h, "GET", "/v1/db1/?modifiedBy=test", "")
+	var byTest []docResponse
+	err = json.NewDecoder(resp.Body).Decode(&byTest)
+	if err != nil {
+		t.Fatalf("Error unmarshaling collection: %v", err)
+	}
+	if len(byTest) != 1 || byTest[0].Path != "/a" {
+		t.Errorf("Expected only /a modified by test but got %v", byTest)
+	}
+
+	resp = doRequest(h, "GET", "/v1/db1/?modifiedBy=other&interval=[a,b]", "")
+	var inInterval []docResponse
+	err = json.NewDecoder(resp.Body).Decode(&inInterval)
+	if err != nil {
+		t.Fatalf("Error unmarshaling collection: %v", err)
+	}
+	if len(inInterval) != 1 || inInterval[0].Path != "/b" {
+		t.Errorf("Expected only /b within the interval but got %v", inInterval)
+	}
+
+	resp = doRequest(h, "GET", "/v1/db1/?mode=subscribe&modifiedBy=other", "")
+	if resp.StatusCode != 400 {
+		t.Errorf("Expected status code 400 for a filtered subscription but got %d", resp.StatusCode)
+	}
+}
+
+func TestSubscribeMalformedInterval(t *testing.T) {
+	h := newTestHandler()
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"str":"testing"}`)
+
+	// the stream is never opened, so the request returns instead of blocking on events
+	resp := doRequest(h, "GET", "/v1/db1/?mode=subscribe&interval=[d]", "")
+	if resp.StatusCode != 400 {
+		t.Errorf("Expected status code 400 but got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected a json error body but got content type %q", resp.Header.Get("Content-Type"))
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if strings.Contains(string(body), "event:") {
+		t.Errorf("Expected no events before the error but got %s", body)
+	}
+}
+
+func TestContentTypeParameters(t *testing.T) {
+	h := newTestHandler(handler.WithContentTypes("application/vnd.owldb+json"))
+
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	headers := map[string]string{"Authorization": "Bearer abc", "Content-Type": "application/json; charset=utf-8"}
+	resp := doRequestWithHeaders(h, "PUT", "/v1/db1/dc1", `{"str":"testing"}`, headers)
+	if resp.StatusCode != 201 {
+		t.Errorf("Expected status code 201 for a charset parameter but got %d", resp.StatusCode)
+	}
+	resp = doRequestWithHeaders(h, "POST", "/v1/db1/", `{"str":"testing"}`, headers)
+	if resp.StatusCode != 201 {
+		t.Errorf("Expected status code 201 posting with a charset parameter but got %d", resp.StatusCode)
+	}
+	resp = doRequestWithHeaders(h, "PATCH", "/v1/db1/dc1", `[{"op":"ObjectAdd","path":"/a","value":1}]`, headers)
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status code 200 patching with a charset parameter but got %d", resp.StatusCode)
+	}
+
+	headers["Content-Type"] = "application/vnd.owldb+json"
+	resp = doRequestWithHeaders(h, "PUT", "/v1/db1/dc2", `{"str":"testing"}`, headers)
+	if resp.StatusCode != 201 {
+		t.Errorf("Expected status code 201 for an allowed content type but got %d", resp.StatusCode)
+	}
+
+	headers["Content-Type"] = "text/plain"
+	resp = doRequestWithHeaders(h, "PUT", "/v1/db1/dc3", `{"str":"testing"}`, headers)
+	if resp.StatusCode != 400 {
+		t.Errorf("Expected status code 400 for a disallowed content type but got %d", resp.StatusCode)
+	}
+}
+
+func TestListingCap(t *testing.T) {
+	h := newTestHandler(handler.WithListingCap(2))
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		doRequest(h, "PUT", "/v1/db1/"+name, `{"str":"testing"}`)
+	}
+
+	resp := doRequest(h, "GET", "/v1/db1/", "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected status code 200 but got %d", resp.StatusCode)
+	}
+	var docs []docResponse
+	err := json.NewDecoder(resp.Body).Decode(&docs)
+	if err != nil {
+		t.Fatalf("Error unmarshaling truncated listing: %v", err)
+	}
+	if len(docs) != 2 || docs[0].Path != "/a" || docs[1].Path != "/b" {
+		t.Errorf("Expected the listing cut off after /a and /b but got %v", docs)
+	}
+	if resp.Trailer.Get("Owldb-Truncated") != "true" {
+		t.Errorf("Expected the truncation trailer but got %v", resp.Trailer)
+	}
+
+	// a listing within the cap is complete
+	resp = doRequest(h, "GET", "/v1/db1/?interval=[a,b]", "")
+	var tail []docResponse
+	err = json.NewDecoder(resp.Body).Decode(&tail)
+	if err != nil {
+		t.Fatalf("Error unmarshaling listing: %v", err)
+	}
+	if len(tail) != 2 {
+		t.Errorf("Expected 2 documents but got %d", len(tail))
+	}
+	if resp.Trailer.Get("Owldb-Truncated") != "" {
+		t.Errorf("Expected no truncation trailer but got %v", resp.Trailer)
+	}
+}
+
+func TestSortBy(t *testing.T) {
+	h := newTestHandler()
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/a", `{"score":3}`)
+	doRequest(h, "PUT", "/v1/db1/b", `{"score":10}`)
+	doRequest(h, "PUT", "/v1/db1/c", `{"score":1}`)
+	doRequest(h, "PUT", "/v1/db1/d", `{"other":true}`)
+
+	paths := func(resp *http.Response) []string {
+		var docs []docResponse
+		err := json.NewDecoder(resp.Body).Decode(&docs)
+		if err != nil {
+			t.Fatalf("Error unmarshaling listing: %v", err)
+		}
+		result := make([]string, 0)
+		for _, doc := range docs {
+			result = append(result, doc.Path)
+		}
+		return result
+	}
+
+	resp := doRequest(h, "GET", "/v1/db1/?sortBy=/score", "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected status code 200 but got %d", resp.StatusCode)
+	}
+	if got := paths(resp); !reflect.DeepEqual(got, []string{"/c", "/a", "/b", "/d"}) {
+		t.Errorf("Expected ascending order [/c /a /b /d] but got %v", got)
+	}
+
+	resp = doRequest(h, "GET", "/v1/db1/?sortBy=/score&order=desc", "")
+	if got := paths(resp); !reflect.DeepEqual(got, []string{"/b", "/a", "/c", "/d"}) {
+		t.Errorf("Expected descending order [/b /a /c /d] but got %v", got)
+	}
+
+	resp = doRequest(h, "GET", "/v1/db1/?sortBy=score", "")
+	if resp.StatusCode != 400 {
+		t.Errorf("Expected status code 400 for a sortBy that is not a pointer but got %d", resp.StatusCode)
+	}
+	resp = doRequest(h, "GET", "/v1/db1/?sortBy=/score&order=up", "")
+	if resp.StatusCode != 400 {
+		t.Errorf("Expected status code 400 for an unknown order but got %d", resp.StatusCode)
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	h := newTestHandler()
+
+	resp := doRequest(h, "PUT", "/v1/_db", "")
+	if resp.StatusCode != 400 {
+		t.Errorf("Expected status code 400 for a reserved database name but got %d", resp.StatusCode)
+	}
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	resp = doRequest(h, "PUT", "/v1/db1/_foo", `{"str":"testing"}`)
+	if resp.StatusCode != 400 {
+		t.Errorf("Expected status code 400 for a reserved document name but got %d", resp.StatusCode)
+	}
+	resp = doRequest(h, "PUT", "/v1/db1/foo", `{"str":"testing"}`)
+	if resp.StatusCode != 201 {
+		t.Errorf("Expected status code 201 for a normal name but got %d", resp.StatusCode)
+	}
+	resp = doRequest(h, "PUT", "/v1/db1/foo/_col/", "")
+	if resp.StatusCode != 400 {
+		t.Errorf("Expected status code 400 for a reserved collection name but got %d", resp.StatusCode)
+	}
+	resp = doRequest(h, "PUT", "/v1/db1/_schema", `{"str":"testing"}`)
+	if resp.StatusCode != 201 {
+		t.Errorf("Expected status code 201 for the recognized _schema path but got %d", resp.StatusCode)
+	}
+
+	// the prefix is configurable
+	h = newTestHandler(handler.WithReservedPrefix(""))
+	doRequest(h, "PUT", "/v1/db1", "")
+	resp = doRequest(h, "PUT", "/v1/db1/_foo", `{"str":"testing"}`)
+	if resp.StatusCode != 201 {
+		t.Errorf("Expected status code 201 without a reserved prefix but got %d", resp.StatusCode)
+	}
+}
+
+func TestPatchUpsertReservedNames(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	patch := `[{"op":"ObjectAdd","path":"/a","value":1}]`
+	for _, name := range []string{"_foo", document.MaxName} {
+		resp := doRequest(h, "PATCH", "/v1/db1/"+url.PathEscape(name)+"?mode=upsert", patch)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status code 400 upserting a document named %q but got %d", name, resp.StatusCode)
+		}
+	}
+	resp := doRequest(h, "GET", "/v1/db1/_foo", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the reserved document not to be created but got %d", resp.StatusCode)
+	}
+	resp = doRequest(h, "PATCH", "/v1/db1/foo?mode=upsert", patch)
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected status code 201 upserting a normal name but got %d", resp.StatusCode)
+	}
+}
+
+// An sseEvent is one event read from a subscription stream.
+type sseEvent struct {
+	event string
+	data  string
+	id    string
+	seq   string
+}
+
+// subscribe opens a subscription to path on server authorized with the test token and returns a channel of the
+// events read from it. The subscription is closed when the test ends, so server must be closed with t.Cleanup
+// rather than defer.
+func subscribe(t *testing.T, server *httptest.Server, path string) <-chan sseEvent {
+	return subscribeWithHeaders(t, server, path, nil)
+}
+
+// Like subscribe, with extra headers on the subscription request.
+func subscribeWithHeaders(t *testing.T, server *httptest.Server, path string, headers map[string]string) <-chan sseEvent {
+	req, err := http.NewRequest("GET", server.URL+path, nil)
+	if err != nil {
+		t.Fatalf("Error creating subscription request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer abc")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	events := make(chan sseEvent, 100)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		var curr sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if curr.event != "" {
+					events <- curr
+				}
+				curr = sseEvent{}
+			case strings.HasPrefix(line, "event: "):
+				curr.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				curr.data = strings.TrimPrefix(line, "data: ")
+			case strings.HasPrefix(line, "id: "):
+				curr.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "seq: "):
+				curr.seq = strings.TrimPrefix(line, "seq: ")
+			}
+		}
+	}()
+	return events
+}
+
+// nextEvent waits for the next event on events, failing the test if none arrives within a second.
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("subscription closed while waiting for an event")
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event received within a second")
+	}
+	return sseEvent{}
+}
+
+func TestEventCoalescing(t *testing.T) {
+	server := httptest.NewServer(newTestHandler(handler.WithCoalescing(100 * time.Millisecond)))
+	t.Cleanup(server.Close)
+	h := server.Config.Handler
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"count":0}`)
+
+	events := subscribe(t, server, "/v1/db1/dc1?mode=subscribe")
+	// the current state of the document comes first
+	nextEvent(t, events)
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 1; i <= 10; i++ {
+		doRequest(h, "PUT", "/v1/db1/dc1", fmt.Sprintf(`{"count":%d}`, i))
+	}
+
+	updates := make([]sseEvent, 0)
+	timeout := time.After(500 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case event := <-events:
+			updates = append(updates, event)
+		case <-timeout:
+			done = true
+		}
+	}
+
+	if len(updates) == 0 || len(updates) >= 10 {
+		t.Fatalf("Expected the 10 updates coalesced into fewer events but got %d", len(updates))
+	}
+	last := updates[len(updates)-1]
+	if last.event != "update" || !strings.Contains(last.data, `"count":10`) {
+		t.Errorf("Expected the last event to carry the final state but got %v", last)
+	}
+}
+
+func TestLastEventId(t *testing.T) {
+	server := httptest.NewServer(newTestHandler())
+	t.Cleanup(server.Close)
+	h := server.Config.Handler
+
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	res := doRequest(h, "GET", "/v1/db1/?mode=eventid", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", res.StatusCode)
+	}
+	var body struct {
+		LastEventId int64 `json:"lastEventId"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("Could not decode response: %s", err)
+	}
+	if body.LastEventId != 0 {
+		t.Errorf("Expected 0 before any event but got %d", body.LastEventId)
+	}
+
+	events := subscribe(t, server, "/v1/db1/?mode=subscribe")
+	time.Sleep(50 * time.Millisecond)
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"a":1}`)
+	event := nextEvent(t, events)
+
+	res = doRequest(h, "GET", "/v1/db1/?mode=eventid", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", res.StatusCode)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("Could not decode response: %s", err)
+	}
+	if fmt.Sprint(body.LastEventId) != event.id {
+		t.Errorf("Expected last event id %s but got %d", event.id, body.LastEventId)
+	}
+
+	res = doRequest(h, "GET", "/v1/db1/dc1?mode=eventid", "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a document but got %d", res.StatusCode)
+	}
+}
+
+// Concurrent patches of one document must each see the result of the ones before them. There is no increment
+// operation, so each patch adds a distinct value to an array and no value may be lost.
+func TestConcurrentPatch(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"values":[]}`)
+
+	const patches = 100
+	statuses := make(chan int, patches)
+	for i := 0; i < patches; i++ {
+		go func(i int) {
+			res := doRequest(h, "PATCH", "/v1/db1/dc1", fmt.Sprintf(`[{"op":"ArrayAdd","path":"/values","value":%d}]`, i))
+			statuses <- res.StatusCode
+		}(i)
+	}
+	for i := 0; i < patches; i++ {
+		if status := <-statuses; status != http.StatusOK {
+			t.Errorf("Expected status 200 but got %d", status)
+		}
+	}
+
+	res := doRequest(h, "GET", "/v1/db1/dc1", "")
+	var got struct {
+		Doc struct {
+			Values []int `json:"values"`
+		} `json:"doc"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+		t.Fatalf("Could not decode response: %s", err)
+	}
+	if len(got.Doc.Values) != patches {
+		t.Errorf("Expected %d values after concurrent patches but got %d", patches, len(got.Doc.Values))
+	}
+}
+
+func TestEventSequence(t *testing.T) {
+	server := httptest.NewServer(newTestHandler())
+	t.Cleanup(server.Close)
+	h := server.Config.Handler
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	events := subscribe(t, server, "/v1/db1/?mode=subscribe")
+	time.Sleep(50 * time.Millisecond)
+
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"a":1}`)
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"a":2}`)
+	doRequest(h, "PATCH", "/v1/db1/dc1", `[{"op":"ObjectAdd","path":"/b","value":3}]`)
+	doRequest(h, "DELETE", "/v1/db1/dc1", "")
+
+	expected := []string{"update", "update", "update", "delete"}
+	for i, kind := range expected {
+		event := nextEvent(t, events)
+		if event.event != kind {
+			t.Errorf("Expected event %d to be %s but got %s", i, kind, event.event)
+		}
+		if event.seq != fmt.Sprint(i+1) {
+			t.Errorf("Expected event %d to have sequence number %d but got %q", i, i+1, event.seq)
+		}
+	}
+}
+
+// The events of a serial collection are numbered in the order they are delivered, across all of its documents, even
+// when the writes are concurrent. Meant to be run with -race as well.
+func TestSerialCollection(t *testing.T) {
+	server := httptest.NewServer(newTestHandler())
+	t.Cleanup(server.Close)
+	h := server.Config.Handler
+
+	doRequest(h, "PUT", "/v1/db1?serial=true", "")
+	doRequest(h, "PUT", "/v1/db1/shared", `{"count":0}`)
+	events := subscribe(t, server, "/v1/db1/?mode=subscribe&snapshot=false")
+	time.Sleep(50 * time.Millisecond)
+
+	const writes = 60
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < writes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			switch i % 3 {
+			case 0:
+				doRequest(h, "PUT", fmt.Sprintf("/v1/db1/dc%d", i), `{"a":1}`)
+			case 1:
+				doRequest(h, "PATCH", "/v1/db1/shared", `[{"op":"Increment","path":"/count","value":1}]`)
+			default:
+				doRequest(h, "POST", "/v1/db1/", `{"b":2}`)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	// the put of the shared document was the first event
+	for i := 0; i < writes; i++ {
+		event := nextEvent(t, events)
+		if event.seq != fmt.Sprint(i+2) {
+			t.Fatalf("Expected event %d to have sequence number %d but got %q", i, i+2, event.seq)
+		}
+	}
+
+	for _, path := range []string{"/v1/db2?serial=yes", "/v1/db1/doc?serial=true"} {
+		res := doRequest(h, "PUT", path, `{}`)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s but got %d", path, res.StatusCode)
+		}
+	}
+}
+
+// Exactly one of many concurrent puts of a new document creates it, whatever order they run in.
+func TestConcurrentPutStatus(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	const puts = 100
+	start := make(chan struct{})
+	statuses := make(chan int, puts)
+	for i := 0; i < puts; i++ {
+		go func(i int) {
+			<-start
+			res := doRequest(h, "PUT", "/v1/db1/doc1", fmt.Sprintf(`{"put":%d}`, i))
+			statuses <- res.StatusCode
+		}(i)
+	}
+	close(start)
+
+	created := 0
+	for i := 0; i < puts; i++ {
+		switch status := <-statuses; status {
+		case http.StatusCreated:
+			created++
+		case http.StatusOK:
+		default:
+			t.Errorf("Expected status 200 or 201 but got %d", status)
+		}
+	}
+	if created != 1 {
+		t.Errorf("Expected exactly one 201 but got %d", created)
+	}
+}
+
+func TestContentLengthMismatch(t *testing.T) {
+	h := newTestHandler(handler.WithContentLengthCheck())
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"a":1}`)
+
+	send := func(method string, path string, body string, declared int64) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.ContentLength = declared
+		req.Header.Set("Authorization", "Bearer abc")
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	body := `{"a":2}`
+	requests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"PUT", "/v1/db1/dc2", body},
+		{"POST", "/v1/db1/", body},
+		{"PATCH", "/v1/db1/dc1", `[{"op":"ObjectAdd","path":"/b","value":1}]`},
+	}
+	for _, r := range requests {
+		if status := send(r.method, r.path, r.body, int64(len(r.body)+10)); status != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for a %s with a longer Content-Length but got %d", r.method, status)
+		}
+	}
+
+	if status := send("PUT", "/v1/db1/dc2", body, int64(len(body))); status != http.StatusCreated {
+		t.Errorf("Expected status 201 for a matching Content-Length but got %d", status)
+	}
+	// without the option the declared length is not checked
+	h = newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	if status := send("PUT", "/v1/db1/dc2", body, int64(len(body)+10)); status != http.StatusCreated {
+		t.Errorf("Expected status 201 without the check but got %d", status)
+	}
+}
+
+func TestStaticHeaders(t *testing.T) {
+	server := httptest.NewServer(newTestHandler(handler.WithHeaders(map[string]string{"X-Frame-Options": "DENY"})))
+	t.Cleanup(server.Close)
+	h := server.Config.Handler
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"a":1}`)
+
+	res := doRequest(h, "GET", "/v1/db1/dc1", "")
+	if got := res.Header.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("Expected X-Content-Type-Options nosniff on a document GET but got %q", got)
+	}
+	if got := res.Header.Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("Expected X-Frame-Options DENY on a document GET but got %q", got)
+	}
+
+	req, err := http.NewRequest("GET", server.URL+"/v1/db1/dc1?mode=subscribe", nil)
+	if err != nil {
+		t.Fatalf("Error creating subscription request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer abc")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("Expected X-Content-Type-Options nosniff on a subscription but got %q", got)
+	}
+	if got := resp.Header.Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("Expected X-Frame-Options DENY on a subscription but got %q", got)
+	}
+}
+
+func TestValidateAll(t *testing.T) {
+	compiler := jsonschema.NewCompiler()
+	err := compiler.AddResource("strict.json", strings.NewReader(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string"},
+			"age": {"type": "integer", "minimum": 0}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("Could not add schema: %v", err)
+	}
+	schema, err := compiler.Compile("strict.json")
+	if err != nil {
+		t.Fatalf("Could not compile schema: %v", err)
+	}
+	dbFactory := CollectionFactory(collection.NewCollection[handler.Documenter])
+	docFactory := DocumentFactory(document.NewDocument[handler.Collectioner])
+	h := newTestHandlerWithSchema(dbFactory, docFactory, schema)
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	body := `{"name": 5, "age": -1}`
+	for _, r := range []struct {
+		method string
+		path   string
+	}{{"PUT", "/v1/db1/dc1"}, {"POST", "/v1/db1/"}} {
+		res := doRequest(h, r.method, r.path, body)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected status 400 for a %s but got %d", r.method, res.StatusCode)
+		}
+		var violations []string
+		if err := json.NewDecoder(res.Body).Decode(&violations); err != nil {
+			t.Fatalf("Could not decode the violations of a %s: %v", r.method, err)
+		}
+		if len(violations) != 2 {
+			t.Fatalf("Expected 2 violations for a %s but got %v", r.method, violations)
+		}
+		joined := strings.Join(violations, "\n")
+		if !strings.Contains(joined, "/name") || !strings.Contains(joined, "/age") {
+			t.Errorf("Expected violations at /name and /age for a %s but got %v", r.method, violations)
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	h := newTestHandler(handler.WithMaxDepth(2))
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/dc1", `{}`)
+
+	res := doRequest(h, "PUT", "/v1/db1/dc1/col1/", "")
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201 for a collection at depth 1 but got %d", res.StatusCode)
+	}
+	doRequest(h, "PUT", "/v1/db1/dc1/col1/dc2", `{}`)
+	res = doRequest(h, "PUT", "/v1/db1/dc1/col1/dc2/col2/", "")
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201 for a collection at depth 2 but got %d", res.StatusCode)
+	}
+	res = doRequest(h, "POST", "/v1/db1/dc1/col1/dc2/col2/", `{}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201 for a document in a collection at depth 2 but got %d", res.StatusCode)
+	}
+	doRequest(h, "PUT", "/v1/db1/dc1/col1/dc2/col2/dc3", `{}`)
+	res = doRequest(h, "PUT", "/v1/db1/dc1/col1/dc2/col2/dc3/col3/", "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a collection at depth 3 but got %d", res.StatusCode)
+	}
+}
+
+func TestGetPointer(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"a":{"b":{"c":1}},"list":[10,{"x":"y"}]}`)
+
+	for pointer, expected := range map[string]string{
+		"/a/b":     `{"c":1}`,
+		"/list/1":  `{"x":"y"}`,
+		"/list/0":  `10`,
+		"/a/b/c":   `1`,
+		"/a~1b":    "",
+		"/list/2":  "",
+		"/missing": "",
+	} {
+		res := doRequest(h, "GET", "/v1/db1/dc1?pointer="+url.QueryEscape(pointer), "")
+		body, _ := io.ReadAll(res.Body)
+		if expected == "" {
+			if res.StatusCode != http.StatusNotFound {
+				t.Errorf("Expected status 404 for pointer %s but got %d", pointer, res.StatusCode)
+			}
+			continue
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 for pointer %s but got %d", pointer, res.StatusCode)
+		} else if string(body) != expected {
+			t.Errorf("Expected %s at pointer %s but got %s", expected, pointer, body)
+		}
+	}
+
+	res := doRequest(h, "GET", "/v1/db1/dc1?pointer=a", "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a pointer without a leading slash but got %d", res.StatusCode)
+	}
+	res = doRequest(h, "GET", "/v1/db1/?pointer=/a", "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a pointer on a collection but got %d", res.StatusCode)
+	}
+}
+
+func TestCORSMaxAge(t *testing.T) {
+	res := doRequest(newTestHandler(), "OPTIONS", "/v1/db1", "")
+	if got := res.Header.Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("Expected the default max age 600 but got %q", got)
+	}
+
+	h := newTestHandler(handler.WithCORSMaxAge(2 * time.Minute))
+	for _, path := range []string{"/v1/db1", "/auth"} {
+		res = doRequest(h, "OPTIONS", path, "")
+		if got := res.Header.Get("Access-Control-Max-Age"); got != "120" {
+			t.Errorf("Expected max age 120 on OPTIONS %s but got %q", path, got)
+		}
+	}
+
+	res = doRequest(newTestHandler(handler.WithCORSMaxAge(0)), "OPTIONS", "/v1/db1", "")
+	if got := res.Header.Get("Access-Control-Max-Age"); got != "" {
+		t.Errorf("Expected no max age when disabled but got %q", got)
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	h := newTestHandler(handler.WithAdminToken("admin-secret"), handler.WithListingCap(50), handler.WithMaxDepth(3))
+
+	res := doRequestAs(h, "admin-secret", "GET", "/admin/config", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", res.StatusCode)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if strings.Contains(string(body), "admin-secret") {
+		t.Errorf("Expected the admin token to be left out of the configuration but got %s", body)
+	}
+	var config map[string]any
+	if err := json.Unmarshal(body, &config); err != nil {
+		t.Fatalf("Could not decode response: %v", err)
+	}
+	if config["listingCap"] != float64(50) || config["maxDepth"] != float64(3) || config["corsMaxAge"] != "10m0s" {
+		t.Errorf("Expected the configured limits but got %v", config)
+	}
+
+	for _, token := range []string{"abc", "wrong"} {
+		res = doRequestAs(h, token, "GET", "/admin/config", "")
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 with token %s but got %d", token, res.StatusCode)
+		}
+	}
+	res = doRequestAs(newTestHandler(), "", "GET", "/admin/config", "")
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without an admin token configured but got %d", res.StatusCode)
+	}
+}
+
+func TestAdminEvents(t *testing.T) {
+	h := newTestHandler(handler.WithAdminToken("admin-secret"))
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/a", `{"str":"a"}`)
+	doRequest(h, "PUT", "/v1/db1/b", `{"str":"b"}`)
+	doRequest(h, "PUT", "/v1/db1/a", `{"str":"a2"}`)
+	doRequest(h, "DELETE", "/v1/db1/b", "")
+
+	events := func(query string) []map[string]any {
+		res := doRequestAs(h, "admin-secret", "GET", "/admin/events?"+query, "")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s but got %d", query, res.StatusCode)
+		}
+		var body []map[string]any
+		err := json.NewDecoder(res.Body).Decode(&body)
+		if err != nil {
+			t.Fatalf("Error unmarshaling events: %v", err)
+		}
+		return body
+	}
+
+	all := events("path=" + url.QueryEscape("/v1/db1/"))
+	want := [][2]string{{"update", "a"}, {"update", "b"}, {"update", "a"}, {"delete", "b"}}
+	if len(all) != len(want) {
+		t.Fatalf("Expected %d events but got %v", len(want), all)
+	}
+	for i, event := range all {
+		if event["event"] != want[i][0] || event["doc"] != want[i][1] {
+			t.Errorf("Expected event %d to be %v but got %v", i, want[i], event)
+		}
+		if i > 0 && event["id"].(float64) < all[i-1]["id"].(float64) {
+			t.Errorf("Expected event ids in order but got %v", all)
+		}
+	}
+
+	last := events("path=" + url.QueryEscape("/v1/db1/") + "&limit=2")
+	if len(last) != 2 || last[0]["doc"] != "a" || last[1]["event"] != "delete" {
+		t.Errorf("Expected the last two events but got %v", last)
+	}
+
+	res := doRequestAs(h, "abc", "GET", "/admin/events?path=/v1/db1/", "")
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a non admin but got %d", res.StatusCode)
+	}
+	for query, status := range map[string]int{
+		"path=/v1/db1/a":          http.StatusBadRequest,
+		"path=/v1/db1/&limit=0":   http.StatusBadRequest,
+		"path=/v1/db2/":           http.StatusNotFound,
+		"path=/v1/db1/a/missing/": http.StatusNotFound,
+		"path=/v2/db1/":           http.StatusBadRequest,
+	} {
+		res := doRequestAs(h, "admin-secret", "GET", "/admin/events?"+query, "")
+		if res.StatusCode != status {
+			t.Errorf("Expected status %d for %s but got %d", status, query, res.StatusCode)
+		}
+	}
+}
+
+func TestAdminSchema(t *testing.T) {
+	h := newTestHandler(handler.WithAdminToken("admin-secret"))
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	res := doRequest(h, "PUT", "/v1/db1/dc1", `{"name":5}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201 under the old schema but got %d", res.StatusCode)
+	}
+
+	stricter := `{"type":"object","properties":{"name":{"type":"string"}}}`
+	res = doRequestAs(h, "abc", "PUT", "/admin/schema", stricter)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a non admin but got %d", res.StatusCode)
+	}
+	res = doRequestAs(h, "admin-secret", "PUT", "/admin/schema", `{"type": 5}`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a schema that does not compile but got %d", res.StatusCode)
+	}
+	res = doRequestAs(h, "admin-secret", "PUT", "/admin/schema", stricter)
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204 but got %d", res.StatusCode)
+	}
+
+	res = doRequest(h, "PUT", "/v1/db1/dc2", `{"name":5}`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 under the new schema but got %d", res.StatusCode)
+	}
+	res = doRequest(h, "PUT", "/v1/db1/dc2", `{"name":"five"}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("Expected status 201 for a conforming document but got %d", res.StatusCode)
+	}
+}
+
+func TestAdminBanner(t *testing.T) {
+	h := newTestHandler(handler.WithAdminToken("admin-secret"))
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"a":1}`)
+
+	res := doRequest(h, "GET", "/v1/db1/dc1", "")
+	if warning := res.Header.Get("Warning"); warning != "" {
+		t.Errorf("Expected no Warning header without a banner but got %q", warning)
+	}
+
+	res = doRequestAs(h, "abc", "PUT", "/admin/banner", "maintenance")
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a non admin but got %d", res.StatusCode)
+	}
+	res = doRequestAs(h, "admin-secret", "PUT", "/admin/banner", `Read only until 10:00 "UTC"`)
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204 but got %d", res.StatusCode)
+	}
+	for _, path := range []string{"/v1/db1/dc1", "/v1/db1/", "/v1/db1/missing"} {
+		res = doRequest(h, "GET", path, "")
+		if warning := res.Header.Get("Warning"); warning != `299 - "Read only until 10:00 \"UTC\""` {
+			t.Errorf("Expected the banner in the Warning header of %s but got %q", path, warning)
+		}
+	}
+
+	res = doRequestAs(h, "admin-secret", "PUT", "/admin/banner", "")
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204 but got %d", res.StatusCode)
+	}
+	res = doRequest(h, "GET", "/v1/db1/dc1", "")
+	if warning := res.Header.Get("Warning"); warning != "" {
+		t.Errorf("Expected no Warning header after clearing the banner but got %q", warning)
+	}
+}
+
+func TestHTTP10SubscribeRejection(t *testing.T) {
+	server := httptest.NewServer(newTestHandler(handler.WithHTTP10SubscribeRejection()))
+	t.Cleanup(server.Close)
+	h := server.Config.Handler
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"a":1}`)
+
+	req := httptest.NewRequest("GET", "/v1/db1/dc1?mode=subscribe", nil)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.0", 1, 0
+	req.Header.Set("Authorization", "Bearer abc")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusHTTPVersionNotSupported {
+		t.Errorf("Expected status 505 for an HTTP/1.0 subscription but got %d", w.Code)
+	}
+
+	req.URL.RawQuery = ""
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for an HTTP/1.0 GET but got %d", w.Code)
+	}
+
+	// over HTTP/1.1 the subscription goes ahead and sends the document's current state
+	events := subscribe(t, server, "/v1/db1/dc1?mode=subscribe")
+	if event := nextEvent(t, events); event.event != "update" {
+		t.Errorf("Expected an update event over HTTP/1.1 but got %v", event)
+	}
+}
+
+func TestSubscribeWithoutSnapshot(t *testing.T) {
+	server := httptest.NewServer(newTestHandler())
+	t.Cleanup(server.Close)
+	h := server.Config.Handler
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"a":1}`)
+
+	colEvents := subscribe(t, server, "/v1/db1/?mode=subscribe&snapshot=false")
+	docEvents := subscribe(t, server, "/v1/db1/dc1?mode=subscribe&snapshot=false")
+	time.Sleep(50 * time.Millisecond)
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"a":2}`)
+
+	for _, events := range []<-chan sseEvent{colEvents, docEvents} {
+		event := nextEvent(t, events)
+		if !strings.Contains(event.data, `"a":2`) {
+			t.Errorf("Expected the live update as the first event but got %v", event)
+		}
+	}
+
+	res := doRequest(h, "GET", "/v1/db1/dc1?snapshot=false", "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for snapshot without subscribe but got %d", res.StatusCode)
+	}
+}
+
+func TestResolveReferences(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/b", `{"name":"b"}`)
+	doRequest(h, "PUT", "/v1/db1/a", `{"name":"a","ref":"/v1/db1/b"}`)
+	doRequest(h, "PUT", "/v1/db1/dangling", `{"ref":"/v1/db1/missing"}`)
+	doRequest(h, "PUT", "/v1/db1/c", `{"ref":"/v1/db1/d"}`)
+	doRequest(h, "PUT", "/v1/db1/d", `{"ref":"/v1/db1/c"}`)
+
+	get := func(path string) map[string]any {
+		res := doRequest(h, "GET", path, "")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s but got %d", path, res.StatusCode)
+		}
+		var body struct {
+			Path string         `json:"path"`
+			Doc  map[string]any `json:"doc"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatalf("Could not decode response for %s: %v", path, err)
+		}
+		return body.Doc
+	}
+
+	doc := get("/v1/db1/a?resolve=/ref")
+	if ref, ok := doc["ref"].(map[string]any); !ok || ref["name"] != "b" {
+		t.Errorf("Expected the content of b inlined at /ref but got %v", doc)
+	}
+	if doc = get("/v1/db1/dangling?resolve=/ref"); doc["ref"] != "/v1/db1/missing" {
+		t.Errorf("Expected a dangling reference to be left as it is but got %v", doc)
+	}
+	// documents referencing each other are only resolved so deep
+	doc = get("/v1/db1/c?resolve=/ref")
+	depth := 0
+	for {
+		ref, ok := doc["ref"].(map[string]any)
+		if !ok {
+			break
+		}
+		doc = ref
+		depth++
+	}
+	if depth == 0 || depth > 10 {
+		t.Errorf("Expected a cycle of references to be resolved a bounded number of times but got %d", depth)
+	}
+
+	res := doRequest(h, "GET", "/v1/db1/?resolve=/ref", "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for resolve on a collection but got %d", res.StatusCode)
+	}
+}
+
+// Document names cannot contain "/", since it separates the path segments, so the test groups by "-" instead.
+func TestDelimitedListing(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	for _, name := range []string{"a-x", "a-y", "b", "c-z"} {
+		doRequest(h, "PUT", "/v1/db1/"+name, `{}`)
+	}
+
+	res := doRequest(h, "GET", "/v1/db1/?delimiter=-", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", res.StatusCode)
+	}
+	var body struct {
+		Prefixes  []string `json:"prefixes"`
+		Documents []struct {
+			Path string `json:"path"`
+		} `json:"documents"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("Could not decode response: %v", err)
+	}
+	if !reflect.DeepEqual(body.Prefixes, []string{"a-", "c-"}) {
+		t.Errorf("Expected prefixes a- and c- but got %v", body.Prefixes)
+	}
+	if len(body.Documents) != 1 || body.Documents[0].Path != "/b" {
+		t.Errorf("Expected only the document b but got %v", body.Documents)
+	}
+
+	res = doRequest(h, "GET", "/v1/db1/b?delimiter=-", "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a delimiter on a document but got %d", res.StatusCode)
+	}
+}
+
+func TestVerbosePatch(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"list":[1]}`)
+
+	patch := `[
+		{"op":"ArrayAdd","path":"/list","value":2},
+		{"op":"ArrayAdd","path":"/list","value":1},
+		{"op":"ArrayAdd","path":"/missing","value":1},
+		{"op":"ArrayAdd","path":"/list","value":3}
+	]`
+	res := doRequest(h, "PATCH", "/v1/db1/dc1?verbose=true", patch)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", res.StatusCode)
+	}
+	var body struct {
+		PatchFailed bool `json:"patchFailed"`
+		Operations  []struct {
+			Op      string `json:"op"`
+			Path    string `json:"path"`
+			Result  string `json:"result"`
+			Message string `json:"message"`
+		} `json:"operations"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("Could not decode response: %v", err)
+	}
+	if !body.PatchFailed {
+		t.Errorf("Expected the patch to fail")
+	}
+	expected := []string{"applied", "noop", "failed", "skipped"}
+	if len(body.Operations) != len(expected) {
+		t.Fatalf("Expected %d operation results but got %v", len(expected), body.Operations)
+	}
+	for i, result := range expected {
+		if body.Operations[i].Result != result {
+			t.Errorf("Expected operation %d to be %s but got %v", i, result, body.Operations[i])
+		}
+	}
+	if body.Operations[2].Path != "/missing" || body.Operations[2].Message == "" {
+		t.Errorf("Expected the failed operation to report its path and why it failed but got %v", body.Operations[2])
+	}
+
+	res = doRequest(h, "PATCH", "/v1/db1/dc1", `[{"op":"ArrayAdd","path":"/list","value":2}]`)
+	raw, _ := io.ReadAll(res.Body)
+	if strings.Contains(string(raw), "operations") {
+		t.Errorf("Expected no operation results without verbose but got %s", raw)
+	}
+}
+
+// Subscribers coming and going while events are sent must not break the server or the remaining subscribers.
+func TestSubscriberChurn(t *testing.T) {
+	server := httptest.NewServer(newTestHandler())
+	t.Cleanup(server.Close)
+	h := server.Config.Handler
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	events := subscribe(t, server, "/v1/db1/?mode=subscribe")
+	time.Sleep(50 * time.Millisecond)
+
+	const updates = 50
+	done := make(chan struct{})
+	churned := make(chan struct{})
+	go func() {
+		defer close(churned)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/v1/db1/?mode=subscribe", nil)
+			req.Header.Set("Authorization", "Bearer abc")
+			resp, err := server.Client().Do(req)
+			if err == nil {
+				time.Sleep(time.Millisecond)
+				resp.Body.Close()
+			}
+			cancel()
+		}
+	}()
+
+	for i := 0; i < updates; i++ {
+		doRequest(h, "PUT", "/v1/db1/dc1", fmt.Sprintf(`{"count":%d}`, i))
+	}
+	close(done)
+	<-churned
+
+	for i := 0; i < updates; i++ {
+		event := nextEvent(t, events)
+		if !strings.Contains(event.data, fmt.Sprintf(`"count":%d`, i)) {
+			t.Fatalf("Expected update %d but got %v", i, event)
+		}
+	}
+}
+
+func TestExternalAuth(t *testing.T) {
+	calls := 0
+	validate := func(token string) (string, time.Time, bool) {
+		calls++
+		if token == "external-token" {
+			return "remote", time.Now().Add(time.Hour), true
+		}
+		if token == "expired-token" {
+			return "remote", time.Now().Add(-time.Minute), true
+		}
+		return "", time.Time{}, false
+	}
+	h := newTestHandlerWithAuth(auth.NewExternalAuth(validate))
+
+	res := doRequestAs(h, "external-token", "PUT", "/v1/db1", "")
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201 with a token the provider accepts but got %d", res.StatusCode)
+	}
+	doRequestAs(h, "external-token", "PUT", "/v1/db1/dc1", `{}`)
+	res = doRequestAs(h, "external-token", "GET", "/v1/db1/dc1", "")
+	var body struct {
+		Meta struct {
+			CreatedBy string `json:"createdBy"`
+		} `json:"meta"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("Could not decode response: %v", err)
+	}
+	if body.Meta.CreatedBy != "remote" {
+		t.Errorf("Expected the document created by the provider's user but got %q", body.Meta.CreatedBy)
+	}
+	if calls != 1 {
+		t.Errorf("Expected the provider to be asked once for a cached token but it was asked %d times", calls)
+	}
+
+	for _, token := range []string{"abc", "expired-token"} {
+		res = doRequestAs(h, token, "GET", "/v1/db1/dc1", "")
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 with token %s but got %d", token, res.StatusCode)
+		}
+	}
+
+	res = doRequestAs(h, "external-token", "DELETE", "/auth", "")
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204 logging out but got %d", res.StatusCode)
+	}
+	res = doRequestAs(h, "external-token", "GET", "/v1/db1/dc1", "")
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 after logging out but got %d", res.StatusCode)
+	}
+
+	res = doRequestWithHeaders(h, "POST", "/auth", `{"username":"remote"}`, map[string]string{"Content-Type": "application/json"})
+	if res.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Expected status 501 asking for a token but got %d", res.StatusCode)
+	}
+}
+
+func TestOpaqueContentType(t *testing.T) {
+	h := newTestHandler(handler.WithOpaqueContentTypes("text/plain"))
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	// the body is neither JSON nor an object, as the schema requires
+	headers := map[string]string{"Authorization": "Bearer abc", "Content-Type": "text/plain; charset=utf-8"}
+	res := doRequestWithHeaders(h, "PUT", "/v1/db1/notes", "hello, world", headers)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201 putting a text/plain document but got %d", res.StatusCode)
+	}
+
+	res = doRequest(h, "GET", "/v1/db1/notes", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", res.StatusCode)
+	}
+	if res.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Expected Content-Type text/plain but got %q", res.Header.Get("Content-Type"))
+	}
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "hello, world" {
+		t.Errorf("Expected the document returned as it was put but got %q", body)
+	}
+
+	// listings stay JSON, with the opaque data as a string
+	res = doRequest(h, "GET", "/v1/db1/", "")
+	var docs []map[string]any
+	err := json.NewDecoder(res.Body).Decode(&docs)
+	if err != nil {
+		t.Fatalf("Error unmarshaling listing: %v", err)
+	}
+	if len(docs) != 1 || docs[0]["doc"] != "hello, world" || docs[0]["contentType"] != "text/plain" {
+		t.Errorf("Expected the opaque document rendered as a string but got %v", docs)
+	}
+
+	res = doRequest(h, "PATCH", "/v1/db1/notes", `[{"op":"ObjectAdd","path":"/a","value":1}]`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 patching an opaque document but got %d", res.StatusCode)
+	}
+	res = doRequest(h, "GET", "/v1/db1/notes?pointer=/a", "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a pointer into an opaque document but got %d", res.StatusCode)
+	}
+
+	// putting JSON over it makes it a JSON document again
+	res = doRequest(h, "PUT", "/v1/db1/notes", `{"str":"testing"}`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 overwriting the document but got %d", res.StatusCode)
+	}
+	res = doRequest(h, "GET", "/v1/db1/notes", "")
+	if res.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected Content-Type application/json but got %q", res.Header.Get("Content-Type"))
+	}
+}
+
+func TestDeletedDatabaseTombstone(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	h := newTestHandler(handler.WithTombstones(time.Minute), handler.WithClock(clock))
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"str":"testing"}`)
+	res := doRequest(h, "DELETE", "/v1/db1", "")
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204 deleting the database but got %d", res.StatusCode)
+	}
+
+	now = now.Add(30 * time.Second)
+	res = doRequest(h, "GET", "/v1/db1/doc", "")
+	if res.StatusCode != http.StatusGone {
+		t.Errorf("Expected status 410 within the tombstone window but got %d", res.StatusCode)
+	}
+	if res.Header.Get("Retry-After") != "30" {
+		t.Errorf("Expected Retry-After 30 but got %q", res.Header.Get("Retry-After"))
+	}
+	res = doRequest(h, "GET", "/v1/db2/doc", "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a database that never existed but got %d", res.StatusCode)
+	}
+
+	now = now.Add(time.Minute)
+	res = doRequest(h, "GET", "/v1/db1/doc", "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 after the tombstone expired but got %d", res.StatusCode)
+	}
+
+	// creating the database again clears its tombstone
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "DELETE", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1", "")
+	res = doRequest(h, "GET", "/v1/db1/doc", "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing document of a recreated database but got %d", res.StatusCode)
+	}
+}
+
+func TestPatchPathSegmentLimit(t *testing.T) {
+	log.SetOutput(io.Discard)
+	dbFactory := CollectionFactory(collection.NewCollection[handler.Documenter])
+	docFactory := DocumentFactory(document.NewDocument[handler.Collectioner])
+	compiler := jsonschema.NewCompiler()
+	schema, _ := compiler.Compile("schema1.json")
+	authMap := auth.NewAuth()
+	authMap.AddPair("test", "abc", time.Now().Add(time.Hour))
+	visitorFactory := PatchVisitorFactory(patchvisitors.LimitSegments[handler.PatchOper, handler.PatchOpFactory](3))
+	h := handler.New(dbFactory, docFactory, authMap, schema, skipList.New[string, handler.Collectioner]("databaseList", "", "\U0010FFFF"),
+		PatchOpListVisitorFactory(patchvisitors.NewPatchOpListVisitor), visitorFactory,
+		DocVisitorFactory(patchvisitors.NewDocVisitor), PatchOpFactory(patchvisitors.NewPatchOp))
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"a":{"b":{}}}`)
+
+	res := doRequest(h, "PATCH", "/v1/db1/doc", `[{"op":"ObjectAdd","path":"/a/b/c","value":1}]`)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 for a path within the limit but got %d", res.StatusCode)
+	}
+
+	res = doRequest(h, "PATCH", "/v1/db1/doc", `[{"op":"ObjectAdd","path":"`+strings.Repeat("/a", 1000)+`","value":1}]`)
+	var response map[string]any
+	err := json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		t.Fatalf("Error unmarshaling patch response: %v", err)
+	}
+	message, _ := response["message"].(string)
+	if response["patchFailed"] != true || !strings.Contains(message, "path has too many segments") {
+		t.Errorf("Expected the patch to fail with too many segments but got %v", response)
+	}
+}
+
+func TestDescendingListing(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	for _, name := range []string{"a", "b", "c", "d"} {
+		doRequest(h, "PUT", "/v1/db1/"+name, `{"str":"testing"}`)
+	}
+
+	paths := func(res *http.Response) []string {
+		var docs []docResponse
+		err := json.NewDecoder(res.Body).Decode(&docs)
+		if err != nil {
+			t.Fatalf("Error unmarshaling listing: %v", err)
+		}
+		result := make([]string, 0)
+		for _, doc := range docs {
+			result = append(result, doc.Path)
+		}
+		return result
+	}
+
+	res := doRequest(h, "GET", "/v1/db1/?order=desc", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", res.StatusCode)
+	}
+	if got := paths(res); !reflect.DeepEqual(got, []string{"/d", "/c", "/b", "/a"}) {
+		t.Errorf("Expected descending order [/d /c /b /a] but got %v", got)
+	}
+	res = doRequest(h, "GET", "/v1/db1/?order=asc", "")
+	if got := paths(res); !reflect.DeepEqual(got, []string{"/a", "/b", "/c", "/d"}) {
+		t.Errorf("Expected ascending order [/a /b /c /d] but got %v", got)
+	}
+	res = doRequest(h, "GET", "/v1/db1/?order=desc&interval=[a,b]", "")
+	if got := paths(res); !reflect.DeepEqual(got, []string{"/b", "/a"}) {
+		t.Errorf("Expected [/b /a] but got %v", got)
+	}
+
+	// the listing cap keeps the first documents in the order asked for
+	capped := newTestHandler(handler.WithListingCap(2))
+	doRequest(capped, "PUT", "/v1/db1", "")
+	for _, name := range []string{"a", "b", "c", "d"} {
+		doRequest(capped, "PUT", "/v1/db1/"+name, `{"str":"testing"}`)
+	}
+	res = doRequest(capped, "GET", "/v1/db1/?order=desc", "")
+	if got := paths(res); !reflect.DeepEqual(got, []string{"/d", "/c"}) {
+		t.Errorf("Expected the capped listing [/d /c] but got %v", got)
+	}
+
+	res = doRequest(h, "GET", "/v1/db1/?order=down", "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown order but got %d", res.StatusCode)
+	}
+}
+
+func TestUniquePost(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	res := doRequest(h, "POST", "/v1/db1/?unique=/email", `{"email":"a@example.com"}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201 for the first document but got %d", res.StatusCode)
+	}
+	res = doRequest(h, "POST", "/v1/db1/?unique=/email", `{"email":"a@example.com","name":"other"}`)
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 for a duplicate email but got %d", res.StatusCode)
+	}
+	res = doRequest(h, "POST", "/v1/db1/?unique=/email", `{"email":"b@example.com"}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("Expected status 201 for a different email but got %d", res.StatusCode)
+	}
+	// without ?unique duplicates are allowed
+	res = doRequest(h, "POST", "/v1/db1/", `{"email":"a@example.com"}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("Expected status 201 without unique but got %d", res.StatusCode)
+	}
+
+	res = doRequest(h, "POST", "/v1/db1/?unique=email", `{"email":"c@example.com"}`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a unique that is not a pointer but got %d", res.StatusCode)
+	}
+}
+
+func TestPatchTestOperation(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"version":1,"tags":["a","b"],"owner":{"name":"x"}}`)
+
+	patch := func(body string) map[string]any {
+		res := doRequest(h, "PATCH", "/v1/db1/doc", body)
+		var response map[string]any
+		err := json.NewDecoder(res.Body).Decode(&response)
+		if err != nil {
+			t.Fatalf("Error unmarshaling patch response: %v", err)
+		}
+		return response
+	}
+
+	response := patch(`[{"op":"Test","path":"/version","value":1},{"op":"Test","path":"/tags/1","value":"b"},` +
+		`{"op":"Test","path":"/owner","value":{"name":"x"}},{"op":"ObjectAdd","path":"/checked","value":true}]`)
+	if response["patchFailed"] != false {
+		t.Errorf("Expected the tests to pass but got %v", response)
+	}
+
+	response = patch(`[{"op":"Test","path":"/version","value":2},{"op":"ObjectAdd","path":"/stale","value":true}]`)
+	if response["patchFailed"] != true || response["message"] != "error applying patches: test failed at path /version" {
+		t.Errorf("Expected the test to fail at /version but got %v", response)
+	}
+	response = patch(`[{"op":"Test","path":"/missing","value":1}]`)
+	if response["patchFailed"] != true || response["message"] != "error applying patches: test failed at path /missing" {
+		t.Errorf("Expected the test to fail at /missing but got %v", response)
+	}
+
+	res := doRequest(h, "GET", "/v1/db1/doc", "")
+	var doc struct {
+		Doc map[string]any `json:"doc"`
+	}
+	err := json.NewDecoder(res.Body).Decode(&doc)
+	if err != nil {
+		t.Fatalf("Error unmarshaling document: %v", err)
+	}
+	data := doc.Doc
+	if data["checked"] != true || data["stale"] != nil {
+		t.Errorf("Expected only the patch with passing tests applied but got %v", data)
+	}
+}
+
+// trackingReader is a request body that records whether the handler read from it.
+type trackingReader struct {
+	body *strings.Reader
+	read bool
+}
+
+func (r *trackingReader) Read(p []byte) (int, error) {
+	r.read = true
+	return r.body.Read(p)
+}
+
+func TestRejectBeforeReadingBody(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	large := `{"str":"` + strings.Repeat("x", 1<<20) + `"}`
+
+	send := func(method string, path string, headers map[string]string) (int, bool) {
+		body := &trackingReader{body: strings.NewReader(large)}
+		req := httptest.NewRequest(method, path, body)
+		req.Header.Set("Expect", "100-continue")
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code, body.read
+	}
+
+	code, read := send("PUT", "/v1/db1/doc", map[string]string{"Content-Type": "application/json"})
+	if code != http.StatusUnauthorized || read {
+		t.Errorf("Expected an unauthorized PUT rejected with 401 before reading the body but got %d, body read %t", code, read)
+	}
+	code, read = send("PUT", "/v1/db1/doc", map[string]string{"Authorization": "Bearer abc", "Content-Type": "text/html"})
+	if code != http.StatusBadRequest || read {
+		t.Errorf("Expected a PUT with a bad content type rejected with 400 before reading the body but got %d, body read %t", code, read)
+	}
+	code, read = send("POST", "/v1/db1/", map[string]string{"Authorization": "Bearer abc", "Content-Type": "text/html"})
+	if code != http.StatusBadRequest || read {
+		t.Errorf("Expected a POST with a bad content type rejected with 400 before reading the body but got %d, body read %t", code, read)
+	}
+	code, read = send("PUT", "/v1/db1/doc", map[string]string{"Authorization": "Bearer abc", "Content-Type": "application/json"})
+	if code != http.StatusCreated || !read {
+		t.Errorf("Expected a valid PUT to read the body and return 201 but got %d, body read %t", code, read)
+	}
+}
+
+func TestPostIDFormats(t *testing.T) {
+	post := func(h http.Handler) string {
+		res := doRequest(h, "POST", "/v1/db1/", `{"str":"testing"}`)
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201 but got %d", res.StatusCode)
+		}
+		var response map[string]string
+		json.NewDecoder(res.Body).Decode(&response)
+		return strings.TrimPrefix(response["uri"], "/v1/db1/")
+	}
+
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	name := post(h)
+	if millis, err := strconv.ParseInt(name, 10, 64); err != nil || time.Since(time.UnixMilli(millis)) > time.Minute {
+		t.Errorf("Expected a millisecond timestamp but got %q", name)
+	}
+
+	h = newTestHandler(handler.WithIDFormat(handler.IDUUID))
+	doRequest(h, "PUT", "/v1/db1", "")
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	first, second := post(h), post(h)
+	if !uuid.MatchString(first) || !uuid.MatchString(second) || first == second {
+		t.Errorf("Expected two distinct version 4 UUIDs but got %q and %q", first, second)
+	}
+
+	h = newTestHandler(handler.WithIDFormat(handler.IDCounter))
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/2", `{"str":"taken"}`)
+	doRequest(h, "PUT", "/v1/db2", "")
+	names := []string{post(h), post(h), post(h)}
+	// the name 2 is taken, so the counter moves past it
+	if !reflect.DeepEqual(names, []string{"1", "3", "4"}) {
+		t.Errorf("Expected the counter names [1 3 4] but got %v", names)
+	}
+	res := doRequest(h, "POST", "/v1/db2/", `{"str":"testing"}`)
+	var response map[string]string
+	json.NewDecoder(res.Body).Decode(&response)
+	if response["uri"] != "/v1/db2/1" {
+		t.Errorf("Expected every collection to count on its own but got %q", response["uri"])
+	}
+}
+
+func TestPatchArrayInsert(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"list":["b","d"]}`)
+
+	patch := func(body string) map[string]any {
+		res := doRequest(h, "PATCH", "/v1/db1/doc", body)
+		var response map[string]any
+		err := json.NewDecoder(res.Body).Decode(&response)
+		if err != nil {
+			t.Fatalf("Error unmarshaling patch response: %v", err)
+		}
+		return response
+	}
+
+	// head, middle and tail
+	response := patch(`[{"op":"ArrayInsert","path":"/list/0","value":"a"},{"op":"ArrayInsert","path":"/list/2","value":"c"},` +
+		`{"op":"ArrayInsert","path":"/list/4","value":"e"},{"op":"ArrayInsert","path":"/list/5","value":"a"}]`)
+	if response["patchFailed"] != false {
+		t.Errorf("Expected the inserts to succeed but got %v", response)
+	}
+	res := doRequest(h, "GET", "/v1/db1/doc", "")
+	var doc struct {
+		Doc map[string]any `json:"doc"`
+	}
+	json.NewDecoder(res.Body).Decode(&doc)
+	if !reflect.DeepEqual(doc.Doc["list"], []any{"a", "b", "c", "d", "e", "a"}) {
+		t.Errorf("Expected [a b c d e a] but got %v", doc.Doc["list"])
+	}
+
+	response = patch(`[{"op":"ArrayInsert","path":"/list/7","value":"x"}]`)
+	if response["patchFailed"] != true || response["message"] != "error applying patches: insert index exceeds array length" {
+		t.Errorf("Expected an out of bounds insert to fail but got %v", response)
+	}
+	response = patch(`[{"op":"ArrayInsert","path":"/list","value":"x"}]`)
+	if response["patchFailed"] != true {
+		t.Errorf("Expected an insert without an index to fail but got %v", response)
+	}
+}
+
+func TestPatchMove(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"user":{"name":"ann","address":{"city":"x"}},"list":[{"a":1},{"b":2}]}`)
+
+	patch := func(body string) map[string]any {
+		res := doRequest(h, "PATCH", "/v1/db1/doc", body)
+		var response map[string]any
+		err := json.NewDecoder(res.Body).Decode(&response)
+		if err != nil {
+			t.Fatalf("Error unmarshaling patch response: %v", err)
+		}
+		return response
+	}
+	get := func() map[string]any {
+		res := doRequest(h, "GET", "/v1/db1/doc", "")
+		var doc struct {
+			Doc map[string]any `json:"doc"`
+		}
+		json.NewDecoder(res.Body).Decode(&doc)
+		return doc.Doc
+	}
+
+	response := patch(`[{"op":"Move","from":"/user/address","path":"/address"},` +
+		`{"op":"Move","from":"/list/0","path":"/user/first"}]`)
+	if response["patchFailed"] != false {
+		t.Fatalf("Expected the moves to succeed but got %v", response)
+	}
+	want := map[string]any{
+		"user":    map[string]any{"name": "ann", "first": map[string]any{"a": float64(1)}},
+		"address": map[string]any{"city": "x"},
+		"list":    []any{map[string]any{"b": float64(2)}},
+	}
+	if doc := get(); !reflect.DeepEqual(doc, want) {
+		t.Errorf("Expected %v but got %v", want, doc)
+	}
+
+	for body, message := range map[string]string{
+		`[{"op":"Move","from":"/missing","path":"/x"}]`:        "error applying patches: nothing to move at path /missing",
+		`[{"op":"Move","from":"/user","path":"/address"}]`:     "error applying patches: cannot move onto existing key at path /address",
+		`[{"op":"Move","from":"/user","path":"/user/inner"}]`:  "error applying patches: cannot move /user into itself",
+		`[{"op":"Move","from":"/user/name","path":"/list/0"}]`: "error applying patches: Move path must end in an object key",
+		`[{"op":"Move","path":"/x"}]`:                          "patch operation missing \"from\" property",
+		`[{"op":"Move","from":5,"path":"/x"}]`:                 "value of \"from\" property not string",
+	} {
+		response := patch(body)
+		if response["patchFailed"] != true || response["message"] != message {
+			t.Errorf("Expected %s to fail with %q but got %v", body, message, response)
+		}
+	}
+	if doc := get(); !reflect.DeepEqual(doc, want) {
+		t.Errorf("Expected failed moves to leave the document as %v but got %v", want, doc)
+	}
+}
+
+func TestPatchDryRun(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"list":["a"]}`)
+	etag := doRequest(h, "GET", "/v1/db1/doc", "").Header.Get("ETag")
+
+	patch := func(path string, body string) (*http.Response, map[string]any) {
+		res := doRequest(h, "PATCH", path, body)
+		var response map[string]any
+		err := json.NewDecoder(res.Body).Decode(&response)
+		if err != nil {
+			t.Fatalf("Error unmarshaling patch response: %v", err)
+		}
+		return res, response
+	}
+	unchanged := func() {
+		res := doRequest(h, "GET", "/v1/db1/doc", "")
+		var doc struct {
+			Doc map[string]any `json:"doc"`
+		}
+		json.NewDecoder(res.Body).Decode(&doc)
+		if !reflect.DeepEqual(doc.Doc, map[string]any{"list": []any{"a"}}) || res.Header.Get("ETag") != etag {
+			t.Errorf("Expected the dry run to leave the document unchanged but got %v", doc.Doc)
+		}
+	}
+
+	res, response := patch("/v1/db1/doc?dryRun=true", `[{"op":"ArrayAdd","path":"/list","value":"b"}]`)
+	if res.StatusCode != http.StatusOK || response["patchFailed"] != false {
+		t.Errorf("Expected a successful dry run but got %d %v", res.StatusCode, response)
+	}
+	if !reflect.DeepEqual(response["doc"], map[string]any{"list": []any{"a", "b"}}) {
+		t.Errorf("Expected the patched document in the response but got %v", response["doc"])
+	}
+	unchanged()
+
+	_, response = patch("/v1/db1/doc?dryRun=true", `[{"op":"ArrayAdd","path":"/missing","value":"b"}]`)
+	if response["patchFailed"] != true || response["doc"] != nil {
+		t.Errorf("Expected a failed dry run without a document but got %v", response)
+	}
+	unchanged()
+
+	res, response = patch("/v1/db1/new?dryRun=true&mode=upsert", `[{"op":"ObjectAdd","path":"/a","value":1}]`)
+	if res.StatusCode != http.StatusOK || !reflect.DeepEqual(response["doc"], map[string]any{"a": float64(1)}) {
+		t.Errorf("Expected a dry run upsert to return the new document but got %d %v", res.StatusCode, response)
+	}
+	if res := doRequest(h, "GET", "/v1/db1/new", ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a dry run upsert not to create the document but got %d", res.StatusCode)
+	}
+
+	if res := doRequest(h, "PATCH", "/v1/db1/doc?dryRun=yes", `[]`); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a malformed dryRun but got %d", res.StatusCode)
+	}
+	_, response = patch("/v1/db1/doc", `[{"op":"ArrayAdd","path":"/list","value":"b"}]`)
+	if response["doc"] != nil {
+		t.Errorf("Expected no document in the response of a real patch but got %v", response["doc"])
+	}
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	compiler := jsonschema.NewCompiler()
+	err := compiler.AddResource("strict.json", strings.NewReader(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string"},
+			"age": {"type": "integer", "minimum": 0}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("Could not add schema: %v", err)
+	}
+	schema, err := compiler.Compile("strict.json")
+	if err != nil {
+		t.Fatalf("Could not compile schema: %v", err)
+	}
+	dbFactory := CollectionFactory(collection.NewCollection[handler.Documenter])
+	docFactory := DocumentFactory(document.NewDocument[handler.Collectioner])
+	h := newTestHandlerWithSchema(dbFactory, docFactory, schema)
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	res := doRequest(h, "POST", "/v1/db1/:validate", `{"name":"x","age":3}`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", res.StatusCode)
+	}
+	var response struct {
+		Valid  bool  `json:"valid"`
+		Errors []any `json:"errors"`
+	}
+	json.NewDecoder(res.Body).Decode(&response)
+	if !response.Valid || len(response.Errors) != 0 {
+		t.Errorf("Expected the document to be valid but got %+v", response)
+	}
+
+	res = doRequest(h, "POST", "/v1/db1/:validate", `{"name":1,"age":-1}`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", res.StatusCode)
+	}
+	response.Errors = nil
+	json.NewDecoder(res.Body).Decode(&response)
+	if response.Valid || len(response.Errors) != 2 {
+		t.Errorf("Expected the document to be invalid with 2 violations but got %+v", response)
+	}
+
+	// nothing was created
+	res = doRequest(h, "GET", "/v1/db1/", "")
+	var docs []any
+	json.NewDecoder(res.Body).Decode(&docs)
+	if len(docs) != 0 {
+		t.Errorf("Expected validating to create no documents but got %v", docs)
+	}
+
+	res = doRequest(h, "POST", "/v1/db2/:validate", `{"name":"x"}`)
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing database but got %d", res.StatusCode)
+	}
+	res = doRequest(h, "POST", "/v1/db1/:validate", `{"name":`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a body that is not JSON but got %d", res.StatusCode)
+	}
+}
+
+func TestBulkPut(t *testing.T) {
+	compiler := jsonschema.NewCompiler()
+	err := compiler.AddResource("strict.json", strings.NewReader(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string"},
+			"age": {"type": "integer", "minimum": 0}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("Could not add schema: %v", err)
+	}
+	schema, err := compiler.Compile("strict.json")
+	if err != nil {
+		t.Fatalf("Could not compile schema: %v", err)
+	}
+	dbFactory := CollectionFactory(collection.NewCollection[handler.Documenter])
+	docFactory := DocumentFactory(document.NewDocument[handler.Collectioner])
+	h := newTestHandlerWithSchema(dbFactory, docFactory, schema)
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/b", `{"name":"old"}`)
+
+	res := doRequest(h, "POST", "/v1/db1/?mode=bulk", `[
+		{"name":"a","doc":{"name":"x","age":1}},
+		{"name":"b","doc":{"name":"y"}},
+		{"name":"c","doc":{"age":-1}},
+		{"name":"d"},
+		{"name":"","doc":{}},
+		{"name":"e","doc":{"age":2}}
+	]`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", res.StatusCode)
+	}
+	var results []struct {
+		Name   string          `json:"name"`
+		Status string          `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&results)
+	if err != nil {
+		t.Fatalf("Error unmarshaling bulk results: %v", err)
+	}
+	expected := []string{"created", "updated", "failed", "failed", "failed", "created"}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results but got %d", len(expected), len(results))
+	}
+	for i, status := range expected {
+		if results[i].Status != status {
+			t.Errorf("Expected item %d to be %s but got %s", i, status, results[i].Status)
+		}
+		if (status == "failed") != (len(results[i].Error) > 0) {
+			t.Errorf("Expected an error only for failed item %d but got %s", i, results[i].Error)
+		}
+	}
+	var violations []string
+	if json.Unmarshal(results[2].Error, &violations) != nil || len(violations) != 1 {
+		t.Errorf("Expected the schema violation of item 2 but got %s", results[2].Error)
+	}
+
+	for name, expected := range map[string]string{"a": "x", "b": "y"} {
+		res = doRequest(h, "GET", "/v1/db1/"+name, "")
+		var doc struct {
+			Doc map[string]any `json:"doc"`
+		}
+		json.NewDecoder(res.Body).Decode(&doc)
+		if doc.Doc["name"] != expected {
+			t.Errorf("Expected /%s to have name %s but got %v", name, expected, doc.Doc)
+		}
+	}
+	res = doRequest(h, "GET", "/v1/db1/c", "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the invalid item not to be put but got %d", res.StatusCode)
+	}
+
+	for _, test := range []struct {
+		path   string
+		body   string
+		status int
+	}{
+		{"/v1/db1/?mode=bulk", `{"name":"a"}`, http.StatusBadRequest},
+		{"/v1/db1/?mode=bulk&unique=/name", `[]`, http.StatusBadRequest},
+		{"/v1/db1/?mode=other", `[]`, http.StatusBadRequest},
+		{"/v1/db1/missing/col/?mode=bulk", `[]`, http.StatusNotFound},
+	} {
+		res = doRequest(h, "POST", test.path, test.body)
+		if res.StatusCode != test.status {
+			t.Errorf("Expected status %d for %s but got %d", test.status, test.path, res.StatusCode)
+		}
+	}
+}
+
+func TestPartialBulkPut(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	res := doRequest(h, "POST", "/v1/db1/?mode=partial", `[
+		{"name":"a","doc":{"str":"a"}},
+		{"name":"_b","doc":{"str":"b"}},
+		{"name":"c","doc":{"str":"c"}}
+	]`)
+	if res.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("Expected status 207 but got %d", res.StatusCode)
+	}
+	var results []struct {
+		Name   string          `json:"name"`
+		Status string          `json:"status"`
+		Code   int             `json:"code"`
+		Error  json.RawMessage `json:"error"`
+	}
+	err := json.NewDecoder(res.Body).Decode(&results)
+	if err != nil {
+		t.Fatalf("Error unmarshaling partial results: %v", err)
+	}
+	expected := []int{http.StatusCreated, http.StatusBadRequest, http.StatusCreated}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results but got %d", len(expected), len(results))
+	}
+	for i, code := range expected {
+		if results[i].Code != code {
+			t.Errorf("Expected item %d to have status %d but got %d", i, code, results[i].Code)
+		}
+	}
+	if len(results[1].Error) == 0 {
+		t.Error("Expected a message for the failed item")
+	}
+
+	for _, name := range []string{"a", "c"} {
+		res = doRequest(h, "GET", "/v1/db1/"+name, "")
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Expected /%s to be created but got %d", name, res.StatusCode)
+		}
+	}
+}
+
+func TestInvertedInterval(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/a", `{"str":"testing"}`)
+
+	res := doRequest(h, "GET", "/v1/db1/?interval=[z,a]", "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an inverted interval but got %d", res.StatusCode)
+	}
+	var message string
+	json.NewDecoder(res.Body).Decode(&message)
+	if message != "interval start must not exceed end" {
+		t.Errorf("Expected the inverted interval message but got %q", message)
+	}
+	res = doRequest(h, "GET", "/v1/db1/?interval=[z,a]&mode=subscribe", "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 subscribing with an inverted interval but got %d", res.StatusCode)
+	}
+
+	// equal bounds and an open end are not inverted
+	res = doRequest(h, "GET", "/v1/db1/?interval=[a,a]", "")
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 for equal bounds but got %d", res.StatusCode)
+	}
+	res = doRequest(h, "GET", "/v1/db1/?interval=[z,]", "")
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 for an open end but got %d", res.StatusCode)
+	}
+}
+
+func TestPatchIncrement(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"count":1,"stats":{"views":10,"scores":[1,2]},"name":"x","none":null}`)
+
+	patch := func(body string) map[string]any {
+		res := doRequest(h, "PATCH", "/v1/db1/doc", body)
+		var response map[string]any
+		err := json.NewDecoder(res.Body).Decode(&response)
+		if err != nil {
+			t.Fatalf("Error unmarshaling patch response: %v", err)
+		}
+		return response
+	}
+
+	response := patch(`[{"op":"Increment","path":"/count","value":1},{"op":"Increment","path":"/stats/views","value":-2.5},` +
+		`{"op":"Increment","path":"/stats/scores/1","value":3}]`)
+	if response["patchFailed"] != false {
+		t.Errorf("Expected the increments to succeed but got %v", response)
+	}
+	res := doRequest(h, "GET", "/v1/db1/doc", "")
+	var doc struct {
+		Doc map[string]any `json:"doc"`
+	}
+	json.NewDecoder(res.Body).Decode(&doc)
+	stats, _ := doc.Doc["stats"].(map[string]any)
+	if doc.Doc["count"] != 2.0 || stats["views"] != 7.5 || !reflect.DeepEqual(stats["scores"], []any{1.0, 5.0}) {
+		t.Errorf("Expected count 2, views 7.5 and scores [1 5] but got %v", doc.Doc)
+	}
+
+	response = patch(`[{"op":"Increment","path":"/name","value":1}]`)
+	if response["patchFailed"] != true || response["message"] != "error applying patches: cannot increment non-number at path /name" {
+		t.Errorf("Expected incrementing a string to fail but got %v", response)
+	}
+	response = patch(`[{"op":"Increment","path":"/none","value":1}]`)
+	if response["patchFailed"] != true {
+		t.Errorf("Expected incrementing null to fail but got %v", response)
+	}
+	response = patch(`[{"op":"Increment","path":"/count","value":"1"}]`)
+	if response["patchFailed"] != true || response["message"] != "error applying patches: increment value must be a number" {
+		t.Errorf("Expected a non-number increment to fail but got %v", response)
+	}
+
+	// concurrent increments are not lost
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doRequest(h, "PATCH", "/v1/db1/doc", `[{"op":"Increment","path":"/count","value":1}]`)
+		}()
+	}
+	wg.Wait()
+	res = doRequest(h, "GET", "/v1/db1/doc", "")
+	json.NewDecoder(res.Body).Decode(&doc)
+	if doc.Doc["count"] != 52.0 {
+		t.Errorf("Expected count 52 after concurrent increments but got %v", doc.Doc["count"])
+	}
+}
+
+func TestPatchRejectsNonFiniteNumbers(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"big":1.7e308}`)
+
+	res := doRequest(h, "PATCH", "/v1/db1/doc", `[{"op":"Increment","path":"/big","value":1.7e308}]`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 for an infinite result but got %d", res.StatusCode)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if strings.TrimSpace(string(body)) != `"numbers must be finite"` {
+		t.Errorf("Expected the infinite number to be reported but got %s", body)
+	}
+
+	res = doRequest(h, "GET", "/v1/db1/doc", "")
+	var doc struct {
+		Doc map[string]any `json:"doc"`
+	}
+	json.NewDecoder(res.Body).Decode(&doc)
+	if doc.Doc["big"] != 1.7e308 {
+		t.Errorf("Expected the document to be unchanged but got %v", doc.Doc)
+	}
+
+	res = doRequest(h, "PUT", "/v1/db1/other", `{"big":1e999}`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an out of range number but got %d", res.StatusCode)
+	}
+}
+
+func TestSubscribeMetadataPayload(t *testing.T) {
+	server := httptest.NewServer(newTestHandler())
+	t.Cleanup(server.Close)
+	h := server.Config.Handler
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/dc1", `{"secret":1}`)
+
+	events := subscribe(t, server, "/v1/db1/?mode=subscribe&payload=metadata")
+	full := subscribe(t, server, "/v1/db1/?mode=subscribe")
+
+	// the snapshot
+	event := nextEvent(t, events)
+	var data map[string]any
+	err := json.Unmarshal([]byte(event.data), &data)
+	if err != nil {
+		t.Fatalf("Error unmarshaling event data %q: %v", event.data, err)
+	}
+	if data["path"] != "/dc1" || data["meta"] == nil || data["doc"] != nil {
+		t.Errorf("Expected the snapshot with metadata but no document but got %v", data)
+	}
+	nextEvent(t, full)
+
+	doRequest(h, "PUT", "/v1/db1/dc2", `{"secret":2}`)
+	event = nextEvent(t, events)
+	data = nil
+	err = json.Unmarshal([]byte(event.data), &data)
+	if err != nil {
+		t.Fatalf("Error unmarshaling event data %q: %v", event.data, err)
+	}
+	meta, _ := data["meta"].(map[string]any)
+	if event.event != "update" || data["path"] != "/dc2" || meta["createdBy"] != "test" || data["doc"] != nil {
+		t.Errorf("Expected an update with metadata but no document but got %v", event)
+	}
+	// other subscribers still get the document
+	event = nextEvent(t, full)
+	if !strings.Contains(event.data, `"secret":2`) {
+		t.Errorf("Expected the full document for a subscriber without payload=metadata but got %v", event)
+	}
+
+	res := doRequest(h, "GET", "/v1/db1/dc1?payload=metadata", "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for payload without subscribe but got %d", res.StatusCode)
+	}
+}
+
+func TestPatchOpsApplied(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"list":[]}`)
+
+	patch := func(body string) map[string]any {
+		res := doRequest(h, "PATCH", "/v1/db1/doc", body)
+		var response map[string]any
+		err := json.NewDecoder(res.Body).Decode(&response)
+		if err != nil {
+			t.Fatalf("Error unmarshaling patch response: %v", err)
+		}
+		return response
+	}
+
+	response := patch(`[{"op":"ObjectAdd","path":"/a","value":1},{"op":"ArrayAdd","path":"/list","value":2},` +
+		`{"op":"ObjectAdd","path":"/a","value":1}]`)
+	if response["patchFailed"] != false || response["opsApplied"] != float64(3) {
+		t.Errorf("Expected all 3 operations applied but got %v", response)
+	}
+
+	response = patch(`[{"op":"ObjectAdd","path":"/b","value":1},{"op":"ArrayAdd","path":"/missing","value":2},` +
+		`{"op":"ObjectAdd","path":"/c","value":1}]`)
+	if response["patchFailed"] != true || response["opsApplied"] != float64(1) {
+		t.Errorf("Expected 1 operation applied before the failure but got %v", response)
+	}
+}
+
+func TestHeadDocument(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"a":1}`)
+	doRequest(h, "PUT", "/v1/db1/doc/col/", "")
+
+	res := doRequest(h, "HEAD", "/v1/db1/doc", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 for an existing document but got %d", res.StatusCode)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if len(body) != 0 {
+		t.Errorf("Expected no body but got %q", body)
+	}
+	lastModified, err := http.ParseTime(res.Header.Get("Last-Modified"))
+	if err != nil || time.Since(lastModified) > time.Minute {
+		t.Errorf("Expected a recent Last-Modified header but got %q", res.Header.Get("Last-Modified"))
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/v1/db1/missing", http.StatusNotFound},
+		{"/v1/db1/missing/col/doc", http.StatusNotFound},
+		{"/v1/db2/doc", http.StatusNotFound},
+		{"/v1/db1/doc/col/", http.StatusBadRequest},
+		{"/v1/db1/", http.StatusBadRequest},
+		{"/v1/db1", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		res := doRequest(h, "HEAD", test.path, "")
+		if res.StatusCode != test.status {
+			t.Errorf("Expected status %d for HEAD %s but got %d", test.status, test.path, res.StatusCode)
+		}
+	}
+}
+
+func TestPutIfMatch(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	ifMatch := func(etag string) map[string]string {
+		return map[string]string{"Authorization": "Bearer abc", "Content-Type": "application/json", "If-Match": etag}
+	}
+	res := doRequest(h, "PUT", "/v1/db1/doc", `{"version":1}`)
+	created := res.Header.Get("ETag")
+	if created == "" {
+		t.Fatalf("Expected an ETag header on PUT")
+	}
+
+	res = doRequest(h, "GET", "/v1/db1/doc", "")
+	if res.Header.Get("ETag") != created {
+		t.Errorf("Expected GET to return ETag %s but got %s", created, res.Header.Get("ETag"))
+	}
+
+	res = doRequestWithHeaders(h, "PUT", "/v1/db1/doc", `{"version":2}`, ifMatch(created))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 for a fresh If-Match but got %d", res.StatusCode)
+	}
+	updated := res.Header.Get("ETag")
+	if updated == "" || updated == created {
+		t.Errorf("Expected a new ETag after the update but got %q", updated)
+	}
+
+	// the first writer's tag is now stale
+	res = doRequestWithHeaders(h, "PUT", "/v1/db1/doc", `{"version":3}`, ifMatch(created))
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected status 412 for a stale If-Match but got %d", res.StatusCode)
+	}
+	res = doRequest(h, "GET", "/v1/db1/doc", "")
+	var doc struct {
+		Doc map[string]any `json:"doc"`
+	}
+	err := json.NewDecoder(res.Body).Decode(&doc)
+	if err != nil {
+		t.Fatalf("Error unmarshaling document: %v", err)
+	}
+	if doc.Doc["version"] != float64(2) {
+		t.Errorf("Expected the stale write to be rejected but got %v", doc.Doc)
+	}
+
+	res = doRequestWithHeaders(h, "PUT", "/v1/db1/doc", `{"version":3}`, ifMatch(`"other", `+updated))
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 when any listed ETag matches but got %d", res.StatusCode)
+	}
+	res = doRequestWithHeaders(h, "PUT", "/v1/db1/missing", `{}`, ifMatch("*"))
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected status 412 for If-Match on a missing document but got %d", res.StatusCode)
+	}
+}
+
+func TestSubscribeRetryHint(t *testing.T) {
+	tests := []struct {
+		opts  []handler.Option
+		first string
+	}{
+		{nil, "retry: 3000"},
+		{[]handler.Option{handler.WithSSERetry(1500 * time.Millisecond)}, "retry: 1500"},
+		{[]handler.Option{handler.WithSSERetry(0)}, "event: update"},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(newTestHandler(test.opts...))
+		h := server.Config.Handler
+		doRequest(h, "PUT", "/v1/db1", "")
+		doRequest(h, "PUT", "/v1/db1/doc", `{"a":1}`)
+
+		req, _ := http.NewRequest("GET", server.URL+"/v1/db1/doc?mode=subscribe", nil)
+		req.Header.Set("Authorization", "Bearer abc")
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Error subscribing: %v", err)
+		}
+		line, err := bufio.NewReader(resp.Body).ReadString('\n')
+		if err != nil || strings.TrimSpace(line) != test.first {
+			t.Errorf("Expected the stream to start with %q but got %q (%v)", test.first, line, err)
+		}
+		resp.Body.Close()
+		server.Close()
+	}
+}
+
+func TestDeleteIfMatch(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	etag := doRequest(h, "PUT", "/v1/db1/doc", `{"version":1}`).Header.Get("ETag")
+	doRequest(h, "PUT", "/v1/db1/other", `{"version":1}`)
+
+	ifMatch := func(etag string) map[string]string {
+		return map[string]string{"Authorization": "Bearer abc", "If-Match": etag}
+	}
+
+	doRequest(h, "PUT", "/v1/db1/doc", `{"version":2}`)
+	res := doRequestWithHeaders(h, "DELETE", "/v1/db1/doc", "", ifMatch(etag))
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected status 412 for a stale If-Match but got %d", res.StatusCode)
+	}
+	res = doRequest(h, "GET", "/v1/db1/doc", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the document to survive a stale delete but got %d", res.StatusCode)
+	}
+
+	res = doRequestWithHeaders(h, "DELETE", "/v1/db1/doc", "", ifMatch(res.Header.Get("ETag")))
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204 for a matching If-Match but got %d", res.StatusCode)
+	}
+	res = doRequest(h, "GET", "/v1/db1/doc", "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the document to be deleted but got %d", res.StatusCode)
+	}
+
+	res = doRequest(h, "DELETE", "/v1/db1/other", "")
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204 for a delete without If-Match but got %d", res.StatusCode)
+	}
+}
+
+func TestCollectionTree(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/a", `{"secret":"a"}`)
+	doRequest(h, "PUT", "/v1/db1/b", `{"secret":"b"}`)
+	doRequest(h, "PUT", "/v1/db1/a/col1/", "")
+	doRequest(h, "PUT", "/v1/db1/a/col2/", "")
+	doRequest(h, "PUT", "/v1/db1/a/col1/c", `{"secret":"c"}`)
+	doRequest(h, "PUT", "/v1/db1/a/col1/c/deep/", "")
+	doRequest(h, "PUT", "/v1/db1/a/col1/c/deep/d", `{"secret":"d"}`)
+
+	res := doRequest(h, "GET", "/v1/db1/?mode=tree", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 for a tree but got %d", res.StatusCode)
+	}
+	body, _ := io.ReadAll(res.Body)
+	expected := `[{"name":"a","collections":[{"name":"col1","documents":[{"name":"c","collections":[` +
+		`{"name":"deep","documents":[{"name":"d"}]}]}]},{"name":"col2","documents":[]}]},{"name":"b"}]`
+	if string(body) != expected {
+		t.Errorf("Expected tree %s but got %s", expected, body)
+	}
+
+	res = doRequest(h, "GET", "/v1/db1/?mode=tree&depth=2", "")
+	body, _ = io.ReadAll(res.Body)
+	expected = `[{"name":"a","collections":[{"name":"col1","documents":[{"name":"c","truncated":true}]},` +
+		`{"name":"col2","documents":[]}]},{"name":"b"}]`
+	if string(body) != expected {
+		t.Errorf("Expected tree cut off at depth 2 %s but got %s", expected, body)
+	}
+
+	tests := []string{"/v1/db1/a?mode=tree", "/v1/db1/?mode=tree&depth=0", "/v1/db1/?mode=tree&depth=x",
+		"/v1/db1/?depth=2"}
+	for _, path := range tests {
+		res := doRequest(h, "GET", path, "")
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s but got %d", path, res.StatusCode)
+		}
+	}
+}
+
+func TestGzipResponses(t *testing.T) {
+	server := httptest.NewServer(newTestHandler())
+	t.Cleanup(server.Close)
+	h := server.Config.Handler
+	doRequest(h, "PUT", "/v1/db1", "")
+	for i := 0; i < 20; i++ {
+		doRequest(h, "PUT", fmt.Sprintf("/v1/db1/doc%d", i), `{"str":"a fairly repetitive document body"}`)
+	}
+
+	plain := doRequest(h, "GET", "/v1/db1/", "")
+	expected, _ := io.ReadAll(plain.Body)
+	if plain.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Expected no compression without Accept-Encoding but got %q", plain.Header.Get("Content-Encoding"))
+	}
+
+	headers := map[string]string{"Authorization": "Bearer abc", "Accept-Encoding": "gzip, deflate"}
+	res := doRequestWithHeaders(h, "GET", "/v1/db1/", "", headers)
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a gzipped listing but got Content-Encoding %q", res.Header.Get("Content-Encoding"))
+	}
+	compressed, _ := io.ReadAll(res.Body)
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("Error reading gzipped listing: %v", err)
+	}
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Error decompressing listing: %v", err)
+	}
+	if !bytes.Equal(decompressed, expected) {
+		t.Errorf("Expected the decompressed listing to be %s but got %s", expected, decompressed)
+	}
+	if len(compressed) >= len(expected) {
+		t.Errorf("Expected the listing to shrink from %d bytes but got %d", len(expected), len(compressed))
+	}
+
+	res = doRequestWithHeaders(h, "GET", "/v1/db1/", "", map[string]string{"Authorization": "Bearer abc", "Accept-Encoding": "gzip;q=0"})
+	if res.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Expected no compression when gzip is refused but got %q", res.Header.Get("Content-Encoding"))
+	}
+
+	// subscriptions stream uncompressed
+	req, _ := http.NewRequest("GET", server.URL+"/v1/db1/doc0?mode=subscribe", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Expected an uncompressed subscription but got Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "retry: 3000\n" {
+		t.Errorf("Expected the plain event stream but got %q (%v)", line, err)
+	}
+}
+
+func TestRequireUserAgent(t *testing.T) {
+	withAgent := map[string]string{"Authorization": "Bearer abc", "User-Agent": "owldb-test"}
+	withoutAgent := map[string]string{"Authorization": "Bearer abc"}
+
+	h := newTestHandler(handler.WithUserAgentRequired())
+	res := doRequestWithHeaders(h, "PUT", "/v1/db1", "", withoutAgent)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without a User-Agent but got %d", res.StatusCode)
+	}
+	res = doRequestWithHeaders(h, "PUT", "/v1/db1", "", withAgent)
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("Expected status 201 with a User-Agent but got %d", res.StatusCode)
+	}
+
+	h = newTestHandler()
+	res = doRequestWithHeaders(h, "PUT", "/v1/db1", "", withoutAgent)
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("Expected status 201 without a User-Agent when it is not required but got %d", res.StatusCode)
+	}
+}
+
+func TestCollectionPagination(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		doRequest(h, "PUT", "/v1/db1/"+name, `{"str":"`+name+`"}`)
+	}
+
+	names := func(path string) []string {
+		res := doRequest(h, "GET", path, "")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s but got %d", path, res.StatusCode)
+		}
+		var docs []docResponse
+		err := json.NewDecoder(res.Body).Decode(&docs)
+		if err != nil {
+			t.Fatalf("Error unmarshaling listing: %v", err)
+		}
+		result := make([]string, 0)
+		for _, doc := range docs {
+			result = append(result, doc.Path)
+		}
+		return result
+	}
+
+	tests := []struct {
+		path     string
+		expected []string
+	}{
+		{"/v1/db1/?limit=2&offset=1", []string{"/b", "/c"}},
+		{"/v1/db1/?limit=2", []string{"/a", "/b"}},
+		{"/v1/db1/?offset=3", []string{"/d", "/e"}},
+		{"/v1/db1/?offset=9", []string{}},
+		{"/v1/db1/?limit=2&offset=1&order=desc", []string{"/d", "/c"}},
+		{"/v1/db1/?limit=3&offset=2&interval=[a,d]", []string{"/c", "/d"}},
+	}
+	for _, test := range tests {
+		result := names(test.path)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("Expected %v for %s but got %v", test.expected, test.path, result)
+		}
+	}
+
+	for _, path := range []string{"/v1/db1/?limit=-1", "/v1/db1/?offset=x", "/v1/db1/?limit=1.5",
+		"/v1/db1/?limit=1&mode=subscribe", "/v1/db1/?offset=1&delimiter=/"} {
+		res := doRequest(h, "GET", path, "")
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s but got %d", path, res.StatusCode)
+		}
+	}
+
+	// the server's listing cap still bounds a larger page
+	h = newTestHandler(handler.WithListingCap(1))
+	doRequest(h, "PUT", "/v1/db1", "")
+	for _, name := range []string{"a", "b", "c"} {
+		doRequest(h, "PUT", "/v1/db1/"+name, `{"str":"`+name+`"}`)
+	}
+	if result := names("/v1/db1/?limit=2&offset=1"); !reflect.DeepEqual(result, []string{"/b"}) {
+		t.Errorf("Expected the listing cap to apply to the page but got %v", result)
+	}
+}
+
+func TestCountMode(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	count := func(path string) int {
+		res := doRequest(h, "GET", path, "")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s but got %d", path, res.StatusCode)
+		}
+		var response struct {
+			Count *int `json:"count"`
+		}
+		err := json.NewDecoder(res.Body).Decode(&response)
+		if err != nil || response.Count == nil {
+			t.Fatalf("Error unmarshaling count for %s: %v", path, err)
+		}
+		return *response.Count
+	}
+
+	if n := count("/v1/db1/?mode=count"); n != 0 {
+		t.Errorf("Expected an empty collection to count 0 but got %d", n)
+	}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		doRequest(h, "PUT", "/v1/db1/"+name, `{"str":"`+name+`"}`)
+	}
+	doRequestAs(h, "def", "PUT", "/v1/db1/f", `{"str":"f"}`)
+
+	tests := []struct {
+		path     string
+		expected int
+	}{
+		{"/v1/db1/?mode=count", 6},
+		{"/v1/db1/?mode=count&interval=[b,d]", 3},
+		{"/v1/db1/?mode=count&interval=[,b]", 2},
+		{"/v1/db1/?mode=count&interval=[e,]", 2},
+		{"/v1/db1/?mode=count&modifiedBy=other", 1},
+	}
+	for _, test := range tests {
+		if n := count(test.path); n != test.expected {
+			t.Errorf("Expected a count of %d for %s but got %d", test.expected, test.path, n)
+		}
+	}
+
+	for _, path := range []string{"/v1/db1/?mode=count&mode=subscribe", "/v1/db1/a?mode=count"} {
+		res := doRequest(h, "GET", path, "")
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s but got %d", path, res.StatusCode)
+		}
+	}
+}
+
+func TestMetadataMode(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	for _, name := range []string{"a", "b", "c", "d"} {
+		doRequest(h, "PUT", "/v1/db1/"+name, `{"secret":"contents of `+name+`"}`)
+	}
+
+	listing := func(path string) []map[string]json.RawMessage {
+		res := doRequest(h, "GET", path, "")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s but got %d", path, res.StatusCode)
+		}
+		body, _ := io.ReadAll(res.Body)
+		if strings.Contains(string(body), "contents of") {
+			t.Errorf("Expected no document contents for %s but got %s", path, body)
+		}
+		var result []map[string]json.RawMessage
+		err := json.Unmarshal(body, &result)
+		if err != nil {
+			t.Fatalf("Error unmarshaling metadata listing for %s: %v", path, err)
+		}
+		return result
+	}
+
+	result := listing("/v1/db1/?mode=metadata")
+	if len(result) != 4 {
+		t.Fatalf("Expected 4 documents but got %d", len(result))
+	}
+	for i, name := range []string{"a", "b", "c", "d"} {
+		var path string
+		json.Unmarshal(result[i]["path"], &path)
+		if path != "/"+name {
+			t.Errorf("Expected path /%s but got %s", name, path)
+		}
+		var meta struct {
+			CreatedBy      string `json:"createdBy"`
+			LastModifiedBy string `json:"lastModifiedBy"`
+		}
+		if err := json.Unmarshal(result[i]["meta"], &meta); err != nil || meta.CreatedBy == "" || meta.LastModifiedBy == "" {
+			t.Errorf("Expected a metadata block for /%s but got %s", name, result[i]["meta"])
+		}
+		if _, ok := result[i]["doc"]; ok {
+			t.Errorf("Expected no doc field for /%s", name)
+		}
+	}
+
+	paths := func(result []map[string]json.RawMessage) []string {
+		names := make([]string, 0)
+		for _, doc := range result {
+			var path string
+			json.Unmarshal(doc["path"], &path)
+			names = append(names, path)
+		}
+		return names
+	}
+	if names := paths(listing("/v1/db1/?mode=metadata&interval=[a,c]")); !reflect.DeepEqual(names, []string{"/a", "/b", "/c"}) {
+		t.Errorf("Expected the interval to apply but got %v", names)
+	}
+	if names := paths(listing("/v1/db1/?mode=metadata&offset=1&limit=2")); !reflect.DeepEqual(names, []string{"/b", "/c"}) {
+		t.Errorf("Expected the page to apply but got %v", names)
+	}
+
+	res := doRequest(h, "GET", "/v1/db1/a?mode=metadata", "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for metadata mode on a document but got %d", res.StatusCode)
+	}
+}
+
+func TestDiffMode(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db2", "")
+	doRequest(h, "PUT", "/v1/db1/same", `{"a":1,"b":[1,2]}`)
+	doRequest(h, "PUT", "/v1/db2/same", `{ "b": [1, 2], "a": 1 }`)
+	doRequest(h, "PUT", "/v1/db1/changed", `{"a":1}`)
+	doRequest(h, "PUT", "/v1/db2/changed", `{"a":2}`)
+	doRequest(h, "PUT", "/v1/db1/mine", `{"a":1}`)
+	doRequest(h, "PUT", "/v1/db2/theirs", `{"a":1}`)
+	doRequest(h, "PUT", "/v1/db2/yours", `{"a":1}`)
+
+	res := doRequest(h, "GET", "/v1/db1/?mode=diff&against=/v1/db2/", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", res.StatusCode)
+	}
+	var diff struct {
+		OnlyInThis  []string `json:"onlyInThis"`
+		OnlyInOther []string `json:"onlyInOther"`
+		Differing   []string `json:"differing"`
+	}
+	err := json.NewDecoder(res.Body).Decode(&diff)
+	if err != nil {
+		t.Fatalf("Error unmarshaling diff: %v", err)
+	}
+	if !reflect.DeepEqual(diff.OnlyInThis, []string{"mine"}) {
+		t.Errorf("Expected only mine in this collection but got %v", diff.OnlyInThis)
+	}
+	if !reflect.DeepEqual(diff.OnlyInOther, []string{"theirs", "yours"}) {
+		t.Errorf("Expected only theirs and yours in the other collection but got %v", diff.OnlyInOther)
+	}
+	if !reflect.DeepEqual(diff.Differing, []string{"changed"}) {
+		t.Errorf("Expected only changed to differ but got %v", diff.Differing)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/v1/db1/?mode=diff&against=/v1/missing/", http.StatusNotFound},
+		{"/v1/db1/?mode=diff&against=/v1/db2/same/col/", http.StatusNotFound},
+		{"/v1/db1/?mode=diff&against=/v1/db2/same", http.StatusBadRequest},
+		{"/v1/db1/?mode=diff", http.StatusBadRequest},
+		{"/v1/db1/?against=/v1/db2/", http.StatusBadRequest},
+		{"/v1/db1/same?mode=diff&against=/v1/db2/", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		res := doRequest(h, "GET", test.path, "")
+		if res.StatusCode != test.status {
+			t.Errorf("Expected status %d for %s but got %d", test.status, test.path, res.StatusCode)
+		}
+	}
+}
+
+func TestPutExistingConflict(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"str":"testing"}`)
+	doRequest(h, "PUT", "/v1/db1/doc/col/", "")
+
+	tests := []struct {
+		path    string
+		message string
+	}{
+		{"/v1/db1", `"database already exists"`},
+		{"/v1/db1/doc/col/", `"collection already exists"`},
+	}
+	for _, test := range tests {
+		res := doRequest(h, "PUT", test.path, "")
+		if res.StatusCode != http.StatusConflict {
+			t.Errorf("Expected status 409 for %s but got %d", test.path, res.StatusCode)
+		}
+		body, _ := io.ReadAll(res.Body)
+		if strings.TrimSpace(string(body)) != test.message {
+			t.Errorf("Expected %s for %s but got %s", test.message, test.path, body)
+		}
+	}
+}
+
+func TestPutReturnExisting(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	etag := doRequest(h, "PUT", "/v1/db1/doc", `{"str":"original"}`).Header.Get("ETag")
+
+	res := doRequest(h, "PUT", "/v1/db1/doc?mode=nooverwrite&return=existing", `{"str":"replacement"}`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 for an existing document but got %d", res.StatusCode)
+	}
+	var doc docResponse
+	err := json.NewDecoder(res.Body).Decode(&doc)
+	if err != nil {
+		t.Fatalf("Error unmarshaling existing document: %v", err)
+	}
+	if doc.Path != "/doc" || doc.Doc.Str != "original" || doc.Meta.CreatedBy != "test" {
+		t.Errorf("Expected the existing document but got %v", doc)
+	}
+	if res.Header.Get("ETag") != etag {
+		t.Errorf("Expected the existing document's ETag %s but got %s", etag, res.Header.Get("ETag"))
+	}
+
+	res = doRequest(h, "PUT", "/v1/db1/doc?mode=nooverwrite", `{"str":"replacement"}`)
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected status 412 without return=existing but got %d", res.StatusCode)
+	}
+
+	res = doRequest(h, "PUT", "/v1/db1/new?mode=nooverwrite&return=existing", `{"str":"created"}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("Expected status 201 for a missing document but got %d", res.StatusCode)
+	}
+
+	for _, path := range []string{"/v1/db1/doc?return=existing", "/v1/db1/doc?mode=nooverwrite&return=new"} {
+		res := doRequest(h, "PUT", path, `{"str":"replacement"}`)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s but got %d", path, res.StatusCode)
+		}
+	}
+}
+
+func TestNamesAtMaxNameRejected(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	for _, name := range []string{document.MaxName, document.MaxName + "a"} {
+		res := doRequest(h, "PUT", "/v1/db1/"+url.PathEscape(name), `{"str":"x"}`)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for a document named %q but got %d", name, res.StatusCode)
+		}
+		res = doRequest(h, "PUT", "/v1/"+url.PathEscape(name), "")
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for a database named %q but got %d", name, res.StatusCode)
+		}
+	}
+
+	// names just below the sentinel are still listed by an open interval
+	high := "\U0010FFFE"
+	doRequest(h, "PUT", "/v1/db1/a", `{"str":"a"}`)
+	doRequest(h, "PUT", "/v1/db1/"+url.PathEscape(high), `{"str":"high"}`)
+	res := doRequest(h, "GET", "/v1/db1/", "")
+	var docs []docResponse
+	err := json.NewDecoder(res.Body).Decode(&docs)
+	if err != nil {
+		t.Fatalf("Error unmarshaling listing: %v", err)
+	}
+	if len(docs) != 2 || docs[0].Path != "/a" || docs[1].Path != "/"+high {
+		t.Errorf("Expected the listing to span every valid name but got %v", docs)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	authMap := auth.NewAuth()
+	authMap.AddPair("test", "abc", time.Now().Add(time.Hour))
+	authMap.AddPair("test", "expired", time.Now().Add(-time.Minute))
+	h := newTestHandlerWithAuth(authMap)
+
+	refresh := func(token string, query string) (*http.Response, string) {
+		res := doRequestAs(h, token, "POST", "/auth/refresh"+query, "")
+		var output struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(res.Body).Decode(&output)
+		return res, output.Token
+	}
+
+	res, fresh := refresh("abc", "")
+	if res.StatusCode != http.StatusOK || fresh == "" || fresh == "abc" {
+		t.Fatalf("Expected a new token for a valid one but got %d %q", res.StatusCode, fresh)
+	}
+	if name, ok := authMap.IsTokenValid(fresh); !ok || name != "test" {
+		t.Errorf("Expected the new token to belong to test but got %q, %v", name, ok)
+	}
+	if _, ok := authMap.IsTokenValid("abc"); !ok {
+		t.Errorf("Expected the old token to stay valid without revoke")
+	}
+
+	res, newest := refresh(fresh, "?revoke=true")
+	if res.StatusCode != http.StatusOK || newest == "" {
+		t.Fatalf("Expected a new token when revoking but got %d %q", res.StatusCode, newest)
+	}
+	if _, ok := authMap.IsTokenValid(fresh); ok {
+		t.Errorf("Expected the old token to be revoked")
+	}
+	if res := doRequestAs(h, newest, "PUT", "/v1/db1", ""); res.StatusCode != http.StatusCreated {
+		t.Errorf("Expected the new token to authorize requests but got %d", res.StatusCode)
+	}
+
+	for _, token := range []string{"expired", fresh, "unknown"} {
+		res, _ := refresh(token, "")
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 refreshing %q but got %d", token, res.StatusCode)
+		}
+	}
+	if res, _ := refresh("abc", "?revoke=yes"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a malformed revoke but got %d", res.StatusCode)
+	}
+}
+
+func TestLogoutAll(t *testing.T) {
+	authMap := auth.NewAuth()
+	authMap.AddPair("test", "abc", time.Now().Add(time.Hour))
+	authMap.AddPair("test", "def", time.Now().Add(time.Hour))
+	authMap.AddPair("other", "xyz", time.Now().Add(time.Hour))
+	h := newTestHandlerWithAuth(authMap)
+
+	res := doRequestAs(h, "abc", "DELETE", "/auth/all", "")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", res.StatusCode)
+	}
+	var output struct {
+		Revoked int `json:"revoked"`
+	}
+	json.NewDecoder(res.Body).Decode(&output)
+	if output.Revoked != 2 {
+		t.Errorf("Expected 2 tokens revoked but got %d", output.Revoked)
+	}
+	for _, token := range []string{"abc", "def"} {
+		if _, ok := authMap.IsTokenValid(token); ok {
+			t.Errorf("Expected %s to be revoked", token)
+		}
+	}
+	if res := doRequestAs(h, "xyz", "PUT", "/v1/db1", ""); res.StatusCode != http.StatusCreated {
+		t.Errorf("Expected the other user's token to still authorize requests but got %d", res.StatusCode)
+	}
+	if res := doRequestAs(h, "abc", "DELETE", "/auth/all", ""); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 with a revoked token but got %d", res.StatusCode)
+	}
+}
+
+func TestStructuredLimitErrors(t *testing.T) {
+	h := newTestHandler(handler.WithMaxBodySize(64), handler.WithMaxDocumentSize(32))
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	limitReport := func(res *http.Response) map[string]any {
+		if res.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Fatalf("Expected status 413 but got %d", res.StatusCode)
+		}
+		var report map[string]any
+		err := json.NewDecoder(res.Body).Decode(&report)
+		if err != nil {
+			t.Fatalf("Error unmarshaling limit report: %v", err)
+		}
+		return report
+	}
+
+	big := `{"str":"` + strings.Repeat("x", 100) + `"}`
+	report := limitReport(doRequest(h, "PUT", "/v1/db1/doc", big))
+	if report["limit"] != "bodySize" || report["max"] != float64(64) || report["error"] != "request body too large" {
+		t.Errorf("Expected a body size report but got %v", report)
+	}
+	report = limitReport(doRequest(h, "POST", "/v1/db1/", big))
+	if report["limit"] != "bodySize" {
+		t.Errorf("Expected a body size report for POST but got %v", report)
+	}
+
+	medium := `{"str":"` + strings.Repeat("x", 40) + `"}`
+	report = limitReport(doRequest(h, "PUT", "/v1/db1/doc", medium))
+	if report["limit"] != "documentSize" || report["max"] != float64(32) || report["error"] != "document too large" {
+		t.Errorf("Expected a document size report but got %v", report)
+	}
+
+	// a small patch can still grow a document past the limit
+	res := doRequest(h, "PUT", "/v1/db1/doc", `{"str":"small"}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201 for a small document but got %d", res.StatusCode)
+	}
+	report = limitReport(doRequest(h, "PATCH", "/v1/db1/doc", `[{"op":"ObjectAdd","path":"/more","value":"0123456789"}]`))
+	if report["limit"] != "documentSize" {
+		t.Errorf("Expected a document size report for PATCH but got %v", report)
+	}
+	res = doRequest(h, "GET", "/v1/db1/doc", "")
+	var doc docResponse
+	json.NewDecoder(res.Body).Decode(&doc)
+	if doc.Doc.Str != "small" {
+		t.Errorf("Expected the document to be unchanged but got %v", doc)
+	}
+}
+
+func TestCaseInsensitiveModes(t *testing.T) {
+	server := httptest.NewServer(newTestHandler())
+	t.Cleanup(server.Close)
+	h := server.Config.Handler
+
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"str":"original"}`)
+
+	events := subscribe(t, server, "/v1/db1/doc?mode=SUBSCRIBE")
+	if event := nextEvent(t, events); event.event != "update" || !strings.Contains(event.data, "original") {
+		t.Errorf("Expected the document as the first event but got %+v", event)
+	}
+
+	res := doRequest(h, "PUT", "/v1/db1/doc?mode=NoOverwrite", `{"str":"replacement"}`)
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected status 412 for an existing document but got %d", res.StatusCode)
+	}
+	res = doRequest(h, "PUT", "/v1/db1/new?mode=NoOverwrite", `{"str":"created"}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("Expected status 201 for a new document but got %d", res.StatusCode)
+	}
+
+	if res := doRequest(h, "GET", "/v1/db1/doc?mode=Subscribes", ""); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown get mode but got %d", res.StatusCode)
+	}
+	if res := doRequest(h, "PUT", "/v1/db1/doc?mode=OVERWRITES", `{"str":"x"}`); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown put mode but got %d", res.StatusCode)
+	}
+}
+
+// largeDocument returns a JSON document of roughly the given number of bytes, an object holding an array of objects.
+func largeDocument(size int) string {
+	var doc strings.Builder
+	doc.WriteString(`{"items":[`)
+	for i := 0; doc.Len() < size; i++ {
+		if i > 0 {
+			doc.WriteString(",")
+		}
+		fmt.Fprintf(&doc, `{"id":%d,"name":"item %d","tags":["a","b","c"],"score":%d.5}`, i, i, i)
+	}
+	doc.WriteString("]}")
+	return doc.String()
+}
+
+func TestPutLargeDocument(t *testing.T) {
+	h := newTestHandler(handler.WithMaxDocumentSize(2 << 20))
+	doRequest(h, "PUT", "/v1/db1", "")
+	doc := largeDocument(1 << 20)
+
+	if res := doRequest(h, "PUT", "/v1/db1/doc", doc); res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201 creating a large document but got %d", res.StatusCode)
+	}
+	if res := doRequest(h, "PUT", "/v1/db1/doc", doc); res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 overwriting a large document but got %d", res.StatusCode)
+	}
+	res := doRequest(h, "GET", "/v1/db1/doc", "")
+	var stored struct {
+		Doc json.RawMessage `json:"doc"`
+	}
+	json.NewDecoder(res.Body).Decode(&stored)
+	if string(stored.Doc) != doc {
+		t.Errorf("Expected the large document to be stored as sent")
+	}
+
+	for name, body := range map[string]string{
+		"truncated":     doc[:len(doc)-10],
+		"trailing data": doc + `{}`,
+		"not an object": "[" + doc + "]",
+	} {
+		res := doRequest(h, "PUT", "/v1/db1/bad", body)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for a %s document but got %d", name, res.StatusCode)
+		}
+	}
+	if res := doRequest(h, "PUT", "/v1/db1/bad", largeDocument(3<<20)); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413 for a document over the limit but got %d", res.StatusCode)
+	}
+	if res := doRequest(h, "GET", "/v1/db1/bad", ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected rejected documents not to be stored but got %d", res.StatusCode)
+	}
+}
+
+// Measures putting a 1MB document, both as a new document and over an existing one.
+func BenchmarkPutLargeDocument(b *testing.B) {
+	log.SetOutput(io.Discard)
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doc := largeDocument(1 << 20)
+
+	b.Run("create", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(doc)))
+		for i := 0; i < b.N; i++ {
+			doRequest(h, "PUT", "/v1/db1/doc"+strconv.Itoa(i), doc)
+			doRequest(h, "DELETE", "/v1/db1/doc"+strconv.Itoa(i), "")
+		}
+	})
+	b.Run("overwrite", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(doc)))
+		for i := 0; i < b.N; i++ {
+			doRequest(h, "PUT", "/v1/db1/doc", doc)
+		}
+	})
+}
+
+func TestLoadTokens(t *testing.T) {
+	defaultExpiry := time.Now().Add(24 * time.Hour)
+
+	authMap := auth.NewAuth()
+	err := loadTokens([]byte(`{"alice":"abc","bob":"def"}`), authMap, defaultExpiry)
+	if err != nil {
+		t.Fatalf("Expected the flat format to load but got %v", err)
+	}
+	for token, name := range map[string]string{"abc": "alice", "def": "bob"} {
+		if user, ok := authMap.IsTokenValid(token); !ok || user != name {
+			t.Errorf("Expected %s to be a token of %s but got %q, %v", token, name, user, ok)
+		}
+	}
+
+	authMap = auth.NewAuth()
+	err = loadTokens([]byte(`{
+		"service": {"token": "long", "expiresAt": "2999-01-01T00:00:00Z"},
+		"alice": {"token": "short"},
+		"bob": "flat",
+		"old": {"token": "expired", "expiresAt": "2000-01-01T00:00:00Z"}
+	}`), authMap, defaultExpiry)
+	if err != nil {
+		t.Fatalf("Expected the format with expiries to load but got %v", err)
+	}
+	for token, name := range map[string]string{"long": "service", "short": "alice", "flat": "bob"} {
+		if user, ok := authMap.IsTokenValid(token); !ok || user != name {
+			t.Errorf("Expected %s to be a token of %s but got %q, %v", token, name, user, ok)
+		}
+	}
+	if _, ok := authMap.IsTokenValid("expired"); ok {
+		t.Errorf("Expected a token past its expiresAt to be invalid")
+	}
+	if tokens := authMap.TokensFor("service"); len(tokens) != 1 {
+		t.Errorf("Expected the service token to be loaded but got %v", tokens)
+	}
+
+	for name, file := range map[string]string{
+		"invalid timestamp": `{"bob":"def","alice":{"token":"abc","expiresAt":"tomorrow"}}`,
+		"missing token":     `{"bob":"def","alice":{"expiresAt":"2999-01-01T00:00:00Z"}}`,
+		"wrong type":        `{"bob":"def","alice":5}`,
+		"list of tokens":    `["def"]`,
+	} {
+		authMap := auth.NewAuth()
+		if err := loadTokens([]byte(file), authMap, defaultExpiry); err == nil {
+			t.Errorf("Expected an error for a file with a %s", name)
+		}
+		if _, ok := authMap.IsTokenValid("def"); ok {
+			t.Errorf("Expected no tokens to be loaded from a file with a %s", name)
+		}
+	}
+	err = loadTokens([]byte(`{"alice":{"token":"abc","expiresAt":"tomorrow"}}`), auth.NewAuth(), defaultExpiry)
+	if err == nil || !strings.Contains(err.Error(), "alice") || !strings.Contains(err.Error(), "tomorrow") {
+		t.Errorf("Expected the error to name the user and the timestamp but got %v", err)
+	}
+}
+
+// recordingDocumentFactory is a DocumentFactory that remembers the documents it creates by name, so tests can inspect
+// the data they store.
+type recordingDocumentFactory struct {
+	inner handler.DocumentFactory
+	docs  map[string]handler.Documenter
+}
+
+func (f recordingDocumentFactory) NewDocument(name string, data []byte, creator string) handler.Documenter {
+	doc := f.inner.NewDocument(name, data, creator)
+	f.docs[name] = doc
+	return doc
+}
+
+func TestMinify(t *testing.T) {
+	spaced := "{\n  \"b\" : [ 1, 2 ],\n  \"a\" : { \"str\" : \"x y\" }\n}\n"
+	minified := `{"b":[1,2],"a":{"str":"x y"}}`
+
+	for _, minify := range []bool{false, true} {
+		docs := recordingDocumentFactory{inner: DocumentFactory(document.NewDocument[handler.Collectioner]),
+			docs: make(map[string]handler.Documenter)}
+		opts := []handler.Option{handler.WithMaxDocumentSize(int64(len(spaced) - 1))}
+		if minify {
+			opts = append(opts, handler.WithMinify())
+		}
+		h := newTestHandlerWithFactories(CollectionFactory(collection.NewCollection[handler.Documenter]), docs, opts...)
+		doRequest(h, "PUT", "/v1/db1", "")
+
+		res := doRequest(h, "PUT", "/v1/db1/doc", spaced)
+		if !minify {
+			if res.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Errorf("Expected status 413 storing the document as sent but got %d", res.StatusCode)
+			}
+			continue
+		}
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201 for a document that fits once minified but got %d", res.StatusCode)
+		}
+		if data := string(docs.docs["doc"].GetData()); data != minified {
+			t.Errorf("Expected the document to be stored as %s but got %s", minified, data)
+		}
+		doRequest(h, "PUT", "/v1/db1/doc", spaced)
+		if data := string(docs.docs["doc"].GetData()); data != minified {
+			t.Errorf("Expected the overwritten document to be stored as %s but got %s", minified, data)
+		}
+		res = doRequest(h, "POST", "/v1/db1/", spaced)
+		var posted struct {
+			Uri string `json:"uri"`
+		}
+		json.NewDecoder(res.Body).Decode(&posted)
+		name := posted.Uri[strings.LastIndex(posted.Uri, "/")+1:]
+		if doc, ok := docs.docs[name]; !ok || string(doc.GetData()) != minified {
+			t.Errorf("Expected the posted document %q to be stored minified", name)
+		}
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	persister := handler.NewPersister(dir)
+	h := newTestHandler(handler.WithOpaqueContentTypes("text/plain"), handler.WithPersistence(persister))
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db2?serial=true", "")
+	doRequest(h, "PUT", "/v1/db1/doc", "{\n  \"a\" : [1, 2]\n}")
+	doRequest(h, "PUT", "/v1/db1/doc/col/", "")
+	doRequest(h, "PUT", "/v1/db1/doc/col/inner", `{"str":"nested"}`)
+	doRequestWithHeaders(h, "PUT", "/v1/db1/notes", "hello, world",
+		map[string]string{"Authorization": "Bearer abc", "Content-Type": "text/plain"})
+	doRequest(h, "PUT", "/v1/db2/other", `{"b":true}`)
+	doRequest(h, "PUT", "/v1/gone", "")
+
+	doRequest(h, "DELETE", "/v1/gone", "")
+	err := persister.Snapshot()
+	if err != nil {
+		t.Fatalf("Error saving databases: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 2 {
+		t.Errorf("Expected a file for each of the 2 databases but got %v", files)
+	}
+
+	reloaded := handler.NewPersister(dir)
+	h2 := newTestHandler(handler.WithOpaqueContentTypes("text/plain"), handler.WithPersistence(reloaded))
+	err = reloaded.Load()
+	if err != nil {
+		t.Fatalf("Error loading databases: %v", err)
+	}
+
+	for _, path := range []string{"/v1/db1/doc", "/v1/db1/notes", "/v1/db1/", "/v1/db1/doc/col/", "/v1/db1/doc/col/inner",
+		"/v1/db2/"} {
+		res := doRequest(h, "GET", path, "")
+		want, _ := io.ReadAll(res.Body)
+		res = doRequest(h2, "GET", path, "")
+		got, _ := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK || string(got) != string(want) {
+			t.Errorf("Expected GET %s to return %s after reloading but got %d %s", path, want, res.StatusCode, got)
+		}
+	}
+	res := doRequest(h2, "GET", "/v1/gone/", "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a database deleted before the snapshot but got %d", res.StatusCode)
+	}
+	res = doRequest(h2, "GET", "/v1/db1/notes", "")
+	if res.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Expected the opaque document to keep its Content-Type but got %q", res.Header.Get("Content-Type"))
+	}
+
+	err = reloaded.Load()
+	if err == nil {
+		t.Errorf("Expected an error loading databases that already exist")
+	}
+}
+
+func TestWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "owldb.wal")
+	wal, err := handler.OpenWAL(path)
+	if err != nil {
+		t.Fatalf("Error opening write-ahead log: %v", err)
+	}
+	h := newTestHandler(handler.WithOpaqueContentTypes("text/plain"), handler.WithWAL(wal))
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db2?serial=true", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"a":[1]}`)
+	doRequest(h, "PATCH", "/v1/db1/doc", `[{"op":"ArrayAdd","path":"/a","value":2}]`)
+	res := doRequest(h, "POST", "/v1/db1/", `{"str":"posted"}`)
+	var posted struct {
+		Uri string `json:"uri"`
+	}
+	json.NewDecoder(res.Body).Decode(&posted)
+	doRequest(h, "PUT", "/v1/db1/doc/col/", "")
+	doRequest(h, "PUT", "/v1/db1/doc/col/inner", `{"str":"nested"}`)
+	doRequestWithHeaders(h, "PUT", "/v1/db1/notes", "hello, world",
+		map[string]string{"Authorization": "Bearer abc", "Content-Type": "text/plain"})
+	doRequest(h, "PUT", "/v1/db2/gone", `{"b":true}`)
+	doRequest(h, "DELETE", "/v1/db2/gone", "")
+	// failed writes are not logged
+	doRequest(h, "PUT", "/v1/db1/bad", `not json`)
+	wal.Close()
+
+	// a crash while appending leaves a partly written entry
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	file.WriteString(`{"method":"PUT","path":"/v1/db1/cut`)
+	file.Close()
+
+	reopened, err := handler.OpenWAL(path)
+	if err != nil {
+		t.Fatalf("Error reopening write-ahead log: %v", err)
+	}
+	defer reopened.Close()
+	h2 := newTestHandler(handler.WithOpaqueContentTypes("text/plain"), handler.WithWAL(reopened))
+	err = reopened.Replay(h2)
+	if err != nil {
+		t.Fatalf("Error replaying write-ahead log: %v", err)
+	}
+
+	for _, docPath := range []string{"/v1/db1/doc", posted.Uri, "/v1/db1/doc/col/inner"} {
+		res = doRequest(h, "GET", docPath, "")
+		var want map[string]any
+		json.NewDecoder(res.Body).Decode(&want)
+		res = doRequest(h2, "GET", docPath, "")
+		var got map[string]any
+		json.NewDecoder(res.Body).Decode(&got)
+		if res.StatusCode != http.StatusOK || !reflect.DeepEqual(got["doc"], want["doc"]) ||
+			!reflect.DeepEqual(got["meta"].(map[string]any)["createdBy"], want["meta"].(map[string]any)["createdBy"]) {
+			t.Errorf("Expected GET %s to return %v after replaying but got %d %v", docPath, want, res.StatusCode, got)
+		}
+	}
+	res = doRequest(h2, "GET", "/v1/db1/notes", "")
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "hello, world" || res.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Expected the opaque document to be replayed but got %q of type %q", body, res.Header.Get("Content-Type"))
+	}
+	for _, missing := range []string{"/v1/db2/gone", "/v1/db1/bad", "/v1/db1/cut"} {
+		res = doRequest(h2, "GET", missing, "")
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status 404 for %s after replaying but got %d", missing, res.StatusCode)
+		}
+	}
+	data, _ := os.ReadFile(path)
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		t.Errorf("Expected the partly written entry to be removed from the log")
+	}
+
+	// replayed writes are not logged again, but new ones are
+	doRequest(h2, "PUT", "/v1/db2/new", `{"b":false}`)
+	after, _ := os.ReadFile(path)
+	if !bytes.HasPrefix(after, data) || bytes.Count(after, []byte("\n")) != bytes.Count(data, []byte("\n"))+1 {
+		t.Errorf("Expected exactly one new entry in the log but got %s", after[len(data):])
+	}
+
+	// a snapshot makes the entries logged before it redundant
+	persister := handler.NewPersister(t.TempDir())
+	h3 := newTestHandler(handler.WithWAL(reopened), handler.WithPersistence(persister))
+	doRequest(h3, "PUT", "/v1/db3", "")
+	err = persister.Snapshot()
+	if err != nil {
+		t.Fatalf("Error saving databases: %v", err)
+	}
+	data, _ = os.ReadFile(path)
+	if len(data) != 0 {
+		t.Errorf("Expected the log to be empty after a snapshot but got %s", data)
+	}
+}
+
+func TestReplayKeepsTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "owldb.wal")
+	wal, err := handler.OpenWAL(path)
+	if err != nil {
+		t.Fatalf("Error opening write-ahead log: %v", err)
+	}
+	h := newTestHandler(handler.WithWAL(wal))
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"a":1}`)
+	wal.Close()
+
+	// replaying must neither evict the only token a user may have nor leave one behind
+	authMap := auth.NewAuth()
+	authMap.SetMaxTokensPerUser(1)
+	authMap.AddPair("test", "provisioned", time.Now().Add(time.Hour))
+	reopened, err := handler.OpenWAL(path)
+	if err != nil {
+		t.Fatalf("Error reopening write-ahead log: %v", err)
+	}
+	defer reopened.Close()
+	h2 := newTestHandlerWithAuth(authMap, handler.WithWAL(reopened))
+	err = reopened.Replay(h2)
+	if err != nil {
+		t.Fatalf("Error replaying write-ahead log: %v", err)
+	}
+	if tokens := authMap.TokensFor("test"); !reflect.DeepEqual(tokens, []string{"provisioned"}) {
+		t.Errorf("Expected only the provisioned token after replaying but got %v", tokens)
+	}
+	res := doRequestAs(h2, "provisioned", "GET", "/v1/db1/doc", "")
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 with the provisioned token after replaying but got %d", res.StatusCode)
+	}
+}
+
+func TestSnapshotDuringWrites(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "owldb.wal")
+	wal, err := handler.OpenWAL(walPath)
+	if err != nil {
+		t.Fatalf("Error opening write-ahead log: %v", err)
+	}
+	dir := t.TempDir()
+	persister := handler.NewPersister(dir)
+	h := newTestHandler(handler.WithWAL(wal), handler.WithPersistence(persister))
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	// every write is either in a snapshot taken while it runs or left in the log after it
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				docPath := fmt.Sprintf("/v1/db1/doc%d-%d", w, i)
+				doRequest(h, "PUT", docPath, `{"a":1}`)
+				if i%2 == 0 {
+					doRequest(h, "DELETE", docPath, "")
+				}
+			}
+		}(w)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for snapshotting := true; snapshotting; {
+		select {
+		case <-done:
+			snapshotting = false
+		default:
+		}
+		err = persister.Snapshot()
+		if err != nil {
+			t.Fatalf("Error saving databases: %v", err)
+		}
+	}
+	wal.Close()
+
+	reopened, err := handler.OpenWAL(walPath)
+	if err != nil {
+		t.Fatalf("Error reopening write-ahead log: %v", err)
+	}
+	defer reopened.Close()
+	reloaded := handler.NewPersister(dir)
+	h2 := newTestHandler(handler.WithWAL(reopened), handler.WithPersistence(reloaded))
+	err = reloaded.Load()
+	if err != nil {
+		t.Fatalf("Error loading databases: %v", err)
+	}
+	err = reopened.Replay(h2)
+	if err != nil {
+		t.Fatalf("Error replaying write-ahead log: %v", err)
+	}
+	for w := 0; w < 4; w++ {
+		for i := 0; i < 50; i++ {
+			docPath := fmt.Sprintf("/v1/db1/doc%d-%d", w, i)
+			want := http.StatusOK
+			if i%2 == 0 {
+				want = http.StatusNotFound
+			}
+			res := doRequest(h2, "GET", docPath, "")
+			if res.StatusCode != want {
+				t.Errorf("Expected status %d for %s after reloading but got %d", want, docPath, res.StatusCode)
+			}
+		}
+	}
+}
+
+func TestListingETags(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/a", `{"str":"first"}`)
+	doRequest(h, "PUT", "/v1/db1/b", `{"str":"second"}`)
+	doRequest(h, "PATCH", "/v1/db1/b", `[{"op":"ObjectAdd","path":"/num","value":1}]`)
+
+	res := doRequest(h, "GET", "/v1/db1/", "")
+	var entries []struct {
+		Path string `json:"path"`
+		ETag string `json:"etag"`
+	}
+	err := json.NewDecoder(res.Body).Decode(&entries)
+	if err != nil {
+		t.Fatalf("Error unmarshaling listing: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 documents in the listing but got %d", len(entries))
+	}
+	for _, entry := range entries {
+		res = doRequest(h, "GET", "/v1/db1"+entry.Path, "")
+		if etag := res.Header.Get("ETag"); entry.ETag == "" || entry.ETag != etag {
+			t.Errorf("Expected the listing entry of %s to have the ETag %s but got %q", entry.Path, etag, entry.ETag)
+		}
+		// the listed tag is good for a conditional request
+		res = doRequestWithHeaders(h, "PUT", "/v1/db1"+entry.Path, `{"str":"replaced"}`,
+			map[string]string{"Authorization": "Bearer abc", "Content-Type": "application/json", "If-Match": entry.ETag})
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 replacing %s if it matches the listed ETag but got %d", entry.Path, res.StatusCode)
+		}
+	}
+}
+
+func TestPrefixQuery(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	for _, name := range []string{"2023-12-31", "2024-01-01", "2024-01-15", "2024-02-01", "notes"} {
+		doRequest(h, "PUT", "/v1/db1/"+name, `{"str":"`+name+`"}`)
+	}
+
+	names := func(path string) []string {
+		res := doRequest(h, "GET", path, "")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s but got %d", path, res.StatusCode)
+		}
+		var docs []struct {
+			Path string `json:"path"`
+		}
+		err := json.NewDecoder(res.Body).Decode(&docs)
+		if err != nil {
+			t.Fatalf("Error unmarshaling listing of %s: %v", path, err)
+		}
+		listed := make([]string, 0)
+		for _, doc := range docs {
+			listed = append(listed, doc.Path)
+		}
+		return listed
+	}
+
+	if listed := names("/v1/db1/?prefix=2024-01-"); !reflect.DeepEqual(listed, []string{"/2024-01-01", "/2024-01-15"}) {
+		t.Errorf("Expected only the documents of January 2024 but got %v", listed)
+	}
+	if listed := names("/v1/db1/?prefix=2024"); !reflect.DeepEqual(listed, []string{"/2024-01-01", "/2024-01-15", "/2024-02-01"}) {
+		t.Errorf("Expected only the documents of 2024 but got %v", listed)
+	}
+	if listed := names("/v1/db1/?prefix=2025"); len(listed) != 0 {
+		t.Errorf("Expected no documents for a prefix nothing starts with but got %v", listed)
+	}
+	if listed := names("/v1/db1/?prefix="); len(listed) != 5 {
+		t.Errorf("Expected every document for an empty prefix but got %v", listed)
+	}
+
+	res := doRequest(h, "GET", "/v1/db1/?prefix=2024&mode=count", "")
+	var count struct {
+		Count int `json:"count"`
+	}
+	json.NewDecoder(res.Body).Decode(&count)
+	if count.Count != 3 {
+		t.Errorf("Expected a count of 3 documents with the prefix but got %d", count.Count)
+	}
+
+	res = doRequest(h, "GET", "/v1/db1/?prefix=2024&interval=[a,b]", "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for both a prefix and an interval but got %d", res.StatusCode)
+	}
+}
+
+func TestNDJSONListing(t *testing.T) {
+	h := newTestHandler()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/a", "{\n  \"str\": \"first\"\n}")
+	doRequest(h, "PUT", "/v1/db1/b", `{"str":"second"}`)
+	doRequest(h, "PUT", "/v1/db1/c", `{"str":"third"}`)
+
+	res := doRequest(h, "GET", "/v1/db1/", "")
+	var want []map[string]any
+	json.NewDecoder(res.Body).Decode(&want)
+
+	res = doRequestWithHeaders(h, "GET", "/v1/db1/", "",
+		map[string]string{"Authorization": "Bearer abc", "Accept": "application/x-ndjson"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", res.StatusCode)
+	}
+	if res.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("Expected Content-Type application/x-ndjson but got %q", res.Header.Get("Content-Type"))
+	}
+	body, _ := io.ReadAll(res.Body)
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines but got %d: %q", len(lines), body)
+	}
+	for i, line := range lines {
+		var got map[string]any
+		err := json.Unmarshal([]byte(line), &got)
+		if err != nil {
+			t.Fatalf("Error unmarshaling line %d %q: %v", i, line, err)
+		}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("Expected line %d to be %v but got %v", i, want[i], got)
+		}
+	}
+
+	// pages and filters apply as they do to the array
+	res = doRequestWithHeaders(h, "GET", "/v1/db1/?offset=1&limit=1", "",
+		map[string]string{"Authorization": "Bearer abc", "Accept": "application/json, application/x-ndjson"})
+	body, _ = io.ReadAll(res.Body)
+	if strings.Count(string(body), "\n") != 1 || !strings.Contains(string(body), `"path":"/b"`) {
+		t.Errorf("Expected only document b on one line but got %q", body)
+	}
+}
+
+func TestSubscriptionCloseOnShutdown(t *testing.T) {
+	closer := handler.NewSubscriptionCloser(200 * time.Millisecond)
+	server := httptest.NewServer(newTestHandler(handler.WithSubscriptionCloser(closer)))
+	t.Cleanup(server.Close)
+	h := server.Config.Handler
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"a":1}`)
+
+	events := subscribe(t, server, "/v1/db1/?mode=subscribe")
+	if event := nextEvent(t, events); event.event != "update" {
+		t.Fatalf("Expected the existing document first but got %q", event.event)
+	}
+
+	start := time.Now()
+	closer.Close()
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Errorf("Expected Close to wait for the delay but it returned after %v", waited)
+	}
+	// the stream has ended by the time the delay is over, so the server can shut down
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := server.Config.Shutdown(ctx)
+	if err != nil {
+		t.Errorf("Expected the server to shut down once the subscriptions were closed but got %v", err)
+	}
+
+	if event := nextEvent(t, events); event.event != "close" {
+		t.Errorf("Expected a close event but got %q", event.event)
+	}
+	select {
+	case event, ok := <-events:
+		if ok {
+			t.Errorf("Expected the stream to end after the close event but got %q", event.event)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected the stream to end after the close event")
+	}
+}
+
+func TestLastEventIDCatchUp(t *testing.T) {
+	server := httptest.NewServer(newTestHandler())
+	t.Cleanup(server.Close)
+	h := server.Config.Handler
+	past := time.Now().Add(-time.Minute).UnixMilli()
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/a", `{"a":1}`)
+	doRequest(h, "PUT", "/v1/db1/b", `{"b":2}`)
+
+	// everything modified since the last event is sent again, even with ?snapshot=false
+	events := subscribeWithHeaders(t, server, "/v1/db1/?mode=subscribe&snapshot=false",
+		map[string]string{"Last-Event-ID": strconv.FormatInt(past, 10)})
+	for _, name := range []string{"a", "b"} {
+		event := nextEvent(t, events)
+		if event.event != "update" || !strings.Contains(event.data, `"/`+name+`"`) {
+			t.Fatalf("Expected a catch-up update for %s but got %q %s", name, event.event, event.data)
+		}
+	}
+
+	// nothing has been modified since a later event
+	future := time.Now().Add(time.Minute).UnixMilli()
+	events = subscribeWithHeaders(t, server, "/v1/db1/a?mode=subscribe",
+		map[string]string{"Last-Event-ID": strconv.FormatInt(future, 10)})
+	time.Sleep(50 * time.Millisecond)
+	doRequest(h, "PUT", "/v1/db1/a", `{"a":2}`)
+	if event := nextEvent(t, events); !strings.Contains(event.data, `"a":2`) {
+		t.Errorf("Expected only the live update but got %s", event.data)
+	}
+
+	res := doRequestWithHeaders(h, "GET", "/v1/db1/?mode=subscribe", "", map[string]string{
+		"Authorization": "Bearer abc",
+		"Last-Event-ID": "yesterday",
+	})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a malformed Last-Event-ID but got %d", res.StatusCode)
+	}
+}
+
+func TestSubscriptionKeepalive(t *testing.T) {
+	server := httptest.NewServer(newTestHandler())
+	t.Cleanup(server.Close)
+	h := server.Config.Handler
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	req, err := http.NewRequest("GET", server.URL+"/v1/db1/?mode=subscribe&keepalive=1", nil)
+	if err != nil {
+		t.Fatalf("Error creating subscription request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer abc")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	comments := make(chan string, 10)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), ":") {
+				comments <- scanner.Text()
+			}
+		}
+	}()
+	select {
+	case comment := <-comments:
+		if comment != ": keep alive" {
+			t.Errorf("Expected a keep alive comment but got %q", comment)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no keep alive comment while idle with ?keepalive=1")
+	}
+
+	for _, keepalive := range []string{"0", "301", "soon"} {
+		res := doRequest(h, "GET", "/v1/db1/?mode=subscribe&keepalive="+keepalive, "")
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected 400 for ?keepalive=%s but got %d", keepalive, res.StatusCode)
+		}
+	}
+	res := doRequest(h, "GET", "/v1/db1/?keepalive=5", "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for ?keepalive without a subscription but got %d", res.StatusCode)
+	}
+}
+
+func TestAuthMethodNotAllowed(t *testing.T) {
+	h := newTestHandler()
+	for _, method := range []string{"PUT", "GET", "PATCH"} {
+		res := doRequest(h, method, "/auth", "")
+		if res.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405 for %s /auth but got %d", method, res.StatusCode)
+		}
+		if allow := res.Header.Get("Allow"); allow != "POST, DELETE, OPTIONS" {
+			t.Errorf("Expected the supported methods in Allow for %s /auth but got %q", method, allow)
+		}
+	}
+
+	// the supported methods are still handled
+	res := doRequest(h, "OPTIONS", "/auth", "")
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 for OPTIONS /auth but got %d", res.StatusCode)
+	}
+	res = doRequest(h, "DELETE", "/auth", "")
+	if res.StatusCode == http.StatusMethodNotAllowed {
+		t.Error("Expected DELETE /auth to still log out")
+	}
+}
+
+func TestServerFields(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	clock := func() time.Time { return now }
+	h := newTestHandler(handler.WithServerFields(handler.FieldID, handler.FieldCreatedAt), handler.WithClock(clock))
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	// fields sent by the client are replaced
+	res := doRequest(h, "PUT", "/v1/db1/doc", `{"str":"testing","_id":"other"}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 creating a document but got %d", res.StatusCode)
+	}
+	var created struct {
+		Doc map[string]any `json:"doc"`
+	}
+	body, _ := io.ReadAll(doRequest(h, "GET", "/v1/db1/doc", "").Body)
+	if err := json.Unmarshal(body, &created); err != nil {
+		t.Fatalf("Error unmarshaling document: %v", err)
+	}
+	if created.Doc["_id"] != "doc" || created.Doc["_createdAt"] != float64(now.UnixMilli()) || created.Doc["str"] != "testing" {
+		t.Errorf("Expected the server fields in the created document but got %v", created.Doc)
+	}
+
+	// overwriting a document leaves the body as sent
+	doRequest(h, "PUT", "/v1/db1/doc", `{"str":"again"}`)
+	body, _ = io.ReadAll(doRequest(h, "GET", "/v1/db1/doc", "").Body)
+	if strings.Contains(string(body), "_id") {
+		t.Errorf("Expected no server fields in an overwritten document but got %s", body)
+	}
+
+	// a posted document gets the name it was given
+	res = doRequest(h, "POST", "/v1/db1/", `{"str":"posted"}`)
+	var posted dbResponse
+	body, _ = io.ReadAll(res.Body)
+	if err := json.Unmarshal(body, &posted); err != nil {
+		t.Fatalf("Error unmarshaling post response: %v", err)
+	}
+	name := posted.Uri[strings.LastIndex(posted.Uri, "/")+1:]
+	body, _ = io.ReadAll(doRequest(h, "GET", posted.Uri, "").Body)
+	if err := json.Unmarshal(body, &created); err != nil {
+		t.Fatalf("Error unmarshaling document: %v", err)
+	}
+	if created.Doc["_id"] != name {
+		t.Errorf("Expected _id %q in the posted document but got %v", name, created.Doc["_id"])
+	}
+
+	res = doRequest(h, "PUT", "/v1/db1/list", `[1,2]`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 creating a document that is not an object but got %d", res.StatusCode)
+	}
+
+	// a document deleted after it was looked up is created by the put that meant to overwrite it
+	stale := newTestHandlerWithFactories(staleCollectionFactory{CollectionFactory(collection.NewCollection[handler.Documenter])},
+		DocumentFactory(document.NewDocument[handler.Collectioner]), handler.WithServerFields(handler.FieldID))
+	doRequest(stale, "PUT", "/v1/db1", "")
+	doRequest(stale, "PUT", "/v1/db1/doc", `{"str":"first"}`)
+	doRequest(stale, "DELETE", "/v1/db1/doc", "")
+	res = doRequest(stale, "PUT", "/v1/db1/doc", `{"str":"second"}`)
+	body, _ = io.ReadAll(doRequest(stale, "GET", "/v1/db1/doc", "").Body)
+	if res.StatusCode != http.StatusCreated || !strings.Contains(string(body), `"_id":"doc"`) {
+		t.Errorf("Expected 201 and the server fields in the recreated document but got %d %s", res.StatusCode, body)
+	}
+
+	// replayed documents keep the time they were first created at
+	path := filepath.Join(t.TempDir(), "owldb.wal")
+	wal, err := handler.OpenWAL(path)
+	if err != nil {
+		t.Fatalf("Error opening write-ahead log: %v", err)
+	}
+	h = newTestHandler(handler.WithServerFields(handler.FieldCreatedAt), handler.WithClock(clock), handler.WithWAL(wal))
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"str":"logged"}`)
+	wal.Close()
+	reopened, err := handler.OpenWAL(path)
+	if err != nil {
+		t.Fatalf("Error reopening write-ahead log: %v", err)
+	}
+	defer reopened.Close()
+	later := func() time.Time { return now.Add(time.Hour) }
+	h = newTestHandler(handler.WithServerFields(handler.FieldCreatedAt), handler.WithClock(later), handler.WithWAL(reopened))
+	err = reopened.Replay(h)
+	if err != nil {
+		t.Fatalf("Error replaying write-ahead log: %v", err)
+	}
+	body, _ = io.ReadAll(doRequest(h, "GET", "/v1/db1/doc", "").Body)
+	if err := json.Unmarshal(body, &created); err != nil {
+		t.Fatalf("Error unmarshaling document: %v", err)
+	}
+	if created.Doc["_createdAt"] != float64(now.UnixMilli()) {
+		t.Errorf("Expected the replayed document to keep _createdAt %d but got %v", now.UnixMilli(), created.Doc["_createdAt"])
+	}
+}
+
+// staleCollectionFactory is a CollectionFactory whose collections still find the documents deleted from them, like a
+// lookup made just before a concurrent delete.
+type staleCollectionFactory struct {
+	inner handler.CollectionFactory
+}
+
+func (f staleCollectionFactory) NewCollection(name string) handler.Collectioner {
+	return staleCollection{Collectioner: f.inner.NewCollection(name), deleted: make(map[string]handler.Documenter)}
+}
+
+type staleCollection struct {
+	handler.Collectioner
+	deleted map[string]handler.Documenter
+}
+
+func (c staleCollection) FindDocument(name string) (handler.Documenter, bool) {
+	if doc, ok := c.Collectioner.FindDocument(name); ok {
+		return doc, true
+	}
+	doc, ok := c.deleted[name]
+	return doc, ok
+}
+
+func (c staleCollection) DeleteDocumentIf(name string, check func(currValue handler.Documenter, exists bool) (bool, error)) (handler.Documenter, bool, error) {
+	doc, ok, err := c.Collectioner.DeleteDocumentIf(name, check)
+	if ok {
+		c.deleted[name] = doc
+	}
+	return doc, ok, err
+}
+
+func TestSubscriptionFilter(t *testing.T) {
+	server := httptest.NewServer(newTestHandler())
+	t.Cleanup(server.Close)
+	h := server.Config.Handler
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/a", `{"status":"open"}`)
+	doRequest(h, "PUT", "/v1/db1/b", `{"status":"closed"}`)
+
+	events := subscribe(t, server, "/v1/db1/?mode=subscribe&filter=status=open")
+	// only the matching document is in the snapshot
+	if event := nextEvent(t, events); !strings.Contains(event.data, `"/a"`) {
+		t.Fatalf("Expected the matching document first but got %s", event.data)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	doRequest(h, "PUT", "/v1/db1/c", `{"status":"closed"}`)
+	doRequest(h, "PUT", "/v1/db1/d", `{"status":"open","n":1}`)
+	doRequest(h, "PUT", "/v1/db1/b", `{"status":"open"}`)
+	for _, name := range []string{"d", "b"} {
+		event := nextEvent(t, events)
+		if event.event != "update" || !strings.Contains(event.data, `"/`+name+`"`) {
+			t.Fatalf("Expected an update of matching document %s but got %q %s", name, event.event, event.data)
+		}
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Expected no events for non-matching documents but got %s", event.data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// JSON values are compared as JSON
+	events = subscribe(t, server, "/v1/db1/?mode=subscribe&filter=n=1")
+	if event := nextEvent(t, events); !strings.Contains(event.data, `"/d"`) {
+		t.Errorf("Expected the document with n equal to 1 but got %s", event.data)
+	}
+
+	res := doRequest(h, "GET", "/v1/db1/?mode=subscribe&filter=status", "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a filter without a value but got %d", res.StatusCode)
+	}
+}
+
+func TestOverwriteDisallowed(t *testing.T) {
+	h := newTestHandler(handler.WithOverwriteDisallowed())
+	doRequest(h, "PUT", "/v1/db1", "")
+
+	res := doRequest(h, "PUT", "/v1/db1/doc", `{"str":"testing"}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 creating a document but got %d", res.StatusCode)
+	}
+	for _, path := range []string{"/v1/db1/doc", "/v1/db1/doc?mode=nooverwrite"} {
+		res = doRequest(h, "PUT", path, `{"str":"again"}`)
+		if res.StatusCode != http.StatusConflict {
+			t.Errorf("Expected 409 overwriting a document with PUT %s but got %d", path, res.StatusCode)
+		}
+	}
+
+	res = doRequest(h, "PATCH", "/v1/db1/doc", `[{"op":"ObjectAdd","path":"/a","value":1}]`)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected PATCH to still change the document but got %d", res.StatusCode)
+	}
+	body, _ := io.ReadAll(doRequest(h, "GET", "/v1/db1/doc", "").Body)
+	if !strings.Contains(string(body), `"str":"testing"`) || !strings.Contains(string(body), `"a":1`) {
+		t.Errorf("Expected the patched original document but got %s", body)
+	}
+
+	// a patch is logged as a put of the patched document, which its replay must be able to overwrite with
+	path := filepath.Join(t.TempDir(), "owldb.wal")
+	wal, err := handler.OpenWAL(path)
+	if err != nil {
+		t.Fatalf("Error opening write-ahead log: %v", err)
+	}
+	h = newTestHandler(handler.WithOverwriteDisallowed(), handler.WithWAL(wal))
+	doRequest(h, "PUT", "/v1/db1", "")
+	doRequest(h, "PUT", "/v1/db1/doc", `{"str":"testing"}`)
+	doRequest(h, "PATCH", "/v1/db1/doc", `[{"op":"ObjectAdd","path":"/a","value":1}]`)
+	wal.Close()
+	reopened, err := handler.OpenWAL(path)
+	if err != nil {
+		t.Fatalf("Error reopening write-ahead log: %v", err)
+	}
+	defer reopened.Close()
+	h = newTestHandler(handler.WithOverwriteDisallowed(), handler.WithWAL(reopened))
+	err = reopened.Replay(h)
+	if err != nil {
+		t.Fatalf("Error replaying write-ahead log: %v", err)
+	}
+	body, _ = io.ReadAll(doRequest(h, "GET", "/v1/db1/doc", "").Body)
+	if !strings.Contains(string(body), `"a":1`) {
+		t.Errorf("Expected the replayed patch in the document but got %s", body)
+	}
+	res = doRequest(h, "PUT", "/v1/db1/doc", `{"str":"again"}`)
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 overwriting a document after the replay but got %d", res.StatusCode)
+	}
+}
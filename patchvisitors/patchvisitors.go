@@ -3,7 +3,9 @@
 package patchvisitors
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
 	"strconv"
 	"strings"
@@ -106,6 +108,7 @@ type PatchVisitor[p PatchOper, pf PatchOpFactory[p]] struct {
 	opFind       bool // The flag used to indicate if we're looking for the value of the "op" property
 	pathFind     bool // The flag used to indicate if we're looking for the value of the "path" property
 	patchFactory pf
+	maxSegments  int // If positive, the most segments the path of an operation may have
 }
 
 // NewPatchVisitor creates a new patchVisitor for use in the visitor pattern.
@@ -113,14 +116,26 @@ func NewPatchVisitor[p PatchOper, pf PatchOpFactory[p]](patchFactory pf) PatchVi
 	return PatchVisitor[p, pf]{opFind: false, pathFind: false, patchFactory: patchFactory}
 }
 
+// LimitSegments returns a constructor like NewPatchVisitor, whose patchVisitors reject any operation whose path has
+// more than maxSegments segments before it is applied, so enormously long paths are never traversed.
+func LimitSegments[p PatchOper, pf PatchOpFactory[p]](maxSegments int) func(patchFactory pf) PatchVisitor[p, pf] {
+	return func(patchFactory pf) PatchVisitor[p, pf] {
+		v := NewPatchVisitor[p, pf](patchFactory)
+		v.maxSegments = maxSegments
+		return v
+	}
+}
+
 // Process JSON Map by iterating through map and calling Accept on the values whose keys
 // are "op" or "path"; stores the values whose keys are "op", "path", and "value" inside
-// a patchOp struct and returns it. If the map is missing any of those 3 keys, an
-// error is returned. If there is an error retrieving the value mapped to one of those 3
-// keys, an error is returned.
+// a patchOp struct and returns it. An ArrayReplace operation has "old" and "new" properties
+// instead of "value", which are stored together as an object in the patchOp's value, and a
+// Move operation has a "from" property instead, which is stored as the patchOp's value. If the
+// map is missing any of the required keys, an error is returned. If there is an error
+// retrieving the value mapped to one of those keys, an error is returned.
 func (v PatchVisitor[p, pf]) Map(m map[string]jsondata.JSONValue) (p, error) {
 
-	// Below covers cases where op, path, or value aren't specified in patch operation
+	// Below covers cases where op or path aren't specified in patch operation
 	_, ok := m["op"]
 	if !ok {
 		var j jsondata.JSONValue
@@ -131,11 +146,6 @@ func (v PatchVisitor[p, pf]) Map(m map[string]jsondata.JSONValue) (p, error) {
 		var j jsondata.JSONValue
 		return v.patchFactory.NewPatchOp("", "", j), errors.New("patch operation missing \"path\" property")
 	}
-	_, ok = m["value"]
-	if !ok {
-		var j jsondata.JSONValue
-		return v.patchFactory.NewPatchOp("", "", j), errors.New("patch operation missing \"value\" property")
-	}
 
 	var op string
 	var path string
@@ -165,6 +175,63 @@ func (v PatchVisitor[p, pf]) Map(m map[string]jsondata.JSONValue) (p, error) {
 		}
 	}
 
+	if v.maxSegments > 0 && strings.Count(path, "/") > v.maxSegments {
+		var j jsondata.JSONValue
+		return v.patchFactory.NewPatchOp("", "", j), fmt.Errorf("path has too many segments, at most %d are allowed", v.maxSegments)
+	}
+
+	// ArrayReplace carries "old" and "new" properties instead of "value", which are kept together as its value
+	if op == "ArrayReplace" {
+		_, ok = m["old"]
+		if !ok {
+			var j jsondata.JSONValue
+			return v.patchFactory.NewPatchOp("", "", j), errors.New("patch operation missing \"old\" property")
+		}
+		_, ok = m["new"]
+		if !ok {
+			var j jsondata.JSONValue
+			return v.patchFactory.NewPatchOp("", "", j), errors.New("patch operation missing \"new\" property")
+		}
+		pair, err := jsondata.NewJSONValue(map[string]jsondata.JSONValue{"old": m["old"], "new": m["new"]})
+		if err != nil {
+			var j jsondata.JSONValue
+			return v.patchFactory.NewPatchOp("", "", j), errors.New(err.Error())
+		}
+		return v.patchFactory.NewPatchOp(op, path, pair), nil
+	}
+
+	// Move carries a "from" property instead of "value", which is kept as its value
+	if op == "Move" {
+		fromVal, ok := m["from"]
+		if !ok {
+			var j jsondata.JSONValue
+			return v.patchFactory.NewPatchOp("", "", j), errors.New("patch operation missing \"from\" property")
+		}
+		v.pathFind = true
+		fromHolder, err := jsondata.Accept(fromVal, v)
+		if err != nil {
+			var j jsondata.JSONValue
+			return v.patchFactory.NewPatchOp("", "", j), errors.New("value of \"from\" property not string")
+		}
+		v.pathFind = false
+		if v.maxSegments > 0 && strings.Count(fromHolder.GetPath(), "/") > v.maxSegments {
+			var j jsondata.JSONValue
+			return v.patchFactory.NewPatchOp("", "", j), fmt.Errorf("from has too many segments, at most %d are allowed", v.maxSegments)
+		}
+		from, err := jsondata.NewJSONValue(fromHolder.GetPath())
+		if err != nil {
+			var j jsondata.JSONValue
+			return v.patchFactory.NewPatchOp("", "", j), errors.New(err.Error())
+		}
+		return v.patchFactory.NewPatchOp(op, path, from), nil
+	}
+
+	_, ok = m["value"]
+	if !ok {
+		var j jsondata.JSONValue
+		return v.patchFactory.NewPatchOp("", "", j), errors.New("patch operation missing \"value\" property")
+	}
+
 	return v.patchFactory.NewPatchOp(op, path, value), nil
 }
 
@@ -235,12 +302,42 @@ type DocVisitor struct {
 	op    string             // The name of the operation being patched in by the visitor pattern.
 	path  string             // The jsonpointer path specifying the element of the JSON value to be modified.
 	value jsondata.JSONValue // The value associated with the current operation being patched.
+	old   jsondata.JSONValue // The value being replaced by the current operation, if it replaces one.
 	first bool               // A flag denoting whether or not the docVisitor is currently at the "start" of the original "path".
+	whole string             // The original "path" of the operation, for error messages.
+	from  string             // The path a Move operation takes its value from.
+	stage moveStage          // Which half of a Move operation the docVisitor is carrying out.
 }
 
-// NewDocVisitor creates a new docVisitor for use in the visitor pattern.
+// The halves a Move operation is carried out in, by a docVisitor of its own each, once the value has been found.
+type moveStage int
+
+const (
+	moveStart  moveStage = iota // the Move has not been started
+	moveRemove                  // removing the value at "from"
+	moveInsert                  // inserting the value at "path"
+)
+
+// NewDocVisitor creates a new docVisitor for use in the visitor pattern. For ArrayReplace, value is the object
+// holding the "old" and "new" properties of the operation, which are split into the old and value fields. For Move,
+// value is the "from" property of the operation.
 func NewDocVisitor(op string, path string, value jsondata.JSONValue) *DocVisitor {
-	return &DocVisitor{op: op, path: path, value: value, first: true}
+	visitor := &DocVisitor{op: op, path: path, value: value, first: true, whole: path}
+	if op == "ArrayReplace" {
+		var pair map[string]jsondata.JSONValue
+		encoded, err := json.Marshal(value)
+		if err == nil && json.Unmarshal(encoded, &pair) == nil {
+			visitor.old = pair["old"]
+			visitor.value = pair["new"]
+		}
+	} else if op == "Move" {
+		encoded, err := json.Marshal(value)
+		if err == nil {
+			json.Unmarshal(encoded, &visitor.from)
+		}
+		visitor.value = jsondata.JSONValue{}
+	}
+	return visitor
 }
 
 // Process JSON Map in the docVisitor visitor pattern. If the current "path" field in the docVisitor is the
@@ -251,15 +348,66 @@ func NewDocVisitor(op string, path string, value jsondata.JSONValue) *DocVisitor
 // "path" field. If there are errors in these nested Accept calls, return an error. Also return an error if the
 // docVisitor's "op" field is none of "ArrayAdd", "ArrayRemove", or "ObjectAdd". If element of JSONValue to be
 // modified is successfully found and patch is carried out, return NewJSONValue of m, which reflects the updates
-// made to m.
+// made to m. A Test operation compares the value at its path to the docVisitor's "value" field instead, returning
+// an error if they differ and leaving m unchanged either way.
 func (v DocVisitor) Map(m map[string]jsondata.JSONValue) (jsondata.JSONValue, error) {
 	slog.Debug("It's a map")
 
+	if v.op == "Move" && v.stage == moveStart {
+		doc, err := jsondata.NewJSONValue(m)
+		if err != nil {
+			return jsondata.JSONValue{}, errors.New(err.Error())
+		}
+		return doMove(v, doc)
+	}
+
 	v, splitPaths, err := handlePathStart(v)
 	if err != nil {
 		return jsondata.JSONValue{}, errors.New(err.Error())
 	}
 
+	if v.op == "Move" {
+		return moveInMap(v, m, splitPaths)
+	}
+
+	if v.op == "Increment" {
+		// the parent of the number applies the increment, since the number itself cannot be replaced from below
+		if len(splitPaths) == 0 {
+			slog.Debug("Error: Increment path ends in map")
+			return jsondata.JSONValue{}, fmt.Errorf("error applying patches: cannot increment non-number at path %s", v.whole)
+		} else if len(splitPaths) == 1 {
+			key := strings.ReplaceAll(strings.ReplaceAll(splitPaths[0], "~1", "/"), "~0", "~")
+			found, ok := m[key]
+			if !ok {
+				slog.Debug("Error: key not found in map")
+				return jsondata.JSONValue{}, errors.New("error applying patches: key not found in map")
+			}
+			sum, err := doIncrement(v, found)
+			if err != nil {
+				return jsondata.JSONValue{}, err
+			}
+			m[key] = sum
+			return jsondata.NewJSONValue(m)
+		}
+		return mapAcceptNextPath(v, m, splitPaths)
+	}
+
+	if v.op == "Test" {
+		// Test compares the value at the path without modifying anything
+		res, err := jsondata.NewJSONValue(m)
+		if err != nil {
+			return jsondata.JSONValue{}, errors.New(err.Error())
+		}
+		if len(splitPaths) == 0 {
+			return res, doTest(v, res, true)
+		} else if len(splitPaths) == 1 {
+			key := strings.ReplaceAll(strings.ReplaceAll(splitPaths[0], "~1", "/"), "~0", "~")
+			found, ok := m[key]
+			return res, doTest(v, found, ok)
+		}
+		return mapAcceptNextPath(v, m, splitPaths)
+	}
+
 	if len(splitPaths) == 0 {
 		// Error out; path ending in object is failure for all ops
 		slog.Debug("Error: path ends in map")
@@ -267,7 +415,7 @@ func (v DocVisitor) Map(m map[string]jsondata.JSONValue) (jsondata.JSONValue, er
 
 	}
 
-	if v.op == "ArrayAdd" || v.op == "ArrayRemove" {
+	if v.op == "ArrayAdd" || v.op == "ArrayRemove" || v.op == "ArrayReplace" || v.op == "ArrayInsert" {
 
 		// at least one more path left, search for next path as key
 		res, err := mapAcceptNextPath(v, m, splitPaths)
@@ -314,17 +462,27 @@ func (v DocVisitor) Map(m map[string]jsondata.JSONValue) (jsondata.JSONValue, er
 // "path" field. If there are errors in these nested Accept calls, return an error. Also return an error if the
 // docVisitor's "op" field is none of "ArrayAdd", "ArrayRemove", or "ObjectAdd". If element of JSONValue to be
 // modified is successfully found and patch is carried out, return NewJSONValue of s, which reflects the updates
-// made to s.
+// made to s. Test operations are handled as in Map.
 func (v DocVisitor) Slice(s []jsondata.JSONValue) (jsondata.JSONValue, error) {
 	slog.Debug("It's a slice")
 	var splitPaths []string
 
+	if v.op == "Move" && v.stage == moveStart {
+		doc, err := jsondata.NewJSONValue(s)
+		if err != nil {
+			return jsondata.JSONValue{}, errors.New(err.Error())
+		}
+		return doMove(v, doc)
+	}
+
 	v, splitPaths, err := handlePathStart(v)
 	if err != nil {
 		return jsondata.JSONValue{}, errors.New(err.Error())
 	}
 
-	if v.op == "ArrayAdd" {
+	if v.op == "Move" {
+		return moveInSlice(v, s, splitPaths)
+	} else if v.op == "ArrayAdd" {
 		if len(splitPaths) == 0 {
 
 			res, err := doArrayAdd(v, s)
@@ -366,6 +524,94 @@ func (v DocVisitor) Slice(s []jsondata.JSONValue) (jsondata.JSONValue, error) {
 
 		}
 
+	} else if v.op == "ArrayReplace" {
+		if len(splitPaths) == 0 {
+
+			res, err := doArrayReplace(v, s)
+			if err != nil {
+				return jsondata.JSONValue{}, errors.New(err.Error())
+			}
+
+			return res, nil
+
+		} else {
+
+			res, err := sliceAcceptNextPath(v, s, splitPaths)
+			if err != nil {
+				return jsondata.JSONValue{}, errors.New(err.Error())
+			}
+
+			return res, nil
+
+		}
+
+	} else if v.op == "ArrayInsert" {
+		if len(splitPaths) == 0 {
+			// Error out; ArrayInsert path must end in the index to insert at
+			slog.Debug("Error: ArrayInsert path ends in slice")
+			return jsondata.JSONValue{}, errors.New("error applying patches: ArrayInsert path must end in an index")
+
+		} else if len(splitPaths) == 1 {
+
+			res, err := doArrayInsert(v, s, splitPaths[0])
+			if err != nil {
+				return jsondata.JSONValue{}, errors.New(err.Error())
+			}
+
+			return res, nil
+
+		} else {
+
+			res, err := sliceAcceptNextPath(v, s, splitPaths)
+			if err != nil {
+				return jsondata.JSONValue{}, errors.New(err.Error())
+			}
+
+			return res, nil
+
+		}
+
+	} else if v.op == "Increment" {
+		// as in Map, the slice applies the increment to the number at the index
+		if len(splitPaths) == 0 {
+			slog.Debug("Error: Increment path ends in slice")
+			return jsondata.JSONValue{}, fmt.Errorf("error applying patches: cannot increment non-number at path %s", v.whole)
+		} else if len(splitPaths) == 1 {
+			idx, err := strconv.Atoi(splitPaths[0])
+			if err != nil || idx < 0 {
+				slog.Debug("invalid index")
+				return jsondata.JSONValue{}, errors.New("error applying patches: invalid index")
+			}
+			if idx >= len(s) {
+				slog.Debug("indexOutOfBounds")
+				return jsondata.JSONValue{}, errors.New("error applying patches: index exceeds array length")
+			}
+			sum, err := doIncrement(v, s[idx])
+			if err != nil {
+				return jsondata.JSONValue{}, err
+			}
+			s[idx] = sum
+			return jsondata.NewJSONValue(s)
+		}
+		return sliceAcceptNextPath(v, s, splitPaths)
+
+	} else if v.op == "Test" {
+		// Test compares the value at the path without modifying anything
+		res, err := jsondata.NewJSONValue(s)
+		if err != nil {
+			return jsondata.JSONValue{}, errors.New(err.Error())
+		}
+		if len(splitPaths) == 0 {
+			return res, doTest(v, res, true)
+		} else if len(splitPaths) == 1 {
+			idx, err := strconv.Atoi(splitPaths[0])
+			if err != nil || idx < 0 || idx >= len(s) {
+				return res, doTest(v, jsondata.JSONValue{}, false)
+			}
+			return res, doTest(v, s[idx], true)
+		}
+		return sliceAcceptNextPath(v, s, splitPaths)
+
 	} else if v.op == "ObjectAdd" {
 		if len(splitPaths) == 0 {
 			// Error out; ObjectAdd path ends in slice
@@ -593,6 +839,82 @@ func doArrayRemove(v DocVisitor, s []jsondata.JSONValue) (jsondata.JSONValue, er
 	return res, nil // value is not in array
 }
 
+// Replaces the first value in s equal to the "old" field in v with the "value" field in v, keeping its position
+// in s. Throws an error if no value in s equals the "old" field, or if there are any issues re-wrapping s in a
+// JSONValue struct using NewJSONValue.
+func doArrayReplace(v DocVisitor, s []jsondata.JSONValue) (jsondata.JSONValue, error) {
+	for replaceIdx := 0; replaceIdx < len(s); replaceIdx++ {
+		if s[replaceIdx].Equal(v.old) {
+			newArr := make([]jsondata.JSONValue, 0)
+			newArr = append(newArr, s...)
+			newArr[replaceIdx] = v.value
+			slog.Debug("value to replace exists in array; this is what we want")
+			res, err := jsondata.NewJSONValue(newArr)
+			if err != nil {
+				return jsondata.JSONValue{}, errors.New(err.Error())
+			}
+
+			return res, nil
+		}
+	}
+
+	slog.Debug("Error: value to replace does not exist in array")
+	return jsondata.JSONValue{}, errors.New("error applying patches: value to replace not found in array")
+}
+
+// Inserts the "value" field in v into s at the index given by the last path segment, shifting the elements from
+// that index on to the right. An index equal to the length of s appends the value. Throws an error if the index is
+// not a number or lies outside of s, or if there are any issues re-wrapping the new array.
+func doArrayInsert(v DocVisitor, s []jsondata.JSONValue, index string) (jsondata.JSONValue, error) {
+	idx, err := strconv.Atoi(index)
+	if err != nil || idx < 0 {
+		slog.Debug("invalid index")
+		return jsondata.JSONValue{}, errors.New("error applying patches: invalid index")
+	}
+	if idx > len(s) {
+		slog.Debug("Error: insert index out of bounds")
+		return jsondata.JSONValue{}, errors.New("error applying patches: insert index exceeds array length")
+	}
+
+	newArr := make([]jsondata.JSONValue, 0, len(s)+1)
+	newArr = append(newArr, s[:idx]...)
+	newArr = append(newArr, v.value)
+	newArr = append(newArr, s[idx:]...)
+	res, err := jsondata.NewJSONValue(newArr)
+	if err != nil {
+		return jsondata.JSONValue{}, errors.New(err.Error())
+	}
+	return res, nil
+}
+
+// Adds the "value" field in v to found, the number at the path of an Increment operation, and returns the sum.
+// Throws an error if either of them is not a number.
+func doIncrement(v DocVisitor, found jsondata.JSONValue) (jsondata.JSONValue, error) {
+	// pointers, since null unmarshals into a float64 without an error
+	var current, delta *float64
+	encoded, err := json.Marshal(found)
+	if err != nil || json.Unmarshal(encoded, &current) != nil || current == nil {
+		slog.Debug("Error: increment target is not a number")
+		return jsondata.JSONValue{}, fmt.Errorf("error applying patches: cannot increment non-number at path %s", v.whole)
+	}
+	encoded, err = json.Marshal(v.value)
+	if err != nil || json.Unmarshal(encoded, &delta) != nil || delta == nil {
+		slog.Debug("Error: increment value is not a number")
+		return jsondata.JSONValue{}, errors.New("error applying patches: increment value must be a number")
+	}
+	return jsondata.NewJSONValue(*current + *delta)
+}
+
+// Compares found, the value at the path of a Test operation if ok is true, to the "value" field in v. Returns an
+// error naming the path if nothing was found or the values differ.
+func doTest(v DocVisitor, found jsondata.JSONValue, ok bool) error {
+	if !ok || !found.Equal(v.value) {
+		slog.Debug("Error: test failed")
+		return fmt.Errorf("error applying patches: test failed at path %s", v.whole)
+	}
+	return nil
+}
+
 // Adds a new key-value pair to m, where the key is the first (and only) element of splitPaths, and the value
 // is the "value" field in v. Does nothing if the key already exists in m. After adding (or not adding) m,
 // re-wraps m in a JSONValue struct using NewJSONValue and returns it. Throws an error if there are any issues
@@ -615,3 +937,82 @@ func doObjectAdd(v DocVisitor, m map[string]jsondata.JSONValue, splitPaths []str
 	}
 	return res, nil
 }
+
+// Carries out a Move operation on doc, the whole document: finds the value at the "from" field in v, then removes it
+// from there and inserts it at the "path" field in v with a docVisitor for each half. The value must be inserted as a
+// new key of an object. Throws an error if nothing is at "from", if "path" lies within "from" or already exists, or
+// if either path is not a valid path of a value in doc.
+func doMove(v DocVisitor, doc jsondata.JSONValue) (jsondata.JSONValue, error) {
+	if !strings.HasPrefix(v.from, "/") || !strings.HasPrefix(v.path, "/") {
+		slog.Debug("Error: Path should start with /")
+		return jsondata.JSONValue{}, errors.New("error applying patches: path should always start with /")
+	}
+	if v.path == v.from || strings.HasPrefix(v.path, v.from+"/") {
+		slog.Debug("Error: Move into itself")
+		return jsondata.JSONValue{}, fmt.Errorf("error applying patches: cannot move %s into itself", v.from)
+	}
+	moved, ok := doc.Get(v.from)
+	if !ok {
+		slog.Debug("Error: nothing to move")
+		return jsondata.JSONValue{}, fmt.Errorf("error applying patches: nothing to move at path %s", v.from)
+	}
+
+	remover := DocVisitor{op: v.op, path: v.from, first: true, whole: v.from, stage: moveRemove}
+	doc, err := jsondata.Accept(doc, remover)
+	if err != nil {
+		return jsondata.JSONValue{}, err
+	}
+	inserter := DocVisitor{op: v.op, path: v.path, value: moved, first: true, whole: v.whole, stage: moveInsert}
+	return jsondata.Accept(doc, inserter)
+}
+
+// Carries out one half of a Move operation in m: if only one path segment is left, removes the key it names from m
+// or inserts the "value" field in v under it, depending on v's stage. Otherwise, moves on to the next path segment.
+// Throws an error if the key to remove is missing, the key to insert exists, or the path ends in m.
+func moveInMap(v DocVisitor, m map[string]jsondata.JSONValue, splitPaths []string) (jsondata.JSONValue, error) {
+	if len(splitPaths) == 0 {
+		slog.Debug("Error: path ends in map")
+		return jsondata.JSONValue{}, errors.New("error applying patches: path ends in map")
+	} else if len(splitPaths) > 1 {
+		return mapAcceptNextPath(v, m, splitPaths)
+	}
+
+	key := strings.ReplaceAll(strings.ReplaceAll(splitPaths[0], "~1", "/"), "~0", "~")
+	_, ok := m[key]
+	if v.stage == moveRemove {
+		if !ok {
+			slog.Debug("Error: key not found in map")
+			return jsondata.JSONValue{}, errors.New("error applying patches: key not found in map")
+		}
+		delete(m, key)
+	} else {
+		if ok {
+			slog.Debug("Error: Move target exists")
+			return jsondata.JSONValue{}, fmt.Errorf("error applying patches: cannot move onto existing key at path %s", v.whole)
+		}
+		m[key] = v.value
+	}
+	return jsondata.NewJSONValue(m)
+}
+
+// Carries out one half of a Move operation in s: if only one path segment is left, removes the element at the index
+// it names from s. Values can only be moved into objects, so inserting into s is an error. Otherwise, moves on to the
+// next path segment.
+func moveInSlice(v DocVisitor, s []jsondata.JSONValue, splitPaths []string) (jsondata.JSONValue, error) {
+	if len(splitPaths) == 0 || (len(splitPaths) == 1 && v.stage == moveInsert) {
+		slog.Debug("Error: Move path ends in slice")
+		return jsondata.JSONValue{}, errors.New("error applying patches: Move path must end in an object key")
+	} else if len(splitPaths) > 1 {
+		return sliceAcceptNextPath(v, s, splitPaths)
+	}
+
+	idx, err := strconv.Atoi(splitPaths[0])
+	if err != nil || idx < 0 || idx >= len(s) {
+		slog.Debug("invalid index")
+		return jsondata.JSONValue{}, errors.New("error applying patches: invalid index")
+	}
+	newArr := make([]jsondata.JSONValue, 0, len(s)-1)
+	newArr = append(newArr, s[:idx]...)
+	newArr = append(newArr, s[idx+1:]...)
+	return jsondata.NewJSONValue(newArr)
+}
@@ -9,9 +9,11 @@ import (
 	"log/slog"
 	"math"
 	"math/rand/v2"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 // A node is an element within the skiplist containing one key value pair. A zero value node is an empty node ready to use.
@@ -20,9 +22,9 @@ type node[K cmp.Ordered, V any] struct {
 	value       V
 	mtx         sync.Mutex
 	topLevel    int
-	marked      bool
-	fullyLinked bool
-	time        time.Time
+	marked      atomic.Bool
+	fullyLinked atomic.Bool
+	time        atomic.Int64 // the Unix time in nanoseconds the node was last inserted or updated at
 	next        []atomic.Pointer[node[K, V]]
 }
 
@@ -32,7 +34,7 @@ type UpdateCheck[K cmp.Ordered, V any] func(key K, currValue V, exists bool) (ne
 
 // This function operates on a node and takes another node as a parameter. Returns true if the two nodes have the same keys and creation times, false otherwise
 func (n *node[K, V]) equals(toCompare *node[K, V]) bool {
-	if (n.key == toCompare.key) && (n.time == toCompare.time) {
+	if (n.key == toCompare.key) && (n.time.Load() == toCompare.time.Load()) {
 		slog.Info(fmt.Sprintf("found nodes to be equal: %v and %v", n.key, toCompare.key))
 		return true
 	} else {
@@ -43,29 +45,54 @@ func (n *node[K, V]) equals(toCompare *node[K, V]) bool {
 
 // A SkipList is a concurrent safe index that can store and access ordered key value pairs. A SkipList should be created using the New function
 type Skiplist[K cmp.Ordered, V any] struct {
-	head *node[K, V]
+	head   *node[K, V]
+	length atomic.Int64 // the number of nodes linked in, counted when an insert or remove takes effect
+}
+
+// The number of levels of a skiplist created without WithMaxLevel.
+const defaultMaxLevel = 5
+
+// An Option configures a Skiplist created by New.
+type Option func(*settings)
+
+// The settings of a Skiplist that can be changed with Options.
+type settings struct {
+	maxLevel int
+}
+
+// WithMaxLevel sets the number of levels of the skiplist's index, which should grow with the logarithm of the number
+// of keys the skiplist is expected to hold. A maxLevel of 0 keeps the default of 5, and at least 2 levels are used.
+func WithMaxLevel(maxLevel int) Option {
+	return func(s *settings) {
+		if maxLevel > 0 {
+			s.maxLevel = max(maxLevel, 2)
+		}
+	}
 }
 
 // New function creates a skiplist with a head node (with the provided min value key) pointing to the tail (with provided maximum value key) node at every level.
-func New[K cmp.Ordered, V any](name string, minVal K, maxVal K) *Skiplist[K, V] {
+// The skiplist has 5 levels unless another number is set with WithMaxLevel.
+func New[K cmp.Ordered, V any](name string, minVal K, maxVal K, opts ...Option) *Skiplist[K, V] {
+	config := settings{maxLevel: defaultMaxLevel}
+	for _, opt := range opts {
+		opt(&config)
+	}
 
 	tail := new(node[K, V])
 	tail.key = maxVal
 	tail.topLevel = 0
-	tail.marked = false
-	tail.fullyLinked = true
+	tail.marked.Store(false)
+	tail.fullyLinked.Store(true)
 
 	head := new(node[K, V])
 	head.key = minVal
 	head.topLevel = 0
-	head.marked = false
-	head.fullyLinked = true
-	head.next = make([]atomic.Pointer[node[K, V]], 5)
-	head.next[0].Store(tail)
-	head.next[1].Store(tail)
-	head.next[2].Store(tail)
-	head.next[3].Store(tail)
-	head.next[4].Store(tail)
+	head.marked.Store(false)
+	head.fullyLinked.Store(true)
+	head.next = make([]atomic.Pointer[node[K, V]], config.maxLevel)
+	for level := range head.next {
+		head.next[level].Store(tail)
+	}
 	slog.Info(fmt.Sprintf("created new skip list with name %s", name))
 	return &Skiplist[K, V]{head: head}
 }
@@ -114,7 +141,7 @@ func (s *Skiplist[K, V]) Find(key K) (V, bool) {
 		return none, false
 	} else {
 		foundNode := succs[levelFound]
-		if foundNode.marked || !foundNode.fullyLinked {
+		if foundNode.marked.Load() || !foundNode.fullyLinked.Load() {
 			var none V
 			return none, false
 		}
@@ -129,16 +156,36 @@ func (s *Skiplist[K, V]) CallUpsert(key K, check func(key K, currValue V, exists
 	return s.Upsert(key, check)
 }
 
+// Functionally identical to UpsertCtx, but takes input of func(key K, currValue V, exists bool) (V, error) rather than
+// checkfunction. Calls UpsertCtx with this function as a check function
+func (s *Skiplist[K, V]) CallUpsertCtx(ctx context.Context, key K, check func(key K, currValue V, exists bool) (V, error)) (V, bool, error) {
+	return s.UpsertCtx(ctx, key, check)
+}
+
 // Upsert takes a key and a updatecheck function. If they key is in the skiplist, it will lock the node with that key,
 // check if the key is being deleted or inserted, and call the check function with the found value
 // If the key is not found, it will call the check and insert the returned value into the skiplist
 func (s *Skiplist[K, V]) Upsert(key K, check UpdateCheck[K, V]) (V, error) {
+	value, _, err := s.UpsertCtx(context.Background(), key, check)
+	return value, err
+}
+
+// UpsertCtx is Upsert, but gives up once the provided context is done. The context is checked every time the upsert
+// has to retry or wait on a node being inserted by someone else, so a contended upsert returns the context's error
+// instead of spinning indefinitely. Once the check function has been called the upsert runs to completion.
+// Also returns whether a new node was inserted, as opposed to an existing one being updated.
+func (s *Skiplist[K, V]) UpsertCtx(ctx context.Context, key K, check UpdateCheck[K, V]) (V, bool, error) {
 
 	// Pick random top level
 	topLevel := randomLevel(len(s.head.next) - 2)
 	slog.Info(fmt.Sprintf("chose top level %d for key %v", topLevel, key))
 	// Keep trying to insert until success/failure
 	for {
+		if err := ctx.Err(); err != nil {
+			var empty V
+			slog.Error(fmt.Sprintf("upsert of key %v abandoned: %s", key, err.Error()))
+			return empty, false, err
+		}
 
 		lockMap := make(map[*node[K, V]]bool)
 		levelFound, preds, succs := s.find(key)
@@ -146,24 +193,29 @@ func (s *Skiplist[K, V]) Upsert(key K, check UpdateCheck[K, V]) (V, error) {
 			slog.Info(fmt.Sprintf("found existing key %v during upsert", key))
 			found := succs[levelFound]
 
-			if !found.marked {
+			if !found.marked.Load() {
 				// Node is being added, wait for other insert to finish
-				for !found.fullyLinked {
+				for !found.fullyLinked.Load() {
+					if err := ctx.Err(); err != nil {
+						var empty V
+						slog.Error(fmt.Sprintf("upsert of key %v abandoned: %s", key, err.Error()))
+						return empty, false, err
+					}
 				}
 
 				found.mtx.Lock()
 				slog.Info(fmt.Sprintf("locked existing key %v during upsert", key))
-				if !found.marked && found.fullyLinked {
-					found.time = time.Now()
+				if !found.marked.Load() && found.fullyLinked.Load() {
+					found.time.Store(time.Now().UnixNano())
 					// Did not insert this key/value pair
 					toPut, err := check(key, found.value, true)
 					// if err == nil{
 					// 	found.value = toPut
 					// }
-					slog.Info(fmt.Sprintf("modified exising node with key %v to have value %v", key, toPut))
+					slog.Info(fmt.Sprintf("modified exising node with key %v", key))
 					found.mtx.Unlock()
 
-					return toPut, err
+					return toPut, false, err
 				}
 				found.mtx.Unlock()
 
@@ -186,7 +238,7 @@ func (s *Skiplist[K, V]) Upsert(key K, check UpdateCheck[K, V]) (V, error) {
 				}
 				highestLocked = level
 				// Check if pred/succ are still valid
-				unmarked := (!preds[level].marked && !succs[level].marked)
+				unmarked := (!preds[level].marked.Load() && !succs[level].marked.Load())
 				connected := preds[level].next[level].Load().equals(succs[level])
 				valid = unmarked && connected
 				level = level + 1
@@ -210,11 +262,22 @@ func (s *Skiplist[K, V]) Upsert(key K, check UpdateCheck[K, V]) (V, error) {
 			value, err := check(key, empty, false)
 			if err != nil {
 				slog.Error(err.Error())
-				return empty, err
+				// Nothing is inserted, release the predecessors
+				level = highestLocked
+				for level >= 0 {
+					isLocked, ok := lockMap[preds[level]]
+					if ok && isLocked {
+						preds[level].mtx.Unlock()
+						lockMap[preds[level]] = false
+					}
+					level = level - 1
+				}
+				return empty, false, err
 			}
 
-			node := node[K, V]{key: key, value: value, topLevel: topLevel, marked: false, fullyLinked: false, time: time.Now(), next: make([]atomic.Pointer[node[K, V]], (topLevel + 1))}
-			slog.Info(fmt.Sprintf("created new node with key %v and value %v", key, value))
+			node := node[K, V]{key: key, value: value, topLevel: topLevel, next: make([]atomic.Pointer[node[K, V]], (topLevel + 1))}
+			node.time.Store(time.Now().UnixNano())
+			slog.Info(fmt.Sprintf("created new node with key %v", key))
 			// Set next pointers
 			level = 0
 
@@ -229,7 +292,8 @@ func (s *Skiplist[K, V]) Upsert(key K, check UpdateCheck[K, V]) (V, error) {
 				level = level + 1
 			}
 
-			node.fullyLinked = true
+			node.fullyLinked.Store(true)
+			s.length.Add(1)
 			slog.Info(fmt.Sprintf("new node with key %v fully linked", key))
 			// Unlock
 			level = highestLocked
@@ -242,11 +306,55 @@ func (s *Skiplist[K, V]) Upsert(key K, check UpdateCheck[K, V]) (V, error) {
 				}
 				level = level - 1
 			}
-			return value, nil
+			return value, true, nil
 		}
 	}
 }
 
+// Len returns the number of keys in the skiplist. Inserts and removes still in progress are not counted until they
+// take effect, so under concurrent use the result may be out of date as soon as it is returned.
+func (s *Skiplist[K, V]) Len() int {
+	return int(s.length.Load())
+}
+
+// ApproxMemory estimates the bytes used by the skiplist's nodes, counting each node, its slice of next pointers and,
+// for string keys, the bytes of the key. Values are not counted, since they are usually pointers to data held
+// elsewhere. Nodes that are removed but still linked in are counted, and under concurrent use the estimate may be
+// out of date as soon as it is returned.
+func (s *Skiplist[K, V]) ApproxMemory() int64 {
+	var total int64
+	nodeSize := int64(unsafe.Sizeof(node[K, V]{}))
+	pointerSize := int64(unsafe.Sizeof(atomic.Pointer[node[K, V]]{}))
+	tail := s.head.next[len(s.head.next)-1].Load()
+	for curr := s.head; curr != nil; curr = curr.nextAtBottom(tail) {
+		total += nodeSize + pointerSize*int64(len(curr.next))
+		if key, ok := any(curr.key).(string); ok {
+			total += int64(len(key))
+		}
+	}
+	return total
+}
+
+// Returns the node after n on the bottom level, or nil if n is the tail.
+func (n *node[K, V]) nextAtBottom(tail *node[K, V]) *node[K, V] {
+	if n == tail {
+		return nil
+	}
+	return n.next[0].Load()
+}
+
+// QueryDescending is Query, but returns the keys and values in descending order of the keys. It makes the same
+// consistency checks as Query and gives up on the same context.
+func (s *Skiplist[K, V]) QueryDescending(ctx context.Context, start K, end K, copier func(val V) any) ([]K, []V, error) {
+	keys, values, err := s.Query(ctx, start, end, copier)
+	if err != nil {
+		return nil, nil, err
+	}
+	slices.Reverse(keys)
+	slices.Reverse(values)
+	return keys, values, nil
+}
+
 // Query takes a context and a starting key value and and ending key value, and returns a list of keys and a list of corresponding values from within the skiplist with keys between the start and end
 // values (inclusive). Ensures concurrent saftey by iterating over the list twice and ensuring it finds the same nodes (with the same keys and last modified times) in both iterattions
 // If iterations don't match, retries, stopping if the context Deadline passes.
@@ -259,7 +367,9 @@ func (s *Skiplist[K, V]) Query(ctx context.Context, start K, end K, copier func(
 		giveUpTime, ok = ctx.Deadline()
 	}
 	for ctxNil || !ok || !time.Now().After(giveUpTime) || ctx.Err() == nil {
-		curr := s.head
+		// the nodes before start are skipped by going down the levels
+		_, preds, _ := s.find(start)
+		curr := preds[0]
 		first_iter := make([]*node[K, V], 0)
 		toReturnKeys := make([]K, 0)
 		toReturnValues := make([]V, 0)
@@ -268,7 +378,7 @@ func (s *Skiplist[K, V]) Query(ctx context.Context, start K, end K, copier func(
 		next := curr.next[0].Load()
 		for !next.equals(tail) && next.key >= start && next.key <= end {
 			curr = next
-			if !curr.marked {
+			if !curr.marked.Load() {
 				first_iter = append(first_iter, curr)
 				toReturnKeys = append(toReturnKeys, curr.key)
 				copy := copier(curr.value)
@@ -290,13 +400,14 @@ func (s *Skiplist[K, V]) Query(ctx context.Context, start K, end K, copier func(
 		toLog += ("\n Onto Second Iteration: ")
 
 		allOk := true
-		curr = s.head
+		_, preds, _ = s.find(start)
+		curr = preds[0]
 		i := 0
 		tail = s.head.next[len(s.head.next)-1].Load()
 		next = curr.next[0].Load()
 		for !next.equals(tail) && next.key >= start && next.key <= end && i < len(first_iter) && allOk {
 			curr = next
-			if first_iter[i].equals(curr) && !curr.marked {
+			if first_iter[i].equals(curr) && !curr.marked.Load() {
 				toLog += fmt.Sprint(curr.key)
 				toLog += (", ")
 
@@ -316,9 +427,106 @@ func (s *Skiplist[K, V]) Query(ctx context.Context, start K, end K, copier func(
 	return nil, nil, errors.New(`"deadline past durying query or context done"`)
 }
 
+// ForEach calls fn with the key and value of every node in the skiplist in key order, without copying the list like
+// Query does. Nodes still being inserted or marked for removal are skipped, the same way Find skips them. Stops early
+// if fn returns false, or with the context's error if the context is done. Nodes inserted or removed during the walk
+// may or may not be visited. fn must not call back into the skiplist, since an upsert of a node the walk is waiting
+// on could deadlock.
+func (s *Skiplist[K, V]) ForEach(ctx context.Context, fn func(key K, value V) bool) error {
+	tail := s.head.next[len(s.head.next)-1].Load()
+	curr := s.head.next[0].Load()
+	for !curr.equals(tail) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !curr.marked.Load() && curr.fullyLinked.Load() {
+			if !fn(curr.key, curr.value) {
+				return nil
+			}
+		}
+		curr = curr.next[0].Load()
+	}
+	return nil
+}
+
+// Min returns the smallest key in the skiplist and its value, or false if the skiplist is empty. Like Find, it skips
+// nodes still being inserted or marked for removal, so a smallest node being removed concurrently is passed over
+// for the one after it.
+func (s *Skiplist[K, V]) Min() (K, V, bool) {
+	tail := s.head.next[len(s.head.next)-1].Load()
+	for curr := s.head.next[0].Load(); curr != tail; curr = curr.next[0].Load() {
+		if !curr.marked.Load() && curr.fullyLinked.Load() {
+			return curr.key, curr.value, true
+		}
+	}
+	var none K
+	var empty V
+	return none, empty, false
+}
+
+// Max returns the largest key in the skiplist and its value, or false if the skiplist is empty. The last node is found
+// by going down the levels like find does, so it takes about as long as a Find. If it is still being inserted or is
+// marked for removal, the search is repeated for the last node before it, and so on.
+func (s *Skiplist[K, V]) Max() (K, V, bool) {
+	tail := s.head.next[len(s.head.next)-1].Load()
+	var bound *node[K, V] // the nodes searched for are before bound, or anywhere while it is nil
+	for {
+		pred := s.head
+		for level := len(s.head.next) - 1; level >= 0; level-- {
+			curr := pred.next[level].Load()
+			for curr != tail && (bound == nil || curr.key < bound.key) {
+				pred = curr
+				curr = pred.next[level].Load()
+			}
+		}
+		if pred == s.head {
+			var none K
+			var empty V
+			return none, empty, false
+		}
+		if !pred.marked.Load() && pred.fullyLinked.Load() {
+			return pred.key, pred.value, true
+		}
+		bound = pred
+	}
+}
+
 // Remove takes a key value and removes the node with this key from the skipList if it exists. Returns the value corresponding
 // to this key if it was removed and a boolean representing whether or not a node was succesfully removed.
 func (s *Skiplist[K, V]) Remove(key K) (V, bool) {
+	value, _, ok := s.RemoveWithTime(key)
+	return value, ok
+}
+
+// RemoveWithTime is Remove, but also returns the time the removed node was last inserted or updated at. The time is
+// the zero time if no node was removed.
+func (s *Skiplist[K, V]) RemoveWithTime(key K) (V, time.Time, bool) {
+	value, removedAt, ok, _ := s.removeIf(key, nil)
+	return value, removedAt, ok
+}
+
+// CallConditionalRemove is Remove, but only removes the node with the key if check allows it. check is called with
+// the node's value and true while the node is locked, so the value cannot be updated or removed by anyone else until
+// the node is removed, or with the zero value and false if there is no node with the key. The node is removed if
+// check returns true and no error. Returns the removed value, whether a node was removed, and check's error.
+func (s *Skiplist[K, V]) CallConditionalRemove(key K, check func(currValue V, exists bool) (bool, error)) (V, bool, error) {
+	value, _, ok, err := s.removeIf(key, check)
+	return value, ok, err
+}
+
+// Removes the node with the key if check, when not nil, allows it. Returns the removed value, the time it was last
+// inserted or updated at, whether a node was removed, and check's error.
+func (s *Skiplist[K, V]) removeIf(key K, check func(currValue V, exists bool) (bool, error)) (V, time.Time, bool, error) {
+	// nothing to remove, but the check is still told so
+	notFound := func() (V, time.Time, bool, error) {
+		var empty V
+		if check != nil {
+			_, err := check(empty, false)
+			return empty, time.Time{}, false, err
+		}
+		return empty, time.Time{}, false, nil
+	}
+
 	lockMap := make(map[*node[K, V]]bool)
 	var victim *node[K, V] // Victim node to remove
 	isMarked := false      // Have we already marked the victim?
@@ -335,32 +543,40 @@ func (s *Skiplist[K, V]) Remove(key K) (V, bool) {
 		}
 		if !isMarked {
 			// First time through
-			var empty V
 			if levelFound == -1 {
 				slog.Info(fmt.Sprintf("No node found with key %v", key))
-				return empty, false
+				return notFound()
 			}
-			if !victim.fullyLinked {
+			if !victim.fullyLinked.Load() {
 				slog.Info(fmt.Sprintf("victim with key %v still being inserted", key))
-				return empty, false
+				return notFound()
 			}
 
-			if victim.marked {
+			if victim.marked.Load() {
 				slog.Info(fmt.Sprintf("victim with key %v already marked for deletion", key))
-				return empty, false
+				return notFound()
 			}
 			if victim.topLevel != levelFound {
 				slog.Info(fmt.Sprintf("victim with key %v not fully linked", key))
-				return empty, false
+				return notFound()
 			}
 			topLevel = victim.topLevel
 			victim.mtx.Lock()
-			if victim.marked {
+			if victim.marked.Load() {
 				// Another remove call beat us
 				victim.mtx.Unlock()
-				return empty, false
+				return notFound()
+			}
+			if check != nil {
+				remove, err := check(victim.value, true)
+				if err != nil || !remove {
+					slog.Info(fmt.Sprintf("check kept victim with key %v", key))
+					victim.mtx.Unlock()
+					var empty V
+					return empty, time.Time{}, false, err
+				}
 			}
-			victim.marked = true
+			victim.marked.Store(true)
 			isMarked = true
 			slog.Info(fmt.Sprintf("victim with key %v marked for deletion", key))
 		}
@@ -380,7 +596,7 @@ func (s *Skiplist[K, V]) Remove(key K) (V, bool) {
 			}
 			highestLocked = level
 			successor := pred.next[level].Load().equals(victim)
-			valid = !pred.marked && successor
+			valid = !pred.marked.Load() && successor
 			level = level + 1
 		}
 
@@ -406,6 +622,7 @@ func (s *Skiplist[K, V]) Remove(key K) (V, bool) {
 			slog.Info(fmt.Sprintf("predecessor to victim with key %v at level %d no longer points to victim", key, level))
 			level = level - 1
 		}
+		s.length.Add(-1)
 		// Unlock
 		victim.mtx.Unlock()
 		slog.Info(fmt.Sprintf("victim with key %v unlocked", key))
@@ -420,7 +637,7 @@ func (s *Skiplist[K, V]) Remove(key K) (V, bool) {
 			}
 			level = level - 1
 		}
-		return victim.value, true
+		return victim.value, time.Unix(0, victim.time.Load()), true, nil
 	}
 }
 
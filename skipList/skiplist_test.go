@@ -2,12 +2,14 @@ package skipList
 
 import (
 	"context"
+	"errors"
 	"io"
 	"log"
 	"slices"
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestSkipList(t *testing.T) {
@@ -231,3 +233,490 @@ func TestSkipList(t *testing.T) {
 	}
 
 }
+
+func TestUpsertCtxCancelled(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	funcVar := func(key string, currValue int, exists bool) (int, error) {
+		return currValue + 1, nil
+	}
+
+	myList := New[string, int]("myList", "", "\U0010FFFF")
+	myList.Upsert("contended", funcVar)
+
+	// simulate a remove that never finishes unlinking, so every upsert of the key has to retry
+	_, _, succs := myList.find("contended")
+	succs[0].marked.Store(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, _, err := myList.UpsertCtx(ctx, "contended", funcVar)
+		done <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("upsert did not return after its context was cancelled")
+	}
+
+	// an uncontended upsert with a live context still succeeds, on a list without the stuck node
+	freeList := New[string, int]("freeList", "", "\U0010FFFF")
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	value, inserted, err := freeList.CallUpsertCtx(ctx, "free", funcVar)
+	if err != nil || value != 1 || !inserted {
+		t.Errorf("expected value 1 inserted and no error, got %d, %t and %v", value, inserted, err)
+	}
+	value, inserted, err = freeList.CallUpsertCtx(ctx, "free", funcVar)
+	if err != nil || value != 2 || inserted {
+		t.Errorf("expected value 2 updated and no error, got %d, %t and %v", value, inserted, err)
+	}
+}
+
+func TestUpsertCheckErrorReleasesLocks(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	myList := New[string, int]("myList", "", "\U0010FFFF")
+	failing := func(key string, currValue int, exists bool) (int, error) {
+		return 0, errors.New("refused")
+	}
+	_, err := myList.Upsert("a", failing)
+	if err == nil {
+		t.Errorf("expected the check function's error")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		myList.Upsert("a", func(key string, currValue int, exists bool) (int, error) {
+			return 1, nil
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("upsert after a refused insert deadlocked")
+	}
+}
+
+func TestRemoveWithTime(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	funcVar := func(key string, currValue int, exists bool) (int, error) {
+		return currValue + 1, nil
+	}
+
+	myList := New[string, int]("myList", "", "\U0010FFFF")
+	myList.Upsert("key", funcVar)
+	time.Sleep(time.Millisecond)
+	myList.Upsert("key", funcVar)
+	_, _, succs := myList.find("key")
+	upserted := time.Unix(0, succs[0].time.Load())
+
+	_, removedTime, ok := myList.RemoveWithTime("key")
+	if !ok {
+		t.Errorf("expected the key to be removed")
+	}
+	if !removedTime.Equal(upserted) {
+		t.Errorf("expected the time of the last upsert %v, got %v", upserted, removedTime)
+	}
+
+	_, removedTime, ok = myList.RemoveWithTime("key")
+	if ok || !removedTime.IsZero() {
+		t.Errorf("expected nothing removed and the zero time, got %t and %v", ok, removedTime)
+	}
+}
+
+func TestCallConditionalRemove(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	funcVar := func(key string, currValue int, exists bool) (int, error) {
+		return 5, nil
+	}
+	myList := New[string, int]("myList", "", "\U0010FFFF")
+	myList.Upsert("key", funcVar)
+
+	isEven := func(currValue int, exists bool) (bool, error) {
+		return exists && currValue%2 == 0, nil
+	}
+	_, ok, err := myList.CallConditionalRemove("key", isEven)
+	if ok || err != nil {
+		t.Errorf("expected the odd value to be kept, got %t and %v", ok, err)
+	}
+	if value, found := myList.Find("key"); !found || value != 5 {
+		t.Errorf("expected the kept node to still hold 5, got %d and %t", value, found)
+	}
+
+	errRefused := errors.New("refused")
+	_, ok, err = myList.CallConditionalRemove("key", func(currValue int, exists bool) (bool, error) {
+		return true, errRefused
+	})
+	if ok || err != errRefused {
+		t.Errorf("expected the check's error and nothing removed, got %t and %v", ok, err)
+	}
+	if _, found := myList.Find("key"); !found {
+		t.Errorf("expected the node to survive a failing check")
+	}
+
+	isOdd := func(currValue int, exists bool) (bool, error) {
+		return exists && currValue%2 == 1, nil
+	}
+	value, ok, err := myList.CallConditionalRemove("key", isOdd)
+	if !ok || err != nil || value != 5 {
+		t.Errorf("expected 5 to be removed, got %d, %t and %v", value, ok, err)
+	}
+	if _, found := myList.Find("key"); found || myList.Len() != 0 {
+		t.Errorf("expected the node to be gone")
+	}
+
+	called := false
+	_, ok, _ = myList.CallConditionalRemove("key", func(currValue int, exists bool) (bool, error) {
+		called = true
+		if exists {
+			t.Errorf("expected a missing key to be reported as not existing")
+		}
+		return true, nil
+	})
+	if ok || !called {
+		t.Errorf("expected the check to be called for a missing key and nothing removed, got %t and %t", ok, called)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	funcVar := func(key int, currValue int, exists bool) (int, error) {
+		return key * 10, nil
+	}
+
+	myList := New[int, int]("myList", -1, 1000)
+	for i := 0; i < 100; i += 2 {
+		myList.Upsert(i, funcVar)
+	}
+
+	keys := make([]int, 0)
+	err := myList.ForEach(context.Background(), func(key int, value int) bool {
+		if value != key*10 {
+			t.Errorf("expected value %d for key %d, got %d", key*10, key, value)
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil || len(keys) != 50 || !slices.IsSorted(keys) {
+		t.Errorf("expected the 50 keys in order and no error, got %v and %v", keys, err)
+	}
+
+	visited := 0
+	myList.ForEach(context.Background(), func(key int, value int) bool {
+		visited++
+		return visited < 3
+	})
+	if visited != 3 {
+		t.Errorf("expected the walk to stop after 3 keys, visited %d", visited)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := myList.ForEach(ctx, func(key int, value int) bool { return true }); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	// odd keys inserted during the walks may or may not be visited, but the even keys always are, in order
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i < 100; i += 2 {
+			myList.Upsert(i, funcVar)
+		}
+	}()
+	for walk := 0; walk < 20; walk++ {
+		keys = keys[:0]
+		myList.ForEach(context.Background(), func(key int, value int) bool {
+			keys = append(keys, key)
+			return true
+		})
+		evens := 0
+		for _, key := range keys {
+			if key%2 == 0 {
+				evens++
+			}
+		}
+		if evens != 50 || !slices.IsSorted(keys) {
+			t.Errorf("expected all 50 even keys in order during concurrent inserts, got %v", keys)
+		}
+	}
+	wg.Wait()
+}
+
+func TestLen(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	funcVar := func(key int, currValue int, exists bool) (int, error) {
+		return key, nil
+	}
+
+	myList := New[int, int]("myList", -1, 10000)
+	if myList.Len() != 0 {
+		t.Errorf("expected an empty list to have length 0, got %d", myList.Len())
+	}
+
+	// every key is upserted by two goroutines, so half the upserts are updates, and every third key is removed twice
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := (g / 2) * 250; i < (g/2+1)*250; i++ {
+				myList.Upsert(i, funcVar)
+			}
+			for i := (g / 2) * 250; i < (g/2+1)*250; i += 3 {
+				myList.Remove(i)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	keys, _, err := myList.Query(context.Background(), 0, 9999, func(val int) any { return val })
+	if err != nil {
+		t.Fatalf("unexpected query error %v", err)
+	}
+	if myList.Len() != len(keys) {
+		t.Errorf("expected length %d to match the query, got %d", len(keys), myList.Len())
+	}
+	// 84 of each block of 250 keys are removed
+	if myList.Len() != 1000-4*84 {
+		t.Errorf("expected length %d, got %d", 1000-4*84, myList.Len())
+	}
+}
+
+func TestQueryDescending(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	funcVar := func(key int, currValue int, exists bool) (int, error) {
+		return key * 10, nil
+	}
+
+	myList := New[int, int]("myList", -1, 1000)
+	for i := 0; i < 20; i++ {
+		myList.Upsert(i, funcVar)
+	}
+
+	keys, values, err := myList.QueryDescending(context.Background(), 0, 9, func(val int) any { return val })
+	if err != nil {
+		t.Fatalf("unexpected query error %v", err)
+	}
+	if !slices.Equal(keys, []int{9, 8, 7, 6, 5, 4, 3, 2, 1, 0}) {
+		t.Errorf("expected keys 9 down to 0, got %v", keys)
+	}
+	for i, key := range keys {
+		if values[i] != key*10 {
+			t.Errorf("expected value %d for key %d, got %d", key*10, key, values[i])
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	deadline, cancelDeadline := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer cancelDeadline()
+	_, _, err = myList.QueryDescending(deadline, 0, 9, func(val int) any { return val })
+	if err == nil {
+		t.Errorf("expected an error for a context past its deadline")
+	}
+}
+
+func TestWithMaxLevel(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	funcVar := func(key int, currValue int, exists bool) (int, error) {
+		return key, nil
+	}
+
+	for _, maxLevel := range []int{0, 1, 2, 16} {
+		myList := New[int, int]("myList", -1, 100000, WithMaxLevel(maxLevel))
+		for i := 0; i < 1000; i++ {
+			myList.Upsert(i, funcVar)
+		}
+		for i := 0; i < 1000; i += 2 {
+			myList.Remove(i)
+		}
+		for i := 0; i < 1000; i++ {
+			_, ok := myList.Find(i)
+			if ok != (i%2 == 1) {
+				t.Errorf("with max level %d expected key %d found to be %t", maxLevel, i, i%2 == 1)
+			}
+		}
+		keys, _, err := myList.Query(context.Background(), 0, 99999, func(val int) any { return val })
+		if err != nil || len(keys) != 500 || myList.Len() != 500 {
+			t.Errorf("with max level %d expected 500 keys, got %d, length %d and error %v", maxLevel, len(keys), myList.Len(), err)
+		}
+	}
+}
+
+// Compares lookups among 100k keys with the default 5 levels to a skiplist sized for that many keys.
+func BenchmarkFind(b *testing.B) {
+	log.SetOutput(io.Discard)
+
+	funcVar := func(key int, currValue int, exists bool) (int, error) {
+		return key, nil
+	}
+
+	for _, maxLevel := range []int{5, 18} {
+		b.Run("maxLevel="+strconv.Itoa(maxLevel), func(b *testing.B) {
+			myList := New[int, int]("myList", -1, 1000000, WithMaxLevel(maxLevel))
+			for i := 0; i < 100000; i++ {
+				myList.Upsert(i, funcVar)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// spread the lookups over the whole list
+				myList.Find(i * 7919 % 100000)
+			}
+		})
+	}
+}
+
+func TestApproxMemory(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	funcVar := func(key string, currValue int, exists bool) (int, error) {
+		return len(key), nil
+	}
+
+	myList := New[string, int]("myList", "", "\U0010FFFF")
+	previous := myList.ApproxMemory()
+	if previous <= 0 {
+		t.Errorf("expected an empty list to use some memory, got %d", previous)
+	}
+	for i := 0; i < 100; i++ {
+		myList.Upsert("key"+strconv.Itoa(i), funcVar)
+		estimate := myList.ApproxMemory()
+		if estimate <= previous {
+			t.Fatalf("expected the estimate to grow after inserting key %d, went from %d to %d", i, previous, estimate)
+		}
+		previous = estimate
+	}
+
+	// updates add no nodes
+	myList.Upsert("key0", funcVar)
+	if myList.ApproxMemory() != previous {
+		t.Errorf("expected an update to keep the estimate at %d, got %d", previous, myList.ApproxMemory())
+	}
+
+	for i := 0; i < 100; i += 2 {
+		myList.Remove("key" + strconv.Itoa(i))
+		estimate := myList.ApproxMemory()
+		if estimate >= previous {
+			t.Fatalf("expected the estimate to shrink after removing key %d, went from %d to %d", i, previous, estimate)
+		}
+		previous = estimate
+	}
+}
+
+func TestMinMax(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	funcVar := func(key string, currValue int, exists bool) (int, error) {
+		return len(key), nil
+	}
+
+	myList := New[string, int]("myList", "", "\U0010FFFF")
+	if _, _, ok := myList.Min(); ok {
+		t.Errorf("expected no min in an empty list")
+	}
+	if _, _, ok := myList.Max(); ok {
+		t.Errorf("expected no max in an empty list")
+	}
+
+	for i := 10; i < 60; i++ {
+		myList.Upsert("key"+strconv.Itoa(i), funcVar)
+	}
+	if key, value, ok := myList.Min(); !ok || key != "key10" || value != 5 {
+		t.Errorf("expected min key10 with value 5, got %s %d %v", key, value, ok)
+	}
+	if key, value, ok := myList.Max(); !ok || key != "key59" || value != 5 {
+		t.Errorf("expected max key59 with value 5, got %s %d %v", key, value, ok)
+	}
+
+	// a node marked by a remove that has not unlinked it yet is passed over
+	_, _, succs := myList.find("key10")
+	first := succs[0]
+	_, _, succs = myList.find("key59")
+	last := succs[0]
+	first.marked.Store(true)
+	last.marked.Store(true)
+	if key, _, ok := myList.Min(); !ok || key != "key11" {
+		t.Errorf("expected min key11 while key10 is being removed, got %s %v", key, ok)
+	}
+	if key, _, ok := myList.Max(); !ok || key != "key58" {
+		t.Errorf("expected max key58 while key59 is being removed, got %s %v", key, ok)
+	}
+	// removes next to a marked node wait for it to be unlinked, so the nodes are unmarked and removed for real
+	first.marked.Store(false)
+	last.marked.Store(false)
+	myList.Remove("key10")
+	myList.Remove("key59")
+
+	// the bounds follow concurrent removes from both ends
+	var wg sync.WaitGroup
+	for i := 11; i < 30; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			myList.Remove("key" + strconv.Itoa(i))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			myList.Remove("key" + strconv.Itoa(69-i))
+		}(i)
+	}
+	wg.Wait()
+	if key, _, ok := myList.Min(); !ok || key != "key30" {
+		t.Errorf("expected min key30 after removes, got %s %v", key, ok)
+	}
+	if key, _, ok := myList.Max(); !ok || key != "key39" {
+		t.Errorf("expected max key39 after removes, got %s %v", key, ok)
+	}
+
+	for i := 30; i < 40; i++ {
+		myList.Remove("key" + strconv.Itoa(i))
+	}
+	if key, _, ok := myList.Min(); ok {
+		t.Errorf("expected no min once every live key is removed, got %s", key)
+	}
+	if key, _, ok := myList.Max(); ok {
+		t.Errorf("expected no max once every live key is removed, got %s", key)
+	}
+}
+
+func TestQueryFromMiddle(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	funcVar := func(key int, currValue int, exists bool) (int, error) {
+		return key * 10, nil
+	}
+
+	myList := New[int, int]("myList", -1, 1000)
+	for i := 0; i < 100; i++ {
+		myList.Upsert(i, funcVar)
+	}
+
+	// the keys before start are skipped rather than ending the query
+	keys, values, err := myList.Query(context.Background(), 40, 44, func(val int) any { return val })
+	if err != nil {
+		t.Fatalf("unexpected query error %v", err)
+	}
+	if !slices.Equal(keys, []int{40, 41, 42, 43, 44}) || !slices.Equal(values, []int{400, 410, 420, 430, 440}) {
+		t.Errorf("expected keys 40 to 44, got %v with values %v", keys, values)
+	}
+	keys, _, err = myList.Query(context.Background(), 150, 200, func(val int) any { return val })
+	if err != nil || len(keys) != 0 {
+		t.Errorf("expected no keys past the last one, got %v %v", keys, err)
+	}
+}